@@ -26,18 +26,24 @@
 package api
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 	"github.com/gorilla/mux"
 	"github.com/jeffbmartinez/delay"
 	"github.com/rs/cors"
-	"github.com/technoweenie/grohl"
+	uuid "github.com/satori/go.uuid"
 	"github.com/urfave/negroni"
 
+	"github.com/omani/readium-lcp-server/health"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/metrics"
 	"github.com/omani/readium-lcp-server/problem"
+	"github.com/omani/readium-lcp-server/tracing"
 )
 
 const (
@@ -83,8 +89,17 @@ func CreateServerRouter(tplPath string) ServerRouter {
 	recovery.ErrorHandlerFunc = problem.PanicReport
 	n.Use(recovery)
 
-	//https://github.com/urfave/negroni#logger
-	n.Use(negroni.NewLogger())
+	// set the id of the request, used in logs and problem documents
+	n.Use(negroni.HandlerFunc(RequestID))
+
+	// trace requests, following the trace context given by the caller
+	n.Use(tracing.HTTPMiddleware(r))
+
+	// log requests as structured records
+	n.Use(negroni.HandlerFunc(AccessLogger))
+
+	// count requests and measure their latency, by route
+	n.Use(metrics.HTTPMiddleware(r))
 
 	// debug: log request details
 	//n.Use(negroni.HandlerFunc(ExtraLogger))
@@ -104,7 +119,9 @@ func CreateServerRouter(tplPath string) ServerRouter {
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"PATCH", "HEAD", "POST", "GET", "OPTIONS", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Range", "Content-Type", "Origin", "X-Requested-With", "Accept", "Accept-Language", "Content-Language", "Authorization"},
+		AllowedHeaders: []string{"Range", "Content-Type", "Origin", "X-Requested-With", "Accept", "Accept-Language", "Content-Language", "Authorization",
+			logging.RequestIDHeader, "traceparent", "tracestate"},
+		ExposedHeaders: []string{logging.RequestIDHeader},
 		Debug:          false,
 	})
 	n.Use(c)
@@ -119,33 +136,139 @@ func CreateServerRouter(tplPath string) ServerRouter {
 	return sr
 }
 
-func ExtraLogger(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+// ServeMetrics exposes the metrics of the server at /metrics, in the Prometheus text format.
+// They are served by the server router if port is 0, else by a dedicated listener on host:port.
+func ServeMetrics(sr ServerRouter, host string, port int) {
+	if port == 0 {
+		sr.R.Handle("/metrics", metrics.Handler()).Methods("GET")
+		return
+	}
+	addr := host + ":" + strconv.Itoa(port)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		logging.Info("serving metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logging.Error("cannot serve metrics", "addr", addr, "error", err)
+		}
+	}()
+}
 
-	log.Print(" << -------------------")
+// DefaultShutdownTimeout is the time given to in-flight requests and tasks to complete on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
 
-	fmt.Printf("%s => %s (%s)\n", r.RemoteAddr, r.URL.String(), r.RequestURI)
+// Shutdown stops a server gracefully: the server stops accepting connections and waits for the
+// in-flight requests, then the drain functions wait for the background work of the server,
+// e.g. encryption tasks, and the pending spans are exported. timeout bounds the whole shutdown,
+// DefaultShutdownTimeout if 0; an error is returned if the server could not be drained in time.
+func Shutdown(server *http.Server, timeout time.Duration, drain ...func(ctx context.Context) error) error {
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logging.Info("shutting down", "timeout", timeout)
+	var failed error
+	if err := server.Shutdown(ctx); err != nil {
+		logging.Error("in-flight requests not completed", "error", err)
+		failed = err
+	}
+	for _, fn := range drain {
+		if err := fn(ctx); err != nil {
+			logging.Error("background tasks not completed", "error", err)
+			failed = err
+		}
+	}
+	if err := tracing.Shutdown(ctx); err != nil {
+		logging.Error("spans not exported", "error", err)
+		failed = err
+	}
+	return failed
+}
 
-	grohl.Log(grohl.Data{"method": r.Method, "path": r.URL.Path, "query": r.URL.RawQuery})
+// Paths of the health endpoints, public so that they can be used as liveness and readiness probes
+const (
+	HealthPath  = "/healthz"
+	ReadyPath   = "/readyz"
+	VersionPath = "/version"
+)
 
-	log.Printf("REQUEST headers: %#v", r.Header)
+// ServeHealth exposes the liveness of the server at /healthz, its readiness at /readyz,
+// running the checks of the default health registry, and its build information at /version.
+// readonly is reported as the mode of the server.
+func ServeHealth(sr ServerRouter, service string, readonly bool) {
+	mode := "readwrite"
+	if readonly {
+		mode = "readonly"
+	}
+	sr.R.Handle(HealthPath, health.LiveHandler()).Methods("GET", "HEAD")
+	sr.R.Handle(ReadyPath, health.ReadyHandler(health.Default, mode)).Methods("GET", "HEAD")
+	sr.R.Handle(VersionPath, health.VersionHandler(service)).Methods("GET")
+}
+
+// RequestID propagates the id of a request given by the X-Request-ID header, or generates one.
+// The id is sent back in the response and is available to handlers via the request context.
+func RequestID(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(logging.RequestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewV4().String()
+	}
+	rw.Header().Set(logging.RequestIDHeader, id)
+	next(rw, r.WithContext(logging.WithRequestID(r.Context(), id)))
+}
+
+// validRequestID checks that a request id given by a client is short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLogger logs every request with its status and duration
+func AccessLogger(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
 
-	// before
 	next(rw, r)
-	// after
 
-	contentType := rw.Header().Get("Content-Type")
-	if contentType == problem.ContentType_PROBLEM_JSON {
-		log.Print("^^^^ " + problem.ContentType_PROBLEM_JSON + " ^^^^")
+	status := http.StatusOK
+	if nrw, ok := rw.(negroni.ResponseWriter); ok && nrw.Status() != 0 {
+		status = nrw.Status()
 	}
+	// probes are frequent, they are only logged at debug level
+	level := logging.LevelInfo
+	if r.URL.Path == HealthPath || r.URL.Path == ReadyPath {
+		level = logging.LevelDebug
+	}
+	logging.FromContext(r.Context()).Log(level, "request",
+		"method", r.Method, "path", r.URL.Path, "status", status,
+		"duration_ms", time.Since(start).Milliseconds(), "remote", r.RemoteAddr)
+}
+
+// ExtraLogger logs request and response details, for debug purposes
+func ExtraLogger(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-	log.Printf("RESPONSE headers: %#v", rw.Header())
+	logger := logging.FromContext(r.Context())
+	logger.Debug("request details", "remote", r.RemoteAddr, "url", r.URL.String(), "method", r.Method,
+		"query", r.URL.RawQuery, "headers", fmt.Sprintf("%#v", r.Header))
+
+	// before
+	next(rw, r)
+	// after
 
-	log.Print(" >> -------------------")
+	logger.Debug("response details", "problem", rw.Header().Get("Content-Type") == problem.ContentType_PROBLEM_JSON,
+		"headers", fmt.Sprintf("%#v", rw.Header()))
 }
 
 func CORSHeaders(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-	grohl.Log(grohl.Data{"CORS": "yes"})
+	logging.FromContext(r.Context()).Debug("CORS headers")
 	rw.Header().Add("Access-Control-Allow-Methods", "PATCH, HEAD, POST, GET, OPTIONS, PUT, DELETE")
 	rw.Header().Add("Access-Control-Allow-Credentials", "true")
 	rw.Header().Add("Access-Control-Allow-Origin", "*")
@@ -161,11 +284,11 @@ func CORSHeaders(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 func CheckAuth(authenticator *auth.BasicAuth, w http.ResponseWriter, r *http.Request) bool {
 	var username string
 	if username = authenticator.CheckAuth(r); username == "" {
-		grohl.Log(grohl.Data{"error": "Unauthorized", "method": r.Method, "path": r.URL.Path})
+		logging.FromContext(r.Context()).Warn("unauthorized", "method", r.Method, "path", r.URL.Path)
 		w.Header().Set("WWW-Authenticate", `Basic realm="`+authenticator.Realm+`"`)
 		problem.Error(w, r, problem.Problem{Detail: "User or password do not match!"}, http.StatusUnauthorized)
 		return false
 	}
-	grohl.Log(grohl.Data{"user": username})
+	logging.FromContext(r.Context()).Debug("authenticated", "user", username)
 	return true
 }
@@ -37,6 +37,7 @@ import (
 type Configuration struct {
 	Certificate    Certificate        `yaml:"certificate"`
 	Storage        Storage            `yaml:"storage"`
+	Packager       Packager           `yaml:"packager"`
 	License        License            `yaml:"license"`
 	LcpServer      ServerInfo         `yaml:"lcp"`
 	LsdServer      LsdServerInfo      `yaml:"lsd"`
@@ -49,6 +50,8 @@ type Configuration struct {
 	ComplianceMode bool               `yaml:"compliance_mode"`
 	GoofyMode      bool               `yaml:"goofy_mode"`
 	Profile        string             `yaml:"profile,omitempty"`
+	Log            Log                `yaml:"log"`
+	Tracing        Tracing            `yaml:"tracing"`
 
 	// DISABLED, see https://github.com/readium/readium-lcp-server/issues/109
 	//AES256_CBC_OR_GCM string             `yaml:"aes256_cbc_or_gcm,omitempty"`
@@ -62,6 +65,10 @@ type ServerInfo struct {
 	PublicBaseUrl string `yaml:"public_base_url,omitempty"`
 	Database      string `yaml:"database,omitempty"`
 	Directory     string `yaml:"directory,omitempty"`
+	// MetricsPort is the port of a dedicated listener for /metrics; 0 serves the metrics on the server port
+	MetricsPort int `yaml:"metrics_port,omitempty"`
+	// ShutdownTimeout is the time given to in-flight requests and tasks to complete on shutdown, in seconds; 30 by default
+	ShutdownTimeout int `yaml:"shutdown_timeout,omitempty"`
 }
 
 type LsdServerInfo struct {
@@ -80,6 +87,28 @@ type FrontendServerInfo struct {
 	EncryptedRepository string `yaml:"encrypted_repository"`
 }
 
+// Log configures the logs of the servers
+type Log struct {
+	// Level is the minimum level of the records: debug, info (by default), warn or error
+	Level string `yaml:"level"`
+	// Format is json (by default) or text
+	Format string `yaml:"format"`
+}
+
+// Tracing configures the export of the traces of the servers
+type Tracing struct {
+	// Exporter is none (by default), file or otlp
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the base url of an OTLP/HTTP collector, e.g. http://localhost:4318
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Headers are added to the requests to the collector, e.g. for authentication
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// File is the path of the file exporter output
+	File string `yaml:"file,omitempty"`
+	// SampleRatio is the ratio of new traces which are recorded, 1 by default
+	SampleRatio float64 `yaml:"sample_ratio,omitempty"`
+}
+
 type Auth struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
@@ -88,14 +117,64 @@ type Auth struct {
 type Certificate struct {
 	Cert       string `yaml:"cert"`
 	PrivateKey string `yaml:"private_key"`
+	// Provider selects where the private key is held: "file" (private_key, by default), "pkcs11" or "remote"
+	Provider string       `yaml:"provider"`
+	PKCS11   PKCS11       `yaml:"pkcs11"`
+	Remote   RemoteSigner `yaml:"remote"`
+	// Certificates are additional provider certificates, kept active during a rotation
+	Certificates []Certificate `yaml:"certificates"`
+	// Selection is the policy selecting the certificate which signs licenses: "newest" (by default) or "first"
+	Selection string `yaml:"selection"`
+	// ReloadInterval is the interval between two checks of the certificate files, in seconds; 60 by default, -1 to disable
+	ReloadInterval int `yaml:"reload_interval"`
+	// CA is a PEM file holding the provider CA chain, used to verify licenses
+	CA  string   `yaml:"ca"`
+	CRL []string `yaml:"crl"`
+}
+
+// PKCS11 selects a private key held by a token (e.g. an HSM), through a PKCS#11 module
+type PKCS11 struct {
+	Module     string `yaml:"module"`
+	TokenLabel string `yaml:"token_label"`
+	PIN        string `yaml:"pin"`
+	KeyLabel   string `yaml:"key_label"`
+	KeyID      string `yaml:"key_id"` // hex encoded
+}
+
+// RemoteSigner selects a private key held by a remote signing service
+type RemoteSigner struct {
+	URL      string `yaml:"url"`
+	KeyID    string `yaml:"key_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Timeout  int    `yaml:"timeout"` // in seconds
 }
 
 type FileSystem struct {
 	Directory string `yaml:"directory"`
+	Sharded   bool   `yaml:"sharded"`
+}
+
+type Azure struct {
+	Account       string `yaml:"account"`
+	Key           string `yaml:"key"`
+	SASToken      string `yaml:"sas_token"`
+	Container     string `yaml:"container"`
+	Endpoint      string `yaml:"endpoint"`
+	PublicBaseUrl string `yaml:"public_base_url"`
+}
+
+type GCS struct {
+	Bucket          string `yaml:"bucket"`
+	CredentialsFile string `yaml:"credentials_file"`
+	Endpoint        string `yaml:"endpoint"`
+	PublicBaseUrl   string `yaml:"public_base_url"`
 }
 
 type Storage struct {
 	FileSystem FileSystem `yaml:"filesystem"`
+	Azure      Azure      `yaml:"azure"`
+	GCS        GCS        `yaml:"gcs"`
 	AccessId   string     `yaml:"access_id"`
 	DisableSSL bool       `yaml:"disable_ssl"`
 	PathStyle  bool       `yaml:"path_style"`
@@ -107,6 +186,14 @@ type Storage struct {
 	Token      string
 }
 
+type Packager struct {
+	Queue          bool `yaml:"queue"`
+	Concurrency    int  `yaml:"concurrency"`
+	PollInterval   int  `yaml:"poll_interval"`
+	Strict         bool `yaml:"strict"`
+	ObfuscateFonts bool `yaml:"obfuscate_fonts"`
+}
+
 type License struct {
 	Links map[string]string `yaml:"links"`
 }
@@ -144,6 +231,17 @@ func ReadConfig(configFileName string) {
 	}
 }
 
+// ReadCertificateConfig reads the certificate section of a configuration file, without changing the current configuration
+func ReadCertificateConfig(configFileName string) (Certificate, error) {
+	var c Configuration
+	yamlFile, err := ioutil.ReadFile(configFileName)
+	if err != nil {
+		return c.Certificate, err
+	}
+	err = yaml.Unmarshal(yamlFile, &c)
+	return c.Certificate, err
+}
+
 func SetPublicUrls() error {
 	var lcpPublicBaseUrl, lsdPublicBaseUrl, frontendPublicBaseUrl, lcpHost, lsdHost, frontendHost string
 	var lcpPort, lsdPort, frontendPort int
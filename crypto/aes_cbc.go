@@ -30,6 +30,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 )
 
@@ -93,18 +94,26 @@ func (c cbcEncrypter) Decrypt(key ContentKey, r io.Reader, w io.Writer) error {
 	}
 
 	var buffer bytes.Buffer
-	io.Copy(&buffer, r)
+	if _, err = io.Copy(&buffer, r); err != nil {
+		return err
+	}
 
 	buf := buffer.Bytes()
+	if len(buf) < 2*aes.BlockSize || len(buf)%aes.BlockSize != 0 {
+		return errors.New("invalid ciphertext length")
+	}
 	iv := buf[:aes.BlockSize]
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(buf[aes.BlockSize:], buf[aes.BlockSize:])
 
-	padding := buf[len(buf)-1] // padding length valid for both PKCS#7 and W3C schemes
-	w.Write(buf[aes.BlockSize : len(buf)-int(padding)])
+	padding := int(buf[len(buf)-1]) // padding length valid for both PKCS#7 and W3C schemes
+	if padding == 0 || padding > aes.BlockSize {
+		return errors.New("invalid padding")
+	}
+	_, err = w.Write(buf[aes.BlockSize : len(buf)-padding])
 
-	return nil
+	return err
 }
 
 func NewAESCBCEncrypter() Encrypter {
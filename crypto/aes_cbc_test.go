@@ -117,6 +117,16 @@ func TestDecrypt(t *testing.T) {
 	}
 }
 
+func TestDecryptInvalidCiphertext(t *testing.T) {
+	key := sha256.Sum256([]byte("password"))
+	cbc := &cbcEncrypter{}
+
+	var res bytes.Buffer
+	if err := cbc.Decrypt(key[:], bytes.NewReader(make([]byte, 20)), &res); err == nil {
+		t.Error("Expected an error for a truncated ciphertext")
+	}
+}
+
 func TestKeyWrap(t *testing.T) {
 	key := []byte{0x00, 0x01, 0x02, 0x03,
 		0x04, 0x05, 0x06, 0x07,
@@ -20,4 +20,17 @@ CREATE TABLE license (
   content_fk varchar(255) NOT NULL,
   lsd_status integer default 0,
   FOREIGN KEY(content_fk) REFERENCES content(id)
-);
\ No newline at end of file
+);
+
+CREATE TABLE job (
+  id varchar(255) PRIMARY KEY NOT NULL,
+  name text NOT NULL,
+  content_id varchar(255) NOT NULL,
+  status varchar(16) NOT NULL,
+  stage varchar(32) NOT NULL,
+  error text NOT NULL,
+  worker varchar(255) NOT NULL,
+  attempts int NOT NULL,
+  created datetime NOT NULL,
+  updated datetime NOT NULL
+);
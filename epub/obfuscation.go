@@ -0,0 +1,81 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package epub
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/omani/readium-lcp-server/epub/opf"
+)
+
+// Number of obfuscated bytes at the beginning of a font
+const (
+	obfuscatedLength_IDPF  = 1040
+	obfuscatedLength_ADOBE = 1024
+)
+
+// ObfuscationKey derives the key of a font obfuscation algorithm from the identifiers of a package:
+// the SHA-1 of the unique identifier, whitespaces removed, for the IDPF algorithm,
+// the bytes of the urn:uuid identifier for the Adobe algorithm.
+func ObfuscationKey(algorithm string, p opf.Package) ([]byte, error) {
+	switch algorithm {
+	case FontObfuscation_IDPF:
+		id := strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, p.UniqueID())
+		if id == "" {
+			return nil, errors.New("font obfuscation: the package has no unique identifier")
+		}
+		key := sha1.Sum([]byte(id))
+		return key[:], nil
+	case FontObfuscation_ADOBE:
+		for _, id := range p.Identifiers() {
+			if !strings.HasPrefix(strings.ToLower(id), "urn:uuid:") {
+				continue
+			}
+			key, err := hex.DecodeString(strings.Replace(id[len("urn:uuid:"):], "-", "", -1))
+			if err == nil && len(key) == 16 {
+				return key, nil
+			}
+		}
+		return nil, errors.New("font obfuscation: the package has no urn:uuid identifier")
+	}
+	return nil, errors.New("font obfuscation: unknown algorithm " + algorithm)
+}
+
+// obfuscationReader applies a font obfuscation algorithm to the bytes read from a font
+type obfuscationReader struct {
+	r      io.Reader
+	key    []byte
+	length int
+	pos    int
+}
+
+// NewObfuscationReader returns a reader which obfuscates the font read from r, or deobfuscates it,
+// as the algorithms are symmetric
+func NewObfuscationReader(r io.Reader, algorithm string, key []byte) io.Reader {
+	length := obfuscatedLength_IDPF
+	if algorithm == FontObfuscation_ADOBE {
+		length = obfuscatedLength_ADOBE
+	}
+	return &obfuscationReader{r: r, key: key, length: length}
+}
+
+func (or *obfuscationReader) Read(p []byte) (int, error) {
+	n, err := or.r.Read(p)
+	for i := 0; i < n && or.pos < or.length; i++ {
+		p[i] ^= or.key[or.pos%len(or.key)]
+		or.pos++
+	}
+	return n, err
+}
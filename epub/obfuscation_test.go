@@ -0,0 +1,75 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package epub
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/omani/readium-lcp-server/epub/opf"
+)
+
+const obfuscationOPF = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="isbn">9782070360024</dc:identifier>
+    <dc:identifier id="uid"> urn:uuid:0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0 </dc:identifier>
+  </metadata>
+  <manifest/>
+  <spine/>
+</package>`
+
+func TestObfuscationKey(t *testing.T) {
+	p, err := opf.Parse(strings.NewReader(obfuscationOPF))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ObfuscationKey(FontObfuscation_IDPF, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sha1.Sum([]byte("urn:uuid:0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"))
+	if !bytes.Equal(key, expected[:]) {
+		t.Errorf("Unexpected IDPF key %x", key)
+	}
+
+	key, err = ObfuscationKey(FontObfuscation_ADOBE, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 16 || key[0] != 0x0f || key[15] != 0xf0 {
+		t.Errorf("Unexpected Adobe key %x", key)
+	}
+
+	if _, err = ObfuscationKey("http://example.com/unknown", p); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+	if _, err = ObfuscationKey(FontObfuscation_IDPF, opf.Package{}); err == nil {
+		t.Error("Expected an error for a package without identifier")
+	}
+}
+
+func TestObfuscationReader(t *testing.T) {
+	font := bytes.Repeat([]byte{0xAB}, 2000)
+	key := []byte{1, 2, 3}
+
+	for algorithm, length := range map[string]int{FontObfuscation_IDPF: 1040, FontObfuscation_ADOBE: 1024} {
+		obfuscated, err := ioutil.ReadAll(NewObfuscationReader(bytes.NewReader(font), algorithm, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obfuscated[length-1] == 0xAB || obfuscated[length] != 0xAB {
+			t.Errorf("%s: expected the first %d bytes to be obfuscated", algorithm, length)
+		}
+		clear, _ := ioutil.ReadAll(NewObfuscationReader(bytes.NewReader(obfuscated), algorithm, key))
+		if !bytes.Equal(clear, font) {
+			t.Errorf("%s: expected the obfuscation to be symmetric", algorithm)
+		}
+	}
+}
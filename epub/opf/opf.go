@@ -5,17 +5,23 @@
 package opf
 
 import (
+	"bytes"
 	"encoding/xml"
 	"io"
+	"io/ioutil"
+	"strings"
 
 	"golang.org/x/net/html/charset"
 )
 
 // Package is the main opf structure
 type Package struct {
-	BasePath string   `xml:"-"`
-	Metadata Metadata `xml:"http://www.idpf.org/2007/opf metadata"`
-	Manifest Manifest `xml:"http://www.idpf.org/2007/opf manifest"`
+	BasePath         string   `xml:"-"`
+	Version          string   `xml:"version,attr"`
+	UniqueIdentifier string   `xml:"unique-identifier,attr"`
+	Metadata         Metadata `xml:"http://www.idpf.org/2007/opf metadata"`
+	Manifest         Manifest `xml:"http://www.idpf.org/2007/opf manifest"`
+	Spine            Spine    `xml:"http://www.idpf.org/2007/opf spine"`
 }
 
 // Metadata is the package metadata structure
@@ -25,6 +31,50 @@ type Metadata struct {
 	Isbn   string `json:"isbn" xml:"http://purl.org/dc/elements/1.1/ identifier"`
 	Metas  []Meta `xml:"http://www.idpf.org/2007/opf meta"`
 	Cover  string `json:"cover"`
+	// Elements holds every element of the metadata, in document order
+	Elements []Element `xml:"-"`
+}
+
+// Identifiers returns the values of the dc:identifier elements of the package, in document order
+func (p Package) Identifiers() (ids []string) {
+	for _, e := range p.Metadata.Elements {
+		if e.IsDC("identifier") {
+			ids = append(ids, strings.TrimSpace(e.Value))
+		}
+	}
+	return
+}
+
+// UniqueID returns the value of the unique identifier of the package, referenced by the unique-identifier attribute
+func (p Package) UniqueID() string {
+	for _, e := range p.Metadata.Elements {
+		if e.IsDC("identifier") && e.Attr("id") == p.UniqueIdentifier {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+// Element is a generic metadata element (e.g. dc:creator or meta), with its attributes
+type Element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Value   string     `xml:",chardata"`
+}
+
+// Attr returns the value of an attribute of the element, whatever its namespace
+func (e Element) Attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// IsDC indicates that the element is a Dublin Core element with a given name
+func (e Element) IsDC(name string) bool {
+	return e.XMLName.Space == "http://purl.org/dc/elements/1.1/" && e.XMLName.Local == name
 }
 
 // Meta is the metadata item structure
@@ -47,6 +97,28 @@ type Item struct {
 	Properties string `xml:"properties,attr"`
 }
 
+// Spine is the package spine structure
+type Spine struct {
+	Toc      string    `xml:"toc,attr"`
+	Itemrefs []Itemref `xml:"http://www.idpf.org/2007/opf itemref"`
+}
+
+// Itemref is the spine item structure
+type Itemref struct {
+	IDRef  string `xml:"idref,attr"`
+	Linear string `xml:"linear,attr"`
+}
+
+// ItemWithID looks for the manifest item with a given id
+func (m Manifest) ItemWithID(id string) (Item, bool) {
+	for _, i := range m.Items {
+		if i.ID == id {
+			return i, true
+		}
+	}
+	return Item{}, false
+}
+
 // ItemWithPath looks for the manifest item corresponding to a given path
 func (m Manifest) ItemWithPath(path string) (Item, bool) {
 	for _, i := range m.Items {
@@ -60,9 +132,28 @@ func (m Manifest) ItemWithPath(path string) (Item, bool) {
 // Parse parses the opf xml struct and returns a Package object
 func Parse(r io.Reader) (Package, error) {
 	var p Package
-	xd := xml.NewDecoder(r)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return p, err
+	}
+	xd := xml.NewDecoder(bytes.NewReader(data))
 	// deal with non utf-8 xml files
 	xd.CharsetReader = charset.NewReaderLabel
-	err := xd.Decode(&p)
-	return p, err
+	if err = xd.Decode(&p); err != nil {
+		return p, err
+	}
+
+	// collect every metadata element, in document order
+	var all struct {
+		Metadata struct {
+			Elements []Element `xml:",any"`
+		} `xml:"http://www.idpf.org/2007/opf metadata"`
+	}
+	xd = xml.NewDecoder(bytes.NewReader(data))
+	xd.CharsetReader = charset.NewReaderLabel
+	if err = xd.Decode(&all); err != nil {
+		return p, err
+	}
+	p.Metadata.Elements = all.Metadata.Elements
+	return p, nil
 }
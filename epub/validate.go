@@ -0,0 +1,265 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package epub
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/omani/readium-lcp-server/epub/opf"
+	"github.com/omani/readium-lcp-server/xmlenc"
+)
+
+// Font obfuscation algorithms, as declared in the encryption file of an EPUB
+const (
+	FontObfuscation_IDPF  = string(xmlenc.AlgorithmObfuscationIDPF)
+	FontObfuscation_ADOBE = string(xmlenc.AlgorithmObfuscationAdobe)
+)
+
+// Severity levels of a validation issue
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Codes of the validation issues
+const (
+	IssueMimetypeMissing    = "mimetype-missing"
+	IssueMimetypeNotFirst   = "mimetype-not-first"
+	IssueMimetypeCompressed = "mimetype-compressed"
+	IssueMimetypeContent    = "mimetype-content"
+	IssueContainer          = "container"
+	IssuePackage            = "package"
+	IssueMissingItem        = "missing-item"
+	IssueEmptySpine         = "empty-spine"
+	IssueMissingSpineItem   = "missing-spine-item"
+	IssueUndeclaredFile     = "undeclared-file"
+	IssueFontNotObfuscated  = "font-not-obfuscated"
+	IssueAlreadyProtected   = "already-protected"
+)
+
+// ValidationIssue is a problem found in an EPUB file
+type ValidationIssue struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+// String formats an issue for logs
+func (i ValidationIssue) String() string {
+	if i.Path == "" {
+		return i.Severity + ": " + i.Message
+	}
+	return i.Severity + ": " + i.Path + ": " + i.Message
+}
+
+// ValidationReport lists the issues found in an EPUB file
+type ValidationReport struct {
+	Issues []ValidationIssue `json:"issues"`
+}
+
+// Valid indicates that no error has been found; warnings are accepted
+func (r ValidationReport) Valid() bool {
+	return len(r.Errors()) == 0
+}
+
+// Errors returns the issues which make the EPUB file invalid
+func (r ValidationReport) Errors() []ValidationIssue {
+	return r.filter(SeverityError)
+}
+
+// Warnings returns the issues which do not prevent the encryption of the EPUB file
+func (r ValidationReport) Warnings() []ValidationIssue {
+	return r.filter(SeverityWarning)
+}
+
+func (r ValidationReport) filter(severity string) (issues []ValidationIssue) {
+	for _, i := range r.Issues {
+		if i.Severity == severity {
+			issues = append(issues, i)
+		}
+	}
+	return
+}
+
+func (r *ValidationReport) add(severity, code, path, message string) {
+	r.Issues = append(r.Issues, ValidationIssue{Severity: severity, Code: code, Path: path, Message: message})
+}
+
+// Validate checks the structure of an EPUB file before its encryption:
+// the mimetype file, the container and package documents, the presence of manifest and spine items,
+// the obfuscation of fonts. Unlike Read, it does not stop at the first problem.
+func Validate(zr *zip.Reader) (report ValidationReport) {
+
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			files[f.Name] = f
+		}
+	}
+
+	validateMimetype(zr, &report)
+
+	// encryption manifest
+	var encryption *xmlenc.Manifest
+	if f, ok := files[EncryptionFile]; ok {
+		if rc, err := f.Open(); err == nil {
+			m, err := xmlenc.Read(rc)
+			rc.Close()
+			if err != nil {
+				report.add(SeverityError, IssueContainer, EncryptionFile, "invalid encryption file: "+err.Error())
+			} else {
+				encryption = &m
+			}
+		}
+	}
+	if _, ok := files[LicenseFile]; ok {
+		report.add(SeverityError, IssueAlreadyProtected, LicenseFile, "the publication is already protected by LCP")
+	}
+
+	// container and package documents
+	container, ok := files[ContainerFile]
+	if !ok {
+		report.add(SeverityError, IssueContainer, ContainerFile, "missing container file")
+		return
+	}
+	rc, err := container.Open()
+	if err != nil {
+		report.add(SeverityError, IssueContainer, ContainerFile, err.Error())
+		return
+	}
+	rootFiles, err := findRootFiles(rc)
+	rc.Close()
+	if err != nil || len(rootFiles) == 0 {
+		report.add(SeverityError, IssueContainer, ContainerFile, "no package document declared")
+		return
+	}
+
+	declared := map[string]bool{"mimetype": true, ContainerFile: true}
+	for _, rootFile := range rootFiles {
+		declared[rootFile.FullPath] = true
+		f, ok := files[rootFile.FullPath]
+		if !ok {
+			report.add(SeverityError, IssuePackage, rootFile.FullPath, "missing package document")
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			report.add(SeverityError, IssuePackage, rootFile.FullPath, err.Error())
+			continue
+		}
+		p, err := opf.Parse(rc)
+		rc.Close()
+		if err != nil {
+			report.add(SeverityError, IssuePackage, rootFile.FullPath, "invalid package document: "+err.Error())
+			continue
+		}
+		validatePackage(p, path.Dir(rootFile.FullPath), files, encryption, declared, &report)
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || declared[f.Name] || strings.HasPrefix(f.Name, "META-INF/") {
+			continue
+		}
+		report.add(SeverityWarning, IssueUndeclaredFile, f.Name, "file not declared in the package manifest")
+	}
+	return
+}
+
+// validateMimetype checks that the mimetype file is the first entry of the archive, and that it is stored
+func validateMimetype(zr *zip.Reader, report *ValidationReport) {
+
+	var mimetype *zip.File
+	for i, f := range zr.File {
+		if f.Name == "mimetype" {
+			mimetype = f
+			if i != 0 {
+				report.add(SeverityError, IssueMimetypeNotFirst, f.Name, "the mimetype file must be the first entry of the archive")
+			}
+			break
+		}
+	}
+	if mimetype == nil {
+		report.add(SeverityError, IssueMimetypeMissing, "mimetype", "missing mimetype file")
+		return
+	}
+	if mimetype.Method != zip.Store {
+		report.add(SeverityError, IssueMimetypeCompressed, mimetype.Name, "the mimetype file must be stored without compression")
+	}
+	rc, err := mimetype.Open()
+	if err != nil {
+		report.add(SeverityError, IssueMimetypeContent, mimetype.Name, err.Error())
+		return
+	}
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	if err != nil || string(content) != ContentType_EPUB {
+		report.add(SeverityError, IssueMimetypeContent, mimetype.Name, "the mimetype file must contain "+ContentType_EPUB)
+	}
+}
+
+// validatePackage checks the manifest and spine of a package document
+func validatePackage(p opf.Package, basePath string, files map[string]*zip.File, encryption *xmlenc.Manifest, declared map[string]bool, report *ValidationReport) {
+
+	for _, item := range p.Manifest.Items {
+		// remote resources are not part of the archive
+		if strings.Contains(item.Href, "://") {
+			continue
+		}
+		href, err := url.PathUnescape(item.Href)
+		if err != nil {
+			href = item.Href
+		}
+		itemPath := path.Join(basePath, href)
+		declared[itemPath] = true
+		if _, ok := files[itemPath]; !ok {
+			report.add(SeverityError, IssueMissingItem, itemPath, "manifest item "+item.ID+" not found in the archive")
+			continue
+		}
+
+		var data xmlenc.Data
+		encrypted := false
+		if encryption != nil {
+			data, encrypted = encryption.DataForFile(itemPath)
+		}
+		obfuscated := encrypted && data.Obfuscated()
+		if encrypted && !obfuscated {
+			report.add(SeverityError, IssueAlreadyProtected, itemPath, "the resource is already encrypted with "+string(data.Method.Algorithm))
+		}
+		if IsFont(item.MediaType, itemPath) && !obfuscated {
+			report.add(SeverityWarning, IssueFontNotObfuscated, itemPath, "font not obfuscated")
+		}
+	}
+
+	if len(p.Spine.Itemrefs) == 0 {
+		report.add(SeverityError, IssueEmptySpine, "", "the spine of the package is empty")
+	}
+	for _, itemref := range p.Spine.Itemrefs {
+		if _, ok := p.Manifest.ItemWithID(itemref.IDRef); !ok {
+			report.add(SeverityError, IssueMissingSpineItem, "", "spine item "+itemref.IDRef+" not found in the package manifest")
+		}
+	}
+}
+
+// IsFont indicates that a resource is a font, from its media type or its extension
+func IsFont(mediaType string, name string) bool {
+	switch mediaType {
+	case "application/vnd.ms-opentype", "application/font-sfnt", "application/font-woff",
+		"application/x-font-ttf", "application/x-font-otf", "application/x-font-truetype", "application/x-font-opentype":
+		return true
+	}
+	if strings.HasPrefix(mediaType, "font/") {
+		return true
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".ttf", ".otf", ".woff", ".woff2":
+		return true
+	}
+	return false
+}
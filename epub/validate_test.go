@@ -0,0 +1,108 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+const brokenOPF = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Broken</dc:title></metadata>
+  <manifest>
+    <item id="c1" href="chapter%201.xhtml" media-type="application/xhtml+xml"/>
+    <item id="c2" href="chapter2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="f1" href="fonts/font.otf" media-type="application/vnd.ms-opentype"/>
+    <item id="f2" href="fonts/obfuscated.woff" media-type="font/woff"/>
+  </manifest>
+  <spine><itemref idref="c1"/><itemref idref="c3"/></spine>
+</package>`
+
+const brokenEncryption = `<?xml version="1.0"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <enc:CipherData><enc:CipherReference URI="OEBPS/fonts/obfuscated.woff"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`
+
+func TestValidateSample(t *testing.T) {
+	zr, err := zip.OpenReader("../test/samples/lorem.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	report := Validate(&zr.Reader)
+	if !report.Valid() || len(report.Issues) != 0 {
+		t.Errorf("Expected a valid EPUB, got %v", report.Issues)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	files := []struct {
+		name, content string
+	}{
+		{ContainerFile, `<?xml version="1.0"?><container xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{"mimetype", ContentType_EPUB},
+		{EncryptionFile, brokenEncryption},
+		{"OEBPS/content.opf", brokenOPF},
+		{"OEBPS/chapter 1.xhtml", "<html/>"},
+		{"OEBPS/fonts/font.otf", "font"},
+		{"OEBPS/fonts/obfuscated.woff", "font"},
+		{"OEBPS/notes.txt", "undeclared"},
+	}
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := Validate(zr)
+	if report.Valid() {
+		t.Error("Expected an invalid EPUB")
+	}
+
+	expected := map[string]string{
+		IssueMimetypeNotFirst:   SeverityError,
+		IssueMimetypeCompressed: SeverityError,
+		IssueMissingItem:        SeverityError,
+		IssueMissingSpineItem:   SeverityError,
+		IssueUndeclaredFile:     SeverityWarning,
+		IssueFontNotObfuscated:  SeverityWarning,
+	}
+	found := map[string]ValidationIssue{}
+	for _, i := range report.Issues {
+		if _, ok := found[i.Code]; ok {
+			t.Errorf("Unexpected duplicate issue %s", i)
+		}
+		found[i.Code] = i
+	}
+	for code, severity := range expected {
+		if found[code].Severity != severity {
+			t.Errorf("Expected a %s issue %s, got %v", severity, code, report.Issues)
+		}
+	}
+	if len(found) != len(expected) {
+		t.Errorf("Expected %d issues, got %v", len(expected), report.Issues)
+	}
+	if found[IssueMissingItem].Path != "OEBPS/chapter2.xhtml" || found[IssueFontNotObfuscated].Path != "OEBPS/fonts/font.otf" {
+		t.Errorf("Unexpected paths in %v", report.Issues)
+	}
+	if len(report.Errors())+len(report.Warnings()) != len(report.Issues) {
+		t.Error("Expected every issue to be an error or a warning")
+	}
+}
@@ -7,14 +7,13 @@ package staticapi
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
-	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/frontend/webpublication"
 	"github.com/omani/readium-lcp-server/frontend/webpurchase"
+	"github.com/omani/readium-lcp-server/logging"
 	"github.com/omani/readium-lcp-server/problem"
 )
 
@@ -23,7 +22,7 @@ import (
 func GetFilteredLicenses(w http.ResponseWriter, r *http.Request, s IServer) {
 
 	rDevices := r.FormValue("devices")
-	log.Println("Licenses used by " + rDevices + " devices")
+	logging.FromContext(r.Context()).Info("get licenses by number of devices", "devices", rDevices)
 	if rDevices == "" {
 		rDevices = "0"
 	}
@@ -71,7 +70,7 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s IServer) {
 		return
 	}
 	// get an existing license from the lcp server
-	fullLicense, err := s.PurchaseAPI().GenerateOrGetLicense(purchase)
+	fullLicense, err := s.PurchaseAPI().GenerateOrGetLicense(r.Context(), purchase)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
@@ -90,6 +89,5 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
-	// message to the console
-	log.Println("Get license / id " + licenseID + " / " + purchase.Publication.Title + " / purchase " + strconv.FormatInt(purchase.ID, 10))
+	logging.FromContext(r.Context()).Info("get license", "license_id", licenseID, "purchase_id", purchase.ID, "title", purchase.Publication.Title)
 }
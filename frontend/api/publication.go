@@ -6,7 +6,7 @@ package staticapi
 
 import (
 	"encoding/json"
-	"log"
+	"io"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -14,6 +14,8 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/frontend/webpublication"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/pack"
 	"github.com/omani/readium-lcp-server/problem"
 )
 
@@ -109,13 +111,38 @@ func GetPublication(w http.ResponseWriter, r *http.Request, s IServer) {
 	}
 }
 
+// GetPublicationCover returns a cover thumbnail of a publication, from its numeric id given as part of the calling url.
+// The optional size parameter is passed to the license server.
+func GetPublicationCover(w http.ResponseWriter, r *http.Request, s IServer) {
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: "The publication id must be an integer"}, http.StatusBadRequest)
+		return
+	}
+
+	cover, err := s.PublicationAPI().GetCover(r.Context(), int64(id), r.URL.Query().Get("size"))
+	if err == webpublication.ErrNotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		return
+	} else if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer cover.Close()
+
+	w.Header().Set("Content-Type", pack.ContentType_JPEG)
+	io.Copy(w, cover)
+}
+
 // CheckPublicationByTitle checks if a publication with this title exists
 func CheckPublicationByTitle(w http.ResponseWriter, r *http.Request, s IServer) {
 
 	var title string
 	title = r.URL.Query()["title"][0]
 
-	log.Println("Check the existence of a publication named " + string(title))
+	logging.FromContext(r.Context()).Info("check the existence of a publication", "title", title)
 
 	if pub, err := s.PublicationAPI().CheckByTitle(string(title)); err == nil {
 		enc := json.NewEncoder(w)
@@ -129,7 +156,7 @@ func CheckPublicationByTitle(w http.ResponseWriter, r *http.Request, s IServer)
 		switch err {
 		case webpublication.ErrNotFound:
 			{
-				log.Println("No publication stored with name " + string(title))
+				logging.FromContext(r.Context()).Info("no publication stored with this title", "title", title)
 				//	problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
 			}
 		default:
@@ -162,10 +189,10 @@ func CreatePublication(w http.ResponseWriter, r *http.Request, s IServer) {
 		return
 	}
 
-	log.Println("Create a publication named " + pub.Title)
+	logging.FromContext(r.Context()).Info("create a publication", "title", pub.Title)
 
 	// add publication
-	if err := s.PublicationAPI().Add(pub); err != nil {
+	if err := s.PublicationAPI().Add(r.Context(), pub); err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
@@ -186,12 +213,13 @@ func UploadPublication(w http.ResponseWriter, r *http.Request, s IServer) {
 		pub.UUID = r.URL.Query()["uuid"][0]
 	}
 
-	log.Println("Upload a publication named " + pub.Title)
+	logger := logging.FromContext(r.Context()).With("title", pub.Title)
+	logger.Info("upload a publication")
 
 	// get the file handle
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		log.Println("Error in FormFile")
+		logger.Warn("no file in the upload form", "error", err)
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
@@ -199,7 +227,7 @@ func UploadPublication(w http.ResponseWriter, r *http.Request, s IServer) {
 	// get the input file extension (will be used to select the proper encryption process)
 	extension := filepath.Ext(header.Filename)
 
-	err = s.PublicationAPI().Upload(file, extension, pub)
+	err = s.PublicationAPI().Upload(r.Context(), file, extension, pub)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
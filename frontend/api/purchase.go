@@ -8,7 +8,6 @@ package staticapi
 import (
 	"bytes"
 	"encoding/json"
-	"log"
 	"net/http"
 	"strconv"
 
@@ -16,6 +15,7 @@ import (
 	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/frontend/webpurchase"
 	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/logging"
 	"github.com/omani/readium-lcp-server/problem"
 
 	"github.com/Machiel/slugify"
@@ -130,10 +130,11 @@ func CreatePurchase(w http.ResponseWriter, r *http.Request, s IServer) {
 	// publication added to db
 	w.WriteHeader(http.StatusCreated)
 
-	if purchase.Type == webpurchase.LOAN {
-		log.Println("user " + strconv.Itoa(int(purchase.User.ID)) + " lent publication " + strconv.Itoa(int(purchase.Publication.ID)) + " until " + purchase.EndDate.String())
+	logger := logging.FromContext(r.Context()).With("user_id", purchase.User.ID, "publication_id", purchase.Publication.ID)
+	if purchase.Type == webpurchase.LOAN && purchase.EndDate != nil {
+		logger.Info("publication lent", "end", purchase.EndDate.String())
 	} else {
-		log.Println("user " + strconv.Itoa(int(purchase.User.ID)) + " bought publication " + strconv.Itoa(int(purchase.Publication.ID)))
+		logger.Info("publication bought")
 	}
 }
 
@@ -152,13 +153,13 @@ func GetPurchasedLicense(w http.ResponseWriter, r *http.Request, s IServer) {
 		return
 	}
 
-	purchase, err := s.PurchaseAPI().Get(id)
+	purchase, err := s.PurchaseAPI().Get(r.Context(), id)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
 		return
 	}
 
-	fullLicense, err := s.PurchaseAPI().GenerateOrGetLicense(purchase)
+	fullLicense, err := s.PurchaseAPI().GenerateOrGetLicense(r.Context(), purchase)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
@@ -177,8 +178,7 @@ func GetPurchasedLicense(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
-	// message to the console
-	log.Println("Return license / id " + vars["id"] + " / " + purchase.Publication.Title + " / purchase " + strconv.FormatInt(purchase.ID, 10))
+	logging.FromContext(r.Context()).Info("return license", "purchase_id", purchase.ID, "title", purchase.Publication.Title)
 
 }
 
@@ -194,7 +194,7 @@ func GetPurchase(w http.ResponseWriter, r *http.Request, s IServer) {
 		return
 	}
 
-	purchase, err := s.PurchaseAPI().Get(int64(id))
+	purchase, err := s.PurchaseAPI().Get(r.Context(), int64(id))
 	if err != nil {
 		switch err {
 		case webpurchase.ErrNotFound:
@@ -271,11 +271,20 @@ func UpdatePurchase(w http.ResponseWriter, r *http.Request, s IServer) {
 		return
 	}
 
-	// console
-	log.Printf("Update purchase %v, license id %v, start %v, end %v, status %v", newPurchase.ID, *newPurchase.LicenseUUID, newPurchase.StartDate, newPurchase.EndDate, newPurchase.Status)
+	logger := logging.FromContext(r.Context()).With("purchase_id", id, "status", newPurchase.Status)
+	if newPurchase.LicenseUUID != nil {
+		logger = logger.With("license_id", *newPurchase.LicenseUUID)
+	}
+	if newPurchase.StartDate != nil {
+		logger = logger.With("start", newPurchase.StartDate.String())
+	}
+	if newPurchase.EndDate != nil {
+		logger = logger.With("end", newPurchase.EndDate.String())
+	}
+	logger.Info("update purchase")
 
 	// update the purchase, license id, start and end dates, status
-	if err := s.PurchaseAPI().Update(webpurchase.Purchase{
+	if err := s.PurchaseAPI().Update(r.Context(), webpurchase.Purchase{
 		ID:          int64(id),
 		LicenseUUID: newPurchase.LicenseUUID,
 		StartDate:   newPurchase.StartDate,
@@ -36,12 +36,14 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/config"
 	frontend "github.com/omani/readium-lcp-server/frontend/server"
 	"github.com/omani/readium-lcp-server/frontend/webdashboard"
@@ -50,6 +52,10 @@ import (
 	"github.com/omani/readium-lcp-server/frontend/webpurchase"
 	"github.com/omani/readium-lcp-server/frontend/webrepository"
 	"github.com/omani/readium-lcp-server/frontend/webuser"
+	"github.com/omani/readium-lcp-server/health"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/metrics"
+	"github.com/omani/readium-lcp-server/tracing"
 )
 
 func dbFromURI(uri string) (string, string) {
@@ -65,6 +71,12 @@ func main() {
 		configFile = "config.yaml"
 	}
 	config.ReadConfig(configFile)
+	if err = logging.Setup(config.Config.Log.Level, config.Config.Log.Format); err != nil {
+		panic(err)
+	}
+	if err = tracing.Setup("frontend", config.Config.Tracing); err != nil {
+		panic(err)
+	}
 	log.Println("Read config from " + configFile)
 
 	err = config.SetPublicUrls()
@@ -84,6 +96,8 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// expose the statistics of the connection pool
+	metrics.RegisterDBStats(db)
 	if driver == "sqlite3" {
 		_, err = db.Exec("PRAGMA journal_mode = WAL")
 		if err != nil {
@@ -153,7 +167,10 @@ func main() {
 	log.Println(configJs)
 
 	fileConfigJs.WriteString(configJs)
-	HandleSignals()
+	// readiness checks
+	health.Register("database", true, health.Database(db))
+
+	stop := HandleSignals()
 
 	// basic authentication, optional in the frontend server.
 	// Authentication is used for getting user info from a license id.
@@ -172,28 +189,47 @@ func main() {
 	log.Println("Frontend webserver for LCP running on " + config.Config.FrontendServer.Host + ":" + strconv.Itoa(config.Config.FrontendServer.Port))
 	log.Println("using database " + dbURI)
 
-	if err := s.ListenAndServe(); err != nil {
+	// serve until SIGINT or SIGTERM, then wait for the in-flight requests before closing the database
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ListenAndServe()
+	}()
+	select {
+	case err = <-serveErr:
 		log.Println("Error " + err.Error())
+	case <-stop:
+		err = api.Shutdown(&s.Server, time.Duration(config.Config.FrontendServer.ShutdownTimeout)*time.Second)
+	}
+	db.Close()
+	if err != nil {
+		os.Exit(1)
 	}
 }
 
-// HandleSignals handles system signals and adds a log before quitting
-func HandleSignals() {
-	sigChan := make(chan os.Signal)
+// HandleSignals dumps the goroutines on SIGQUIT;
+// the returned channel is closed on SIGINT or SIGTERM, to shut down the server
+func HandleSignals() <-chan struct{} {
+	sigChan := make(chan os.Signal, 1)
+	stop := make(chan struct{})
 	go func() {
 		stacktrace := make([]byte, 1<<20)
+		stopping := false
 		for sig := range sigChan {
 			switch sig {
 			case syscall.SIGQUIT:
 				length := runtime.Stack(stacktrace, true)
 				fmt.Println(string(stacktrace[:length]))
-			case syscall.SIGINT:
-				fallthrough
-			case syscall.SIGTERM:
-				fmt.Println("Shutting down...")
-				os.Exit(0)
+			case syscall.SIGINT, syscall.SIGTERM:
+				// a second signal stops the server without waiting for the shutdown
+				if stopping {
+					log.Println("Forced shutdown")
+					os.Exit(1)
+				}
+				stopping = true
+				close(stop)
 			}
 		}
 	}()
 	signal.Notify(sigChan, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
+	return stop
 }
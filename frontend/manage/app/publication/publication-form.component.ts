@@ -64,7 +64,8 @@ export class PublicationFormComponent implements OnInit {
         this.split = fileItem.file.name.split('.');
         let extension = this.split[this.split.length-1];
         if (extension === "epub" || extension === "pdf" || extension === "lpf" || 
-            extension === "rpf" || extension === "audiobook" || extension === "divina")
+            extension === "rpf" || extension === "audiobook" || extension === "divina" ||
+            extension === "cbz")
         {
             this.notAPublication = false;
         }
@@ -46,6 +46,7 @@ import (
 	"github.com/omani/readium-lcp-server/frontend/webpurchase"
 	"github.com/omani/readium-lcp-server/frontend/webrepository"
 	"github.com/omani/readium-lcp-server/frontend/webuser"
+	"github.com/omani/readium-lcp-server/tracing"
 )
 
 //Server struct contains server info and  db interfaces
@@ -129,6 +130,7 @@ func New(
 	s.handleFunc(publicationsRoutes, "/{id}", staticapi.GetPublication).Methods("GET")
 	s.handleFunc(publicationsRoutes, "/{id}", staticapi.UpdatePublication).Methods("PUT")
 	s.handleFunc(publicationsRoutes, "/{id}", staticapi.DeletePublication).Methods("DELETE")
+	s.handleFunc(publicationsRoutes, "/{id}/cover", staticapi.GetPublicationCover).Methods("GET")
 	//
 	// user functions
 	//
@@ -175,6 +177,12 @@ func New(
 		s.handlePrivateFunc(licenseRoutes, "/{license_id}/user", staticapi.GetLicenseOwner, basicAuth).Methods("GET")
 	}
 
+	// liveness, readiness and build information
+	api.ServeHealth(sr, "frontend", config.Config.FrontendServer.ReadOnly)
+
+	// metrics, in the Prometheus text format
+	api.ServeMetrics(sr, config.Config.FrontendServer.Host, config.Config.FrontendServer.MetricsPort)
+
 	return s
 }
 
@@ -186,7 +194,7 @@ func fetchLicenseStatusesTask(s *Server) {
 	auth := config.Config.LsdNotifyAuth
 
 	// prepare the request
-	client := &http.Client{}
+	client := &http.Client{Transport: tracing.Transport(nil)}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		panic(err)
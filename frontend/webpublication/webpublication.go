@@ -6,6 +6,7 @@ package webpublication
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -14,6 +15,7 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -26,7 +28,9 @@ import (
 	"github.com/omani/readium-lcp-server/lcpencrypt/encrypt"
 	apilcp "github.com/omani/readium-lcp-server/lcpserver/api"
 	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/logging"
 	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/tracing"
 	uuid "github.com/satori/go.uuid"
 
 	"github.com/Machiel/slugify"
@@ -47,12 +51,13 @@ var ErrNotFound = errors.New("Publication not found")
 type WebPublication interface {
 	Get(id int64) (Publication, error)
 	GetByUUID(uuid string) (Publication, error)
-	Add(publication Publication) error
+	Add(ctx context.Context, publication Publication) error
 	Update(publication Publication) error
 	Delete(id int64) error
 	List(page int, pageNum int) func() (Publication, error)
-	Upload(multipart.File, string, Publication) error
+	Upload(context.Context, multipart.File, string, Publication) error
 	CheckByTitle(title string) (int64, error)
+	GetCover(ctx context.Context, id int64, size string) (io.ReadCloser, error)
 }
 
 // Publication struct defines a publication
@@ -118,6 +123,45 @@ func (pubManager PublicationManager) GetByUUID(uuid string) (Publication, error)
 	return Publication{}, ErrNotFound
 }
 
+// GetCover gets a cover thumbnail of a publication from the license server.
+// size is optional; ErrNotFound is returned if the publication has no cover.
+// ctx holds the id and the trace of the request, forwarded to the License Server.
+func (pubManager PublicationManager) GetCover(ctx context.Context, id int64, size string) (io.ReadCloser, error) {
+
+	pub, err := pubManager.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	lcpURL := pubManager.config.LcpServer.PublicBaseUrl + "/contents/" + pub.UUID + "/cover"
+	if size != "" {
+		lcpURL += "?size=" + url.QueryEscape(size)
+	}
+	logging.FromContext(ctx).Info("outbound request", "method", "GET", "url", lcpURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", lcpURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	logging.ForwardRequestID(ctx, req)
+
+	var lcpClient = &http.Client{
+		Timeout:   time.Second * 10,
+		Transport: tracing.Transport(nil),
+	}
+	resp, err := lcpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	resp.Body.Close()
+	return nil, errors.New("The License Server returned an error")
+}
+
 // CheckByTitle checks if the title of a publication exists or not in the db
 func (pubManager PublicationManager) CheckByTitle(title string) (int64, error) {
 
@@ -141,7 +185,7 @@ func (pubManager PublicationManager) CheckByTitle(title string) (int64, error) {
 }
 
 // encryptPublication encrypts an EPUB, PDF, LPF or RPF file and provides the resulting file to the LCP server
-func encryptPublication(inputPath string, pub Publication, pubManager PublicationManager) error {
+func encryptPublication(ctx context.Context, inputPath string, pub Publication, pubManager PublicationManager) error {
 
 	// generate a new uuid; this will be the content id in the lcp server
 	uid := uuid.NewV4()
@@ -173,7 +217,7 @@ func encryptPublication(inputPath string, pub Publication, pubManager Publicatio
 		contentType = epub.ContentType_EPUB
 		encryptedPub, err = encrypt.EncryptEpub(inputPath, outputPath)
 		if err != nil {
-			log.Printf("Error encrypting webpub: %s", err)
+			logging.FromContext(ctx).Error("cannot encrypt the publication", "path", inputPath, "error", err)
 			return err
 		}
 
@@ -183,34 +227,40 @@ func encryptPublication(inputPath string, pub Publication, pubManager Publicatio
 		clearWebPubPath := outputPath + ".webpub"
 		err = pack.BuildRPFFromPDF(pub.Title, inputPath, clearWebPubPath)
 		if err != nil {
-			log.Printf("Error building webpub package: %s", err)
+			logging.FromContext(ctx).Error("cannot build the publication package", "path", inputPath, "error", err)
 			return err
 		}
 		defer os.Remove(clearWebPubPath)
 		encryptedPub, err = encrypt.EncryptPackage(lcpProfile, clearWebPubPath, outputPath)
 
-		// process LPF files
-	case ".lpf":
-		// FIXME: short term solution; should be extended to other profiles
-		contentType = "application/audiobook+lcp"
+		// process LPF and RPF Audiobook files
+	case ".lpf", ".audiobook":
+		// FIXME: short term solution; LPF files should be extended to other profiles
+		contentType = pack.ContentType_AUDIOBOOK_LCP
 		clearWebPubPath := outputPath + ".webpub"
-		err = pack.BuildRPFFromLPF(inputPath, clearWebPubPath)
+		err = pack.BuildAudiobook(inputPath, clearWebPubPath)
 		if err != nil {
 			return err
 		}
 		defer os.Remove(clearWebPubPath)
 		encryptedPub, err = encrypt.EncryptPackage(lcpProfile, clearWebPubPath, outputPath)
 
-		// process RPF Audiobook files
-	case ".audiobook":
-		contentType = "application/audiobook+lcp"
-		encryptedPub, err = encrypt.EncryptPackage(lcpProfile, inputPath, outputPath)
-
 		// process RPF Divina files
 	case ".divina":
-		contentType = "application/divina+lcp"
+		contentType = pack.ContentType_DIVINA_LCP
 		encryptedPub, err = encrypt.EncryptPackage(lcpProfile, inputPath, outputPath)
 
+		// process CBZ files
+	case ".cbz":
+		contentType = pack.ContentType_DIVINA_LCP
+		clearWebPubPath := outputPath + ".webpub"
+		err = pack.BuildDivina(inputPath, clearWebPubPath)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(clearWebPubPath)
+		encryptedPub, err = encrypt.EncryptPackage(lcpProfile, clearWebPubPath, outputPath)
+
 		// process RPF PDF files
 	case ".rpf":
 		contentType = "application/pdf+lcp"
@@ -240,6 +290,7 @@ func encryptPublication(inputPath string, pub Publication, pubManager Publicatio
 	lcpPublication.Checksum = &encryptedPub.Checksum
 	lcpPublication.Size = &encryptedPub.Size
 	lcpPublication.ContentType = contentType
+	lcpPublication.Thumbnails = encryptedPub.Thumbnails
 
 	// json encode the payload
 	jsonBody, err := json.Marshal(lcpPublication)
@@ -250,11 +301,12 @@ func encryptPublication(inputPath string, pub Publication, pubManager Publicatio
 	// send the content to the LCP server
 	lcpServerConfig := pubManager.config.LcpServer
 	lcpURL := lcpServerConfig.PublicBaseUrl + "/contents/" + contentUUID
-	log.Println("PUT " + lcpURL)
-	req, err := http.NewRequest("PUT", lcpURL, bytes.NewReader(jsonBody))
+	logging.FromContext(ctx).Info("outbound request", "method", "PUT", "url", lcpURL)
+	req, err := http.NewRequestWithContext(ctx, "PUT", lcpURL, bytes.NewReader(jsonBody))
 	if err != nil {
 		return err
 	}
+	logging.ForwardRequestID(ctx, req)
 	// authenticate
 	lcpUpdateAuth := pubManager.config.LcpUpdateAuth
 	if pubManager.config.LcpUpdateAuth.Username != "" {
@@ -264,7 +316,8 @@ func encryptPublication(inputPath string, pub Publication, pubManager Publicatio
 	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
 
 	var lcpClient = &http.Client{
-		Timeout: time.Second * 60,
+		Timeout:   time.Second * 60,
+		Transport: tracing.Transport(nil),
 	}
 	// sends the import request to the lcp server
 	resp, err := lcpClient.Do(req)
@@ -296,25 +349,25 @@ func encryptPublication(inputPath string, pub Publication, pubManager Publicatio
 
 // Add adds a new publication
 // Encrypts a master File and sends the content to the LCP server
-func (pubManager PublicationManager) Add(pub Publication) error {
+func (pubManager PublicationManager) Add(ctx context.Context, pub Publication) error {
 
 	// get the path to the master file
 	inputPath := path.Join(
 		pubManager.config.FrontendServer.MasterRepository, pub.MasterFilename)
 
-	log.Println("Add a publication from path " + inputPath)
+	logging.FromContext(ctx).Info("add a publication", "path", inputPath)
 
 	if _, err := os.Stat(inputPath); err != nil {
 		// the master file does not exist
 		return err
 	}
 	// encrypt the publication and send the content to the LCP server
-	return encryptPublication(inputPath, pub, pubManager)
+	return encryptPublication(ctx, inputPath, pub, pubManager)
 }
 
 // Upload creates a new publication, named after a POST form parameter.
 // The file is processed, encrypted and sent to the LCP server.
-func (pubManager PublicationManager) Upload(file multipart.File, extension string, pub Publication) error {
+func (pubManager PublicationManager) Upload(ctx context.Context, file multipart.File, extension string, pub Publication) error {
 
 	// create a temp file
 	tmpfile, err := ioutil.TempFile("", "uploaded-*"+extension)
@@ -323,7 +376,7 @@ func (pubManager PublicationManager) Upload(file multipart.File, extension strin
 	}
 	defer os.Remove(tmpfile.Name())
 
-	log.Println("Upload a publication, use a tmp file")
+	logging.FromContext(ctx).Info("upload a publication", "path", tmpfile.Name())
 
 	// copy the request payload to the temp file
 	if _, err = io.Copy(tmpfile, file); err != nil {
@@ -336,7 +389,7 @@ func (pubManager PublicationManager) Upload(file multipart.File, extension strin
 	}
 
 	// process and encrypt the publication, send the content to the LCP server
-	err = encryptPublication(tmpfile.Name(), pub, pubManager)
+	err = encryptPublication(ctx, tmpfile.Name(), pub, pubManager)
 	if err != nil {
 		return err
 	}
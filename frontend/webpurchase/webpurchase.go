@@ -7,6 +7,7 @@ package webpurchase
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
@@ -22,6 +23,8 @@ import (
 	"github.com/omani/readium-lcp-server/frontend/webuser"
 	"github.com/omani/readium-lcp-server/license"
 	licensestatuses "github.com/omani/readium-lcp-server/license_statuses"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/tracing"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -44,15 +47,15 @@ join publication pu on (p.publication_id=pu.id)`
 
 //WebPurchase defines possible interactions with DB
 type WebPurchase interface {
-	Get(id int64) (Purchase, error)
-	GenerateOrGetLicense(purchase Purchase) (license.License, error)
-	GetPartialLicense(purchase Purchase) (license.License, error)
-	GetLicenseStatusDocument(purchase Purchase) (licensestatuses.LicenseStatus, error)
+	Get(ctx context.Context, id int64) (Purchase, error)
+	GenerateOrGetLicense(ctx context.Context, purchase Purchase) (license.License, error)
+	GetPartialLicense(ctx context.Context, purchase Purchase) (license.License, error)
+	GetLicenseStatusDocument(ctx context.Context, purchase Purchase) (licensestatuses.LicenseStatus, error)
 	GetByLicenseID(licenseID string) (Purchase, error)
 	List(page int, pageNum int) func() (Purchase, error)
 	ListByUser(userID int64, page int, pageNum int) func() (Purchase, error)
 	Add(p Purchase) error
-	Update(p Purchase) error
+	Update(ctx context.Context, p Purchase) error
 }
 
 // Purchase status
@@ -143,8 +146,9 @@ func convertRecordToPurchase(records *sql.Rows) (Purchase, error) {
 }
 
 // Get a purchase using its id
+// ctx holds the id and the trace of the request, forwarded to the License Status Server.
 //
-func (pManager PurchaseManager) Get(id int64) (Purchase, error) {
+func (pManager PurchaseManager) Get(ctx context.Context, id int64) (Purchase, error) {
 	dbGetQuery := purchaseManagerQuery + ` WHERE p.id = ? LIMIT 1`
 	dbGet, err := pManager.db.Prepare(dbGetQuery)
 	if err != nil {
@@ -165,7 +169,7 @@ func (pManager PurchaseManager) Get(id int64) (Purchase, error) {
 		if purchase.LicenseUUID != nil {
 			// Query LSD to retrieve max end date (PotentialRights.End)
 			// FIXME: calling the lsd server at this point is too heavy: the max end date should be in the db.
-			statusDocument, err := pManager.GetLicenseStatusDocument(purchase)
+			statusDocument, err := pManager.GetLicenseStatusDocument(ctx, purchase)
 
 			if err != nil {
 				return Purchase{}, err
@@ -185,8 +189,9 @@ func (pManager PurchaseManager) Get(id int64) (Purchase, error) {
 // GenerateOrGetLicense generates a new license associated with a purchase,
 // or gets an existing license,
 // depending on the value of the license id in the purchase.
+// ctx holds the id and the trace of the request, forwarded to the License Server.
 //
-func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license.License, error) {
+func (pManager PurchaseManager) GenerateOrGetLicense(ctx context.Context, purchase Purchase) (license.License, error) {
 	// create a partial license
 	partialLicense := license.License{}
 
@@ -254,13 +259,14 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 		lcpURL = lcpServerConfig.PublicBaseUrl + "/licenses/" + *purchase.LicenseUUID
 	}
 	// message to the console
-	log.Println("POST " + lcpURL)
+	logging.FromContext(ctx).Info("outbound request", "method", "POST", "url", lcpURL)
 
 	// add the partial license to the POST request
-	req, err := http.NewRequest("POST", lcpURL, bytes.NewReader(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", lcpURL, bytes.NewReader(jsonBody))
 	if err != nil {
 		return license.License{}, err
 	}
+	logging.ForwardRequestID(ctx, req)
 	lcpUpdateAuth := pManager.config.LcpUpdateAuth
 	if pManager.config.LcpUpdateAuth.Username != "" {
 		req.SetBasicAuth(lcpUpdateAuth.Username, lcpUpdateAuth.Password)
@@ -269,7 +275,8 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
 
 	var lcpClient = &http.Client{
-		Timeout: time.Second * 10,
+		Timeout:   time.Second * 10,
+		Transport: tracing.Transport(nil),
 	}
 	// POST the request
 	resp, err := lcpClient.Do(req)
@@ -299,7 +306,9 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 	// store the license id if it was not already set
 	if purchase.LicenseUUID == nil {
 		purchase.LicenseUUID = &fullLicense.ID
-		pManager.Update(purchase)
+		_, span := tracing.StartDB(ctx, "UPDATE", "purchase")
+		err = pManager.Update(ctx, purchase)
+		tracing.End(span, err)
 		if err != nil {
 			return license.License{}, errors.New("Unable to update the license id")
 		}
@@ -310,7 +319,7 @@ func (pManager PurchaseManager) GenerateOrGetLicense(purchase Purchase) (license
 
 // GetPartialLicense gets the license associated with a purchase, from the license server
 //
-func (pManager PurchaseManager) GetPartialLicense(purchase Purchase) (license.License, error) {
+func (pManager PurchaseManager) GetPartialLicense(ctx context.Context, purchase Purchase) (license.License, error) {
 
 	if purchase.LicenseUUID == nil {
 		return license.License{}, errors.New("No license has been yet delivered")
@@ -319,12 +328,13 @@ func (pManager PurchaseManager) GetPartialLicense(purchase Purchase) (license.Li
 	lcpServerConfig := pManager.config.LcpServer
 	lcpURL := lcpServerConfig.PublicBaseUrl + "/licenses/" + *purchase.LicenseUUID
 	// message to the console
-	log.Println("GET " + lcpURL)
+	logging.FromContext(ctx).Info("outbound request", "method", "GET", "url", lcpURL)
 	// prepare the request
-	req, err := http.NewRequest("GET", lcpURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", lcpURL, nil)
 	if err != nil {
 		return license.License{}, err
 	}
+	logging.ForwardRequestID(ctx, req)
 	// set credentials
 	lcpUpdateAuth := pManager.config.LcpUpdateAuth
 	if pManager.config.LcpUpdateAuth.Username != "" {
@@ -332,7 +342,8 @@ func (pManager PurchaseManager) GetPartialLicense(purchase Purchase) (license.Li
 	}
 	// send the request
 	var lcpClient = &http.Client{
-		Timeout: time.Second * 10,
+		Timeout:   time.Second * 10,
+		Transport: tracing.Transport(nil),
 	}
 	resp, err := lcpClient.Do(req)
 	if err != nil {
@@ -360,22 +371,24 @@ func (pManager PurchaseManager) GetPartialLicense(purchase Purchase) (license.Li
 
 // GetLicenseStatusDocument gets a license status document associated with a purchase
 //
-func (pManager PurchaseManager) GetLicenseStatusDocument(purchase Purchase) (licensestatuses.LicenseStatus, error) {
+func (pManager PurchaseManager) GetLicenseStatusDocument(ctx context.Context, purchase Purchase) (licensestatuses.LicenseStatus, error) {
 	if purchase.LicenseUUID == nil {
 		return licensestatuses.LicenseStatus{}, errors.New("No license has been yet delivered")
 	}
 
 	lsdServerConfig := pManager.config.LsdServer
 	lsdURL := lsdServerConfig.PublicBaseUrl + "/licenses/" + *purchase.LicenseUUID + "/status"
-	log.Println("GET " + lsdURL)
-	req, err := http.NewRequest("GET", lsdURL, nil)
+	logging.FromContext(ctx).Info("outbound request", "method", "GET", "url", lsdURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", lsdURL, nil)
 	if err != nil {
 		return licensestatuses.LicenseStatus{}, err
 	}
+	logging.ForwardRequestID(ctx, req)
 	req.Header.Add("Content-Type", api.ContentType_JSON)
 
 	var lsdClient = &http.Client{
-		Timeout: time.Second * 10,
+		Timeout:   time.Second * 10,
+		Transport: tracing.Transport(nil),
 	}
 
 	resp, err := lsdClient.Do(req)
@@ -489,10 +502,11 @@ func (pManager PurchaseManager) Add(p Purchase) error {
 // Update modifies a purchase on a renew or return request
 // parameters: a Purchase structure withID,	LicenseUUID, StartDate,	EndDate, Status
 // EndDate may be undefined (nil), in which case the lsd server will choose the renew period
+// ctx holds the id and the trace of the request, forwarded to the License and License Status Servers.
 //
-func (pManager PurchaseManager) Update(p Purchase) error {
+func (pManager PurchaseManager) Update(ctx context.Context, p Purchase) error {
 	// Get the original purchase from the db
-	origPurchase, err := pManager.Get(p.ID)
+	origPurchase, err := pManager.Get(ctx, p.ID)
 
 	if err != nil {
 		return ErrNotFound
@@ -526,12 +540,13 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 			p.Status = StatusOk
 		}
 		// message to the console
-		log.Println("PUT " + lsdURL)
+		logging.FromContext(ctx).Info("outbound request", "method", "PUT", "url", lsdURL)
 		// prepare the request for renew or return to the license status server
-		req, err := http.NewRequest("PUT", lsdURL, nil)
+		req, err := http.NewRequestWithContext(ctx, "PUT", lsdURL, nil)
 		if err != nil {
 			return err
 		}
+		logging.ForwardRequestID(ctx, req)
 		// set credentials
 		lsdAuth := pManager.config.LsdNotifyAuth
 		if lsdAuth.Username != "" {
@@ -539,7 +554,8 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 		}
 		// call the lsd server
 		var lsdClient = &http.Client{
-			Timeout: time.Second * 10,
+			Timeout:   time.Second * 10,
+			Transport: tracing.Transport(nil),
 		}
 		resp, err := lsdClient.Do(req)
 		if err != nil {
@@ -554,7 +570,7 @@ func (pManager PurchaseManager) Update(p Purchase) error {
 
 		// get the new end date from the license server
 		// FIXME: is there a lighter solution to get the new end date?
-		license, err := pManager.GetPartialLicense(origPurchase)
+		license, err := pManager.GetPartialLicense(ctx, origPurchase)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,218 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package health exposes the liveness, readiness and build information of the servers.
+// Readiness checks are registered at startup in a default registry, served at /readyz.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// Build information, set at build time with
+// -ldflags "-X github.com/omani/readium-lcp-server/health.Version=... -X ...health.Commit=... -X ...health.BuildDate=..."
+var (
+	Version   = ""
+	Commit    = ""
+	BuildDate = ""
+)
+
+// CheckTimeout bounds the time spent running each readiness check
+var CheckTimeout = 5 * time.Second
+
+// Check is a readiness check; a check which is not critical reports a degraded service when it fails
+type Check struct {
+	Name     string
+	Critical bool
+	Run      func(ctx context.Context) error
+}
+
+// Registry is a set of readiness checks
+type Registry struct {
+	mu     sync.Mutex
+	checks []Check
+}
+
+// Default is the registry of the checks added by Register
+var Default = &Registry{}
+
+// Register adds a check to the registry
+func (reg *Registry) Register(name string, critical bool, run func(ctx context.Context) error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.checks = append(reg.checks, Check{Name: name, Critical: critical, Run: run})
+}
+
+// Register adds a check to the default registry
+func Register(name string, critical bool, run func(ctx context.Context) error) {
+	Default.Register(name, critical, run)
+}
+
+// Statuses of the service and of the checks
+const (
+	StatusOK          = "ok"
+	StatusReady       = "ready"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+	StatusError       = "error"
+)
+
+// CheckResult is the result of a readiness check
+type CheckResult struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the readiness of a server
+type Report struct {
+	Status string                 `json:"status"`
+	Mode   string                 `json:"mode"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Run runs the checks concurrently; the service is unavailable if a critical check fails,
+// degraded if another check fails
+func (reg *Registry) Run(ctx context.Context) Report {
+	reg.mu.Lock()
+	checks := append([]Check{}, reg.checks...)
+	reg.mu.Unlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c Check) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.Run(cctx)
+			results[i] = CheckResult{Status: StatusOK, Critical: c.Critical, Duration: time.Since(start).String()}
+			if err != nil {
+				results[i].Status = StatusError
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusReady, Checks: make(map[string]CheckResult, len(checks))}
+	for i, c := range checks {
+		report.Checks[c.Name] = results[i]
+		if results[i].Status == StatusOK {
+			continue
+		}
+		if c.Critical {
+			report.Status = StatusUnavailable
+		} else if report.Status == StatusReady {
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// LiveHandler tells that the process is up and serving requests; it runs no check
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+	})
+}
+
+// ReadyHandler runs the checks of a registry: the response is 503 Service Unavailable if a critical
+// check fails, 200 otherwise. mode is reported as is, e.g. readonly.
+func ReadyHandler(reg *Registry, mode string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := reg.Run(r.Context())
+		report.Mode = mode
+		status := http.StatusOK
+		if report.Status == StatusUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+}
+
+// BuildInfo is the version of a server
+type BuildInfo struct {
+	Service   string `json:"service"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Info returns the build information of a server; the version defaults to the module version
+// when the server is installed with go install, "dev" otherwise
+func Info(service string) BuildInfo {
+	info := BuildInfo{Service: service, Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if info.Version == "" {
+		info.Version = "dev"
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+	}
+	return info
+}
+
+// VersionHandler returns the build information of a server
+func VersionHandler(service string) http.Handler {
+	info := Info(service)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, info)
+	})
+}
+
+// Database checks the connectivity to a database
+func Database(db *sql.DB) func(ctx context.Context) error {
+	return db.PingContext
+}
+
+// Storage checks the reachability of a store of encrypted publications; writable also checks
+// that publications can be added, when the backend can tell without adding one
+func Storage(s storage.Store, writable bool) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return storage.Check(ctx, s, writable)
+	}
+}
+
+// Server checks that another server responds at url, with a status other than a server error
+func Server(url string) func(ctx context.Context) error {
+	client := &http.Client{}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return errors.New(url + " returned " + resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func readiness(t *testing.T, reg *Registry, mode string) (int, Report) {
+	rec := httptest.NewRecorder()
+	ReadyHandler(reg, mode).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failed := func(ctx context.Context) error { return errors.New("unreachable") }
+
+	reg := &Registry{}
+	reg.Register("database", true, ok)
+	code, report := readiness(t, reg, "readwrite")
+	if code != http.StatusOK || report.Status != StatusReady || report.Mode != "readwrite" || report.Checks["database"].Status != StatusOK {
+		t.Errorf("Expected a ready service, got %d %+v", code, report)
+	}
+
+	// a failed check which is not critical degrades the service
+	reg.Register("lcpserver", false, failed)
+	code, report = readiness(t, reg, "readonly")
+	if code != http.StatusOK || report.Status != StatusDegraded || report.Checks["lcpserver"].Error != "unreachable" {
+		t.Errorf("Expected a degraded service, got %d %+v", code, report)
+	}
+
+	// a failed critical check makes the service unavailable
+	reg.Register("storage", true, failed)
+	code, report = readiness(t, reg, "readwrite")
+	if code != http.StatusServiceUnavailable || report.Status != StatusUnavailable || len(report.Checks) != 3 {
+		t.Errorf("Expected an unavailable service, got %d %+v", code, report)
+	}
+}
+
+func TestServerCheck(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	check := Server(server.URL + "/healthz")
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected a reachable server, got %v", err)
+	}
+	status = http.StatusBadGateway
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected an error for a server error")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	Version, Commit = "1.9.0", "abc123"
+	defer func() { Version, Commit = "", "" }()
+
+	rec := httptest.NewRecorder()
+	VersionHandler("lcpserver").ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	var info BuildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Service != "lcpserver" || info.Version != "1.9.0" || info.Commit != "abc123" || info.GoVersion == "" {
+		t.Errorf("Unexpected build information %+v", info)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// lcpencrypt-worker encrypts the EPUB files queued in the database of the License server.
+// It shares the configuration file of the License server, and any number of workers
+// may run on separate machines, as long as they access the same database and storage.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/omani/readium-lcp-server/api"
+	"github.com/omani/readium-lcp-server/config"
+	"github.com/omani/readium-lcp-server/index"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+func dbFromURI(uri string) (string, string) {
+	parts := strings.Split(uri, "://")
+	return parts[0], parts[1]
+}
+
+func main() {
+	var config_file, dbURI string
+
+	hostname, _ := os.Hostname()
+	name := flag.String("name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "name of the worker, recorded in the jobs it processes")
+	flag.Parse()
+
+	if config_file = os.Getenv("READIUM_LCPSERVER_CONFIG"); config_file == "" {
+		config_file = "config.yaml"
+	}
+	config.ReadConfig(config_file)
+	err := logging.Setup(config.Config.Log.Level, config.Config.Log.Format)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Reading config " + config_file)
+
+	err = config.SetPublicUrls()
+	if err != nil {
+		panic(err)
+	}
+	// use a sqlite db by default
+	if dbURI = config.Config.LcpServer.Database; dbURI == "" {
+		dbURI = "sqlite3://file:lcp.sqlite?cache=shared&mode=rwc"
+	}
+	driver, cnxn := dbFromURI(dbURI)
+	db, err := sql.Open(driver, cnxn)
+	if err != nil {
+		panic(err)
+	}
+	if driver == "sqlite3" {
+		_, err = db.Exec("PRAGMA journal_mode = WAL")
+		if err != nil {
+			panic(err)
+		}
+	}
+	idx, err := index.Open(db)
+	if err != nil {
+		panic(err)
+	}
+	queue, err := pack.OpenQueue(db)
+	if err != nil {
+		panic(err)
+	}
+	store, err := storage.FromConfig(config.Config.Storage, config.Config.LcpServer.PublicBaseUrl+"/files")
+	if err != nil {
+		panic(err)
+	}
+
+	concurrency := config.Config.Packager.Concurrency
+	if concurrency == 0 {
+		concurrency = 4
+	}
+	interval := time.Duration(config.Config.Packager.PollInterval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+
+	packager := pack.NewPackager(store, idx, concurrency)
+	source := pack.NewQueueSource(queue, store, *name, concurrency, interval)
+	source.Feed(packager.Incoming)
+
+	log.Printf("Encryption worker %s running, %d concurrent jobs", *name, concurrency)
+	log.Println("Using database " + dbURI)
+
+	// on SIGINT or SIGTERM, stop claiming jobs and wait for the jobs in progress;
+	// the jobs which are not done in time are released, to be claimed at once by another worker
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	go func() {
+		// a second signal stops the worker without waiting for the shutdown
+		<-sigChan
+		log.Println("Forced shutdown")
+		os.Exit(1)
+	}()
+	err = shutdown(source, packager)
+	db.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// shutdown waits for the jobs in progress, for at most the shutdown timeout of the License server
+func shutdown(source *pack.QueueSource, packager *pack.Packager) error {
+	timeout := time.Duration(config.Config.LcpServer.ShutdownTimeout) * time.Second
+	if timeout == 0 {
+		timeout = api.DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logging.Info("shutting down", "timeout", timeout)
+	var failed error
+	if err := source.Shutdown(ctx); err != nil {
+		logging.Error("jobs not completed, released", "error", err)
+		failed = err
+	}
+	if err := packager.Shutdown(ctx); err != nil {
+		logging.Error("encryption tasks not completed", "error", err)
+		failed = err
+	}
+	return failed
+}
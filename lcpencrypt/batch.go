@@ -0,0 +1,276 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	apilcp "github.com/omani/readium-lcp-server/lcpserver/api"
+)
+
+// exit codes of the batch mode, in addition to 10 (incorrect parameters)
+const (
+	batchSuccess        = 0
+	batchManifestError  = 11
+	batchPartialFailure = 60
+	batchFailure        = 61
+)
+
+// batchItem is a row of a batch manifest
+type batchItem struct {
+	Input     string `json:"input"`
+	ContentID string `json:"contentid"`
+	Output    string `json:"output"`
+	Profile   string `json:"profile"`
+}
+
+// batchResult is a line of the batch report
+type batchResult struct {
+	Input string `json:"input"`
+	apilcp.LcpPublication
+}
+
+// batchColumns lists the columns of a csv manifest, in their default order
+var batchColumns = []string{"input", "contentid", "output", "profile"}
+
+// batch runs the batch mode and returns the exit code of lcpencrypt
+func batch(args []string) int {
+	flags := flag.NewFlagSet("batch", flag.ContinueOnError)
+	manifest := flags.String("manifest", "", "list of publications to encrypt: a csv file (columns: input, contentid, output, profile) or a jsonl file (one object per line, with the same properties)")
+	workers := flags.Int("workers", 4, "number of publications encrypted concurrently")
+	report := flags.String("report", "", "path of the jsonl report (default: standard output)")
+	lcpsv := flags.String("lcpsv", "", "optional http endpoint of the License server (adds content)")
+	username := flags.String("login", "", "login (License server)")
+	password := flags.String("password", "", "password (License server)")
+	profile := flags.String("profile", "basic", "default LCP Profile to use for encryption: 'basic' or 'v1'")
+	retries := flags.Int("retries", 3, "number of retries of a failed notification of the License server")
+	strict := flags.Bool("strict", false, "refuse to encrypt EPUB files with structural errors")
+	obfuscateFonts := flags.Bool("obfuscate-fonts", false, "obfuscate the fonts of EPUB files instead of encrypting them")
+	if err := flags.Parse(args); err != nil {
+		return 10
+	}
+	if *manifest == "" {
+		log.Println("lcpencrypt batch needs a -manifest parameter, for more information type 'lcpencrypt batch -help'")
+		return 10
+	}
+	if *lcpsv != "" && (*username == "" || *password == "") {
+		log.Println("incorrect parameters, lcpsv needs a login and password, for more information type 'lcpencrypt batch -help'")
+		return 10
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	items, err := readManifest(*manifest)
+	if err != nil {
+		log.Println("Error reading the manifest: " + err.Error())
+		return batchManifestError
+	}
+
+	var out io.Writer = os.Stdout
+	if *report != "" {
+		f, err := os.Create(*report)
+		if err != nil {
+			log.Println("Error creating the report: " + err.Error())
+			return 10
+		}
+		defer f.Close()
+		out = f
+	}
+
+	// encrypt the publications concurrently; the report is written as the results come
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	encoder := json.NewEncoder(out)
+	failures := 0
+	queue := make(chan batchItem)
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				if item.Profile == "" {
+					item.Profile = *profile
+				}
+				result := batchResult{Input: item.Input}
+				result.LcpPublication = encryptBatchItem(item, *lcpsv, *username, *password, *retries, epubOptions{strict: *strict, obfuscateFonts: *obfuscateFonts})
+
+				mutex.Lock()
+				if result.ErrorMessage != "" {
+					failures++
+				}
+				if err := encoder.Encode(result); err != nil {
+					log.Println("Error writing the report: " + err.Error())
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, item := range items {
+		queue <- item
+	}
+	close(queue)
+	wg.Wait()
+
+	log.Printf("%d publications processed, %d failures", len(items), failures)
+	switch {
+	case failures == 0:
+		return batchSuccess
+	case failures < len(items):
+		return batchPartialFailure
+	default:
+		return batchFailure
+	}
+}
+
+// encryptBatchItem encrypts a publication and notifies the License server; errors are reported in the ErrorMessage property
+func encryptBatchItem(item batchItem, lcpsv, username, password string, retries int, opts epubOptions) apilcp.LcpPublication {
+	pub, outputExt := preparePublication(item.Input, item.ContentID, item.Output)
+
+	if _, err := os.Stat(item.Input); err != nil {
+		pub.ErrorMessage = "Input file does not exist: " + err.Error()
+		return pub
+	}
+	_, err := encryptPublication(&pub, item.Input, outputExt, encryptionProfile(item.Profile), opts)
+	if err != nil {
+		pub.ErrorMessage = withDetail(pub.ErrorMessage, err)
+		return pub
+	}
+	if lcpsv != "" {
+		err = notifyLcpServerWithRetry(lcpsv, pub.ContentID, pub, username, password, retries)
+		if err != nil {
+			pub.ErrorMessage = withDetail("Error notifying the License Server", err)
+		}
+	}
+	return pub
+}
+
+// withDetail appends the description of an error to a message
+func withDetail(message string, err error) string {
+	if message == "" {
+		return err.Error()
+	}
+	return message + ": " + err.Error()
+}
+
+// readManifest reads a csv or jsonl manifest, selected by its extension
+func readManifest(path string) ([]batchItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []batchItem
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		items, err = readCSVManifest(f)
+	case ".jsonl", ".ndjson":
+		items, err = readJSONLManifest(f)
+	default:
+		return nil, errors.New("the manifest must be a .csv or .jsonl file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		if item.Input == "" {
+			return nil, fmt.Errorf("item %d: missing input", i+1)
+		}
+	}
+	return items, nil
+}
+
+// readCSVManifest reads a csv manifest; the first row may name the columns, in any order
+func readCSVManifest(r io.Reader) ([]batchItem, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := batchColumns
+	if len(records) > 0 && isHeader(records[0]) {
+		columns = records[0]
+		records = records[1:]
+	}
+
+	var items []batchItem
+	for _, record := range records {
+		// skip empty lines
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		var item batchItem
+		for i, value := range record {
+			if i >= len(columns) {
+				break
+			}
+			value = strings.TrimSpace(value)
+			switch strings.ToLower(strings.TrimSpace(columns[i])) {
+			case "input":
+				item.Input = value
+			case "contentid":
+				item.ContentID = value
+			case "output":
+				item.Output = value
+			case "profile":
+				item.Profile = value
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// isHeader indicates that a csv record only contains column names
+func isHeader(record []string) bool {
+	for _, value := range record {
+		known := false
+		for _, column := range batchColumns {
+			if strings.EqualFold(strings.TrimSpace(value), column) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// readJSONLManifest reads a manifest made of one json object per line
+func readJSONLManifest(r io.Reader) ([]batchItem, error) {
+	var items []batchItem
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var item batchItem
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadCSVManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcpencrypt_batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "list.csv")
+	ioutil.WriteFile(path, []byte("profile,input,contentid\nv1,a.epub,id-a\n\nbasic,b.pdf,\n"), 0644)
+	items, err := readManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0] != (batchItem{Input: "a.epub", ContentID: "id-a", Profile: "v1"}) || items[1] != (batchItem{Input: "b.pdf", Profile: "basic"}) {
+		t.Errorf("Unexpected items %+v", items)
+	}
+
+	// without a header, the columns are in the default order
+	ioutil.WriteFile(path, []byte("a.epub,id-a,/tmp/a.epub\n"), 0644)
+	items, err = readManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0] != (batchItem{Input: "a.epub", ContentID: "id-a", Output: "/tmp/a.epub"}) {
+		t.Errorf("Unexpected items %+v", items)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcpencrypt_batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a License server which fails once for each publication
+	var mutex sync.Mutex
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls[r.URL.Path]++
+		if calls[r.URL.Path] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	notifyRetryDelay = time.Millisecond
+
+	manifest := filepath.Join(dir, "list.jsonl")
+	ioutil.WriteFile(manifest, []byte(
+		`{"input": "../test/samples/sample.epub", "contentid": "id-sample", "output": "`+filepath.Join(dir, "sample.epub")+`"}`+"\n"+
+			`{"input": "../test/samples/lorem.epub", "contentid": "id-lorem", "output": "`+filepath.Join(dir, "lorem.epub")+`", "profile": "v1"}`+"\n"+
+			`{"input": "../test/samples/missing.epub", "contentid": "id-missing"}`+"\n"), 0644)
+	report := filepath.Join(dir, "report.jsonl")
+
+	code := batch([]string{"-manifest", manifest, "-report", report, "-workers", "2", "-lcpsv", server.URL, "-login", "l", "-password", "p"})
+	if code != batchPartialFailure {
+		t.Errorf("Expected exit code %d, got %d", batchPartialFailure, code)
+	}
+
+	f, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	results := map[string]batchResult{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var result batchResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		results[result.ContentID] = result
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+	for _, id := range []string{"id-sample", "id-lorem"} {
+		if results[id].ErrorMessage != "" || results[id].Checksum == nil {
+			t.Errorf("Expected %s to be encrypted, got %+v", id, results[id])
+		}
+		if calls["/contents/"+id] != 2 {
+			t.Errorf("Expected the notification of %s to be retried once, got %d calls", id, calls["/contents/"+id])
+		}
+	}
+	if results["id-missing"].ErrorMessage == "" || results["id-missing"].Input != "../test/samples/missing.epub" {
+		t.Errorf("Expected an error for a missing input, got %+v", results["id-missing"])
+	}
+}
@@ -5,7 +5,6 @@
 package encrypt
 
 import (
-	"archive/zip"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -13,7 +12,6 @@ import (
 	"os"
 
 	"github.com/omani/readium-lcp-server/crypto"
-	"github.com/omani/readium-lcp-server/epub"
 	"github.com/omani/readium-lcp-server/license"
 	"github.com/omani/readium-lcp-server/pack"
 )
@@ -29,6 +27,8 @@ type EncryptionArtifact struct {
 	Size int64
 	// A Hex-Encoded SHA256 checksum of the encrypted package
 	Checksum string
+	// The thumbnails of the cover of the publication, if any
+	Thumbnails []pack.Thumbnail
 }
 
 func encryptionError(message string) (EncryptionArtifact, error) {
@@ -39,53 +39,13 @@ func encryptionError(message string) (EncryptionArtifact, error) {
 // It is called from the test frontend server
 func EncryptPackage(profile license.EncryptionProfile, inputPath string, outputPath string) (EncryptionArtifact, error) {
 
-	// create an AES encrypter for publication resources
-	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
-
 	// create a reader on the un-encrypted readium package
 	reader, err := pack.OpenRPF(inputPath)
 	if err != nil {
 		return encryptionError(err.Error())
 	}
 
-	// create the encrypted package file
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return encryptionError("Unable to create output file")
-	}
-	defer outputFile.Close()
-
-	// create a writer on the encrypted package
-	writer, err := reader.NewWriter(outputFile)
-	if err != nil {
-		return encryptionError("Unable to create output writer")
-	}
-
-	// encrypt resources from the input package, return the encryption key
-	encryptionKey, err := pack.Process(profile, encrypter, reader, writer)
-	if err != nil {
-		return encryptionError("Unable to encrypt file")
-	}
-
-	err = writer.Close()
-	if err != nil {
-		return encryptionError("Unable to close the writer")
-	}
-
-	// calculate the output file size and checksum
-	hasher := sha256.New()
-	outputFile.Seek(0, 0)
-	size, err := io.Copy(hasher, outputFile)
-	if err != nil {
-		return encryptionError("Could not generate a hash for the file")
-	}
-
-	return EncryptionArtifact{
-		Path:          outputPath,
-		EncryptionKey: encryptionKey,
-		Size:          size,
-		Checksum:      hex.EncodeToString(hasher.Sum(nil)),
-	}, nil
+	return encryptPackage(profile, reader, outputPath)
 }
 
 // EncryptEpub generates an encrypted output file out of the input file
@@ -96,33 +56,48 @@ func EncryptEpub(inputPath string, outputPath string) (EncryptionArtifact, error
 		return encryptionError("Input file does not exist")
 	}
 
-	// create a zip reader from the input path
-	zr, err := zip.OpenReader(inputPath)
-	if err != nil {
-		return encryptionError("Unable to open the input file")
-	}
-	defer zr.Close()
-
-	// parse the source epub
-	epubContent, err := epub.Read(&zr.Reader)
+	// create a reader on the source epub
+	reader, err := pack.OpenEPUB(inputPath)
 	if err != nil {
 		return encryptionError("Error reading epub content")
 	}
 
-	// create the output file
+	return encryptPackage(license.BasicProfile, reader, outputPath)
+}
+
+// encryptPackage encrypts the resources of a package (EPUB or RPF) into the output file
+func encryptPackage(profile license.EncryptionProfile, reader pack.PackageReader, outputPath string) (EncryptionArtifact, error) {
+
+	// create an AES encrypter for publication resources
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+
+	// resize the cover before its encryption; a missing or invalid cover is not an error
+	thumbnails, _ := pack.CoverThumbnails(reader)
+
+	// create the encrypted package file
 	outputFile, err := os.Create(outputPath)
 	if err != nil {
 		return encryptionError("Unable to create output file")
 	}
 	defer outputFile.Close()
 
-	// pack / encrypt the epub content, fill the output file
-	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
-	_, encryptionKey, err := pack.Do(encrypter, epubContent, outputFile)
+	// create a writer on the encrypted package
+	writer, err := reader.NewWriter(outputFile)
+	if err != nil {
+		return encryptionError("Unable to create output writer")
+	}
+
+	// encrypt resources from the input package, return the encryption key
+	encryptionKey, err := pack.Process(profile, encrypter, reader, writer)
 	if err != nil {
 		return encryptionError("Unable to encrypt file")
 	}
 
+	err = writer.Close()
+	if err != nil {
+		return encryptionError("Unable to close the writer")
+	}
+
 	// calculate the output file size and checksum
 	hasher := sha256.New()
 	outputFile.Seek(0, 0)
@@ -136,5 +111,6 @@ func EncryptEpub(inputPath string, outputPath string) (EncryptionArtifact, error
 		EncryptionKey: encryptionKey,
 		Size:          size,
 		Checksum:      hex.EncodeToString(hasher.Sum(nil)),
+		Thumbnails:    thumbnails,
 	}, nil
 }
@@ -19,6 +19,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/omani/readium-lcp-server/crypto"
 	"github.com/omani/readium-lcp-server/epub"
@@ -60,6 +61,7 @@ func notifyLcpServer(lcpService, contentid string, lcpPublication apilcp.LcpPubl
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 	if (resp.StatusCode != 302) && (resp.StatusCode/100) != 2 { //302=found or 20x reply = OK
 		return fmt.Errorf("lcp server error %d", resp.StatusCode)
 	}
@@ -67,17 +69,38 @@ func notifyLcpServer(lcpService, contentid string, lcpPublication apilcp.LcpPubl
 	return nil
 }
 
+// notifyRetryDelay is the delay before the first retry of a failed notification; it doubles at each retry
+var notifyRetryDelay = time.Second
+
+// notifyLcpServerWithRetry notifies the License server, and retries on failure with an exponential backoff
+func notifyLcpServerWithRetry(lcpService, contentid string, lcpPublication apilcp.LcpPublication, username string, password string, retries int) error {
+	delay := notifyRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := notifyLcpServer(lcpService, contentid, lcpPublication, username, password)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		log.Printf("Error notifying the License Server of %s, retrying in %s: %s", contentid, delay, err.Error())
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 func showHelpAndExit() {
 
 	log.Println("lcpencrypt protects a publication using the LCP DRM")
-	log.Println("-input        source file path")
+	log.Println("-input        source file path (epub, pdf, lpf, audiobook, divina, cbz or rpf file, audiobook folder or folder of images)")
 	log.Println("[-profile]    encryption profile")
 	log.Println("[-contentid]  optional content identifier, if omitted a new one will be generated")
 	log.Println("[-output]     optional target location for protected content (file system or http PUT)")
 	log.Println("[-lcpsv]      optional http endpoint for the License server")
 	log.Println("[-login]      login ( needed for License server) ")
 	log.Println("[-password]   password ( needed for License server)")
+	log.Println("[-strict]     refuse to encrypt an EPUB file with structural errors")
+	log.Println("[-obfuscate-fonts] obfuscate the fonts of an EPUB file (IDPF algorithm) instead of encrypting them")
 	log.Println("[-help] :     help information")
+	log.Println("lcpencrypt batch -manifest <file> encrypts the publications listed in a csv or jsonl file; type 'lcpencrypt batch -help' for more information")
+	log.Println("lcpencrypt watch -dir <folder> encrypts the publications dropped into a hot folder; type 'lcpencrypt watch -help' for more information")
 	os.Exit(0)
 	return
 }
@@ -128,7 +151,7 @@ func outputExtension(sourceExt string) string {
 		targetExt = ".lcpdf"
 	case ".audiobook":
 		targetExt = ".lcpau"
-	case ".divina":
+	case ".divina", ".cbz":
 		targetExt = ".lcpdi"
 	case ".lpf":
 		// short term solution. We'll need to inspect the manifest and check conformsTo,
@@ -139,7 +162,6 @@ func outputExtension(sourceExt string) string {
 }
 
 // buildEncryptedRPF builds an encrypted Readium package out of an un-encrypted one
-// FIXME: it cannot be used for EPUB as long as Do() and Process() are not merged
 func buildEncryptedRPF(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.Encrypter, lcpProfile license.EncryptionProfile) error {
 
 	// create a reader on the un-encrypted readium package
@@ -148,6 +170,19 @@ func buildEncryptedRPF(pub *apilcp.LcpPublication, inputPath string, encrypter c
 		pub.ErrorMessage = "Error opening package " + inputPath
 		return err
 	}
+	return buildEncryptedPackage(pub, reader, encrypter, lcpProfile)
+}
+
+// buildEncryptedPackage builds an encrypted package (EPUB or Readium package) out of an un-encrypted one
+func buildEncryptedPackage(pub *apilcp.LcpPublication, reader pack.PackageReader, encrypter crypto.Encrypter, lcpProfile license.EncryptionProfile) error {
+
+	// resize the cover before its encryption; a missing or invalid cover is not an error
+	thumbnails, err := pack.CoverThumbnails(reader)
+	if err != nil {
+		log.Println("No cover thumbnail: " + err.Error())
+	}
+	pub.Thumbnails = thumbnails
+
 	// create the encrypted package file
 	outputFile, err := os.Create(pub.Output)
 	if err != nil {
@@ -190,54 +225,65 @@ func buildEncryptedRPF(pub *apilcp.LcpPublication, inputPath string, encrypter c
 	return nil
 }
 
-// processEPUB encrypts resources in an EPUB
-func processEPUB(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.Encrypter) error {
-
-	pub.ContentType = epub.ContentType_EPUB
+// validateEPUB logs the structural issues of an EPUB file; in strict mode, errors prevent its encryption
+func validateEPUB(pub *apilcp.LcpPublication, inputPath string, strict bool) error {
 
-	// create a zip reader from the input path
 	zr, err := zip.OpenReader(inputPath)
 	if err != nil {
-		pub.ErrorMessage = "Error opening the epub file"
+		pub.ErrorMessage = "Error reading epub content"
 		return err
 	}
 	defer zr.Close()
 
-	// generate an EPUB object
-	epub, err := epub.Read(&zr.Reader)
-	if err != nil {
-		pub.ErrorMessage = "Error reading epub content"
-		return err
+	report := epub.Validate(&zr.Reader)
+	for _, issue := range report.Issues {
+		log.Println(filepath.Base(inputPath) + ": " + issue.String())
 	}
-	// create the output file
-	outputFile, err := os.Create(pub.Output)
-	if err != nil {
-		pub.ErrorMessage = "Error writing output file"
+	if errs := report.Errors(); len(errs) > 0 && strict {
+		pub.ErrorMessage = "Invalid EPUB"
+		return fmt.Errorf("%d errors, first: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// epubOptions are the command line options specific to EPUB files
+type epubOptions struct {
+	// strict refuses EPUB files with structural errors
+	strict bool
+	// obfuscateFonts obfuscates fonts with the IDPF algorithm instead of encrypting them
+	obfuscateFonts bool
+}
+
+// processEPUB encrypts resources in an EPUB; in strict mode, an invalid EPUB is not encrypted.
+// Fonts are obfuscated instead of being encrypted if requested.
+func processEPUB(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.Encrypter, lcpProfile license.EncryptionProfile, opts epubOptions) error {
+
+	pub.ContentType = epub.ContentType_EPUB
+
+	// check the structure of the epub file
+	if err := validateEPUB(pub, inputPath, opts.strict); err != nil {
 		return err
 	}
-	// will close the output file
-	defer outputFile.Close()
-	// encrypt the content of the publication,
-	// write them into the output file
-	_, encryptionKey, err := pack.Do(encrypter, epub, outputFile)
+
+	// create a reader on the epub file
+	reader, err := pack.OpenEPUB(inputPath)
 	if err != nil {
-		pub.ErrorMessage = "Error encrypting the EPUB content"
+		pub.ErrorMessage = "Error reading epub content"
 		return err
 	}
-	pub.ContentKey = encryptionKey
-	// calculate the output file size and checksum
-	stats, err := outputFile.Stat()
-	if err == nil && (stats.Size() > 0) {
-		filesize := stats.Size()
-		pub.Size = &filesize
-		cs := checksum(outputFile)
-		pub.Checksum = &cs
-	}
-	if stats.Size() == 0 {
-		pub.ErrorMessage = "Empty output file"
-		return err
+	if opts.obfuscateFonts {
+		if err = reader.ObfuscateFonts(); err != nil {
+			pub.ErrorMessage = "Error obfuscating fonts"
+			return err
+		}
 	}
-	return nil
+
+	// extract the metadata document, sent to the lcp server with the publication info
+	metadata := pack.EPUBMetadata(reader.Epub())
+	pub.Metadata = &metadata
+
+	// build an encrypted package
+	return buildEncryptedPackage(pub, reader, encrypter, lcpProfile)
 }
 
 // processPDF wraps an encrypted PDF file inside a Readium package
@@ -259,21 +305,41 @@ func processPDF(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.E
 	return err
 }
 
-// processLPF transforms a W3C LPF file into a Readium Package and encrypts its resources
-func processLPF(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.Encrypter, lcpProfile license.EncryptionProfile, outputExt string) error {
+// processAudiobook builds a Readium audiobook package out of an audiobook folder, a W3C LPF audiobook
+// or a Readium audiobook package, and encrypts its resources
+func processAudiobook(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.Encrypter, lcpProfile license.EncryptionProfile) error {
+
+	pub.ContentType = pack.ContentType_AUDIOBOOK_LCP
+
+	// generate a tmp Readium Package (rwpp) with a validated audiobook manifest
+	tmpPackagePath := pub.Output + ".audiobook"
+	err := pack.BuildAudiobook(inputPath, tmpPackagePath)
+	// will remove the tmp file even if an error is returned
+	defer os.Remove(tmpPackagePath)
+	// process error
+	if err != nil {
+		pub.ErrorMessage = "Error building the audiobook package"
+		return err
+	}
+
+	// build an encrypted package
+	err = buildEncryptedRPF(pub, tmpPackagePath, encrypter, lcpProfile)
+	return err
+}
+
+// processDivina builds a Readium Divina package out of a CBZ file or a folder of images, and encrypts its resources
+func processDivina(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.Encrypter, lcpProfile license.EncryptionProfile) error {
 
-	// When other kinds of LPF files are created, a switch on outputExt will be used
-	// to select the proper mime-type
-	pub.ContentType = "application/audiobook+lcp"
+	pub.ContentType = pack.ContentType_DIVINA_LCP
 
-	// generate a tmp Readium Package (rwpp) out of W3C Package (lpf)
-	tmpPackagePath := pub.Output + ".webpub"
-	err := pack.BuildRPFFromLPF(inputPath, tmpPackagePath)
+	// generate a tmp Readium Package (rwpp) with a Divina manifest
+	tmpPackagePath := pub.Output + ".divina"
+	err := pack.BuildDivina(inputPath, tmpPackagePath)
 	// will remove the tmp file even if an error is returned
 	defer os.Remove(tmpPackagePath)
 	// process error
 	if err != nil {
-		pub.ErrorMessage = "Error building RPF from LPF"
+		pub.ErrorMessage = "Error building the Divina package"
 		return err
 	}
 
@@ -288,9 +354,9 @@ func processRPF(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.E
 	// select a mime-type
 	switch outputExt {
 	case ".lcpau":
-		pub.ContentType = "application/audiobook+lcp"
+		pub.ContentType = pack.ContentType_AUDIOBOOK_LCP
 	case ".lcpdi":
-		pub.ContentType = "application/divina+lcp"
+		pub.ContentType = pack.ContentType_DIVINA_LCP
 	case ".lcpdf":
 		pub.ContentType = "application/pdf+lcp"
 	}
@@ -300,16 +366,110 @@ func processRPF(pub *apilcp.LcpPublication, inputPath string, encrypter crypto.E
 	return err
 }
 
+// preparePublication sets the content id, output path and content disposition of a publication to be encrypted,
+// and returns the extension of the output file.
+// If the content id is empty, a new one is generated. If the output path is empty,
+// then [content-id].[ext] is created into the working directory.
+func preparePublication(inputPath, contentID, outputPath string) (apilcp.LcpPublication, string) {
+	var pub apilcp.LcpPublication
+
+	if contentID == "" { // contentID not set -> generate a new one
+		uid := uuid.NewV4()
+		contentID = uid.String()
+	}
+	pub.ContentID = contentID
+
+	var basefilename string
+	var outputExt string
+	if outputPath == "" {
+		workingDir, _ := os.Getwd()
+		outputExt = outputExtension(inputExtension(inputPath))
+		outputPath = strings.Join([]string{workingDir, string(os.PathSeparator), contentID, outputExt}, "")
+		basefilename = filepath.Base(inputPath)
+		// a folder has no extension
+		if filepath.Ext(basefilename) == "" {
+			basefilename += outputExt
+		}
+	} else {
+		outputExt = filepath.Ext(outputPath)
+		basefilename = filepath.Base(outputPath)
+	}
+	pub.ContentDisposition = &basefilename
+	// reminder: the output path must be accessible from the license server
+	pub.Output = outputPath
+
+	return pub, outputExt
+}
+
+// encryptPublication selects the encryption process from the extension of the input file, and encrypts it.
+// The content id, output path and content disposition of pub must be set by the caller.
+// EPUB options (strict mode, font obfuscation) are ignored for other formats.
+// On failure, the exit code associated with the encryption process is returned.
+func encryptPublication(pub *apilcp.LcpPublication, inputPath string, outputExt string, lcpProfile license.EncryptionProfile, opts epubOptions) (int, error) {
+
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+
+	switch inputExtension(inputPath) {
+	case ".epub":
+		return 30, processEPUB(pub, inputPath, encrypter, lcpProfile, opts)
+	case ".pdf":
+		return 31, processPDF(pub, inputPath, encrypter, lcpProfile)
+	case ".lpf":
+		// short term solution: every LPF file is processed as an audiobook
+		return 32, processAudiobook(pub, inputPath, encrypter, lcpProfile)
+	case ".audiobook":
+		return 33, processAudiobook(pub, inputPath, encrypter, lcpProfile)
+	case ".cbz":
+		return 34, processDivina(pub, inputPath, encrypter, lcpProfile)
+	case ".divina", ".rpf":
+		return 33, processRPF(pub, inputPath, encrypter, lcpProfile, outputExt)
+	}
+	pub.ErrorMessage = "Unsupported file extension"
+	return 20, fmt.Errorf("cannot encrypt %s", inputPath)
+}
+
+// inputExtension returns the extension of the input file.
+// A folder of images is processed as a CBZ file, another folder as an audiobook.
+func inputExtension(inputPath string) string {
+	if fi, err := os.Stat(inputPath); err == nil && fi.IsDir() {
+		if pack.IsImageFolder(inputPath) {
+			return ".cbz"
+		}
+		return ".audiobook"
+	}
+	return filepath.Ext(inputPath)
+}
+
+// encryptionProfile returns the profile selected on the command line
+func encryptionProfile(profile string) license.EncryptionProfile {
+	if profile == "v1" {
+		return license.V1Profile
+	}
+	// covers missing parameter
+	return license.BasicProfile
+}
+
 func main() {
+	// sub-commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "watch":
+			os.Exit(watch(os.Args[2:]))
+		case "batch":
+			os.Exit(batch(os.Args[2:]))
+		}
+	}
+
 	var err error
-	var pub apilcp.LcpPublication
-	var inputPath = flag.String("input", "", "source epub/pdf/lpf file locator (file system or http GET)")
+	var inputPath = flag.String("input", "", "source epub/pdf/lpf/audiobook/divina/cbz/rpf file, audiobook folder or folder of images locator (file system or http GET)")
 	var contentid = flag.String("contentid", "", "optional content identifier; if omitted a new uuid is generated")
 	var outputFilename = flag.String("output", "", "optional target location for the encrypted content (file system or http PUT)")
 	var lcpsv = flag.String("lcpsv", "", "optional http endpoint of the License server (adds content)")
 	var username = flag.String("login", "", "login (License server)")
 	var password = flag.String("password", "", "password (License server)")
 	var profile = flag.String("profile", "basic", "LCP Profile to use for encryption: 'basic' or 'v1'")
+	var strict = flag.Bool("strict", false, "refuse to encrypt an EPUB file with structural errors")
+	var obfuscateFonts = flag.Bool("obfuscate-fonts", false, "obfuscate the fonts of an EPUB file instead of encrypting them")
 
 	var help = flag.Bool("help", false, "shows information")
 
@@ -321,65 +481,16 @@ func main() {
 	}
 
 	if *lcpsv != "" && (*username == "" || *password == "") {
-		pub.ErrorMessage = "incorrect parameters, lcpsv needs a login and password, for more information type 'lcpencrypt -help' "
-		exitWithError(pub, nil, 10)
-	}
-
-	if *contentid == "" { // contentID not set -> generate a new one
-		uid := uuid.NewV4()
-		*contentid = uid.String()
+		exitWithError(apilcp.LcpPublication{ErrorMessage: "incorrect parameters, lcpsv needs a login and password, for more information type 'lcpencrypt -help' "}, nil, 10)
 	}
-	pub.ContentID = *contentid
 
-	// if the output file name not set,
-	// then [content-id].[ext] is created into the working directory
-	inputExt := filepath.Ext(*inputPath)
-	var basefilename string
-	var outputExt string
-	if *outputFilename == "" {
-		workingDir, _ := os.Getwd()
-		outputExt = outputExtension(inputExt)
-		*outputFilename = strings.Join([]string{workingDir, string(os.PathSeparator), *contentid, outputExt}, "")
-		basefilename = filepath.Base(*inputPath)
-	} else {
-		outputExt = filepath.Ext(*outputFilename)
-		basefilename = filepath.Base(*outputFilename)
-	}
-	pub.ContentDisposition = &basefilename
-	// reminder: the output path must be accessible from the license server
-	pub.Output = *outputFilename
+	pub, outputExt := preparePublication(*inputPath, *contentid, *outputFilename)
+	*contentid = pub.ContentID
 
-	var lcpProfile license.EncryptionProfile
-	if *profile == "v1" {
-		lcpProfile = license.V1Profile
-	} else { // covers missing parameter
-		lcpProfile = license.BasicProfile
-	}
-
-	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
-
-	// select the encryption process
-	switch inputExt {
-	case ".epub":
-		err := processEPUB(&pub, *inputPath, encrypter)
-		if err != nil {
-			exitWithError(pub, err, 30)
-		}
-	case ".pdf":
-		err := processPDF(&pub, *inputPath, encrypter, lcpProfile)
-		if err != nil {
-			exitWithError(pub, err, 31)
-		}
-	case ".lpf":
-		err := processLPF(&pub, *inputPath, encrypter, lcpProfile, outputExt)
-		if err != nil {
-			exitWithError(pub, err, 32)
-		}
-	case ".audiobook", ".divina", ".rpf":
-		err := processRPF(&pub, *inputPath, encrypter, lcpProfile, outputExt)
-		if err != nil {
-			exitWithError(pub, err, 33)
-		}
+	// select the encryption process and encrypt the publication
+	errorlevel, err := encryptPublication(&pub, *inputPath, outputExt, encryptionProfile(*profile), epubOptions{strict: *strict, obfuscateFonts: *obfuscateFonts})
+	if err != nil {
+		exitWithError(pub, err, errorlevel)
 	}
 
 	// notify the LCP Server
@@ -0,0 +1,258 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	apilcp "github.com/omani/readium-lcp-server/lcpserver/api"
+	"github.com/omani/readium-lcp-server/license"
+	uuid "github.com/satori/go.uuid"
+)
+
+// processingDir is the sub-directory of the hot folder where files are moved while being encrypted.
+// Files found there at startup have been interrupted by a crash, and are processed again.
+const processingDir = ".processing"
+
+// resultExt is the extension of the sidecar json files written next to processed files
+const resultExt = ".json"
+
+// hotFolder watches a directory and encrypts the files dropped into it
+type hotFolder struct {
+	dir        string
+	doneDir    string
+	failedDir  string
+	outputDir  string
+	profile    license.EncryptionProfile
+	epubOpts   epubOptions
+	lcpsv      string
+	username   string
+	password   string
+	processing string
+	// sizes and modification times seen by the previous scan, used to detect files still being copied
+	seen map[string]os.FileInfo
+}
+
+// watch runs the hot folder mode and returns the exit code of lcpencrypt
+func watch(args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	dir := flags.String("dir", "", "hot folder, in which source publications are dropped")
+	doneDir := flags.String("done", "", "folder receiving the source publications once encrypted (default: <dir>/done)")
+	failedDir := flags.String("failed", "", "folder receiving the source publications which could not be encrypted (default: <dir>/failed)")
+	outputDir := flags.String("output", "", "folder receiving the encrypted publications (default: working directory)")
+	interval := flags.Int("interval", 10, "delay between two scans of the hot folder, in seconds")
+	once := flags.Bool("once", false, "process the files present in the hot folder, then exit")
+	lcpsv := flags.String("lcpsv", "", "optional http endpoint of the License server (adds content)")
+	username := flags.String("login", "", "login (License server)")
+	password := flags.String("password", "", "password (License server)")
+	profile := flags.String("profile", "basic", "LCP Profile to use for encryption: 'basic' or 'v1'")
+	strict := flags.Bool("strict", false, "refuse to encrypt EPUB files with structural errors")
+	obfuscateFonts := flags.Bool("obfuscate-fonts", false, "obfuscate the fonts of EPUB files instead of encrypting them")
+	if err := flags.Parse(args); err != nil {
+		return 10
+	}
+	if *dir == "" {
+		log.Println("lcpencrypt watch needs a -dir parameter, for more information type 'lcpencrypt watch -help'")
+		return 10
+	}
+	if *lcpsv != "" && (*username == "" || *password == "") {
+		log.Println("incorrect parameters, lcpsv needs a login and password, for more information type 'lcpencrypt watch -help'")
+		return 10
+	}
+
+	hf := hotFolder{
+		dir:        *dir,
+		doneDir:    *doneDir,
+		failedDir:  *failedDir,
+		outputDir:  *outputDir,
+		profile:    encryptionProfile(*profile),
+		epubOpts:   epubOptions{strict: *strict, obfuscateFonts: *obfuscateFonts},
+		lcpsv:      *lcpsv,
+		username:   *username,
+		password:   *password,
+		processing: filepath.Join(*dir, processingDir),
+		seen:       map[string]os.FileInfo{},
+	}
+	if hf.doneDir == "" {
+		hf.doneDir = filepath.Join(hf.dir, "done")
+	}
+	if hf.failedDir == "" {
+		hf.failedDir = filepath.Join(hf.dir, "failed")
+	}
+	if hf.outputDir == "" {
+		hf.outputDir, _ = os.Getwd()
+	}
+	for _, d := range []string{hf.processing, hf.doneDir, hf.failedDir, hf.outputDir} {
+		if err := os.MkdirAll(d, os.ModePerm); err != nil {
+			log.Println("Error creating " + d + ": " + err.Error())
+			return 20
+		}
+	}
+
+	// the file being processed is completed before exiting
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	stopped := func() bool {
+		select {
+		case <-sigChan:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// resume the files interrupted by a crash
+	interrupted, err := hf.scan(hf.processing)
+	if err != nil {
+		log.Println("Error reading " + hf.processing + ": " + err.Error())
+		return 20
+	}
+	for _, name := range interrupted {
+		log.Println("Resuming " + name)
+		hf.process(name)
+		if stopped() {
+			return 0
+		}
+	}
+
+	log.Println("Watching " + hf.dir)
+	for {
+		names, err := hf.scan(hf.dir)
+		if err != nil {
+			log.Println("Error reading " + hf.dir + ": " + err.Error())
+		}
+		for _, name := range names {
+			if !*once && !hf.stable(name) {
+				continue
+			}
+			// move the file out of the hot folder before processing it
+			if err = os.Rename(filepath.Join(hf.dir, name), filepath.Join(hf.processing, name)); err != nil {
+				log.Println("Error moving " + name + ": " + err.Error())
+				continue
+			}
+			delete(hf.seen, name)
+			hf.process(name)
+			if stopped() {
+				return 0
+			}
+		}
+		if *once {
+			return 0
+		}
+		select {
+		case <-sigChan:
+			return 0
+		case <-time.After(time.Duration(*interval) * time.Second):
+		}
+	}
+}
+
+// scan lists the publications present in a directory; hidden files and sidecar files are ignored
+func (hf *hotFolder) scan(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, resultExt) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// stable indicates that a file has the same size and modification time as during the previous scan,
+// i.e. that it is not being copied into the hot folder
+func (hf *hotFolder) stable(name string) bool {
+	fi, err := os.Stat(filepath.Join(hf.dir, name))
+	if err != nil {
+		return false
+	}
+	previous, ok := hf.seen[name]
+	hf.seen[name] = fi
+	return ok && previous.Size() == fi.Size() && previous.ModTime().Equal(fi.ModTime())
+}
+
+// process encrypts a file of the processing folder, notifies the License server,
+// then moves the file to the done or failed folder, next to a sidecar json result.
+func (hf *hotFolder) process(name string) {
+	inputPath := filepath.Join(hf.processing, name)
+	statePath := inputPath + resultExt
+
+	// the content id is saved before encryption, so that it is kept if the processing is resumed
+	var pub apilcp.LcpPublication
+	if state, err := ioutil.ReadFile(statePath); err == nil {
+		json.Unmarshal(state, &pub)
+	}
+	if pub.ContentID == "" {
+		pub.ContentID = uuid.NewV4().String()
+		if err := writeResult(statePath, pub); err != nil {
+			log.Println("Error saving the state of " + name + ": " + err.Error())
+		}
+	}
+	pub.ErrorMessage = ""
+
+	outputExt := outputExtension(filepath.Ext(name))
+	pub.Output = filepath.Join(hf.outputDir, pub.ContentID+outputExt)
+	basefilename := name
+	pub.ContentDisposition = &basefilename
+
+	_, err := encryptPublication(&pub, inputPath, outputExt, hf.profile, hf.epubOpts)
+	if err == nil && hf.lcpsv != "" {
+		err = notifyLcpServer(hf.lcpsv, pub.ContentID, pub, hf.username, hf.password)
+		if err != nil {
+			pub.ErrorMessage = "Error notifying the License Server"
+		}
+	}
+
+	targetDir := hf.doneDir
+	if err != nil {
+		targetDir = hf.failedDir
+		if pub.ErrorMessage == "" {
+			pub.ErrorMessage = err.Error()
+		} else {
+			pub.ErrorMessage += ": " + err.Error()
+		}
+		os.Remove(pub.Output)
+		log.Println("Error encrypting " + name + ": " + pub.ErrorMessage)
+	} else {
+		log.Println("Encrypted " + name + " as " + pub.Output)
+	}
+
+	// the result is written before the source file is moved: if a crash occurs in between, the file is processed again
+	if err = writeResult(filepath.Join(targetDir, name+resultExt), pub); err != nil {
+		log.Println("Error writing the result of " + name + ": " + err.Error())
+	}
+	if err = os.Rename(inputPath, filepath.Join(targetDir, name)); err != nil {
+		log.Println("Error moving " + name + ": " + err.Error())
+		return
+	}
+	os.Remove(statePath)
+}
+
+// writeResult writes a publication as json; the file is replaced atomically
+func writeResult(path string, pub apilcp.LcpPublication) error {
+	data, err := json.MarshalIndent(pub, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
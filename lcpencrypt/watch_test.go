@@ -0,0 +1,84 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apilcp "github.com/omani/readium-lcp-server/lcpserver/api"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dst, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readResult(t *testing.T, path string) apilcp.LcpPublication {
+	var pub apilcp.LcpPublication
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, &pub); err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcpencrypt_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hot := filepath.Join(dir, "hot")
+	output := filepath.Join(dir, "output")
+	os.MkdirAll(filepath.Join(hot, processingDir), os.ModePerm)
+
+	copyFile(t, "../test/samples/sample.epub", filepath.Join(hot, "sample.epub"))
+	ioutil.WriteFile(filepath.Join(hot, "notes.txt"), []byte("not a publication"), 0644)
+	// a file interrupted by a crash, with its saved state
+	copyFile(t, "../test/samples/lorem.epub", filepath.Join(hot, processingDir, "lorem.epub"))
+	ioutil.WriteFile(filepath.Join(hot, processingDir, "lorem.epub.json"), []byte(`{"content-id":"resumed-id"}`), 0644)
+
+	if code := watch([]string{"-dir", hot, "-output", output, "-once"}); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	pub := readResult(t, filepath.Join(hot, "done", "sample.epub.json"))
+	if pub.ErrorMessage != "" || pub.ContentKey == nil || pub.Size == nil || *pub.ContentDisposition != "sample.epub" {
+		t.Errorf("Unexpected result %+v", pub)
+	}
+	if _, err = os.Stat(pub.Output); err != nil || filepath.Dir(pub.Output) != output {
+		t.Errorf("Expected the encrypted publication in the output folder, got %s", pub.Output)
+	}
+	if _, err = os.Stat(filepath.Join(hot, "done", "sample.epub")); err != nil {
+		t.Error("Expected the source publication to be moved to the done folder")
+	}
+
+	pub = readResult(t, filepath.Join(hot, "done", "lorem.epub.json"))
+	if pub.ContentID != "resumed-id" {
+		t.Errorf("Expected the content id to be kept when resuming, got %s", pub.ContentID)
+	}
+
+	pub = readResult(t, filepath.Join(hot, "failed", "notes.txt.json"))
+	if pub.ErrorMessage == "" {
+		t.Error("Expected an error message for an unsupported file")
+	}
+
+	remaining, _ := ioutil.ReadDir(filepath.Join(hot, processingDir))
+	if len(remaining) != 0 {
+		t.Errorf("Expected the processing folder to be empty, got %d files", len(remaining))
+	}
+}
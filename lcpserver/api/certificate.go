@@ -0,0 +1,22 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/omani/readium-lcp-server/api"
+)
+
+// ListCertificates lists the active provider certificates, with their expiry
+// and the certificate currently selected to sign licenses
+func ListCertificates(w http.ResponseWriter, r *http.Request, s Server) {
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s.Certificates().Info())
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omani/readium-lcp-server/api"
+	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/problem"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// PostJob queues the encryption of an EPUB file, which will be processed by an encryption worker.
+// The file is the body of the request, its name is given by the 'name' query parameter
+// and its content type by the Content-Type header (EPUB by default).
+// The response is the job in json format, its content id is the id of the future encrypted publication.
+func PostJob(w http.ResponseWriter, r *http.Request, s Server) {
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		problem.Error(w, r, problem.Problem{Detail: "The file name must be set in the url"}, http.StatusBadRequest)
+		return
+	}
+	size := r.ContentLength
+	if size < 0 {
+		size = storage.UnknownSize
+	}
+
+	job, err := pack.PostJob(r.Context(), s.Queue(), s.Store(), name, r.Body, size, r.Header.Get("Content-Type"))
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	// must come *after* w.Header().Add()/Set(), but before w.Write()
+	w.WriteHeader(http.StatusAccepted)
+
+	json.NewEncoder(w).Encode(job)
+}
+
+// GetJob returns the status of an encryption job
+func GetJob(w http.ResponseWriter, r *http.Request, s Server) {
+
+	vars := mux.Vars(r)
+	job, err := s.Queue().Get(vars["job_id"])
+	if err != nil {
+		if err == pack.ErrJobNotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(job)
+}
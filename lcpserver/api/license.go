@@ -7,28 +7,38 @@ package apilcp
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/config"
 	"github.com/omani/readium-lcp-server/epub"
 	"github.com/omani/readium-lcp-server/index"
 	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/metrics"
 	"github.com/omani/readium-lcp-server/problem"
+	"github.com/omani/readium-lcp-server/sign"
+	"github.com/omani/readium-lcp-server/tracing"
 	"github.com/omani/readium-lcp-server/storage"
 )
 
+// licensesGenerated counts the licenses generated, returned alone or in a licensed publication
+var licensesGenerated = metrics.NewCounterVec("lcp_licenses_generated_total",
+	"Number of licenses generated, by response type (license or publication)", "type")
+
 // ErrMandatoryInfoMissing sets an error message returned to the caller
 var ErrMandatoryInfoMissing = errors.New("Mandatory info missing in the input body")
 
@@ -40,11 +50,11 @@ var ErrBadValue = errors.New("Erroneous user_key.value, can't be decoded")
 
 // checkGetLicenseInput: if we generate or get a license, check mandatory information in the input body
 // and compute request parameters
-func checkGetLicenseInput(l *license.License) error {
+func checkGetLicenseInput(ctx context.Context, l *license.License) error {
 
 	// the user hint is mandatory
 	if l.Encryption.UserKey.Hint == "" {
-		log.Println("User hint is missing")
+		logging.FromContext(ctx).Warn("user hint is missing")
 		return ErrMandatoryInfoMissing
 	}
 	// Value or HexValue are mandatory
@@ -58,7 +68,7 @@ func checkGetLicenseInput(l *license.License) error {
 		}
 		l.Encryption.UserKey.Value = value
 	} else if l.Encryption.UserKey.Value == nil {
-		log.Println("User hashed passphrase is missing")
+		logging.FromContext(ctx).Warn("user hashed passphrase is missing")
 		return ErrMandatoryInfoMissing
 	}
 	// check the size of Value (32 bytes), to avoid weird errors in the crypto code
@@ -70,14 +80,14 @@ func checkGetLicenseInput(l *license.License) error {
 }
 
 // checkGenerateLicenseInput: if we generate a license, check mandatory information in the input body
-func checkGenerateLicenseInput(l *license.License) error {
+func checkGenerateLicenseInput(ctx context.Context, l *license.License) error {
 
 	if l.User.ID == "" {
-		log.Println("User identification is missing")
+		logging.FromContext(ctx).Warn("user identification is missing")
 		return ErrMandatoryInfoMissing
 	}
 	// check user hint, passphrase hash and hash algorithm
-	err := checkGetLicenseInput(l)
+	err := checkGetLicenseInput(ctx, l)
 	return err
 }
 
@@ -113,8 +123,21 @@ func setRights(lic *license.License) {
 	}
 }
 
+// buildLicenseStatus returns the http status of an error of buildLicense:
+// the service is unavailable while the signing key (HSM, remote signing service) cannot be reached
+func buildLicenseStatus(err error) int {
+	if errors.Is(err, sign.ErrSignerUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 // build a license, common to get and generate license, get and generate licensed publication
-func buildLicense(lic *license.License, s Server) error {
+func buildLicense(ctx context.Context, lic *license.License, s Server) (err error) {
+	ctx, span := tracing.Start(ctx, "buildLicense", attribute.String("content_id", lic.ContentID))
+	defer func() {
+		tracing.End(span, err)
+	}()
 
 	// set the LCP profile
 	license.SetLicenseProfile(lic)
@@ -123,9 +146,11 @@ func buildLicense(lic *license.License, s Server) error {
 	lic.Encryption.UserKey.Algorithm = "http://www.w3.org/2001/04/xmlenc#sha256"
 
 	// get content info from the db
+	_, dbSpan := tracing.StartDB(ctx, "SELECT", "content")
 	content, err := s.Index().Get(lic.ContentID)
+	tracing.End(dbSpan, err)
 	if err != nil {
-		log.Println("No content with id", lic.ContentID)
+		logging.FromContext(ctx).Warn("no content for the license", "content_id", lic.ContentID, "error", err)
 		return err
 	}
 
@@ -140,11 +165,18 @@ func buildLicense(lic *license.License, s Server) error {
 		return err
 	}
 	// sign the license
+	_, signSpan := tracing.Start(ctx, "SignLicense")
 	err = license.SignLicense(lic, s.Certificate())
-	if err != nil {
-		return err
-	}
-	return nil
+	tracing.End(signSpan, err)
+	return err
+}
+
+// storeLicense stores a new license in the db
+func storeLicense(ctx context.Context, lic license.License, s Server) error {
+	_, span := tracing.StartDB(ctx, "INSERT", "license")
+	err := s.Licenses().Add(lic)
+	tracing.End(span, err)
+	return err
 }
 
 // copyZipFiles copies every file from one zip archive to another
@@ -184,18 +216,19 @@ func isWebPub(in *zip.Reader) bool {
 }
 
 // buildLicensedPublication builds a licensed publication, common to get and generate licensed publication
-func buildLicensedPublication(lic *license.License, s Server) (buf bytes.Buffer, err error) {
+func buildLicensedPublication(ctx context.Context, lic *license.License, s Server) (buf bytes.Buffer, err error) {
 
 	// get content info from the bd
-	item, err := s.Store().Get(lic.ContentID)
+	item, err := s.Store().Get(ctx, lic.ContentID)
 	if err != nil {
 		return
 	}
 	// read the content into a buffer
-	contents, err := item.Contents()
+	contents, err := item.Contents(ctx)
 	if err != nil {
 		return buf, err
 	}
+	defer contents.Close()
 	b, err := ioutil.ReadAll(contents)
 	if err != nil {
 		return buf, err
@@ -246,7 +279,8 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	// get the license id from the request URL
 	licenseID := vars["license_id"]
 
-	log.Println("Get License with id", licenseID)
+	logger := logging.FromContext(r.Context()).With("license_id", licenseID)
+	logger.Info("get license")
 
 	// initialize the license from the info stored in the db.
 	var licOut license.License
@@ -270,7 +304,7 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 		// if there was no partial license given as payload, return a partial license.
 		// The use case is a frontend that needs to get license up to date rights.
 		if err.Error() == "EOF" {
-			log.Println("No payload, get a partial license")
+			logger.Info("no payload, get a partial license")
 
 			// add useful http headers
 			w.Header().Add("Content-Type", api.ContentType_LCP_JSON)
@@ -289,7 +323,7 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// an input body was sent with the request:
 	// check mandatory information in the partial license
-	err = checkGetLicenseInput(&licIn)
+	err = checkGetLicenseInput(r.Context(), &licIn)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
@@ -297,9 +331,9 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	// copy useful data from licIn to LicOut
 	copyInputToLicense(&licIn, &licOut)
 	// build the license
-	err = buildLicense(&licOut, s)
+	err = buildLicense(r.Context(), &licOut, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, buildLicenseStatus(err))
 		return
 	}
 
@@ -323,7 +357,7 @@ func GenerateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	// get the content id from the request URL
 	contentID := vars["content_id"]
 
-	log.Println("Generate License for content id", contentID)
+	logging.FromContext(r.Context()).Info("generate license", "content_id", contentID)
 
 	// get the input body
 	// note: no need to create licIn / licOut here, as the input body contains
@@ -335,7 +369,7 @@ func GenerateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 	// check mandatory information in the input body
-	err = checkGenerateLicenseInput(&lic)
+	err = checkGenerateLicenseInput(r.Context(), &lic)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
@@ -347,14 +381,14 @@ func GenerateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	setRights(&lic)
 
 	// build the license
-	err = buildLicense(&lic, s)
+	err = buildLicense(r.Context(), &lic, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, buildLicenseStatus(err))
 		return
 	}
 
 	// store the license in the db
-	err = s.Licenses().Add(lic)
+	err = storeLicense(r.Context(), lic, s)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		//problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
@@ -370,9 +404,10 @@ func GenerateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	enc.SetEscapeHTML(false)
 	enc.Encode(lic)
 
+	licensesGenerated.With("license").Inc()
 	// notify the lsd server of the creation of the license.
 	// this is an asynchronous call.
-	go notifyLsdServer(lic, s)
+	notifyLsdServerAsync(tracing.Detach(r.Context()), lic, s)
 }
 
 // GetLicensedPublication returns a licensed publication
@@ -383,7 +418,7 @@ func GetLicensedPublication(w http.ResponseWriter, r *http.Request, s Server) {
 	vars := mux.Vars(r)
 	licenseID := vars["license_id"]
 
-	log.Println("Get a Licensed publication for license id", licenseID)
+	logging.FromContext(r.Context()).Info("get licensed publication", "license_id", licenseID)
 
 	// get the input body
 	var licIn license.License
@@ -393,7 +428,7 @@ func GetLicensedPublication(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 	// check mandatory information in the input body
-	err = checkGetLicenseInput(&licIn)
+	err = checkGetLicenseInput(r.Context(), &licIn)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
@@ -411,13 +446,13 @@ func GetLicensedPublication(w http.ResponseWriter, r *http.Request, s Server) {
 	// copy useful data from licIn to LicOut
 	copyInputToLicense(&licIn, &licOut)
 	// build the license
-	err = buildLicense(&licOut, s)
+	err = buildLicense(r.Context(), &licOut, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, buildLicenseStatus(err))
 		return
 	}
 	// build a licensed publication
-	buf, err := buildLicensedPublication(&licOut, s)
+	buf, err := buildLicensedPublication(r.Context(), &licOut, s)
 	if err == storage.ErrNotFound {
 		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: licOut.ContentID}, http.StatusNotFound)
 		return
@@ -439,6 +474,7 @@ func GetLicensedPublication(w http.ResponseWriter, r *http.Request, s Server) {
 	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, location))
 	// FIXME: check the use of X-Lcp-License by the caller (frontend?)
 	w.Header().Add("X-Lcp-License", licOut.ID)
+	setMetadataLink(w, r, s, licOut.ContentID)
 	// must come *after* w.Header().Add()/Set(), but before w.Write()
 	w.WriteHeader(http.StatusCreated)
 	// return the full licensed publication to the caller
@@ -453,7 +489,7 @@ func GenerateLicensedPublication(w http.ResponseWriter, r *http.Request, s Serve
 	vars := mux.Vars(r)
 	contentID := vars["content_id"]
 
-	log.Println("Generate a Licensed publication for content id", contentID)
+	logging.FromContext(r.Context()).Info("generate licensed publication", "content_id", contentID)
 
 	// get the input body
 	var lic license.License
@@ -463,7 +499,7 @@ func GenerateLicensedPublication(w http.ResponseWriter, r *http.Request, s Serve
 		return
 	}
 	// check mandatory information in the input body
-	err = checkGenerateLicenseInput(&lic)
+	err = checkGenerateLicenseInput(r.Context(), &lic)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
@@ -474,23 +510,24 @@ func GenerateLicensedPublication(w http.ResponseWriter, r *http.Request, s Serve
 	setRights(&lic)
 
 	// build the license
-	err = buildLicense(&lic, s)
+	err = buildLicense(r.Context(), &lic, s)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, buildLicenseStatus(err))
 		return
 	}
 	// store the license in the db
-	err = s.Licenses().Add(lic)
+	err = storeLicense(r.Context(), lic, s)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
 		return
 	}
 
+	licensesGenerated.With("publication").Inc()
 	// notify the lsd server of the creation of the license
-	go notifyLsdServer(lic, s)
+	notifyLsdServerAsync(tracing.Detach(r.Context()), lic, s)
 
 	// build a licenced publication
-	buf, err := buildLicensedPublication(&lic, s)
+	buf, err := buildLicensedPublication(r.Context(), &lic, s)
 	if err == storage.ErrNotFound {
 		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: lic.ContentID}, http.StatusNotFound)
 		return
@@ -513,6 +550,7 @@ func GenerateLicensedPublication(w http.ResponseWriter, r *http.Request, s Serve
 	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, location))
 	// FIXME: check the use of X-Lcp-License by the caller (frontend?)
 	w.Header().Add("X-Lcp-License", lic.ID)
+	setMetadataLink(w, r, s, lic.ContentID)
 	// must come *after* w.Header().Add()/Set(), but before w.Write()
 	w.WriteHeader(http.StatusCreated)
 	// return the full licensed publication to the caller
@@ -532,7 +570,8 @@ func UpdateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	// get the license id from the request URL
 	licenseID := vars["license_id"]
 
-	log.Println("Update License with id", licenseID)
+	logger := logging.FromContext(r.Context()).With("license_id", licenseID)
+	logger.Info("update license")
 
 	var licIn license.License
 	err := DecodeJSONLicense(r, &licIn)
@@ -553,31 +592,31 @@ func UpdateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 	// update licOut using information found in licIn
 	if licIn.User.ID != "" {
-		log.Println("new user id: ", licIn.User.ID)
+		logger.Info("new user id", "user_id", licIn.User.ID)
 		licOut.User.ID = licIn.User.ID
 	}
 	if licIn.Provider != "" {
-		log.Println("new provider: ", licIn.Provider)
+		logger.Info("new provider", "provider", licIn.Provider)
 		licOut.Provider = licIn.Provider
 	}
 	if licIn.ContentID != "" {
-		log.Println("new content id: ", licIn.ContentID)
+		logger.Info("new content id", "content_id", licIn.ContentID)
 		licOut.ContentID = licIn.ContentID
 	}
 	if licIn.Rights.Print != nil {
-		log.Println("new right, print: ", *licIn.Rights.Print)
+		logger.Info("new right", "print", *licIn.Rights.Print)
 		licOut.Rights.Print = licIn.Rights.Print
 	}
 	if licIn.Rights.Copy != nil {
-		log.Println("new right, copy: ", *licIn.Rights.Copy)
+		logger.Info("new right", "copy", *licIn.Rights.Copy)
 		licOut.Rights.Copy = licIn.Rights.Copy
 	}
 	if licIn.Rights.Start != nil {
-		log.Println("new right, start: ", *licIn.Rights.Start)
+		logger.Info("new right", "start", *licIn.Rights.Start)
 		licOut.Rights.Start = licIn.Rights.Start
 	}
 	if licIn.Rights.End != nil {
-		log.Println("new right, end: ", *licIn.Rights.End)
+		logger.Info("new right", "end", *licIn.Rights.End)
 		licOut.Rights.End = licIn.Rights.End
 	}
 	// update the license in the database
@@ -719,6 +758,42 @@ func ListLicensesForContent(w http.ResponseWriter, r *http.Request, s Server) {
 
 }
 
+// LicenseVerification is the result of the verification of a license
+type LicenseVerification struct {
+	ID    string `json:"id,omitempty"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyLicense checks the signature of a license given as input, and its certificate
+// against the provider CA chain and revocation lists configured on the server.
+// The result is returned as a json object; an invalid license is not an error of the request.
+func VerifyLicense(w http.ResponseWriter, r *http.Request, s Server) {
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	var lic license.License
+	if err = json.Unmarshal(data, &lic); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	res := LicenseVerification{ID: lic.ID, Valid: true}
+	if err = license.VerifyLicenseJSON(data, s.Verifier()); err != nil {
+		logging.FromContext(r.Context()).Warn("invalid license", "license_id", lic.ID, "error", err)
+		res.Valid = false
+		res.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(res)
+}
+
 // DecodeJSONLicense decodes a license formatted in json and returns a license object
 func DecodeJSONLicense(r *http.Request, lic *license.License) error {
 
@@ -734,18 +809,49 @@ func DecodeJSONLicense(r *http.Request, lic *license.License) error {
 	err := dec.Decode(&lic)
 
 	if err != nil && err.Error() != "EOF" {
-		log.Print("Decode license: invalid json structure")
+		logging.FromContext(r.Context()).Warn("invalid license json structure", "error", err)
 	}
 	return err
 }
 
+// notifications counts the notifications of the License Status Server in progress
+var notifications sync.WaitGroup
+
+// notifyLsdServerAsync notifies the License Status Server in the background
+func notifyLsdServerAsync(ctx context.Context, l license.License, s Server) {
+	notifications.Add(1)
+	go func() {
+		defer notifications.Done()
+		notifyLsdServer(ctx, l, s)
+	}()
+}
+
+// WaitNotifications waits for the notifications of the License Status Server in progress;
+// it is called on shutdown, once no request is processed anymore.
+// It returns the error of ctx if the notifications are not done before ctx ends.
+func WaitNotifications(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		notifications.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // notifyLsdServer informs the License Status Server of the creation of a new license
 // and saves the result of the http request in the DB (using *Store)
-func notifyLsdServer(l license.License, s Server) {
+// ctx holds the id and the trace of the request which created the license, forwarded to the License Status Server.
+func notifyLsdServer(ctx context.Context, l license.License, s Server) {
 
 	if config.Config.LsdServer.PublicBaseUrl != "" {
 		var lsdClient = &http.Client{
-			Timeout: time.Second * 10,
+			Timeout:   time.Second * 10,
+			Transport: tracing.Transport(nil),
 		}
 		pr, pw := io.Pipe()
 		defer pr.Close()
@@ -753,10 +859,11 @@ func notifyLsdServer(l license.License, s Server) {
 			_ = json.NewEncoder(pw).Encode(l)
 			pw.Close() // signal end writing
 		}()
-		req, err := http.NewRequest("PUT", config.Config.LsdServer.PublicBaseUrl+"/licenses", pr)
+		req, err := http.NewRequestWithContext(ctx, "PUT", config.Config.LsdServer.PublicBaseUrl+"/licenses", pr)
 		if err != nil {
 			return
 		}
+		logging.ForwardRequestID(ctx, req)
 		// set credentials on lsd request
 		notifyAuth := config.Config.LsdNotifyAuth
 		if notifyAuth.Username != "" {
@@ -767,25 +874,23 @@ func notifyLsdServer(l license.License, s Server) {
 
 		response, err := lsdClient.Do(req)
 		if err != nil {
-			log.Println("Error Notify LsdServer of new License (" + l.ID + "):" + err.Error())
+			logging.FromContext(ctx).Error("cannot notify the license status server", "license_id", l.ID, "error", err)
 			_ = s.Licenses().UpdateLsdStatus(l.ID, -1)
 		} else {
 			defer req.Body.Close()
 			_ = s.Licenses().UpdateLsdStatus(l.ID, int32(response.StatusCode))
-			// message to the console
-			log.Println("Notify Lsd Server of a new License with id " + l.ID + " = " + strconv.Itoa(response.StatusCode))
+			logging.FromContext(ctx).Info("license status server notified", "license_id", l.ID, "status", response.StatusCode)
 		}
 	}
 }
 
 // utility: log a license for debug purposes
-// ex: logLicense("build licence:", licOut)
-func logLicense(msg string, l *license.License) {
-	log.Println(msg)
+// ex: logLicense(ctx, "build licence", licOut)
+func logLicense(ctx context.Context, msg string, l *license.License) {
 	jsonBody, errj := json.Marshal(*l)
 	if errj != nil {
-		log.Println("logLicense: not well formed json")
+		logging.FromContext(ctx).Debug(msg, "error", errj)
 		return
 	}
-	log.Print(string(jsonBody))
+	logging.FromContext(ctx).Debug(msg, "license", string(jsonBody))
 }
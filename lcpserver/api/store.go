@@ -5,23 +5,28 @@
 package apilcp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 
 	"github.com/omani/readium-lcp-server/api"
+	"github.com/omani/readium-lcp-server/config"
 	"github.com/omani/readium-lcp-server/index"
 	"github.com/omani/readium-lcp-server/license"
 	"github.com/omani/readium-lcp-server/pack"
 	"github.com/omani/readium-lcp-server/problem"
+	"github.com/omani/readium-lcp-server/rwpm"
+	"github.com/omani/readium-lcp-server/sign"
 	"github.com/omani/readium-lcp-server/storage"
 )
 
@@ -30,8 +35,13 @@ type Server interface {
 	Store() storage.Store
 	Index() index.Index
 	Licenses() license.Store
+	// Certificate returns the certificate which signs licenses
 	Certificate() *tls.Certificate
+	Certificates() *sign.Certificates
+	Verifier() *sign.Verifier
 	Source() *pack.ManualSource
+	// Queue returns nil if the encryption is not delegated to workers
+	Queue() pack.Queue
 }
 
 // LcpPublication is a struct for communication with lcp-server
@@ -44,21 +54,10 @@ type LcpPublication struct {
 	ContentDisposition *string `json:"protected-content-disposition"`
 	ContentType        string  `json:"protected-content-type,omitempty"`
 	ErrorMessage       string  `json:"error,omitempty"`
-}
-
-func writeRequestFileToTemp(r io.Reader) (int64, *os.File, error) {
-	dir := os.TempDir()
-	file, err := ioutil.TempFile(dir, "readium-lcp")
-	if err != nil {
-		return 0, file, err
-	}
-
-	n, err := io.Copy(file, r)
-
-	// Rewind to the beginning of the file
-	file.Seek(0, 0)
-
-	return n, file, err
+	// Metadata is the metadata document extracted from the publication, optional
+	Metadata *rwpm.Publication `json:"publication-metadata,omitempty"`
+	// Thumbnails are the resized covers of the publication, optional
+	Thumbnails []pack.Thumbnail `json:"cover-thumbnails,omitempty"`
 }
 
 func cleanupTempFile(f *os.File) {
@@ -69,35 +68,6 @@ func cleanupTempFile(f *os.File) {
 	os.Remove(f.Name())
 }
 
-// StoreContent stores content in the storage.
-// The content name is given in the url (name)
-// A temporary file is created, then deleted after the content has been stored
-func StoreContent(w http.ResponseWriter, r *http.Request, s Server) {
-
-	vars := mux.Vars(r)
-
-	size, f, err := writeRequestFileToTemp(r.Body)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
-		return
-	}
-
-	defer cleanupTempFile(f)
-
-	t := pack.NewTask(vars["name"], f, size)
-	result := s.Source().Post(t)
-
-	if result.Error != nil {
-		problem.Error(w, r, problem.Problem{Detail: result.Error.Error()}, http.StatusBadRequest)
-		return
-	}
-
-	// must come *after* w.Header().Add()/Set(), but before w.Write()
-	w.WriteHeader(http.StatusCreated)
-
-	json.NewEncoder(w).Encode(result.ID)
-}
-
 // AddContent adds content to the storage
 // lcp spec : store data resulting from an external encryption
 // PUT method with PAYLOAD : LcpPublication in json format
@@ -121,17 +91,35 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 		problem.Error(w, r, problem.Problem{Detail: "The content id must be set in the url"}, http.StatusBadRequest)
 		return
 	}
-	// open the encrypted file, use its full path
-	file, err := getAndOpenFile(publication.Output)
+	// open the encrypted file, use its full path, or stream it if its location is a URL
+	HTTPOrHTTPS, err := isHTTPOrHTTPS(publication.Output)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
-	// the input file will be deleted when the function returns
-	defer cleanupTempFile(file)
+	var content io.ReadCloser
+	var size int64
+	if HTTPOrHTTPS {
+		content, size, err = openURL(r.Context(), publication.Output)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		defer content.Close()
+	} else {
+		var file *os.File
+		file, size, err = openFile(publication.Output)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		// the input file will be deleted when the function returns
+		defer cleanupTempFile(file)
+		content = file
+	}
 
 	// add the file to the storage, named by contentID, without file extension
-	_, err = s.Store().Add(contentID, file)
+	_, err = s.Store().Add(r.Context(), contentID, content, size, publication.ContentType)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
@@ -139,8 +127,8 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// insert a row in the database if the content id does not already exist
 	// udpate the database with a new content key and file location if the content id already exists
-	var c index.Content
-	c, err = s.Index().Get(contentID)
+	// the lookup error is kept apart, as err is reused below
+	c, getErr := s.Index().Get(contentID)
 	// set the encryption key (c.EncryptionKey)
 	c.EncryptionKey = publication.ContentKey
 	// set the encrypted file name (c.Location)
@@ -154,10 +142,26 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 
+	// store the metadata document alongside the content
+	if publication.Metadata != nil {
+		err = pack.StoreMetadata(r.Context(), s.Store(), contentID, *publication.Metadata)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// store the cover thumbnails alongside the content
+	err = pack.StoreThumbnails(r.Context(), s.Store(), contentID, publication.Thumbnails)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
 	//todo check hash & length?
 
 	code := http.StatusCreated
-	if err == index.ErrNotFound { //insert into database
+	if getErr == index.ErrNotFound { //insert into database
 		c.ID = contentID
 		err = s.Index().Add(c)
 	} else { //update the encryption key for c.ID = publication.ContentID
@@ -196,12 +200,17 @@ func ListContents(w http.ResponseWriter, r *http.Request, s Server) {
 }
 
 // GetContent fetches and returns an encrypted content file
-// selected by it content id (uuid)
+// selected by it content id (uuid).
+// The metadata document of the content is returned instead if the caller accepts application/webpub+json.
 func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// get the content id from the calling url
 	vars := mux.Vars(r)
 	contentID := vars["content_id"]
+	if strings.Contains(r.Header.Get("Accept"), pack.ContentType_WEBPUB_JSON) {
+		GetContentMetadata(w, r, s)
+		return
+	}
 	content, err := s.Index().Get(contentID)
 	if err != nil { //item probably not found
 		if err == index.ErrNotFound {
@@ -212,7 +221,7 @@ func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 	// check the existence of the file
-	item, err := s.Store().Get(contentID)
+	item, err := s.Store().Get(r.Context(), contentID)
 	if err != nil { //item probably not found
 		if err == storage.ErrNotFound {
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
@@ -222,13 +231,14 @@ func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 	// opens the file
-	contentReadCloser, err := item.Contents()
-	defer contentReadCloser.Close()
+	contentReadCloser, err := item.Contents(r.Context())
 	if err != nil { //file probably not found
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
+	defer contentReadCloser.Close()
 	// set headers
+	setMetadataLink(w, r, s, contentID)
 	w.Header().Set("Content-Disposition", "attachment; filename="+content.Location)
 	w.Header().Set("Content-Type", content.Type)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", content.Length))
@@ -240,65 +250,118 @@ func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 
 }
 
-// getAndOpenFile opens a file from a path, or downloads then opens it if its location is a URL
-func getAndOpenFile(filePathOrURL string) (*os.File, error) {
+// GetContentMetadata returns the metadata document of a content, a Readium manifest without reading order
+func GetContentMetadata(w http.ResponseWriter, r *http.Request, s Server) {
 
-	HTTPOrHTTPS, err := isHTTPOrHTTPS(filePathOrURL)
+	vars := mux.Vars(r)
+	contentID := vars["content_id"]
+	item, err := s.Store().Get(r.Context(), pack.MetadataKey(contentID))
 	if err != nil {
-		return nil, err
+		if err == storage.ErrNotFound {
+			problem.Error(w, r, problem.Problem{Detail: "No metadata for this content", Instance: contentID}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
 	}
-
-	if HTTPOrHTTPS {
-		return downloadAndOpenFile(filePathOrURL)
+	contents, err := item.Contents(r.Context())
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
 	}
+	defer contents.Close()
 
-	return os.Open(filePathOrURL)
+	w.Header().Set("Content-Type", pack.ContentType_WEBPUB_JSON)
+	io.Copy(w, contents)
 }
 
-func downloadAndOpenFile(url string) (*os.File, error) {
-	file, _ := ioutil.TempFile("", "")
-	fileName := file.Name()
-
-	err := downloadFile(url, fileName)
+// GetContentCover returns a cover thumbnail of a content, in JPEG.
+// The optional size parameter selects the smallest thumbnail which is at least as large.
+func GetContentCover(w http.ResponseWriter, r *http.Request, s Server) {
 
+	vars := mux.Vars(r)
+	contentID := vars["content_id"]
+	size := pack.ThumbnailSizes[len(pack.ThumbnailSizes)/2]
+	if param := r.URL.Query().Get("size"); param != "" {
+		requested, err := strconv.Atoi(param)
+		if err != nil || requested <= 0 {
+			problem.Error(w, r, problem.Problem{Detail: "Invalid size " + param}, http.StatusBadRequest)
+			return
+		}
+		size = pack.ThumbnailSize(requested)
+	}
+	item, err := s.Store().Get(r.Context(), pack.ThumbnailKey(contentID, size))
 	if err != nil {
-		return nil, err
+		if err == storage.ErrNotFound {
+			problem.Error(w, r, problem.Problem{Detail: "No cover for this content", Instance: contentID}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	contents, err := item.Contents(r.Context())
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
 	}
+	defer contents.Close()
 
-	return os.Open(fileName)
+	w.Header().Set("Content-Type", pack.ContentType_JPEG)
+	if stat := item.Stat(); stat.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(stat.Size, 10))
+	}
+	io.Copy(w, contents)
 }
 
-func isHTTPOrHTTPS(filePathOrURL string) (bool, error) {
-	url, err := url.Parse(filePathOrURL)
-	if err != nil {
-		return false, errors.New("Error parsing input file")
+// setMetadataLink adds a Link header referencing the metadata document of a content, if it exists
+func setMetadataLink(w http.ResponseWriter, r *http.Request, s Server, contentID string) {
+	if _, err := s.Store().Get(r.Context(), pack.MetadataKey(contentID)); err != nil {
+		return
 	}
-
-	return url.Scheme == "http" || url.Scheme == "https", nil
+	href := config.Config.LcpServer.PublicBaseUrl + "/contents/" + url.PathEscape(contentID) + "/metadata"
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="describedby"; type="%s"`, href, pack.ContentType_WEBPUB_JSON))
 }
 
-func downloadFile(url string, targetFilePath string) error {
-	out, err := os.Create(targetFilePath)
+// openFile opens a local file and returns its size
+func openFile(filePath string) (*os.File, int64, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	defer out.Close()
-
-	resp, err := http.Get(url)
+	fi, err := file.Stat()
 	if err != nil {
-		return err
+		file.Close()
+		return nil, 0, err
 	}
+	return file, fi.Size(), nil
+}
 
+// openURL opens a stream on a remote file and returns its size, or storage.UnknownSize
+func openURL(ctx context.Context, url string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
 	if resp.StatusCode >= 300 {
-		return fmt.Errorf("HTTP response: %d %s when downloading %s", resp.StatusCode, resp.Status, url)
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("HTTP response: %d %s when downloading %s", resp.StatusCode, resp.Status, url)
 	}
+	size := resp.ContentLength
+	if size < 0 {
+		size = storage.UnknownSize
+	}
+	return resp.Body, size, nil
+}
 
-	defer resp.Body.Close()
-
-	_, err = io.Copy(out, resp.Body)
+func isHTTPOrHTTPS(filePathOrURL string) (bool, error) {
+	url, err := url.Parse(filePathOrURL)
 	if err != nil {
-		return err
+		return false, errors.New("Error parsing input file")
 	}
 
-	return nil
+	return url.Scheme == "http" || url.Scheme == "https", nil
 }
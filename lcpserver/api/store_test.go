@@ -0,0 +1,151 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package apilcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omani/readium-lcp-server/index"
+	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/sign"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// memIndex is an in-memory content index
+type memIndex struct {
+	contents []index.Content
+}
+
+func (i *memIndex) Get(id string) (index.Content, error) {
+	for _, c := range i.contents {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return index.Content{}, index.ErrNotFound
+}
+
+func (i *memIndex) Add(c index.Content) error {
+	i.contents = append(i.contents, c)
+	return nil
+}
+
+// Update behaves like a sql update, it silently ignores unknown contents
+func (i *memIndex) Update(c index.Content) error {
+	for n := range i.contents {
+		if i.contents[n].ID == c.ID {
+			i.contents[n] = c
+		}
+	}
+	return nil
+}
+
+func (i *memIndex) List() func() (index.Content, error) {
+	n := 0
+	return func() (index.Content, error) {
+		if n >= len(i.contents) {
+			return index.Content{}, index.ErrNotFound
+		}
+		n++
+		return i.contents[n-1], nil
+	}
+}
+
+// testServer implements Server with a file system storage and an in-memory index
+type testServer struct {
+	store storage.Store
+	idx   *memIndex
+}
+
+func (s *testServer) Store() storage.Store             { return s.store }
+func (s *testServer) Index() index.Index               { return s.idx }
+func (s *testServer) Licenses() license.Store          { return nil }
+func (s *testServer) Certificate() *tls.Certificate    { return nil }
+func (s *testServer) Certificates() *sign.Certificates { return nil }
+func (s *testServer) Verifier() *sign.Verifier         { return nil }
+func (s *testServer) Source() *pack.ManualSource       { return nil }
+func (s *testServer) Queue() pack.Queue                { return nil }
+
+// putContent calls AddContent with an encrypted file created in dir
+func putContent(t *testing.T, s Server, dir, contentID string, key []byte, thumbnails []pack.Thumbnail) int {
+	output := filepath.Join(dir, "encrypted.epub")
+	data := []byte("encrypted content")
+	if err := ioutil.WriteFile(output, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data))
+	checksum := "checksum"
+	disposition := "publication.epub"
+	publication := LcpPublication{
+		ContentKey:         key,
+		Output:             output,
+		Size:               &size,
+		Checksum:           &checksum,
+		ContentDisposition: &disposition,
+		ContentType:        "application/epub+zip",
+		Thumbnails:         thumbnails,
+	}
+	body, err := json.Marshal(publication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("PUT", "/contents/"+contentID, bytes.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"content_id": contentID})
+	w := httptest.NewRecorder()
+	AddContent(w, r, s)
+	return w.Code
+}
+
+func TestAddContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storeDir := filepath.Join(dir, "storage")
+	if err = os.MkdirAll(storeDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{store: storage.NewFileSystem(storeDir, "http://localhost/files"), idx: &memIndex{}}
+	thumbnails := []pack.Thumbnail{{Size: 64, Data: []byte("jpeg")}}
+
+	// a new content is added to the index
+	if code := putContent(t, s, dir, "content-1", []byte("key1"), thumbnails); code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", code)
+	}
+	c, err := s.idx.Get("content-1")
+	if err != nil {
+		t.Fatalf("Expected the new content to be indexed, got %v", err)
+	}
+	if string(c.EncryptionKey) != "key1" || c.Location != "publication.epub" {
+		t.Errorf("Unexpected indexed content %+v", c)
+	}
+	if _, err = s.store.Get(context.Background(), pack.ThumbnailKey("content-1", 64)); err != nil {
+		t.Errorf("Expected the thumbnail to be stored, got %v", err)
+	}
+
+	// an existing content is updated
+	if code := putContent(t, s, dir, "content-1", []byte("key2"), nil); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(s.idx.contents) != 1 {
+		t.Fatalf("Expected a single indexed content, got %d", len(s.idx.contents))
+	}
+	if c, _ = s.idx.Get("content-1"); string(c.EncryptionKey) != "key2" {
+		t.Errorf("Expected the content key to be updated, got %s", c.EncryptionKey)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package check verifies that the content index of the License server and its storage are consistent.
+package check
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omani/readium-lcp-server/index"
+	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// QuarantinePrefix is prepended to the key of orphaned items when they are quarantined.
+// Items whose key starts with this prefix are never reported as orphaned.
+const QuarantinePrefix = "quarantine-"
+
+// Options drives a consistency check
+type Options struct {
+	// Checksums requests the content of every indexed item to be read and hashed;
+	// otherwise only the existence and the length of the items are checked
+	Checksums bool
+	// Quarantine requests orphaned items to be moved under QuarantinePrefix
+	Quarantine bool
+}
+
+// Entry is an inconsistency found in the index or in the storage
+type Entry struct {
+	ID             string `json:"id"`
+	Location       string `json:"location,omitempty"`
+	ExpectedLength int64  `json:"expected_length,omitempty"`
+	ActualLength   int64  `json:"actual_length,omitempty"`
+	ExpectedSha256 string `json:"expected_sha256,omitempty"`
+	ActualSha256   string `json:"actual_sha256,omitempty"`
+	Detail         string `json:"detail,omitempty"`
+	QuarantinedAs  string `json:"quarantined_as,omitempty"`
+}
+
+// Report is the machine-readable result of a consistency check
+type Report struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Contents is the number of rows in the content index
+	Contents int `json:"contents"`
+	// Items is the number of items in the storage, quarantined items, job inputs and derived files excluded
+	Items int `json:"items"`
+	// Derived is the number of files derived from a content (e.g. metadata documents) in the storage
+	Derived int `json:"derived"`
+	// Missing lists the indexed contents which are not in the storage
+	Missing []Entry `json:"missing"`
+	// Corrupted lists the indexed contents whose length or checksum doesn't match the stored item
+	Corrupted []Entry `json:"corrupted"`
+	// Orphaned lists the stored items which are not indexed
+	Orphaned []Entry `json:"orphaned"`
+}
+
+// Consistent indicates that no inconsistency has been found
+func (r Report) Consistent() bool {
+	return len(r.Missing) == 0 && len(r.Corrupted) == 0 && len(r.Orphaned) == 0
+}
+
+// Storage walks through the content index and the storage, and reports
+// missing, corrupted and orphaned items.
+// An error is returned only if one of the sides cannot be walked through;
+// an item which cannot be read is reported as corrupted.
+func Storage(ctx context.Context, idx index.Index, store storage.Store, opts Options) (Report, error) {
+	report := Report{StartedAt: time.Now().UTC(), Missing: []Entry{}, Corrupted: []Entry{}, Orphaned: []Entry{}}
+
+	items, err := storage.ListAll(ctx, store, "")
+	if err != nil {
+		return report, err
+	}
+	stored := make(map[string]storage.Item, len(items))
+	derived := make(map[string]storage.Item)
+	for _, item := range items {
+		// quarantined items and publications waiting for an encryption worker are not expected in the index
+		if strings.HasPrefix(item.Key(), QuarantinePrefix) || strings.HasPrefix(item.Key(), pack.JobInputPrefix) {
+			continue
+		}
+		// derived files belong to the content they are derived from
+		if _, ok := storage.BaseKey(item.Key()); ok {
+			derived[item.Key()] = item
+			continue
+		}
+		stored[item.Key()] = item
+	}
+	report.Items = len(stored)
+	report.Derived = len(derived)
+
+	indexed := make(map[string]bool)
+	fn := idx.List()
+	for c, err := fn(); ; c, err = fn() {
+		if err == index.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Contents++
+		indexed[c.ID] = true
+
+		item, ok := stored[c.ID]
+		if !ok {
+			report.Missing = append(report.Missing, Entry{ID: c.ID, Location: c.Location, ExpectedLength: c.Length, ExpectedSha256: c.Sha256})
+			continue
+		}
+		if entry, ok := checkItem(ctx, store, c, item, opts.Checksums); !ok {
+			report.Corrupted = append(report.Corrupted, entry)
+		}
+	}
+
+	orphans := make(map[string]storage.Item)
+	for key, item := range stored {
+		if !indexed[key] {
+			orphans[key] = item
+		}
+	}
+	for key, item := range derived {
+		if base, _ := storage.BaseKey(key); !indexed[base] {
+			orphans[key] = item
+		}
+	}
+	for key, item := range orphans {
+		entry := Entry{ID: key, ActualLength: item.Stat().Size}
+		if opts.Quarantine {
+			if err := quarantine(ctx, store, item); err != nil {
+				entry.Detail = "quarantine failed: " + err.Error()
+			} else {
+				entry.QuarantinedAs = QuarantinePrefix + key
+			}
+		}
+		report.Orphaned = append(report.Orphaned, entry)
+	}
+	sort.Slice(report.Orphaned, func(i, j int) bool { return report.Orphaned[i].ID < report.Orphaned[j].ID })
+
+	report.FinishedAt = time.Now().UTC()
+	return report, nil
+}
+
+// checkItem compares an indexed content with the stored item; it returns false if they don't match
+func checkItem(ctx context.Context, store storage.Store, c index.Content, item storage.Item, checksums bool) (Entry, bool) {
+	entry := Entry{ID: c.ID, Location: c.Location, ExpectedLength: c.Length, ExpectedSha256: c.Sha256}
+
+	size := item.Stat().Size
+	if size != storage.UnknownSize && size != c.Length {
+		entry.ActualLength = size
+		entry.Detail = "length mismatch"
+		return entry, false
+	}
+	if !checksums {
+		return entry, true
+	}
+
+	// fetch the item again, some backends verify their own checksums at this point
+	item, err := store.Get(ctx, c.ID)
+	if err != nil {
+		entry.Detail = err.Error()
+		return entry, false
+	}
+	contents, err := item.Contents(ctx)
+	if err != nil {
+		entry.Detail = err.Error()
+		return entry, false
+	}
+	defer contents.Close()
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, contents)
+	if err != nil {
+		entry.Detail = err.Error()
+		return entry, false
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if n != c.Length {
+		entry.ActualLength = n
+		entry.ActualSha256 = sum
+		entry.Detail = "length mismatch"
+		return entry, false
+	}
+	if c.Sha256 != "" && !strings.EqualFold(sum, c.Sha256) {
+		entry.ActualSha256 = sum
+		entry.Detail = "checksum mismatch"
+		return entry, false
+	}
+	return entry, true
+}
+
+// quarantine moves an item under QuarantinePrefix
+func quarantine(ctx context.Context, store storage.Store, item storage.Item) error {
+	contents, err := item.Contents(ctx)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	info := item.Stat()
+	if _, err = store.Add(ctx, QuarantinePrefix+item.Key(), contents, info.Size, info.ContentType); err != nil {
+		return err
+	}
+	return store.Remove(ctx, item.Key())
+}
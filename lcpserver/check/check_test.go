@@ -0,0 +1,167 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package check
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omani/readium-lcp-server/index"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// memIndex is an in-memory content index
+type memIndex struct {
+	contents []index.Content
+}
+
+func (i *memIndex) Get(id string) (index.Content, error) {
+	for _, c := range i.contents {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return index.Content{}, index.ErrNotFound
+}
+
+func (i *memIndex) Add(c index.Content) error {
+	i.contents = append(i.contents, c)
+	return nil
+}
+
+func (i *memIndex) Update(c index.Content) error {
+	return nil
+}
+
+func (i *memIndex) List() func() (index.Content, error) {
+	n := 0
+	return func() (index.Content, error) {
+		if n >= len(i.contents) {
+			return index.Content{}, index.ErrNotFound
+		}
+		n++
+		return i.contents[n-1], nil
+	}
+}
+
+func addContent(t *testing.T, store storage.Store, idx *memIndex, id, data string) {
+	if _, err := store.Add(context.Background(), id, strings.NewReader(data), int64(len(data)), ""); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(data))
+	idx.Add(index.Content{ID: id, Location: id + ".epub", Length: int64(len(data)), Sha256: hex.EncodeToString(sum[:])})
+}
+
+func TestCheckStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_check_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := storage.NewShardedFileSystem(dir, "http://localhost/files")
+	idx := &memIndex{}
+	ctx := context.Background()
+
+	addContent(t, store, idx, "ok", "consistent content")
+	addContent(t, store, idx, "resized", "original content")
+	addContent(t, store, idx, "altered", "original content")
+	idx.Add(index.Content{ID: "missing", Location: "missing.epub", Length: 12})
+	if _, err = store.Add(ctx, "orphan", strings.NewReader("orphan"), 6, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// tamper with the stored files, behind the back of the storage
+	tamper := func(key, data string) {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*", "*", key))
+		if len(matches) != 1 {
+			t.Fatalf("Could not find the stored file of %s", key)
+		}
+		if err := ioutil.WriteFile(matches[0], []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tamper("resized", "truncated")
+	tamper("altered", "modified content")
+
+	report, err := Storage(ctx, idx, store, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Contents != 4 || report.Items != 4 {
+		t.Errorf("Expected 4 contents and 4 items, got %d and %d", report.Contents, report.Items)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].ID != "missing" {
+		t.Errorf("Expected the missing content to be reported, got %v", report.Missing)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0].ID != "resized" {
+		t.Errorf("Expected only the resized content to be reported without checksums, got %v", report.Corrupted)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0].ID != "orphan" || report.Orphaned[0].QuarantinedAs != "" {
+		t.Errorf("Expected the orphaned item to be reported, got %v", report.Orphaned)
+	}
+	if report.Consistent() {
+		t.Error("Expected the report to be inconsistent")
+	}
+
+	report, err = Storage(ctx, idx, store, Options{Checksums: true, Quarantine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupted) != 2 {
+		t.Errorf("Expected the resized and altered contents to be reported, got %v", report.Corrupted)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0].QuarantinedAs != QuarantinePrefix+"orphan" {
+		t.Errorf("Expected the orphaned item to be quarantined, got %v", report.Orphaned)
+	}
+	if _, err = store.Get(ctx, "orphan"); err != storage.ErrNotFound {
+		t.Errorf("Expected the orphaned item to be removed, got %v", err)
+	}
+	if _, err = store.Get(ctx, QuarantinePrefix+"orphan"); err != nil {
+		t.Errorf("Expected the orphaned item to be quarantined, got %v", err)
+	}
+
+	report, err = Storage(ctx, idx, store, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphaned) != 0 {
+		t.Errorf("Expected quarantined items to be ignored, got %v", report.Orphaned)
+	}
+}
+
+func TestCheckDerivedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_check_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := storage.NewFileSystem(dir, "http://localhost/files")
+	idx := &memIndex{}
+	ctx := context.Background()
+
+	addContent(t, store, idx, "content", "consistent content")
+	for _, key := range []string{storage.DerivedKey("content", "metadata.json"), storage.DerivedKey("removed", "metadata.json")} {
+		if _, err = store.Add(ctx, key, strings.NewReader("{}"), 2, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Storage(ctx, idx, store, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Items != 1 || report.Derived != 2 {
+		t.Errorf("Expected 1 item and 2 derived files, got %d and %d", report.Items, report.Derived)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0].ID != storage.DerivedKey("removed", "metadata.json") {
+		t.Errorf("Expected the derived file of a removed content to be orphaned, got %v", report.Orphaned)
+	}
+}
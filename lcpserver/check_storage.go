@@ -0,0 +1,67 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/omani/readium-lcp-server/index"
+	"github.com/omani/readium-lcp-server/lcpserver/check"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// exit codes of the check-storage command
+const (
+	checkConsistent   = 0
+	checkFailed       = 1
+	checkInconsistent = 2
+)
+
+// checkStorage runs the check-storage command and returns its exit code.
+// The JSON report is written on the standard output, or in the file given by -output.
+func checkStorage(args []string, idx index.Index, store storage.Store) int {
+	flags := flag.NewFlagSet("check-storage", flag.ContinueOnError)
+	checksums := flags.Bool("checksums", false, "read every stored item and verify its sha256 checksum (slow)")
+	quarantine := flags.Bool("quarantine", false, "move orphaned items under the '"+check.QuarantinePrefix+"' prefix")
+	output := flags.String("output", "", "path to the JSON report (default: standard output)")
+	if err := flags.Parse(args); err != nil {
+		return checkFailed
+	}
+
+	report, err := check.Storage(context.Background(), idx, store, check.Options{Checksums: *checksums, Quarantine: *quarantine})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error checking the storage: "+err.Error())
+		return checkFailed
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating the report: "+err.Error())
+			return checkFailed
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(report); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing the report: "+err.Error())
+		return checkFailed
+	}
+
+	fmt.Fprintf(os.Stderr, "%d contents, %d stored items: %d missing, %d corrupted, %d orphaned\n",
+		report.Contents, report.Items, len(report.Missing), len(report.Corrupted), len(report.Orphaned))
+	if !report.Consistent() {
+		return checkInconsistent
+	}
+	return checkConsistent
+}
@@ -26,7 +26,7 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -36,18 +36,26 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/config"
+	"github.com/omani/readium-lcp-server/health"
 	"github.com/omani/readium-lcp-server/index"
+	apilcp "github.com/omani/readium-lcp-server/lcpserver/api"
 	lcpserver "github.com/omani/readium-lcp-server/lcpserver/server"
 	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/metrics"
 	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/sign"
 	"github.com/omani/readium-lcp-server/storage"
+	"github.com/omani/readium-lcp-server/tracing"
 )
 
 func dbFromURI(uri string) (string, string) {
@@ -56,7 +64,7 @@ func dbFromURI(uri string) (string, string) {
 }
 
 func main() {
-	var config_file, dbURI, storagePath, certFile, privKeyFile string
+	var config_file, dbURI string
 	var readonly bool = false
 	var err error
 
@@ -64,6 +72,12 @@ func main() {
 		config_file = "config.yaml"
 	}
 	config.ReadConfig(config_file)
+	if err = logging.Setup(config.Config.Log.Level, config.Config.Log.Format); err != nil {
+		panic(err)
+	}
+	if err = tracing.Setup("lcpserver", config.Config.Tracing); err != nil {
+		panic(err)
+	}
 	log.Println("Reading config " + config_file)
 
 	readonly = config.Config.LcpServer.ReadOnly
@@ -76,25 +90,13 @@ func main() {
 	if dbURI = config.Config.LcpServer.Database; dbURI == "" {
 		dbURI = "sqlite3://file:lcp.sqlite?cache=shared&mode=rwc"
 	}
-	if storagePath = config.Config.Storage.FileSystem.Directory; storagePath == "" {
-		storagePath = "files"
-	}
-	if certFile = config.Config.Certificate.Cert; certFile == "" {
-		panic("Must specify a certificate")
-	}
-	if privKeyFile = config.Config.Certificate.PrivateKey; privKeyFile == "" {
-		panic("Must specify a private key")
-	}
-	cert, err := tls.LoadX509KeyPair(certFile, privKeyFile)
-	if err != nil {
-		panic(err)
-	}
-
 	driver, cnxn := dbFromURI(dbURI)
 	db, err := sql.Open(driver, cnxn)
 	if err != nil {
 		panic(err)
 	}
+	// expose the statistics of the connection pool
+	metrics.RegisterDBStats(db)
 	if driver == "sqlite3" {
 		_, err = db.Exec("PRAGMA journal_mode = WAL")
 		if err != nil {
@@ -113,17 +115,41 @@ func main() {
 
 	// move config
 	license.CreateDefaultLinks()
-	var store storage.Store
+	store, err := storage.FromConfig(config.Config.Storage, config.Config.LcpServer.PublicBaseUrl+"/files")
+	if err != nil {
+		panic(err)
+	}
 
-	if mode := config.Config.Storage.Mode; mode == "s3" {
-		s3Conf := s3ConfigFromYAML()
-		store, _ = storage.S3(s3Conf)
-	} else {
-		os.MkdirAll(storagePath, os.ModePerm) //ignore the error, the folder can already exist
-		store = storage.NewFileSystem(storagePath, config.Config.LcpServer.PublicBaseUrl+"/files")
+	// lcpserver check-storage [flags] verifies the storage against the content index, then exits
+	if len(os.Args) > 1 && os.Args[1] == "check-storage" {
+		os.Exit(checkStorage(os.Args[2:], idx, store))
+	}
+
+	// the private key is read from a file, or held by an HSM or a remote signing service.
+	// The provider CA chain and revocation lists are optional, used to verify licenses.
+	// The certificates, CA and CRLs are reloaded from the configuration file on SIGHUP or when their files change.
+	certs, err := sign.NewCertificates(func() (config.Certificate, error) {
+		return config.ReadCertificateConfig(config_file)
+	}, config_file)
+	if err != nil {
+		panic("Cannot load the provider certificate and key: " + err.Error())
 	}
+	go certs.Watch(nil)
 
-	packager := pack.NewPackager(store, idx, 4)
+	concurrency := config.Config.Packager.Concurrency
+	if concurrency == 0 {
+		concurrency = 4
+	}
+	packager := pack.NewPackager(store, idx, concurrency)
+
+	// if the encryption is delegated to lcpencrypt-worker processes, jobs are queued in the database
+	var queue pack.Queue
+	if config.Config.Packager.Queue {
+		queue, err = pack.OpenQueue(db)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	authFile := config.Config.LcpServer.AuthFile
 	if authFile == "" {
@@ -136,9 +162,16 @@ func main() {
 	htpasswd := auth.HtpasswdFileProvider(authFile)
 	authenticator := auth.NewBasicAuthenticator("Readium License Content Protection Server", htpasswd)
 
-	HandleSignals()
+	// readiness checks; in readonly mode, the storage is only used to build licensed publications
+	health.Register("database", true, health.Database(db))
+	health.Register("storage", !readonly, health.Storage(store, !readonly))
+	health.Register("certificate", true, func(ctx context.Context) error {
+		return certs.Check()
+	})
+
+	stop := HandleSignals(certs)
 	parsedPort := strconv.Itoa(config.Config.LcpServer.Port)
-	s := lcpserver.New(":"+parsedPort, readonly, &idx, &store, &lst, &cert, packager, authenticator)
+	s := lcpserver.New(":"+parsedPort, readonly, &idx, &store, &lst, certs, packager, queue, authenticator)
 	if readonly {
 		log.Println("License server running in readonly mode on port " + parsedPort)
 	} else {
@@ -151,45 +184,55 @@ func main() {
 		log.Println("  " + nameOfLink + " => " + link)
 	}
 
-	if err := s.ListenAndServe(); err != nil {
+	// serve until SIGINT or SIGTERM, then wait for the in-flight requests, the encryption tasks
+	// and the notifications of the License Status Server before closing the database
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ListenAndServe()
+	}()
+	select {
+	case err = <-serveErr:
 		log.Println("Error " + err.Error())
+	case <-stop:
+		timeout := time.Duration(config.Config.LcpServer.ShutdownTimeout) * time.Second
+		err = api.Shutdown(&s.Server, timeout, packager.Shutdown, apilcp.WaitNotifications)
+	}
+	db.Close()
+	if err != nil {
+		os.Exit(1)
 	}
-
 }
 
-func HandleSignals() {
-	sigChan := make(chan os.Signal)
+// HandleSignals dumps the goroutines on SIGQUIT and reloads the certificates on SIGHUP;
+// the returned channel is closed on SIGINT or SIGTERM, to shut down the server
+func HandleSignals(certs *sign.Certificates) <-chan struct{} {
+	sigChan := make(chan os.Signal, 1)
+	stop := make(chan struct{})
 	go func() {
 		stacktrace := make([]byte, 1<<20)
+		stopping := false
 		for sig := range sigChan {
 			switch sig {
 			case syscall.SIGQUIT:
 				length := runtime.Stack(stacktrace, true)
 				fmt.Println(string(stacktrace[:length]))
-			case syscall.SIGINT:
-				fallthrough
-			case syscall.SIGTERM:
-				fmt.Println("Shutting down...")
-				os.Exit(0)
+			case syscall.SIGHUP:
+				if err := certs.Reload(); err != nil {
+					log.Println("Certificates not reloaded: " + err.Error())
+				} else {
+					log.Println("Certificates reloaded")
+				}
+			case syscall.SIGINT, syscall.SIGTERM:
+				// a second signal stops the server without waiting for the shutdown
+				if stopping {
+					log.Println("Forced shutdown")
+					os.Exit(1)
+				}
+				stopping = true
+				close(stop)
 			}
 		}
 	}()
-	signal.Notify(sigChan, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
-}
-
-func s3ConfigFromYAML() storage.S3Config {
-	s3config := storage.S3Config{}
-
-	s3config.ID = config.Config.Storage.AccessId
-	s3config.Secret = config.Config.Storage.Secret
-	s3config.Token = config.Config.Storage.Token
-
-	s3config.Endpoint = config.Config.Storage.Endpoint
-	s3config.Bucket = config.Config.Storage.Bucket
-	s3config.Region = config.Config.Storage.Region
-
-	s3config.DisableSSL = config.Config.Storage.DisableSSL
-	s3config.ForcePathStyle = config.Config.Storage.PathStyle
-
-	return s3config
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
+	return stop
 }
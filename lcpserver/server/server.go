@@ -34,10 +34,12 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/omani/readium-lcp-server/api"
+	"github.com/omani/readium-lcp-server/config"
 	"github.com/omani/readium-lcp-server/index"
 	apilcp "github.com/omani/readium-lcp-server/lcpserver/api"
 	"github.com/omani/readium-lcp-server/license"
 	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/sign"
 	"github.com/omani/readium-lcp-server/storage"
 )
 
@@ -47,8 +49,9 @@ type Server struct {
 	idx      *index.Index
 	st       *storage.Store
 	lst      *license.Store
-	cert     *tls.Certificate
+	certs    *sign.Certificates
 	source   pack.ManualSource
+	queue    pack.Queue
 }
 
 func (s *Server) Store() storage.Store {
@@ -64,14 +67,26 @@ func (s *Server) Licenses() license.Store {
 }
 
 func (s *Server) Certificate() *tls.Certificate {
-	return s.cert
+	return s.certs.Current()
+}
+
+func (s *Server) Certificates() *sign.Certificates {
+	return s.certs
+}
+
+func (s *Server) Verifier() *sign.Verifier {
+	return s.certs.Verifier()
 }
 
 func (s *Server) Source() *pack.ManualSource {
 	return &s.source
 }
 
-func New(bindAddr string, readonly bool, idx *index.Index, st *storage.Store, lst *license.Store, cert *tls.Certificate, packager *pack.Packager, basicAuth *auth.BasicAuth) *Server {
+func (s *Server) Queue() pack.Queue {
+	return s.queue
+}
+
+func New(bindAddr string, readonly bool, idx *index.Index, st *storage.Store, lst *license.Store, certs *sign.Certificates, packager *pack.Packager, queue pack.Queue, basicAuth *auth.BasicAuth) *Server {
 
 	sr := api.CreateServerRouter("")
 
@@ -87,8 +102,9 @@ func New(bindAddr string, readonly bool, idx *index.Index, st *storage.Store, ls
 		idx:      idx,
 		st:       st,
 		lst:      lst,
-		cert:     cert,
+		certs:    certs,
 		source:   pack.ManualSource{},
+		queue:    queue,
 	}
 
 	// Route.PathPrefix: http://www.gorillatoolkit.org/pkg/mux#Route.PathPrefix
@@ -104,6 +120,10 @@ func New(bindAddr string, readonly bool, idx *index.Index, st *storage.Store, ls
 
 	// get encrypted content by content id (a uuid)
 	s.handleFunc(contentRoutes, "/{content_id}", apilcp.GetContent).Methods("GET")
+	// get the metadata document of a content
+	s.handleFunc(contentRoutes, "/{content_id}/metadata", apilcp.GetContentMetadata).Methods("GET")
+	// get a cover thumbnail of a content
+	s.handleFunc(contentRoutes, "/{content_id}/cover", apilcp.GetContentCover).Methods("GET")
 	// get all licenses associated with a given content
 	s.handlePrivateFunc(contentRoutes, "/{content_id}/licenses", apilcp.ListLicensesForContent, basicAuth).Methods("GET")
 
@@ -120,12 +140,28 @@ func New(bindAddr string, readonly bool, idx *index.Index, st *storage.Store, ls
 		s.handlePrivateFunc(contentRoutes, "/{content_id}/publications", apilcp.GenerateLicensedPublication, basicAuth).Methods("POST")
 	}
 
+	// methods related to encryption jobs, if the encryption is delegated to workers
+
+	if queue != nil {
+		jobRoutesPathPrefix := "/jobs"
+		jobRoutes := sr.R.PathPrefix(jobRoutesPathPrefix).Subrouter().StrictSlash(false)
+
+		// get the status of an encryption job
+		s.handlePrivateFunc(jobRoutes, "/{job_id}", apilcp.GetJob, basicAuth).Methods("GET")
+		if !readonly {
+			// queue the encryption of an EPUB file
+			s.handlePrivateFunc(sr.R, jobRoutesPathPrefix, apilcp.PostJob, basicAuth).Methods("POST")
+		}
+	}
+
 	// methods related to licenses
 
 	licenseRoutesPathPrefix := "/licenses"
 	licenseRoutes := sr.R.PathPrefix(licenseRoutesPathPrefix).Subrouter().StrictSlash(false)
 
 	s.handlePrivateFunc(sr.R, licenseRoutesPathPrefix, apilcp.ListLicenses, basicAuth).Methods("GET")
+	// verify the signature of a license; must be declared before the routes of a license id
+	s.handlePrivateFunc(licenseRoutes, "/verify", apilcp.VerifyLicense, basicAuth).Methods("POST")
 	// get a license
 	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.GetLicense, basicAuth).Methods("GET")
 	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.GetLicense, basicAuth).Methods("POST")
@@ -136,6 +172,17 @@ func New(bindAddr string, readonly bool, idx *index.Index, st *storage.Store, ls
 		s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.UpdateLicense, basicAuth).Methods("PATCH")
 	}
 
+	// methods related to the provider certificates
+
+	// list the active certificates and their expiry
+	s.handlePrivateFunc(sr.R, "/certificates", apilcp.ListCertificates, basicAuth).Methods("GET")
+
+	// liveness, readiness and build information
+	api.ServeHealth(sr, "lcpserver", readonly)
+
+	// metrics, in the Prometheus text format
+	api.ServeMetrics(sr, config.Config.LcpServer.Host, config.Config.LcpServer.MetricsPort)
+
 	s.source.Feed(packager.Incoming)
 	return s
 }
@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"reflect"
@@ -315,7 +316,54 @@ func SignLicense(l *License, cert *tls.Certificate) error {
 	if err != nil {
 		return err
 	}
+	// Ed25519 is not part of the LCP specification: it is an opt-in for licenses of the basic (test) profile
+	if res.Algorithm == sign.AlgorithmEd25519 && l.Encryption.Profile != BasicProfile.String() {
+		return fmt.Errorf("Ed25519 signatures are only allowed with the %s", BasicProfile)
+	}
 	l.Signature = &res
 
 	return nil
 }
+
+// VerifyLicense checks the signature of a license and its certificate,
+// which must be valid at the time the license was issued or last updated
+func VerifyLicense(l License, v *sign.Verifier) error {
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return VerifyLicenseJSON(data, v)
+}
+
+// VerifyLicenseJSON checks the signature of a license received as a json document.
+// The document is canonicalized as is, properties unknown to this server included.
+func VerifyLicenseJSON(data []byte, v *sign.Verifier) error {
+
+	var header struct {
+		Issued    time.Time       `json:"issued"`
+		Updated   *time.Time      `json:"updated"`
+		Signature *sign.Signature `json:"signature"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	if header.Signature == nil {
+		return sign.ErrNoSignature
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as they were written
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	delete(doc, "signature")
+
+	signedAt := header.Issued
+	if header.Updated != nil {
+		signedAt = *header.Updated
+	}
+	return v.Verify(doc, *header.Signature, signedAt)
+}
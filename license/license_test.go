@@ -5,7 +5,18 @@
 package license
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
 	"testing"
+	"time"
+
+	"github.com/omani/readium-lcp-server/sign"
 )
 
 func TestLicense(t *testing.T) {
@@ -22,3 +33,91 @@ func TestLicense(t *testing.T) {
 		t.Errorf("Expected '1.0' or 'basic', got %s", l.Encryption.Profile)
 	}
 }
+
+func TestVerifyLicense(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../sign/cert/sample_rsa.crt", "../sign/cert/sample_rsa.pem")
+	if err != nil {
+		t.Fatal("Couldn't load sample certificate ", err)
+	}
+	x509Cert, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	l := License{Provider: "https://provider.example.com", ID: "1234", Issued: x509Cert.NotBefore.Add(time.Hour).UTC()}
+	l.User.Name = "Ren\u00e9e"
+	if err = SignLicense(&l, &cert); err != nil {
+		t.Fatal(err)
+	}
+
+	// verify the license as received by a partner
+	data, _ := json.Marshal(l)
+	var received License
+	if err = json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	v := sign.NewVerifier(nil, nil, nil)
+	if err = VerifyLicense(received, v); err != nil {
+		t.Errorf("Expected a valid license, got %s", err)
+	}
+	if received.Signature == nil {
+		t.Error("The license should keep its signature")
+	}
+	// properties unknown to the server are part of the signature
+	var doc map[string]interface{}
+	json.Unmarshal(data, &doc)
+	doc["extension"] = "value"
+	data, _ = json.Marshal(doc)
+	if err = VerifyLicenseJSON(data, v); !errors.Is(err, sign.ErrInvalidSignature) {
+		t.Errorf("Expected an invalid signature, got %v", err)
+	}
+
+	received.User.Name = "Renee"
+	if err = VerifyLicense(received, v); !errors.Is(err, sign.ErrInvalidSignature) {
+		t.Errorf("Expected an invalid signature, got %v", err)
+	}
+
+	// the certificate must be valid at the time of the last update
+	updated := x509Cert.NotAfter.Add(time.Hour).UTC()
+	l.Updated = &updated
+	l.Signature = nil
+	if err = SignLicense(&l, &cert); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyLicense(l, v); !errors.Is(err, sign.ErrInvalidCertificate) {
+		t.Errorf("Expected an invalid certificate, got %v", err)
+	}
+}
+
+func TestSignLicenseEd25519(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ed25519"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	// Ed25519 is accepted with the basic profile only
+	l := License{Provider: "https://provider.example.com", ID: "1234", Issued: time.Now().UTC()}
+	l.Encryption.Profile = V1Profile.String()
+	if err = SignLicense(&l, &cert); err == nil {
+		t.Error("Expected an error for an Ed25519 signature with the 1.0 profile")
+	}
+	l.Encryption.Profile = BasicProfile.String()
+	if err = SignLicense(&l, &cert); err != nil {
+		t.Fatal(err)
+	}
+	if l.Signature.Algorithm != sign.AlgorithmEd25519 {
+		t.Errorf("Expected an Ed25519 signature, got %s", l.Signature.Algorithm)
+	}
+	if err = VerifyLicense(l, sign.NewVerifier(nil, nil, nil)); err != nil {
+		t.Errorf("Expected a valid license, got %s", err)
+	}
+}
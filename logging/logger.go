@@ -0,0 +1,263 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record
+type Level int
+
+// Log levels, by increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel returns the level of a name: debug, info (the default for an empty name), warn or error
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, errors.New("unknown log level " + name)
+}
+
+// Output formats of the logger
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Logger writes structured log records, one per line, as json objects or text.
+// A record holds the time, the level, a message and key/value pairs.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	json   bool
+	fields []interface{}
+}
+
+// New creates a logger writing records of the given level or above to out; format is json or text
+func New(out io.Writer, level Level, format string) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level, json: format != FormatText}
+}
+
+// With returns a logger adding key/value pairs to every record
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &child
+}
+
+// Enabled tells if records of a level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes a debug record; kv are alternating keys and values
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.Log(LevelDebug, msg, kv...)
+}
+
+// Info writes an info record
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.Log(LevelInfo, msg, kv...)
+}
+
+// Warn writes a warning record
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.Log(LevelWarn, msg, kv...)
+}
+
+// Error writes an error record
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.Log(LevelError, msg, kv...)
+}
+
+// Log writes a record of the given level
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	var buf bytes.Buffer
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if l.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, fieldValue(fields, i+1))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %s %s", now, strings.ToUpper(level.String()), msg)
+		for i := 0; i < len(fields); i += 2 {
+			fmt.Fprintf(&buf, " %v=%v", fields[i], fieldValue(fields, i+1))
+		}
+		buf.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// fieldValue returns the value of a key/value pair; errors are written as their message
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i >= len(fields) {
+		return "(missing)"
+	}
+	switch v := fields[i].(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fields[i]
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		enc.Encode(fmt.Sprint(v))
+	}
+	// the encoder appends a newline
+	buf.Truncate(buf.Len() - 1)
+}
+
+// std is the logger of the servers
+var std = New(os.Stderr, LevelInfo, FormatJSON)
+
+// Default returns the logger of the servers
+func Default() *Logger {
+	return std
+}
+
+// Setup configures the logger of the servers. The output of the standard log package
+// is also redirected to this logger, as info records.
+func Setup(level, format string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "":
+		format = FormatJSON
+	case FormatJSON, FormatText:
+	default:
+		return errors.New("unknown log format " + format)
+	}
+	std = New(os.Stderr, lvl, format)
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// stdWriter writes the lines of the standard log package as info records
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	std.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// Debug writes a debug record with the logger of the servers
+func Debug(msg string, kv ...interface{}) {
+	std.Log(LevelDebug, msg, kv...)
+}
+
+// Info writes an info record with the logger of the servers
+func Info(msg string, kv ...interface{}) {
+	std.Log(LevelInfo, msg, kv...)
+}
+
+// Warn writes a warning record with the logger of the servers
+func Warn(msg string, kv ...interface{}) {
+	std.Log(LevelWarn, msg, kv...)
+}
+
+// Error writes an error record with the logger of the servers
+func Error(msg string, kv ...interface{}) {
+	std.Log(LevelError, msg, kv...)
+}
+
+type requestIDKey struct{}
+
+// RequestIDHeader is the http header carrying the id of a request, across servers
+const RequestIDHeader = "X-Request-ID"
+
+// WithRequestID returns a context holding the id of a request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the id of the request of a context, or an empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Detach returns a context holding the request id of ctx, which is not canceled with ctx;
+// it is used by tasks outliving a request
+func Detach(ctx context.Context) context.Context {
+	return WithRequestID(context.Background(), RequestID(ctx))
+}
+
+// FromContext returns the logger of the servers, adding the request id of the context to every record
+func FromContext(ctx context.Context) *Logger {
+	if id := RequestID(ctx); id != "" {
+		return std.With("request_id", id)
+	}
+	return std
+}
+
+// ForwardRequestID sets the request id of a context on an outbound request to another server
+func ForwardRequestID(ctx context.Context, req *http.Request) {
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo, FormatJSON).With("license_id", "abc")
+
+	logger.Debug("hidden")
+	logger.Info("license generated", "status", 201, "error", errors.New("some <error>"))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single json record, got %q: %v", buf.String(), err)
+	}
+	if record["level"] != "info" || record["msg"] != "license generated" {
+		t.Errorf("Unexpected level or message: %v", record)
+	}
+	if record["license_id"] != "abc" || record["status"] != float64(201) || record["error"] != "some <error>" {
+		t.Errorf("Unexpected fields: %v", record)
+	}
+	if record["time"] == nil {
+		t.Error("Expected a time field")
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, LevelWarn, FormatText).Warn("rejected", "reason", "invalid_status")
+
+	line := buf.String()
+	if !strings.Contains(line, " WARN rejected reason=invalid_status\n") {
+		t.Errorf("Unexpected text record %q", line)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if level, err := ParseLevel(""); err != nil || level != LevelInfo {
+		t.Errorf("Expected info as the default level, got %v, %v", level, err)
+	}
+	if level, err := ParseLevel("DEBUG"); err != nil || level != LevelDebug {
+		t.Errorf("Expected debug, got %v, %v", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := WithRequestID(context.Background(), "req-1")
+
+	detached := Detach(ctx)
+	if RequestID(detached) != "req-1" {
+		t.Errorf("Expected the request id to survive Detach, got %q", RequestID(detached))
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	ForwardRequestID(ctx, req)
+	if req.Header.Get(RequestIDHeader) != "req-1" {
+		t.Errorf("Expected the request id to be forwarded, got %q", req.Header.Get(RequestIDHeader))
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com", nil)
+	ForwardRequestID(context.Background(), req)
+	if _, ok := req.Header[RequestIDHeader]; ok {
+		t.Error("Expected no request id header without a request id")
+	}
+}
@@ -6,10 +6,10 @@ package apilsd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 
@@ -18,6 +18,8 @@ import (
 	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/config"
 	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/tracing"
 	"github.com/omani/readium-lcp-server/problem"
 )
 
@@ -49,7 +51,7 @@ func GetFreshLicense(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 
 	// get a fresh license from the License Server (as []byte)
-	freshLicense, err := getLicense(licenseID)
+	freshLicense, err := getLicense(r.Context(), licenseID)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
@@ -65,15 +67,16 @@ func GetFreshLicense(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 
-	log.Println("Get license / id " + licenseID + " / status " + statusDoc.Status)
+	logging.FromContext(r.Context()).Info("get fresh license", "license_id", licenseID, "status", statusDoc.Status)
 }
 
-// GetLicense gets a fresh license from the License Server
-func getLicense(licenseID string) (lic []byte, err error) {
+// GetLicense gets a fresh license from the License Server;
+// ctx holds the id and the trace of the request, forwarded to the CMS and the License Server
+func getLicense(ctx context.Context, licenseID string) (lic []byte, err error) {
 
 	// get user data from the CMS
 	var userData UserData
-	userData, err = getUserData(licenseID)
+	userData, err = getUserData(ctx, licenseID)
 	if err != nil {
 		return
 	}
@@ -86,7 +89,7 @@ func getLicense(licenseID string) (lic []byte, err error) {
 	}
 
 	// fetch the license from the License Server
-	lic, err = fetchLicense(plic)
+	lic, err = fetchLicense(ctx, plic)
 	if err != nil {
 		return
 	}
@@ -94,7 +97,7 @@ func getLicense(licenseID string) (lic []byte, err error) {
 }
 
 // getUserData gets user data from the CMS, as a partial license
-func getUserData(licenseID string) (userData UserData, err error) {
+func getUserData(ctx context.Context, licenseID string) (userData UserData, err error) {
 
 	// get the url of the CMS
 	userURL := strings.Replace(config.Config.LsdServer.UserDataUrl, "{license_id}", licenseID, -1)
@@ -104,11 +107,12 @@ func getUserData(licenseID string) (userData UserData, err error) {
 	}
 
 	// fetch user data
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", userURL, nil)
+	client := &http.Client{Transport: tracing.Transport(nil)}
+	req, err := http.NewRequestWithContext(ctx, "GET", userURL, nil)
 	if err != nil {
 		return
 	}
+	logging.ForwardRequestID(ctx, req)
 	auth := config.Config.CMSAccessAuth
 	if auth.Username != "" {
 		req.SetBasicAuth(auth.Username, auth.Password)
@@ -156,7 +160,7 @@ func initPartialLicense(licenseID string, userData UserData) (plic license.Licen
 }
 
 // fetchLicense fetches a license from the License Server
-func fetchLicense(plic license.License) (lic []byte, err error) {
+func fetchLicense(ctx context.Context, plic license.License) (lic []byte, err error) {
 	// json encode the partial license
 	jplic, err := json.Marshal(plic)
 	if err != nil {
@@ -165,11 +169,12 @@ func fetchLicense(plic license.License) (lic []byte, err error) {
 
 	// send the partial license to the License Server and get back a fresh license
 	licenseUrl := config.Config.LcpServer.PublicBaseUrl + "/licenses/" + plic.ID
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", licenseUrl, bytes.NewReader(jplic))
+	client := &http.Client{Transport: tracing.Transport(nil)}
+	req, err := http.NewRequestWithContext(ctx, "POST", licenseUrl, bytes.NewReader(jplic))
 	if err != nil {
 		return
 	}
+	logging.ForwardRequestID(ctx, req)
 	auth := config.Config.LcpUpdateAuth
 	if auth.Username != "" {
 		req.SetBasicAuth(auth.Username, auth.Password)
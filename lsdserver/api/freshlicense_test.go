@@ -5,6 +5,7 @@
 package apilsd
 
 import (
+	"context"
 	"log"
 	"testing"
 
@@ -24,7 +25,7 @@ func TestGetUserData(t *testing.T) {
 
 	log.Println("username ", config.Config.CMSAccessAuth.Username)
 
-	userData, err := getUserData(LicenseID)
+	userData, err := getUserData(context.Background(), LicenseID)
 	if err != nil {
 		t.Error(err.Error())
 		t.FailNow()
@@ -78,7 +79,7 @@ func TestFetchLicense(t *testing.T) {
 
 	plic, err := initPartialLicense(LicenseID, userData)
 
-	_, err = fetchLicense(plic)
+	_, err = fetchLicense(context.Background(), plic)
 	if err != nil {
 		t.Error(err.Error())
 		t.FailNow()
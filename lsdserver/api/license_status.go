@@ -6,10 +6,10 @@ package apilsd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -24,8 +24,10 @@ import (
 	licensestatuses "github.com/omani/readium-lcp-server/license_statuses"
 	"github.com/omani/readium-lcp-server/localization"
 	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/metrics"
 	"github.com/omani/readium-lcp-server/problem"
 	"github.com/omani/readium-lcp-server/status"
+	"github.com/omani/readium-lcp-server/tracing"
 	"github.com/omani/readium-lcp-server/transactions"
 )
 
@@ -36,6 +38,15 @@ type Server interface {
 	GoofyMode() bool
 }
 
+var (
+	// deviceEvents counts the successful registrations, returns and renewals
+	deviceEvents = metrics.NewCounterVec("lsd_events_total",
+		"Number of device registrations, returns and renewals, by type (register, return, renew)", "type")
+	// rejections counts the registrations, returns and renewals rejected, by reason
+	rejections = metrics.NewCounterVec("lsd_rejections_total",
+		"Number of rejected device registrations, returns and renewals, by action and reason", "action", "reason")
+)
+
 // CreateLicenseStatusDocument creates a license status and adds it to database
 // It is triggered by a notification from the license server
 //
@@ -51,7 +62,9 @@ func CreateLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Serve
 	var ls licensestatuses.LicenseStatus
 	makeLicenseStatus(lic, &ls)
 
+	_, span := tracing.StartDB(r.Context(), "INSERT", "license_status")
 	err = s.LicenseStatuses().Add(ls)
+	tracing.End(span, err)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
@@ -146,6 +159,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 		if licenseStatus == nil {
 			// the license is not stored in the lsd server
 			msg = "The license id " + licenseID + " was not found in the database"
+			rejections.With("register", "unknown_license").Inc()
 			problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusNotFound)
 			logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusNotFound), msg)
 			return
@@ -165,6 +179,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// check the mandatory request parameters
 	if (dILen == 0) || (dILen > 255) || (dNLen == 0) || (dNLen > 255) {
 		msg = "device id and device name are mandatory and their maximum length is 255 bytes"
+		rejections.With("register", "invalid_device").Inc()
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusBadRequest), msg)
 		return
@@ -173,6 +188,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// in case we want to test the resilience of an app to registering failures
 	if s.GoofyMode() {
 		msg = "**goofy mode** registering error"
+		rejections.With("register", "goofy_mode").Inc()
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusBadRequest), msg)
 		return
@@ -182,6 +198,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 	// the device cannot be registered if the license has been revoked, returned, cancelled or expired
 	if (licenseStatus.Status != status.STATUS_ACTIVE) && (licenseStatus.Status != status.STATUS_READY) {
 		msg = "License is neither ready or active"
+		rejections.With("register", "invalid_status").Inc()
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusForbidden), msg)
 		return
@@ -195,7 +212,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 	if deviceStatus != "" { // this is not considered a server side error, even if the spec states that devices must not do it.
-		log.Println("The device with id " + deviceID + " and name " + deviceName + " has already been registered")
+		logging.FromContext(r.Context()).Info("device already registered", "license_id", licenseID, "device_id", deviceID, "device_name", deviceName)
 		// a status document will be sent back to the caller
 
 	} else {
@@ -226,6 +243,7 @@ func RegisterDevice(w http.ResponseWriter, r *http.Request, s Server) {
 			logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusInternalServerError), err.Error())
 			return
 		}
+		deviceEvents.With("register").Inc()
 		// log the event in the compliance log
 		msg = "device name: " + deviceName + "  id: " + deviceID + "  new count: " + strconv.Itoa(*licenseStatus.DeviceCount)
 		logging.WriteToFile(complianceTestNumber, REGISTER_DEVICE, strconv.Itoa(http.StatusOK), msg)
@@ -266,6 +284,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 	if err != nil {
 		if licenseStatus == nil {
 			msg = "The license id " + licenseID + " was not found in the database"
+			rejections.With("return", "unknown_license").Inc()
 			problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusNotFound)
 			logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusNotFound), msg)
 			return
@@ -281,6 +300,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// check request parameters
 	if (len(deviceName) > 255) || (len(deviceID) > 255) {
+		rejections.With("return", "invalid_device").Inc()
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusBadRequest), err.Error())
 		return
@@ -296,6 +316,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 		break
 	default:
 		msg = "The current license status is " + licenseStatus.Status + "; return forbidden"
+		rejections.With("return", "invalid_status").Inc()
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
@@ -312,7 +333,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// update a license via a call to the lcp Server
 	// the event date is sent to the lcp server, covers the case where the lsd server clock is badly sync'd with the lcp server clock
-	httpStatusCode, errorr := updateLicense(event.Timestamp, licenseID)
+	httpStatusCode, errorr := updateLicense(r.Context(), event.Timestamp, licenseID)
 	if errorr != nil {
 		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError), err.Error())
@@ -339,6 +360,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 
+	deviceEvents.With("return").Inc()
 	msg = "device name: " + deviceName + "  id: " + deviceID
 	logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusOK), msg)
 
@@ -382,6 +404,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	if err != nil {
 		if licenseStatus == nil {
 			msg = "The license id " + licenseID + " was not found in the database"
+			rejections.With("renew", "unknown_license").Inc()
 			problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusNotFound)
 			logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusNotFound), msg)
 			return
@@ -396,6 +419,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 
 	// check the request parameters
 	if (len(deviceName) > 255) || (len(deviceID) > 255) {
+		rejections.With("renew", "invalid_device").Inc()
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusBadRequest), err.Error())
 		return
@@ -404,6 +428,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	// note: renewing an unactive (ready) license is forbidden
 	if licenseStatus.Status != status.STATUS_ACTIVE {
 		msg = "The current license status is " + licenseStatus.Status + "; renew forbidden"
+		rejections.With("renew", "invalid_status").Inc()
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
@@ -413,12 +438,14 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	var currentEnd time.Time
 	if licenseStatus.CurrentEndLicense == nil || (*licenseStatus.CurrentEndLicense).IsZero() {
 		msg = "This license has no current end date; it cannot be renewed"
+		rejections.With("renew", "no_end_date").Inc()
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
 		return
 	}
 	currentEnd = *licenseStatus.CurrentEndLicense
-	log.Print("Lending renewal. Current end date ", currentEnd.UTC().Format(time.RFC3339))
+	logger := logging.FromContext(r.Context()).With("license_id", licenseID)
+	logger.Info("lending renewal", "current_end", currentEnd.UTC().Format(time.RFC3339))
 
 	var suggestedEnd time.Time
 	// check if the 'end' request parameter is empty
@@ -438,23 +465,25 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 
 		// compute the suggested end date from the current end date
 		suggestedEnd = currentEnd.Add(time.Duration(suggestedDuration))
-		log.Print("Default extension request until ", suggestedEnd.UTC().Format(time.RFC3339))
+		logger.Info("default extension request", "end", suggestedEnd.UTC().Format(time.RFC3339))
 
 		// if the 'end' request parameter is set
 	} else {
 		var err error
 		suggestedEnd, err = time.Parse(time.RFC3339, timeEndString)
 		if err != nil {
+			rejections.With("renew", "invalid_end_date").Inc()
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 			logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusBadRequest), err.Error())
 			return
 		}
-		log.Print("Explicit extension request until ", suggestedEnd.UTC().Format(time.RFC3339))
+		logger.Info("explicit extension request", "end", suggestedEnd.UTC().Format(time.RFC3339))
 	}
 
 	// check the suggested end date vs the upper end date (which is already set in our implementation)
-	log.Print("Potential rights end = ", licenseStatus.PotentialRights.End.UTC().Format(time.RFC3339))
+	logger.Info("potential rights", "end", licenseStatus.PotentialRights.End.UTC().Format(time.RFC3339))
 	if suggestedEnd.After(*licenseStatus.PotentialRights.End) {
+		rejections.With("renew", "beyond_potential_rights").Inc()
 		msg := "Attempt to renew with a date greater than potential rights end = " + licenseStatus.PotentialRights.End.UTC().Format(time.RFC3339)
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
@@ -462,6 +491,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 	// check the suggested end date vs the current end date
 	if suggestedEnd.Before(currentEnd) {
+		rejections.With("renew", "before_current_end").Inc()
 		msg := "Attempt to renew with a date before the current end date"
 		problem.Error(w, r, problem.Problem{Detail: msg}, http.StatusForbidden)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusForbidden), msg)
@@ -478,7 +508,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 
 	// update a license via a call to the lcp Server
-	httpStatusCode, errorr := updateLicense(suggestedEnd, licenseID)
+	httpStatusCode, errorr := updateLicense(r.Context(), suggestedEnd, licenseID)
 	if errorr != nil {
 		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError), errorr.Error())
@@ -505,6 +535,7 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 
+	deviceEvents.With("renew").Inc()
 	// server log of the renewal event
 	msg = "new end date: " + suggestedEnd.UTC().Format(time.RFC3339)
 	logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusOK), msg)
@@ -661,7 +692,8 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 	vars := mux.Vars(r)
 	licenseID := vars["key"]
 
-	log.Println("Cancel or revoke " + licenseID)
+	logger := logging.FromContext(r.Context()).With("license_id", licenseID)
+	logger.Info("cancel or revoke license")
 
 	// get the current license status
 	licenseStatus, err := s.LicenseStatuses().GetByLicenseID(licenseID)
@@ -712,13 +744,13 @@ func LendingCancellation(w http.ResponseWriter, r *http.Request, s Server) {
 	if newStatus.Status == status.STATUS_REVOKED && licenseStatus.Status == status.STATUS_READY {
 		newStatus.Status = status.STATUS_CANCELLED
 	}
-	log.Println("New Status: " + newStatus.Status)
+	logger.Info("new status", "status", newStatus.Status)
 
 	// the new expiration time is now
 	currentTime := time.Now().UTC().Truncate(time.Second)
 
 	// update the license with the new expiration time, via a call to the lcp Server
-	httpStatusCode, erru := updateLicense(currentTime, licenseID)
+	httpStatusCode, erru := updateLicense(r.Context(), currentTime, licenseID)
 	if erru != nil {
 		problem.Error(w, r, problem.Problem{Detail: erru.Error()}, http.StatusInternalServerError)
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError), erru.Error())
@@ -914,9 +946,10 @@ func decodeJsonLicenseStatus(r *http.Request, ls *licensestatuses.LicenseStatus)
 }
 
 // updateLicense updates a license by calling the License Server
-// called from return, renew and cancel/revoke actions
+// called from return, renew and cancel/revoke actions;
+// ctx holds the id and the trace of the request, forwarded to the License Server
 //
-func updateLicense(timeEnd time.Time, licenseID string) (int, error) {
+func updateLicense(ctx context.Context, timeEnd time.Time, licenseID string) (int, error) {
 	// get the lcp server url
 	lcpBaseURL := config.Config.LcpServer.PublicBaseUrl
 	if len(lcpBaseURL) <= 0 {
@@ -929,7 +962,8 @@ func updateLicense(timeEnd time.Time, licenseID string) (int, error) {
 	minLicense.Rights.End = &timeEnd
 
 	var lcpClient = &http.Client{
-		Timeout: time.Second * 10,
+		Timeout:   time.Second * 10,
+		Transport: tracing.Transport(nil),
 	}
 	// FIXME: this Pipe thing should be replaced by a json.Marshal
 	pr, pw := io.Pipe()
@@ -939,13 +973,14 @@ func updateLicense(timeEnd time.Time, licenseID string) (int, error) {
 	}()
 	// prepare the request
 	lcpURL := lcpBaseURL + "/licenses/" + licenseID
-	// message to the console
-	log.Println("PATCH " + lcpURL)
+	logger := logging.FromContext(ctx).With("license_id", licenseID)
+	logger.Info("update license", "url", lcpURL)
 	// send the content to the LCP server
-	req, err := http.NewRequest("PATCH", lcpURL, pr)
+	req, err := http.NewRequestWithContext(ctx, "PATCH", lcpURL, pr)
 	if err != nil {
 		return 0, err
 	}
+	logging.ForwardRequestID(ctx, req)
 	// set the credentials
 	updateAuth := config.Config.LcpUpdateAuth
 	if updateAuth.Username != "" {
@@ -957,12 +992,12 @@ func updateLicense(timeEnd time.Time, licenseID string) (int, error) {
 	response, err := lcpClient.Do(req)
 	if err == nil {
 		if response.StatusCode != http.StatusOK {
-			log.Println("Notify Lcp Server of License (" + licenseID + ") = " + strconv.Itoa(response.StatusCode))
+			logger.Warn("license update rejected by the license server", "status", response.StatusCode)
 		}
 		return response.StatusCode, nil
 	}
 
-	log.Println("Error Notify Lcp Server of License (" + licenseID + "):" + err.Error())
+	logger.Error("cannot update the license on the license server", "error", err)
 	return 0, err
 }
 
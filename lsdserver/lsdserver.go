@@ -15,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 	_ "github.com/go-sql-driver/mysql"
@@ -23,9 +24,13 @@ import (
 	licensestatuses "github.com/omani/readium-lcp-server/license_statuses"
 	lsdserver "github.com/omani/readium-lcp-server/lsdserver/server"
 
+	"github.com/omani/readium-lcp-server/api"
 	"github.com/omani/readium-lcp-server/config"
+	"github.com/omani/readium-lcp-server/health"
 	"github.com/omani/readium-lcp-server/localization"
 	"github.com/omani/readium-lcp-server/logging"
+	"github.com/omani/readium-lcp-server/metrics"
+	"github.com/omani/readium-lcp-server/tracing"
 	"github.com/omani/readium-lcp-server/transactions"
 )
 
@@ -44,6 +49,12 @@ func main() {
 	}
 
 	config.ReadConfig(config_file)
+	if err = logging.Setup(config.Config.Log.Level, config.Config.Log.Format); err != nil {
+		panic(err)
+	}
+	if err = tracing.Setup("lsdserver", config.Config.Tracing); err != nil {
+		panic(err)
+	}
 
 	err = localization.InitTranslations()
 	if err != nil {
@@ -67,6 +78,8 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	// expose the statistics of the connection pool
+	metrics.RegisterDBStats(db)
 	if driver == "sqlite3" {
 		_, err = db.Exec("PRAGMA journal_mode = WAL")
 		if err != nil {
@@ -108,7 +121,13 @@ func main() {
 		panic(err)
 	}
 
-	HandleSignals()
+	// readiness checks; in readonly mode, the License Server is not needed to renew or return licenses
+	health.Register("database", true, health.Database(db))
+	if config.Config.LcpServer.PublicBaseUrl != "" {
+		health.Register("lcpserver", !readonly, health.Server(config.Config.LcpServer.PublicBaseUrl+api.HealthPath))
+	}
+
+	stop := HandleSignals()
 
 	parsedPort := strconv.Itoa(config.Config.LsdServer.Port)
 	s := lsdserver.New(":"+parsedPort, readonly, complianceMode, goofyMode, &hist, &trns, authenticator)
@@ -120,29 +139,48 @@ func main() {
 	log.Println("Using database " + dbURI)
 	log.Println("Public base URL=" + config.Config.LsdServer.PublicBaseUrl)
 
-	if err := s.ListenAndServe(); err != nil {
+	// serve until SIGINT or SIGTERM, then wait for the in-flight requests before closing the database
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ListenAndServe()
+	}()
+	select {
+	case err = <-serveErr:
 		log.Println("Error " + err.Error())
+	case <-stop:
+		err = api.Shutdown(&s.Server, time.Duration(config.Config.LsdServer.ShutdownTimeout)*time.Second)
+	}
+	db.Close()
+	if err != nil {
+		os.Exit(1)
 	}
-
 }
 
-func HandleSignals() {
-	sigChan := make(chan os.Signal)
+// HandleSignals dumps the goroutines on SIGQUIT;
+// the returned channel is closed on SIGINT or SIGTERM, to shut down the server
+func HandleSignals() <-chan struct{} {
+	sigChan := make(chan os.Signal, 1)
+	stop := make(chan struct{})
 	go func() {
 		stacktrace := make([]byte, 1<<20)
+		stopping := false
 		for sig := range sigChan {
 			switch sig {
 			case syscall.SIGQUIT:
 				length := runtime.Stack(stacktrace, true)
 				fmt.Println(string(stacktrace[:length]))
-			case syscall.SIGINT:
-				fallthrough
-			case syscall.SIGTERM:
-				fmt.Println("Shutting down...")
-				os.Exit(0)
+			case syscall.SIGINT, syscall.SIGTERM:
+				// a second signal stops the server without waiting for the shutdown
+				if stopping {
+					log.Println("Forced shutdown")
+					os.Exit(1)
+				}
+				stopping = true
+				close(stop)
 			}
 		}
 	}()
 
 	signal.Notify(sigChan, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
+	return stop
 }
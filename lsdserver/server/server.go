@@ -13,6 +13,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/omani/readium-lcp-server/api"
+	"github.com/omani/readium-lcp-server/config"
 	licensestatuses "github.com/omani/readium-lcp-server/license_statuses"
 	apilsd "github.com/omani/readium-lcp-server/lsdserver/api"
 	"github.com/omani/readium-lcp-server/transactions"
@@ -83,6 +84,12 @@ func New(bindAddr string, readonly bool, complianceMode bool, goofyMode bool, ls
 		s.handlePrivateFunc(licenseRoutes, "/", apilsd.CreateLicenseStatusDocument, basicAuth).Methods("PUT")
 	}
 
+	// liveness, readiness and build information
+	api.ServeHealth(sr, "lsdserver", readonly)
+
+	// metrics, in the Prometheus text format
+	api.ServeMetrics(sr, config.Config.LsdServer.Host, config.Config.LsdServer.MetricsPort)
+
 	return s
 }
 
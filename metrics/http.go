@@ -0,0 +1,64 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+var (
+	httpRequests = NewCounterVec("http_requests_total",
+		"Number of HTTP requests, by method, route and status code", "method", "route", "code")
+	httpDuration = NewHistogramVec("http_request_duration_seconds",
+		"Latency of HTTP requests, by method and route", DefaultBuckets, "method", "route")
+)
+
+// HTTPMiddleware counts the requests and measures their latency, by route.
+// The route is the path template of the router route matching the request, so that
+// ids do not create new series; requests matching no route are reported as "other".
+func HTTPMiddleware(router *mux.Router) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		route := "other"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		next(rw, r)
+
+		code := http.StatusOK
+		if nrw, ok := rw.(negroni.ResponseWriter); ok && nrw.Status() != 0 {
+			code = nrw.Status()
+		}
+		httpRequests.With(r.Method, route, strconv.Itoa(code)).Inc()
+		httpDuration.With(r.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// RegisterDBStats exposes the statistics of the connection pool of a database.
+// It is called once per process, with the main database of the server.
+func RegisterDBStats(db *sql.DB) {
+	NewGaugeFunc("db_open_connections", "Number of established connections to the database, in use or idle",
+		func() float64 { return float64(db.Stats().OpenConnections) })
+	NewGaugeFunc("db_in_use_connections", "Number of connections to the database currently in use",
+		func() float64 { return float64(db.Stats().InUse) })
+	NewGaugeFunc("db_idle_connections", "Number of idle connections to the database",
+		func() float64 { return float64(db.Stats().Idle) })
+	NewGaugeFunc("db_max_open_connections", "Maximum number of open connections to the database, 0 if unlimited",
+		func() float64 { return float64(db.Stats().MaxOpenConnections) })
+	NewCounterFunc("db_wait_count_total", "Number of connections waited for",
+		func() float64 { return float64(db.Stats().WaitCount) })
+	NewCounterFunc("db_wait_duration_seconds_total", "Total time blocked waiting for a new connection",
+		func() float64 { return db.Stats().WaitDuration.Seconds() })
+}
@@ -0,0 +1,315 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package metrics exposes counters, histograms and gauges in the Prometheus text format.
+// Metrics are created at package initialization and registered in a default registry,
+// which is served at /metrics by the servers.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of latency histograms, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is a metric family, written in the text format
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metric families
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default is the registry of the metrics created by the package functions
+var Default = NewRegistry()
+
+func (reg *Registry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.collectors[c.name()]; ok {
+		panic("metrics: " + c.name() + " is already registered")
+	}
+	reg.collectors[c.name()] = c
+}
+
+// WriteTo writes all the metrics of the registry in the Prometheus text format, sorted by name
+func (reg *Registry) WriteTo(w *bufio.Writer) {
+	reg.mu.Lock()
+	names := make([]string, 0, len(reg.collectors))
+	for name := range reg.collectors {
+		names = append(names, name)
+	}
+	reg.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		reg.mu.Lock()
+		c := reg.collectors[name]
+		reg.mu.Unlock()
+		c.write(w)
+	}
+}
+
+// Handler serves the metrics of the registry
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		reg.WriteTo(bw)
+		bw.Flush()
+	})
+}
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// family holds the common properties of a metric family and its series, by label values
+type family struct {
+	mu     sync.Mutex
+	fname  string
+	help   string
+	typ    string
+	labels []string
+	series map[string]interface{}
+}
+
+func (f *family) name() string {
+	return f.fname
+}
+
+func (f *family) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.fname, escapeHelp(f.help), f.fname, f.typ)
+}
+
+// child returns the series of the given label values, created by create if needed
+func (f *family) child(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.fname, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = create()
+		f.series[key] = s
+	}
+	return s
+}
+
+// sortedSeries returns the label values and the series of the family, sorted by label values
+func (f *family) sortedSeries() ([][]string, []interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([][]string, len(keys))
+	series := make([]interface{}, len(keys))
+	for i, k := range keys {
+		if len(f.labels) > 0 {
+			values[i] = strings.Split(k, "\xff")
+		}
+		series[i] = f.series[k]
+	}
+	return values, series
+}
+
+// labelPairs formats label names and values as {name="value",...}, with optional extra pairs
+func labelPairs(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds a positive value to the counter
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: a counter cannot decrease")
+	}
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	family
+}
+
+// NewCounterVec creates a counter family in the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family{fname: name, help: help, typ: "counter", labels: labels, series: make(map[string]interface{})}}
+	Default.register(c)
+	return c
+}
+
+// With returns the counter of the given label values, in the order of the label names
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.child(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	values, series := c.sortedSeries()
+	if len(series) == 0 {
+		return
+	}
+	c.header(w)
+	for i, s := range series {
+		fmt.Fprintf(w, "%s%s %s\n", c.fname, labelPairs(c.labels, values[i]), formatFloat(s.(*Counter).Value()))
+	}
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	family
+	buckets []float64
+}
+
+// NewHistogramVec creates a histogram family in the default registry; buckets are sorted upper bounds
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{family{fname: name, help: help, typ: "histogram", labels: labels, series: make(map[string]interface{})}, buckets}
+	Default.register(h)
+	return h
+}
+
+// With returns the histogram of the given label values, in the order of the label names
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.child(values, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	values, series := h.sortedSeries()
+	if len(series) == 0 {
+		return
+	}
+	h.header(w)
+	for i, s := range series {
+		hist := s.(*Histogram)
+		hist.mu.Lock()
+		for j, bound := range hist.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fname, labelPairs(h.labels, values[i], "le", formatFloat(bound)), hist.counts[j])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fname, labelPairs(h.labels, values[i], "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.fname, labelPairs(h.labels, values[i]), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.fname, labelPairs(h.labels, values[i]), hist.count)
+		hist.mu.Unlock()
+	}
+}
+
+// valueFunc is a metric whose value is read when the metrics are collected
+type valueFunc struct {
+	family
+	value func() float64
+}
+
+// NewGaugeFunc creates a gauge in the default registry, whose value is returned by f
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.register(&valueFunc{family{fname: name, help: help, typ: "gauge"}, f})
+}
+
+// NewCounterFunc creates a counter in the default registry, whose value is returned by f
+func NewCounterFunc(name, help string, f func() float64) {
+	Default.register(&valueFunc{family{fname: name, help: help, typ: "counter"}, f})
+}
+
+func (v *valueFunc) write(w *bufio.Writer) {
+	v.header(w)
+	fmt.Fprintf(w, "%s %s\n", v.fname, formatFloat(v.value()))
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+func collect(t *testing.T) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	Default.WriteTo(w)
+	w.Flush()
+	return buf.String()
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected the line %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_events_total", "Number of test events", "type", "reason")
+	out := collect(t)
+	if strings.Contains(out, "test_events_total") {
+		t.Error("A counter family without series should not be written")
+	}
+
+	c.With("renew", "invalid_status").Inc()
+	c.With("renew", "invalid_status").Add(2)
+	c.With("return", `quote"d`).Inc()
+	expectLines(t, collect(t),
+		"# HELP test_events_total Number of test events",
+		"# TYPE test_events_total counter",
+		`test_events_total{type="renew",reason="invalid_status"} 3`,
+		`test_events_total{type="return",reason="quote\"d"} 1`,
+	)
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Test durations", []float64{0.1, 1}, "operation")
+	h.With("get").Observe(0.05)
+	h.With("get").Observe(0.5)
+	h.With("get").Observe(2)
+	expectLines(t, collect(t),
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{operation="get",le="0.1"} 1`,
+		`test_duration_seconds_bucket{operation="get",le="1"} 2`,
+		`test_duration_seconds_bucket{operation="get",le="+Inf"} 3`,
+		`test_duration_seconds_sum{operation="get"} 2.55`,
+		`test_duration_seconds_count{operation="get"} 3`,
+	)
+}
+
+func TestGaugeFunc(t *testing.T) {
+	value := 4.0
+	NewGaugeFunc("test_connections", "Test connections", func() float64 { return value })
+	expectLines(t, collect(t), "# TYPE test_connections gauge", "test_connections 4")
+	value = 2
+	expectLines(t, collect(t), "test_connections 2")
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("POST")
+	r.Handle("/metrics", Handler())
+	n := negroni.New()
+	n.Use(HTTPMiddleware(r))
+	n.UseHandler(r)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	for _, id := range []string{"1", "2"} {
+		resp, err := http.Post(server.URL+"/items/"+id, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := http.Get(server.URL + "/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	expectLines(t, string(body),
+		`http_requests_total{method="POST",route="/items/{id}",code="201"} 2`,
+		`http_requests_total{method="GET",route="other",code="404"} 1`,
+		`http_request_duration_seconds_count{method="POST",route="/items/{id}"} 2`,
+	)
+}
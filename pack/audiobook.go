@@ -0,0 +1,393 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/omani/readium-lcp-server/rwpm"
+)
+
+// ContentType_AUDIOBOOK_LCP is the media type of an LCP protected audiobook
+const ContentType_AUDIOBOOK_LCP = "application/audiobook+lcp"
+
+// Profile of a Readium audiobook manifest
+const (
+	AudiobookType       = "https://schema.org/Audiobook"
+	AudiobookConformsTo = "https://readium.org/webpub-manifest/profiles/audiobook"
+)
+
+// sourceFile is a file of a source publication, stored in a folder or in a zip archive
+type sourceFile struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// BuildAudiobook builds a Readium audiobook package (rwpp) out of an audiobook folder,
+// a W3C LPF audiobook or a Readium audiobook package (inputPath).
+// The source must contain a W3C (publication.json) or a Readium (manifest.json) manifest.
+// The duration of every reading order item is required;
+// chapters are taken from the table of contents of the primary entry page, if any.
+func BuildAudiobook(inputPath string, outputPath string) error {
+
+	files, closer, err := listSourceFiles(inputPath)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	index := map[string]sourceFile{}
+	for _, f := range files {
+		index[f.name] = f
+	}
+
+	manifest, err := readAudiobookManifest(index)
+	if err != nil {
+		return fmt.Errorf("audiobook %s: %s", inputPath, err.Error())
+	}
+	if err = normalizeAudiobook(&manifest); err != nil {
+		return fmt.Errorf("audiobook %s: %s", inputPath, err.Error())
+	}
+	// every linked file must be present in the package
+	for _, links := range [][]rwpm.Link{manifest.ReadingOrder, manifest.Resources} {
+		for _, l := range links {
+			if _, ok := index[l.Href]; !ok {
+				return fmt.Errorf("audiobook %s: missing file %s", inputPath, l.Href)
+			}
+		}
+	}
+
+	rwpJSON, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+
+	rwppFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer rwppFile.Close()
+	zipWriter := zip.NewWriter(rwppFile)
+
+	man, err := zipWriter.Create(RWPManifestName)
+	if err != nil {
+		return err
+	}
+	if _, err = man.Write(rwpJSON); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.name == RWPManifestName {
+			continue
+		}
+		// audio files are already compressed
+		method := zip.Deflate
+		if strings.HasPrefix(getMediaType(path.Ext(f.name)), "audio/") {
+			method = zip.Store
+		}
+		writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: f.name, Method: method})
+		if err != nil {
+			return err
+		}
+		reader, err := f.open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// listSourceFiles lists the files of a folder or a zip archive.
+// Hidden files and MacOS specific files are ignored. The returned function releases the source.
+func listSourceFiles(inputPath string) ([]sourceFile, func(), error) {
+
+	fi, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []sourceFile
+	if !fi.IsDir() {
+		zr, err := zip.OpenReader(inputPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, file := range zr.File {
+			if file.FileInfo().IsDir() || ignoredSourceFile(file.Name) {
+				continue
+			}
+			files = append(files, sourceFile{name: file.Name, open: file.Open})
+		}
+		return files, func() { zr.Close() }, nil
+	}
+
+	err = filepath.Walk(inputPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(inputPath, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			if name != "." && ignoredSourceFile(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ignoredSourceFile(name) {
+			return nil
+		}
+		files = append(files, sourceFile{name: name, open: func() (io.ReadCloser, error) { return os.Open(p) }})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, func() {}, nil
+}
+
+// ignoredSourceFile indicates that a file must not be copied into the package
+func ignoredSourceFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX") || strings.HasPrefix(base, ".")
+}
+
+// readAudiobookManifest reads the W3C manifest of an audiobook and maps it to a Readium manifest,
+// or reads its Readium manifest if there is no W3C manifest
+func readAudiobookManifest(files map[string]sourceFile) (manifest rwpm.Publication, err error) {
+
+	if f, ok := files[W3CManifestName]; ok {
+		var w3cManifest rwpm.W3CPublication
+		if err = decodeJSONFile(f, &w3cManifest); err != nil {
+			return
+		}
+		if err = validateW3CDurations(w3cManifest); err != nil {
+			return
+		}
+		manifest = generateRWPManifest(w3cManifest)
+		manifest.TOC, err = entryPageTOC(w3cManifest, files)
+		return
+	}
+	if f, ok := files[RWPManifestName]; ok {
+		err = decodeJSONFile(f, &manifest)
+		return
+	}
+	err = errors.New("missing publication.json or manifest.json")
+	return
+}
+
+// decodeJSONFile decodes a json file into v
+func decodeJSONFile(f sourceFile, v interface{}) error {
+	reader, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return json.NewDecoder(reader).Decode(v)
+}
+
+// validateW3CDurations checks that every item of the reading order of a W3C manifest has a valid duration
+func validateW3CDurations(w3cman rwpm.W3CPublication) error {
+
+	if w3cman.Duration != "" {
+		if _, err := isoDurationToSc(w3cman.Duration); err != nil {
+			return fmt.Errorf("invalid duration %q", w3cman.Duration)
+		}
+	}
+	for _, item := range w3cman.ReadingOrder {
+		if item.Duration == "" {
+			return fmt.Errorf("reading order item %s: missing duration", item.URL)
+		}
+		seconds, err := isoDurationToSc(item.Duration)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("reading order item %s: invalid duration %q", item.URL, item.Duration)
+		}
+	}
+	return nil
+}
+
+// normalizeAudiobook checks that a Readium manifest describes an audiobook, and completes it:
+// the audiobook profile, the total duration and, if missing, a table of contents made of the reading order.
+func normalizeAudiobook(manifest *rwpm.Publication) error {
+
+	if len(manifest.ReadingOrder) == 0 {
+		return errors.New("empty reading order")
+	}
+	var total float32
+	for i := range manifest.ReadingOrder {
+		item := &manifest.ReadingOrder[i]
+		if item.Type == "" {
+			item.Type = getMediaType(path.Ext(item.Href))
+		}
+		if !strings.HasPrefix(item.Type, "audio/") {
+			return fmt.Errorf("reading order item %s: not an audio file", item.Href)
+		}
+		if item.Duration <= 0 {
+			return fmt.Errorf("reading order item %s: missing duration", item.Href)
+		}
+		total += item.Duration
+	}
+
+	manifest.Metadata.Type = AudiobookType
+	manifest.Metadata.ConformsTo = AudiobookConformsTo
+	if manifest.Metadata.Duration == 0 {
+		manifest.Metadata.Duration = total
+	}
+
+	if len(manifest.TOC) == 0 {
+		for i, item := range manifest.ReadingOrder {
+			title := item.Title
+			if title == "" {
+				title = fmt.Sprintf("Chapter %d", i+1)
+			}
+			manifest.TOC = append(manifest.TOC, rwpm.Link{Href: item.Href, Title: title})
+		}
+	}
+	return nil
+}
+
+// entryPageTOC returns the table of contents found in the primary entry page of a W3C publication, if any.
+// The entry page is index.html or the resource with a "contents" relation.
+func entryPageTOC(w3cman rwpm.W3CPublication, files map[string]sourceFile) ([]rwpm.Link, error) {
+
+	entryPage := W3CEntryPageName
+	for _, links := range []rwpm.W3CLinks{w3cman.Links, w3cman.Resources} {
+		for _, l := range links {
+			for _, rel := range l.Rel {
+				if rel == "contents" {
+					entryPage = l.URL
+				}
+			}
+		}
+	}
+	f, ok := files[entryPage]
+	if !ok {
+		return nil, nil
+	}
+	reader, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return parseTOC(reader, entryPage)
+}
+
+// parseTOC extracts the table of contents of an html document (a nav element with a doc-toc role),
+// as a hierarchy of links. Hrefs are made relative to the root of the package.
+func parseTOC(r io.Reader, docPath string) ([]rwpm.Link, error) {
+
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	nav := findNode(doc, func(n *html.Node) bool {
+		return n.Data == "nav" && (attr(n, "role") == "doc-toc" || attr(n, "epub:type") == "toc")
+	})
+	if nav == nil {
+		return nil, nil
+	}
+	list := findNode(nav, func(n *html.Node) bool { return n.Data == "ol" || n.Data == "ul" })
+	if list == nil {
+		return nil, nil
+	}
+	return tocItems(list, docPath), nil
+}
+
+// tocItems maps the items of an html list to links
+func tocItems(list *html.Node, docPath string) (links []rwpm.Link) {
+
+	for li := list.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.Data != "li" {
+			continue
+		}
+		var link rwpm.Link
+		for c := li.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.Data {
+			case "a":
+				link.Href = resolveHref(attr(c, "href"), docPath)
+				link.Title = strings.Join(strings.Fields(textContent(c)), " ")
+			case "ol", "ul":
+				link.Children = tocItems(c, docPath)
+			}
+		}
+		if link.Href != "" {
+			links = append(links, link)
+		}
+	}
+	return
+}
+
+// resolveHref resolves an href relative to a document of the package; a fragment is kept
+func resolveHref(href, docPath string) string {
+	if href == "" || strings.Contains(href, "://") {
+		return href
+	}
+	fragment := ""
+	if i := strings.Index(href, "#"); i >= 0 {
+		href, fragment = href[:i], href[i:]
+	}
+	if href == "" {
+		return docPath + fragment
+	}
+	return path.Join(path.Dir(docPath), href) + fragment
+}
+
+// findNode returns the first element, in document order, matching a condition
+func findNode(n *html.Node, match func(*html.Node) bool) *html.Node {
+	if n.Type == html.ElementNode && match(n) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findNode(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// attr returns the value of an attribute of an element
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name || (a.Namespace != "" && a.Namespace+":"+a.Key == name) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns the text of a node and its descendants
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+	return sb.String()
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const audiobookManifest = `{
+  "conformsTo": "https://www.w3.org/TR/audiobooks/",
+  "id": "urn:isbn:9780000000001",
+  "name": "Audiotest",
+  "readingOrder": [
+    {"url": "audio/track1.mp3", "name": "Track 1", "duration": "PT1M30S"},
+    {"url": "audio/track2.mp3", "encodingFormat": "audio/mpeg", "duration": "PT45S"}
+  ],
+  "resources": [
+    {"url": "index.html", "encodingFormat": "text/html", "rel": "contents"}
+  ]
+}`
+
+const audiobookEntryPage = `<!DOCTYPE html>
+<html><body>
+<nav role="doc-toc">
+  <ol>
+    <li><a href="audio/track1.mp3">Part  One</a>
+      <ol><li><a href="audio/track1.mp3#t=60">Chapter 2</a></li></ol>
+    </li>
+    <li><a href="audio/track2.mp3">Part Two</a></li>
+  </ol>
+</nav>
+</body></html>`
+
+func writeAudiobookFolder(t *testing.T, dir, manifest string) {
+	os.MkdirAll(filepath.Join(dir, "audio"), os.ModePerm)
+	files := map[string]string{
+		"publication.json":   manifest,
+		"index.html":         audiobookEntryPage,
+		"audio/track1.mp3":   "track 1",
+		"audio/track2.mp3":   "track 2",
+		".DS_Store":          "ignored",
+		"audio/._track1.mp3": "ignored",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildAudiobook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audiobook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "source")
+	writeAudiobookFolder(t, source, audiobookManifest)
+
+	output := filepath.Join(dir, "test.audiobook")
+	if err = BuildAudiobook(source, output); err != nil {
+		t.Fatalf("Could not build the audiobook, %s", err)
+	}
+
+	reader, err := OpenRPF(output)
+	if err != nil {
+		t.Fatalf("Could not open the audiobook package, %s", err)
+	}
+	meta := reader.manifest.Metadata
+	if meta.ConformsTo != AudiobookConformsTo || meta.Type != AudiobookType {
+		t.Errorf("Expected the audiobook profile, got %s %s", meta.ConformsTo, meta.Type)
+	}
+	if meta.Duration != 135 {
+		t.Errorf("Expected a total duration of 135s, got %f", meta.Duration)
+	}
+	if d := reader.manifest.ReadingOrder[0].Duration; d != 90 {
+		t.Errorf("Expected a duration of 90s, got %f", d)
+	}
+
+	toc := reader.manifest.TOC
+	if len(toc) != 2 || toc[0].Title != "Part One" || toc[1].Href != "audio/track2.mp3" {
+		t.Fatalf("Unexpected table of contents %+v", toc)
+	}
+	if len(toc[0].Children) != 1 || toc[0].Children[0].Href != "audio/track1.mp3#t=60" {
+		t.Errorf("Unexpected chapters %+v", toc[0].Children)
+	}
+
+	for _, file := range reader.zipArchive.File {
+		if strings.Contains(file.Name, "DS_Store") || strings.Contains(file.Name, "._") {
+			t.Errorf("Unexpected file %s in the package", file.Name)
+		}
+	}
+	if len(reader.Resources()) != 2 {
+		t.Errorf("Expected 2 resources to encrypt, got %d", len(reader.Resources()))
+	}
+}
+
+func TestBuildAudiobookDurations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audiobook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, manifest := range map[string]string{
+		"missing": strings.Replace(audiobookManifest, `, "duration": "PT45S"`, "", 1),
+		"invalid": strings.Replace(audiobookManifest, "PT45S", "45 seconds", 1),
+	} {
+		source := filepath.Join(dir, name)
+		writeAudiobookFolder(t, source, manifest)
+		err = BuildAudiobook(source, filepath.Join(dir, name+".audiobook"))
+		if err == nil || !strings.Contains(err.Error(), "audio/track2.mp3") {
+			t.Errorf("Expected a %s duration error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	_ "image/gif"  // register the gif decoder
+	_ "image/jpeg" // register the jpeg decoder
+	_ "image/png"  // register the png decoder
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/omani/readium-lcp-server/rwpm"
+)
+
+// ContentType_DIVINA_LCP is the media type of an LCP protected Divina publication
+const ContentType_DIVINA_LCP = "application/divina+lcp"
+
+// DivinaConformsTo is the profile of a Readium Divina manifest
+const DivinaConformsTo = "https://readium.org/webpub-manifest/profiles/divina"
+
+// ComicInfoName is the name of the optional metadata file of a CBZ
+const ComicInfoName = "ComicInfo.xml"
+
+// comicInfo holds the metadata of a CBZ (ComicRack format) used in a Divina manifest
+type comicInfo struct {
+	Title       string `xml:"Title"`
+	Series      string `xml:"Series"`
+	Number      string `xml:"Number"`
+	Summary     string `xml:"Summary"`
+	Writer      string `xml:"Writer"`
+	Penciller   string `xml:"Penciller"`
+	Inker       string `xml:"Inker"`
+	Colorist    string `xml:"Colorist"`
+	Letterer    string `xml:"Letterer"`
+	Publisher   string `xml:"Publisher"`
+	LanguageISO string `xml:"LanguageISO"`
+	Manga       string `xml:"Manga"`
+}
+
+// BuildDivina builds a Readium Divina package (rwpp) out of a CBZ file or a folder of images (inputPath).
+// Images are sorted by name, numbers being compared by value; the first one is the cover.
+// Metadata and the reading progression are taken from a ComicInfo.xml file if present,
+// otherwise the title is the name of the source and the reading progression is left to right.
+func BuildDivina(inputPath string, outputPath string) error {
+
+	files, closer, err := listSourceFiles(inputPath)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var pages []sourceFile
+	var info comicInfo
+	for _, f := range files {
+		if strings.HasPrefix(getMediaType(strings.ToLower(path.Ext(f.name))), "image/") {
+			pages = append(pages, f)
+		} else if path.Base(f.name) == ComicInfoName {
+			if err = decodeXMLFile(f, &info); err != nil {
+				return fmt.Errorf("divina %s: invalid %s, %s", inputPath, ComicInfoName, err.Error())
+			}
+		}
+	}
+	if len(pages) == 0 {
+		return fmt.Errorf("divina %s: no image found", inputPath)
+	}
+	sort.SliceStable(pages, func(i, j int) bool { return naturalLess(pages[i].name, pages[j].name) })
+
+	title := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+	manifest, err := generateDivinaManifest(title, info, pages)
+	if err != nil {
+		return fmt.Errorf("divina %s: %s", inputPath, err.Error())
+	}
+
+	rwpJSON, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+
+	rwppFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer rwppFile.Close()
+	zipWriter := zip.NewWriter(rwppFile)
+
+	man, err := zipWriter.Create(RWPManifestName)
+	if err != nil {
+		return err
+	}
+	if _, err = man.Write(rwpJSON); err != nil {
+		return err
+	}
+
+	// images are already compressed
+	for _, f := range pages {
+		writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		reader, err := f.open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// generateDivinaManifest generates a Readium Divina manifest; the reading order is made of the pages, with their dimensions
+func generateDivinaManifest(title string, info comicInfo, pages []sourceFile) (manifest rwpm.Publication, err error) {
+
+	manifest.Context = []string{"https://readium.org/webpub-manifest/context.jsonld"}
+	manifest.Metadata.Type = "http://schema.org/ComicStory"
+	manifest.Metadata.ConformsTo = DivinaConformsTo
+	manifest.Metadata.Identifier, _ = newUUID()
+
+	if info.Title != "" {
+		title = info.Title
+	} else if info.Series != "" {
+		title = strings.TrimSpace(info.Series + " " + info.Number)
+	}
+	manifest.Metadata.Title.SetDefault(title)
+	manifest.Metadata.Description = info.Summary
+	if info.LanguageISO != "" {
+		manifest.Metadata.Language = rwpm.MultiString{info.LanguageISO}
+	}
+	manifest.Metadata.Author = comicContributors(info.Writer)
+	manifest.Metadata.Penciler = comicContributors(info.Penciller)
+	manifest.Metadata.Inker = comicContributors(info.Inker)
+	manifest.Metadata.Colorist = comicContributors(info.Colorist)
+	manifest.Metadata.Letterer = comicContributors(info.Letterer)
+	manifest.Metadata.Publisher = comicContributors(info.Publisher)
+	manifest.Metadata.ReadingProgression = "ltr"
+	if info.Manga == "YesAndRightToLeft" {
+		manifest.Metadata.ReadingProgression = "rtl"
+	}
+
+	for i, f := range pages {
+		link := rwpm.Link{Href: f.name, Type: getMediaType(strings.ToLower(path.Ext(f.name)))}
+		link.Width, link.Height, err = imageDimensions(f)
+		if err != nil {
+			return manifest, fmt.Errorf("image %s: %s", f.name, err.Error())
+		}
+		if i == 0 {
+			link.AddRel("cover")
+		}
+		manifest.ReadingOrder = append(manifest.ReadingOrder, link)
+	}
+	return
+}
+
+// imageDimensions returns the width and height of an image.
+// Zero values are returned for formats without a decoder (e.g. webp).
+func imageDimensions(f sourceFile) (width int, height int, err error) {
+	reader, err := f.open()
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	config, _, err := image.DecodeConfig(reader)
+	if err == image.ErrFormat {
+		return 0, 0, nil
+	}
+	return config.Width, config.Height, err
+}
+
+// comicContributors maps a comma separated list of names to contributors
+func comicContributors(names string) (ctors rwpm.Contributors) {
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			var c rwpm.Contributor
+			c.Name.SetDefault(name)
+			ctors = append(ctors, c)
+		}
+	}
+	return
+}
+
+// decodeXMLFile decodes an xml file into v
+func decodeXMLFile(f sourceFile, v interface{}) error {
+	reader, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return xml.NewDecoder(reader).Decode(v)
+}
+
+// naturalLess compares two file names, sequences of digits being compared by value (page2 < page10)
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := isDigit(a[0]), isDigit(b[0])
+		if da && db {
+			na, ra := splitDigits(a)
+			nb, rb := splitDigits(b)
+			// compare the numbers without their leading zeros
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			a, b = ra, rb
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// splitDigits splits a string after its leading digits
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// IsImageFolder indicates that a folder contains images and no publication manifest,
+// i.e. that it must be processed as a Divina publication
+func IsImageFolder(dir string) bool {
+	files, _, err := listSourceFiles(dir)
+	if err != nil {
+		return false
+	}
+	images := false
+	for _, f := range files {
+		switch {
+		case f.name == W3CManifestName || f.name == RWPManifestName:
+			return false
+		case strings.HasPrefix(getMediaType(strings.ToLower(path.Ext(f.name))), "image/"):
+			images = true
+		}
+	}
+	return images
+}
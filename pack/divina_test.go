@@ -0,0 +1,135 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omani/readium-lcp-server/crypto"
+	"github.com/omani/readium-lcp-server/license"
+)
+
+func pngImage(t *testing.T, width, height int) []byte {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestBuildDivina(t *testing.T) {
+	dir, err := ioutil.TempDir("", "divina")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a cbz with pages named without leading zeros, and a ComicInfo file
+	cbzPath := filepath.Join(dir, "My Comic.cbz")
+	f, err := os.Create(cbzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"pages/page10.png", pngImage(t, 30, 40)},
+		{"pages/page2.png", pngImage(t, 20, 40)},
+		{"pages/page1.png", pngImage(t, 10, 40)},
+		{"ComicInfo.xml", []byte(`<?xml version="1.0"?><ComicInfo><Series>Series</Series><Number>3</Number><Writer>Alpha, Beta</Writer><Manga>YesAndRightToLeft</Manga></ComicInfo>`)},
+		{"notes.txt", []byte("not a page")},
+	}
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(file.data)
+	}
+	zw.Close()
+	f.Close()
+
+	output := filepath.Join(dir, "test.divina")
+	if err = BuildDivina(cbzPath, output); err != nil {
+		t.Fatalf("Could not build the Divina package, %s", err)
+	}
+	reader, err := OpenRPF(output)
+	if err != nil {
+		t.Fatalf("Could not open the Divina package, %s", err)
+	}
+
+	meta := reader.manifest.Metadata
+	if meta.ConformsTo != DivinaConformsTo || meta.ReadingProgression != "rtl" || meta.Title.Text() != "Series 3" || len(meta.Author) != 2 {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+	order := reader.manifest.ReadingOrder
+	if len(order) != 3 {
+		t.Fatalf("Expected 3 pages, got %d", len(order))
+	}
+	for i, width := range []int{10, 20, 30} {
+		if order[i].Width != width || order[i].Height != 40 || order[i].Type != "image/png" {
+			t.Errorf("Unexpected page %d: %+v", i, order[i])
+		}
+	}
+	if len(order[0].Rel) != 1 || order[0].Rel[0] != "cover" {
+		t.Error("Expected the first page to be the cover")
+	}
+
+	// the package can be encrypted
+	var b bytes.Buffer
+	writer, err := reader.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Process(license.BasicProfile, crypto.NewAESEncrypter_PUBLICATION_RESOURCES(), reader, writer); err != nil {
+		t.Fatalf("Could not encrypt the Divina package, %s", err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsImageFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "divina")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "001.jpg"), []byte("not decoded"), 0644)
+	if !IsImageFolder(dir) {
+		t.Error("Expected a folder of images")
+	}
+	ioutil.WriteFile(filepath.Join(dir, RWPManifestName), []byte("{}"), 0644)
+	if IsImageFolder(dir) {
+		t.Error("Expected a folder with a manifest not to be a folder of images")
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		less bool
+	}{
+		{"page2.jpg", "page10.jpg", true},
+		{"page10.jpg", "page2.jpg", false},
+		{"page02.jpg", "page2.jpg", false},
+		{"a/p1.jpg", "b/p0.jpg", true},
+		{"p1.jpg", "p1a.jpg", true},
+	} {
+		if naturalLess(c.a, c.b) != c.less {
+			t.Errorf("naturalLess(%s, %s): expected %t", c.a, c.b, c.less)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/omani/readium-lcp-server/epub"
+	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/xmlenc"
+)
+
+// EPUBReader is an EPUB package reader
+type EPUBReader struct {
+	epub epub.Epub
+	// obfuscationKey is set if fonts must be obfuscated instead of being encrypted
+	obfuscationKey []byte
+}
+
+// EPUBWriter is an EPUB package writer; the encryption manifest is written in META-INF/encryption.xml on Close
+type EPUBWriter struct {
+	writer     *epub.Writer
+	encryption *xmlenc.Manifest
+}
+
+// NewEPUBReader creates a new EPUB package reader
+func NewEPUBReader(zipReader *zip.Reader) (*EPUBReader, error) {
+	ep, err := epub.Read(zipReader)
+	if err != nil {
+		return nil, err
+	}
+	return &EPUBReader{epub: ep}, nil
+}
+
+// OpenEPUB opens an EPUB file and returns a package reader
+func OpenEPUB(name string) (*EPUBReader, error) {
+	zipArchive, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEPUBReader(&zipArchive.Reader)
+}
+
+// Epub returns the EPUB object parsed by the reader
+func (reader *EPUBReader) Epub() epub.Epub {
+	return reader.epub
+}
+
+// Cover returns the content of the cover image, nil if the EPUB has no cover.
+// The content of the resource is kept in memory, so that it can still be copied into the encrypted package.
+func (reader *EPUBReader) Cover() ([]byte, error) {
+	found, res := reader.epub.Cover()
+	if !found {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(res.Contents)
+	if err != nil {
+		return nil, err
+	}
+	res.Contents = bytes.NewReader(data)
+	return data, nil
+}
+
+// ObfuscateFonts requests the fonts which are neither obfuscated nor kept in clear to be obfuscated
+// with the IDPF algorithm instead of being encrypted. The key is derived from the unique identifier of the package.
+func (reader *EPUBReader) ObfuscateFonts() error {
+	if len(reader.epub.Package) == 0 {
+		return errors.New("font obfuscation: no package document")
+	}
+	key, err := epub.ObfuscationKey(epub.FontObfuscation_IDPF, reader.epub.Package[0])
+	if err != nil {
+		return err
+	}
+	reader.obfuscationKey = key
+	return nil
+}
+
+// Resources returns the list of all resources of the EPUB package
+// It is part of the PackageReader interface.
+// The resources which must stay in clear (cover, nav, NCX, META-INF) cannot be encrypted.
+func (reader *EPUBReader) Resources() []Resource {
+	var resources []Resource
+	for _, res := range reader.epub.Resource {
+		resource := &epubResource{resource: res, epub: reader.epub}
+		if reader.obfuscationKey != nil && epub.IsFont(res.ContentType, res.Path) && !resource.Encrypted() && resource.epub.CanEncrypt(res.Path) {
+			resource.obfuscationKey = reader.obfuscationKey
+		}
+		resources = append(resources, resource)
+	}
+	return resources
+}
+
+// NewWriter returns a new PackageWriter writing an EPUB to the output
+// The encryption manifest of the source package, if any, is kept
+func (reader *EPUBReader) NewWriter(writer io.Writer) (PackageWriter, error) {
+
+	ew := epub.NewWriter(writer)
+	if err := ew.WriteHeader(); err != nil {
+		return nil, err
+	}
+
+	encryption := &xmlenc.Manifest{}
+	if reader.epub.Encryption != nil {
+		*encryption = *reader.epub.Encryption
+		encryption.Data = append([]xmlenc.Data(nil), reader.epub.Encryption.Data...)
+	}
+
+	return &EPUBWriter{writer: ew, encryption: encryption}, nil
+}
+
+type epubResource struct {
+	resource *epub.Resource
+	epub     epub.Epub
+	// obfuscationKey is set if the resource is a font to be obfuscated
+	obfuscationKey []byte
+}
+
+func (resource *epubResource) Path() string        { return resource.resource.Path }
+func (resource *epubResource) ContentType() string { return resource.resource.ContentType }
+func (resource *epubResource) Size() int64         { return int64(resource.resource.OriginalSize) }
+func (resource *epubResource) CanBeEncrypted() bool {
+	return resource.obfuscationKey == nil && resource.epub.CanEncrypt(resource.resource.Path)
+}
+func (resource *epubResource) CompressBeforeEncryption() bool {
+	return compressBeforeEncryption(resource.resource.ContentType)
+}
+
+// Encrypted indicates that the resource is declared in the encryption manifest of the source package,
+// i.e. that it is already encrypted or that it is an obfuscated font; it is then copied as is
+func (resource *epubResource) Encrypted() bool {
+	if resource.epub.Encryption == nil {
+		return false
+	}
+	_, encrypted := resource.epub.Encryption.DataForFile(resource.resource.Path)
+	return encrypted
+}
+
+// Open returns the content of the resource; it can be read only once
+func (resource *epubResource) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(resource.resource.Contents), nil
+}
+
+func (resource *epubResource) CopyTo(packageWriter PackageWriter) error {
+
+	wc, err := packageWriter.NewFile(resource.Path(), resource.ContentType(), resource.resource.StorageMethod)
+	if err != nil {
+		return err
+	}
+
+	contents := resource.resource.Contents
+	if resource.obfuscationKey != nil {
+		contents = epub.NewObfuscationReader(contents, epub.FontObfuscation_IDPF, resource.obfuscationKey)
+		if epubWriter, ok := packageWriter.(*EPUBWriter); ok {
+			epubWriter.MarkAsObfuscated(resource.Path(), epub.FontObfuscation_IDPF)
+		}
+	}
+	_, err = io.Copy(wc, contents)
+
+	wCloseError := wc.Close()
+	if err != nil {
+		return err
+	}
+	return wCloseError
+}
+
+// NewFile creates a header in the zip archive
+func (writer *EPUBWriter) NewFile(path string, contentType string, storageMethod uint16) (io.WriteCloser, error) {
+	w, err := writer.writer.AddResource(path, storageMethod)
+	return &NopWriteCloser{w}, err
+}
+
+// MarkAsEncrypted adds a resource to the encryption manifest.
+// The profile is not stored in the manifest, it is only present in the license.
+func (writer *EPUBWriter) MarkAsEncrypted(path string, originalSize int64, compressed bool, profile license.EncryptionProfile, algorithm string) {
+
+	data := xmlenc.Data{}
+	data.Method.Algorithm = xmlenc.URI(algorithm)
+	data.KeyInfo = &xmlenc.KeyInfo{}
+	data.KeyInfo.RetrievalMethod.URI = "license.lcpl#/encryption/content_key"
+	data.KeyInfo.RetrievalMethod.Type = "http://readium.org/2014/01/lcp#EncryptedContentKey"
+
+	// the path has been read from the zip archive and is therefore a valid relative URL path
+	uri := url.URL{Path: path}
+	data.CipherData.CipherReference.URI = xmlenc.URI(uri.EscapedPath())
+
+	// declare to the reading software that the content is compressed before encryption
+	method := NoCompression
+	if compressed {
+		method = Deflate
+	}
+	data.Properties = &xmlenc.EncryptionProperties{
+		Properties: []xmlenc.EncryptionProperty{
+			{Compression: xmlenc.Compression{Method: method, OriginalLength: uint64(originalSize)}},
+		},
+	}
+
+	writer.encryption.Data = append(writer.encryption.Data, data)
+}
+
+// MarkAsObfuscated adds an obfuscated font to the encryption manifest
+func (writer *EPUBWriter) MarkAsObfuscated(path string, algorithm string) {
+
+	data := xmlenc.Data{}
+	data.Method.Algorithm = xmlenc.URI(algorithm)
+	uri := url.URL{Path: path}
+	data.CipherData.CipherReference.URI = xmlenc.URI(uri.EscapedPath())
+
+	writer.encryption.Data = append(writer.encryption.Data, data)
+}
+
+// Encryption returns the encryption manifest of the package
+func (writer *EPUBWriter) Encryption() *xmlenc.Manifest {
+	return writer.encryption
+}
+
+// Close writes the encryption manifest and closes the EPUB package writer
+func (writer *EPUBWriter) Close() error {
+	if err := writer.writer.WriteEncryption(writer.encryption); err != nil {
+		return err
+	}
+
+	return writer.writer.Close()
+}
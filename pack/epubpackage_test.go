@@ -0,0 +1,169 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/omani/readium-lcp-server/crypto"
+	"github.com/omani/readium-lcp-server/epub"
+	"github.com/omani/readium-lcp-server/license"
+)
+
+func TestEPUBPackage(t *testing.T) {
+	reader, err := OpenEPUB("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatalf("Could not open the EPUB package, %s", err)
+	}
+	source := reader.Epub()
+
+	var b bytes.Buffer
+	writer, err := reader.NewWriter(&b)
+	if err != nil {
+		t.Fatalf("Could not build a writer, %s", err)
+	}
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	key, err := Process(license.BasicProfile, encrypter, reader, writer)
+	if err != nil {
+		t.Fatalf("Could not encrypt the package, %s", err)
+	}
+	if key == nil {
+		t.Error("Expected a key")
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("Could not close the writer, %s", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("Could not reopen the written archive, %s", err)
+	}
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Error("Expected an uncompressed mimetype file at the beginning of the archive")
+	}
+	output, err := epub.Read(zr)
+	if err != nil {
+		t.Fatalf("Could not read the encrypted EPUB, %s", err)
+	}
+	if output.Encryption == nil {
+		t.Fatal("Expected an encryption manifest")
+	}
+
+	for _, res := range source.Resource {
+		_, encrypted := output.Encryption.DataForFile(res.Path)
+		if encrypted != source.CanEncrypt(res.Path) {
+			t.Errorf("Expected %s to be encrypted: %t, got %t", res.Path, source.CanEncrypt(res.Path), encrypted)
+		}
+	}
+
+	res, ok := FindFile("OPS/images/Moby-Dick_FE_title_page.jpg", output)
+	if !ok || res.Compressed {
+		t.Error("Expected the image to be encrypted without compression")
+	}
+	res, ok = FindFile("OPS/chapter_001.xhtml", output)
+	if !ok || !res.Compressed {
+		t.Error("Expected the html file to be compressed before encryption")
+	}
+}
+
+const fontsOPF = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="uid">urn:uuid:1234</dc:identifier><dc:title>Fonts</dc:title></metadata>
+  <manifest>
+    <item id="c1" href="chapter.xhtml" media-type="application/xhtml+xml"/>
+    <item id="f1" href="fonts/clear.otf" media-type="font/otf"/>
+    <item id="f2" href="fonts/obfuscated font.woff" media-type="font/woff"/>
+  </manifest>
+  <spine><itemref idref="c1"/></spine>
+</package>`
+
+// the reference of the obfuscated font is not escaped, as done by some packagers
+const fontsEncryption = `<?xml version="1.0"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://ns.adobe.com/pdf/enc#RC"/>
+    <enc:CipherData><enc:CipherReference URI="OEBPS/fonts/obfuscated font.woff"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`
+
+func TestEPUBFontObfuscation(t *testing.T) {
+	font := bytes.Repeat([]byte("font"), 500)
+	var source bytes.Buffer
+	zw := zip.NewWriter(&source)
+	for _, f := range []struct{ name, content string }{
+		{"mimetype", epub.ContentType_EPUB},
+		{epub.ContainerFile, `<?xml version="1.0"?><container xmlns="urn:oasis:names:tc:opendocument:xmlns:container"><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`},
+		{epub.EncryptionFile, fontsEncryption},
+		{"OEBPS/content.opf", fontsOPF},
+		{"OEBPS/chapter.xhtml", "<html/>"},
+		{"OEBPS/fonts/clear.otf", string(font)},
+		{"OEBPS/fonts/obfuscated font.woff", "already obfuscated"},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(source.Bytes()), int64(source.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewEPUBReader(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reader.ObfuscateFonts(); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	enc, _, err := DoEPUB(encrypter, reader, &b)
+	if err != nil {
+		t.Fatalf("Could not encrypt the package, %s", err)
+	}
+	expected := map[string]string{
+		"OEBPS/chapter.xhtml":              encrypter.Signature(),
+		"OEBPS/fonts/clear.otf":            epub.FontObfuscation_IDPF,
+		"OEBPS/fonts/obfuscated font.woff": epub.FontObfuscation_ADOBE,
+	}
+	if len(enc.Data) != len(expected) {
+		t.Errorf("Expected %d entries in the encryption manifest, got %d", len(expected), len(enc.Data))
+	}
+	for path, algorithm := range expected {
+		data, ok := enc.DataForFile(path)
+		if !ok {
+			t.Errorf("Expected an entry for %s", path)
+			continue
+		}
+		if string(data.Method.Algorithm) != algorithm {
+			t.Errorf("Expected %s to be processed with %s, got %s", path, algorithm, data.Method.Algorithm)
+		}
+	}
+
+	zr, err = zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := epub.Read(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := epub.ObfuscationKey(epub.FontObfuscation_IDPF, output.Package[0])
+	res, _ := FindFile("OEBPS/fonts/clear.otf", output)
+	clear, _ := ioutil.ReadAll(epub.NewObfuscationReader(res.Contents, epub.FontObfuscation_IDPF, key))
+	if !bytes.Equal(clear, font) {
+		t.Error("Expected the font to be deobfuscated with the key of the package")
+	}
+	res, _ = FindFile("OEBPS/fonts/obfuscated font.woff", output)
+	if content, _ := ioutil.ReadAll(res.Contents); string(content) != "already obfuscated" {
+		t.Error("Expected the obfuscated font to be copied as is")
+	}
+}
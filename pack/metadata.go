@@ -0,0 +1,285 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omani/readium-lcp-server/epub"
+	"github.com/omani/readium-lcp-server/epub/opf"
+	"github.com/omani/readium-lcp-server/rwpm"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// MetadataName is the name of the metadata document derived from a content in the storage
+const MetadataName = "metadata.json"
+
+// ContentType_WEBPUB_JSON is the media type of a Readium manifest, used for metadata documents
+const ContentType_WEBPUB_JSON = "application/webpub+json"
+
+// MetadataKey returns the storage key of the metadata document of a content
+func MetadataKey(contentID string) string {
+	return storage.DerivedKey(contentID, MetadataName)
+}
+
+// StoreMetadata stores the metadata document of a content
+func StoreMetadata(ctx context.Context, store storage.Store, contentID string, doc rwpm.Publication) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = store.Add(ctx, MetadataKey(contentID), bytes.NewReader(data), int64(len(data)), ContentType_WEBPUB_JSON)
+	return err
+}
+
+// roles maps MARC relator codes to the contributor properties of a Readium manifest
+var roles = map[string]func(m *rwpm.Metadata) *rwpm.Contributors{
+	"aut": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Author },
+	"art": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Artist },
+	"clr": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Colorist },
+	"edt": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Editor },
+	"ill": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Illustrator },
+	"ink": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Inker },
+	"nrt": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Narrator },
+	"pbl": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Publisher },
+	"trl": func(m *rwpm.Metadata) *rwpm.Contributors { return &m.Translator },
+}
+
+// opfMetadata gives access to the metadata elements of a package document and to their refinements
+type opfMetadata struct {
+	elements []opf.Element
+	refines  map[string][]opf.Element
+}
+
+// property returns a property of an element: an EPUB 2 attribute (e.g. opf:role) or an EPUB 3 refinement
+func (m opfMetadata) property(e opf.Element, name string) string {
+	if v := e.Attr(name); v != "" && e.XMLName.Local != "meta" {
+		return v
+	}
+	if id := e.Attr("id"); id != "" {
+		for _, r := range m.refines[id] {
+			if r.Attr("property") == name {
+				return strings.TrimSpace(r.Value)
+			}
+		}
+	}
+	return ""
+}
+
+// localized returns the value of an element in its language, with its alternate scripts
+func (m opfMetadata) localized(e opf.Element) (ml rwpm.MultiLanguage) {
+	if lang := e.Attr("lang"); lang != "" {
+		ml.Set(lang, strings.TrimSpace(e.Value))
+	} else {
+		ml.SetDefault(strings.TrimSpace(e.Value))
+	}
+	if id := e.Attr("id"); id != "" {
+		for _, r := range m.refines[id] {
+			if r.Attr("property") == "alternate-script" && r.Attr("lang") != "" {
+				ml.Set(r.Attr("lang"), strings.TrimSpace(r.Value))
+			}
+		}
+	}
+	return
+}
+
+// metaValue returns the value of an EPUB 3 meta (property) or EPUB 2 meta (name) element
+func metaValue(e opf.Element, name string) (string, bool) {
+	if e.XMLName.Local != "meta" || e.Attr("refines") != "" {
+		return "", false
+	}
+	if e.Attr("property") == name {
+		return strings.TrimSpace(e.Value), true
+	}
+	if e.Attr("name") == name {
+		return strings.TrimSpace(e.Attr("content")), true
+	}
+	return "", false
+}
+
+// EPUBMetadata builds a metadata document (a Readium manifest without reading order) from the package document of an EPUB.
+// EPUB 2 attributes (opf:role, opf:file-as, opf:scheme, opf:event) and EPUB 3 refinements are supported.
+// The cover is referenced in the links of the document.
+func EPUBMetadata(ep epub.Epub) (doc rwpm.Publication) {
+
+	doc.Context = []string{"https://readium.org/webpub-manifest/context.jsonld"}
+	doc.Metadata.Type = "http://schema.org/Book"
+	if len(ep.Package) == 0 {
+		return
+	}
+	p := ep.Package[0]
+
+	m := opfMetadata{elements: p.Metadata.Elements, refines: map[string][]opf.Element{}}
+	for _, e := range m.elements {
+		if target := e.Attr("refines"); e.XMLName.Local == "meta" && strings.HasPrefix(target, "#") {
+			m.refines[target[1:]] = append(m.refines[target[1:]], e)
+		}
+	}
+	meta := &doc.Metadata
+
+	titleSet := false
+	for _, e := range m.elements {
+		switch {
+		case e.IsDC("title"):
+			switch m.property(e, "title-type") {
+			case "subtitle":
+				meta.Subtitle = m.localized(e)
+			case "main":
+				meta.Title = m.localized(e)
+				titleSet = true
+			case "":
+				if !titleSet {
+					meta.Title = m.localized(e)
+					titleSet = true
+				}
+			}
+		case e.IsDC("creator"), e.IsDC("contributor"), e.IsDC("publisher"):
+			addContributor(meta, m, e)
+		case e.IsDC("identifier"):
+			addIdentifier(meta, m, e, e.Attr("id") == p.UniqueIdentifier)
+		case e.IsDC("language"):
+			meta.Language = append(meta.Language, strings.TrimSpace(e.Value))
+		case e.IsDC("description"):
+			if meta.Description == "" {
+				meta.Description = strings.TrimSpace(e.Value)
+			}
+		case e.IsDC("subject"):
+			meta.Subject = append(meta.Subject, rwpm.Subject{
+				Name:   strings.TrimSpace(e.Value),
+				Scheme: m.property(e, "authority"),
+				Code:   m.property(e, "term"),
+			})
+		case e.IsDC("date"):
+			// EPUB 3: the publication date; EPUB 2: the event is given as an attribute
+			switch e.Attr("event") {
+			case "", "publication", "original-publication":
+				if t, ok := parseDate(e.Value); ok && meta.Published == nil {
+					published := rwpm.Date(t)
+					meta.Published = &published
+				}
+			case "modification":
+				if t, ok := parseDate(e.Value); ok && meta.Modified == nil {
+					meta.Modified = &t
+				}
+			}
+		}
+		if v, ok := metaValue(e, "dcterms:modified"); ok {
+			if t, ok := parseDate(v); ok {
+				meta.Modified = &t
+			}
+		}
+	}
+	addCollections(meta, m)
+
+	if found, cover := ep.Cover(); found {
+		doc.Links = append(doc.Links, rwpm.Link{Href: cover.Path, Type: cover.ContentType, Rel: []string{"cover"}})
+	}
+	return
+}
+
+// addContributor adds a creator, contributor or publisher to the metadata, according to its role
+func addContributor(meta *rwpm.Metadata, m opfMetadata, e opf.Element) {
+	var c rwpm.Contributor
+	c.Name = m.localized(e)
+	c.SortAs = m.property(e, "file-as")
+	role := m.property(e, "role")
+
+	var ctors *rwpm.Contributors
+	if e.IsDC("publisher") {
+		ctors = &meta.Publisher
+	} else if f, ok := roles[role]; ok {
+		ctors = f(meta)
+	} else if e.IsDC("creator") && role == "" {
+		ctors = &meta.Author
+	} else {
+		c.Role = role
+		ctors = &meta.Contributor
+	}
+	*ctors = append(*ctors, c)
+}
+
+// addIdentifier sets the identifier of the publication, or adds an alternate identifier.
+// ISBNs are normalized as urn:isbn URNs.
+func addIdentifier(meta *rwpm.Metadata, m opfMetadata, e opf.Element, unique bool) {
+	value := strings.TrimSpace(e.Value)
+	scheme := strings.ToLower(m.property(e, "scheme"))
+	// ONIX code list 5: 02 is an ISBN-10, 15 an ISBN-13
+	if t := m.property(e, "identifier-type"); t == "02" || t == "15" {
+		scheme = "isbn"
+	}
+	lower := strings.ToLower(value)
+	if scheme == "isbn" || strings.HasPrefix(lower, "urn:isbn:") || strings.HasPrefix(lower, "isbn:") {
+		value = "urn:isbn:" + normalizeISBN(value)
+	}
+	if value == "" {
+		return
+	}
+	if unique || meta.Identifier == "" {
+		if meta.Identifier != "" {
+			meta.AltIdentifier = append(meta.AltIdentifier, meta.Identifier)
+		}
+		meta.Identifier = value
+		return
+	}
+	meta.AltIdentifier = append(meta.AltIdentifier, value)
+}
+
+// normalizeISBN removes the prefix, hyphens and spaces of an ISBN
+func normalizeISBN(isbn string) string {
+	isbn = strings.TrimSpace(isbn)
+	if i := strings.LastIndex(isbn, ":"); i >= 0 {
+		isbn = isbn[i+1:]
+	}
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+}
+
+// addCollections maps EPUB 3 collections and Calibre series to the metadata
+func addCollections(meta *rwpm.Metadata, m opfMetadata) {
+	var belongsTo rwpm.BelongsTo
+	var calibre rwpm.Collection
+	for _, e := range m.elements {
+		if v, ok := metaValue(e, "belongs-to-collection"); ok {
+			c := rwpm.Collection{Name: v}
+			if pos, err := strconv.ParseFloat(m.property(e, "group-position"), 32); err == nil {
+				c.Position = float32(pos)
+			}
+			if m.property(e, "collection-type") == "series" {
+				belongsTo.Series = append(belongsTo.Series, c)
+			} else {
+				belongsTo.Collection = append(belongsTo.Collection, c)
+			}
+		}
+		if v, ok := metaValue(e, "calibre:series"); ok {
+			calibre.Name = v
+		}
+		if v, ok := metaValue(e, "calibre:series_index"); ok {
+			if pos, err := strconv.ParseFloat(v, 32); err == nil {
+				calibre.Position = float32(pos)
+			}
+		}
+	}
+	if calibre.Name != "" && len(belongsTo.Series) == 0 {
+		belongsTo.Series = append(belongsTo.Series, calibre)
+	}
+	if len(belongsTo.Series) > 0 || len(belongsTo.Collection) > 0 {
+		meta.BelongsTo = &belongsTo
+	}
+}
+
+// parseDate parses the date formats found in package documents (W3CDTF)
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
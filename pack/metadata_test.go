@@ -0,0 +1,119 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/omani/readium-lcp-server/epub"
+	"github.com/omani/readium-lcp-server/epub/opf"
+)
+
+const epub3Metadata = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">urn:uuid:1234</dc:identifier>
+    <dc:identifier id="isbn">978-2-07-036002-4</dc:identifier>
+    <meta refines="#isbn" property="identifier-type" scheme="onix:codelist5">15</meta>
+    <dc:title id="t1">Le Petit Prince</dc:title>
+    <meta refines="#t1" property="title-type">main</meta>
+    <meta refines="#t1" property="alternate-script" xml:lang="ja">星の王子さま</meta>
+    <dc:title id="t2">Récit</dc:title>
+    <meta refines="#t2" property="title-type">subtitle</meta>
+    <dc:creator id="c1">Antoine de Saint-Exupéry</dc:creator>
+    <meta refines="#c1" property="role" scheme="marc:relators">aut</meta>
+    <meta refines="#c1" property="file-as">Saint-Exupéry, Antoine de</meta>
+    <dc:contributor id="c2">Jane Doe</dc:contributor>
+    <meta refines="#c2" property="role" scheme="marc:relators">trl</meta>
+    <dc:publisher>Gallimard</dc:publisher>
+    <dc:language>fr</dc:language>
+    <dc:subject>Fiction</dc:subject>
+    <dc:date>1943-04-06</dc:date>
+    <meta property="dcterms:modified">2020-01-01T10:00:00Z</meta>
+    <meta property="belongs-to-collection" id="s1">Folio</meta>
+    <meta refines="#s1" property="collection-type">series</meta>
+    <meta refines="#s1" property="group-position">2</meta>
+  </metadata>
+  <manifest/>
+  <spine/>
+</package>`
+
+const epub2Metadata = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:identifier opf:scheme="ISBN">2-07-036002-X</dc:identifier>
+    <dc:identifier id="uid" opf:scheme="UUID">urn:uuid:5678</dc:identifier>
+    <dc:title>Vol de nuit</dc:title>
+    <dc:creator opf:role="aut" opf:file-as="Saint-Exupéry, Antoine de">Antoine de Saint-Exupéry</dc:creator>
+    <dc:creator opf:role="ill">John Doe</dc:creator>
+    <dc:date opf:event="publication">1931</dc:date>
+    <dc:date opf:event="modification">2019-05-01</dc:date>
+    <meta name="calibre:series" content="Classics"/>
+    <meta name="calibre:series_index" content="4"/>
+  </metadata>
+  <manifest/>
+  <spine/>
+</package>`
+
+func parseTestPackage(t *testing.T, doc string) epub.Epub {
+	p, err := opf.Parse(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return epub.Epub{Package: []opf.Package{p}}
+}
+
+func TestEPUBMetadata(t *testing.T) {
+	meta := EPUBMetadata(parseTestPackage(t, epub3Metadata)).Metadata
+
+	if meta.Identifier != "urn:uuid:1234" || len(meta.AltIdentifier) != 1 || meta.AltIdentifier[0] != "urn:isbn:9782070360024" {
+		t.Errorf("Unexpected identifiers %s %v", meta.Identifier, meta.AltIdentifier)
+	}
+	if meta.Title.Text() != "Le Petit Prince" || meta.Title["ja"] != "星の王子さま" || meta.Subtitle.Text() != "Récit" {
+		t.Errorf("Unexpected titles %v %v", meta.Title, meta.Subtitle)
+	}
+	if len(meta.Author) != 1 || meta.Author[0].SortAs != "Saint-Exupéry, Antoine de" {
+		t.Errorf("Unexpected authors %+v", meta.Author)
+	}
+	if len(meta.Translator) != 1 || len(meta.Publisher) != 1 || len(meta.Contributor) != 0 {
+		t.Errorf("Unexpected contributors %+v %+v %+v", meta.Translator, meta.Publisher, meta.Contributor)
+	}
+	if len(meta.Language) != 1 || meta.Language[0] != "fr" || len(meta.Subject) != 1 {
+		t.Errorf("Unexpected language or subjects %v %v", meta.Language, meta.Subject)
+	}
+	if meta.Published == nil || meta.Modified == nil || meta.Modified.Year() != 2020 {
+		t.Errorf("Unexpected dates %v %v", meta.Published, meta.Modified)
+	}
+	if meta.BelongsTo == nil || len(meta.BelongsTo.Series) != 1 || meta.BelongsTo.Series[0].Name != "Folio" || meta.BelongsTo.Series[0].Position != 2 {
+		t.Errorf("Unexpected collections %+v", meta.BelongsTo)
+	}
+
+	meta = EPUBMetadata(parseTestPackage(t, epub2Metadata)).Metadata
+
+	if meta.Identifier != "urn:uuid:5678" || len(meta.AltIdentifier) != 1 || meta.AltIdentifier[0] != "urn:isbn:207036002X" {
+		t.Errorf("Unexpected identifiers %s %v", meta.Identifier, meta.AltIdentifier)
+	}
+	if len(meta.Author) != 1 || meta.Author[0].SortAs == "" || len(meta.Illustrator) != 1 {
+		t.Errorf("Unexpected contributors %+v %+v", meta.Author, meta.Illustrator)
+	}
+	if meta.Published == nil || meta.Modified == nil || meta.Modified.Year() != 2019 {
+		t.Errorf("Unexpected dates %v %v", meta.Published, meta.Modified)
+	}
+	if meta.BelongsTo == nil || len(meta.BelongsTo.Series) != 1 || meta.BelongsTo.Series[0].Name != "Classics" || meta.BelongsTo.Series[0].Position != 4 {
+		t.Errorf("Unexpected collections %+v", meta.BelongsTo)
+	}
+}
+
+func TestEPUBMetadataCover(t *testing.T) {
+	reader, err := OpenEPUB("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := EPUBMetadata(reader.Epub())
+	if len(doc.Links) != 1 || doc.Links[0].Rel[0] != "cover" || doc.Links[0].Type != "image/jpeg" {
+		t.Errorf("Expected a cover link, got %+v", doc.Links)
+	}
+}
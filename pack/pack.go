@@ -9,7 +9,6 @@ import (
 	"compress/flate"
 	"io"
 	"log"
-	"net/url"
 	"strings"
 
 	"github.com/omani/readium-lcp-server/crypto"
@@ -27,7 +26,8 @@ type PackageReader interface {
 // PackageWriter is an interface
 type PackageWriter interface {
 	NewFile(path string, contentType string, storageMethod uint16) (io.WriteCloser, error)
-	MarkAsEncrypted(path string, originalSize int64, profile license.EncryptionProfile, algorithm string)
+	// MarkAsEncrypted declares a resource as encrypted; compressed indicates that it has been deflated before encryption
+	MarkAsEncrypted(path string, originalSize int64, compressed bool, profile license.EncryptionProfile, algorithm string)
 	Close() error
 }
 
@@ -44,6 +44,7 @@ type Resource interface {
 }
 
 // Process copies resources from the source to the destination package, after encryption if needed.
+// It is used for every kind of package: EPUB, Readium Packages, and PDF or LPF files converted to Readium Packages.
 func Process(profile license.EncryptionProfile, encrypter crypto.Encrypter, reader PackageReader, writer PackageWriter) (key crypto.ContentKey, err error) {
 
 	// generate an encryption key
@@ -63,7 +64,7 @@ func Process(profile license.EncryptionProfile, encrypter crypto.Encrypter, read
 	// loop through the resources of the source package, encrypt them if needed, copy them into the dest package
 	for _, resource := range reader.Resources() {
 		if !resource.Encrypted() && resource.CanBeEncrypted() {
-			err = encryptRPFResource(compressor, profile, encrypter, key, resource, writer)
+			err = encryptResource(compressor, profile, encrypter, key, resource, writer)
 			if err != nil {
 				log.Println("Error encrypting " + resource.Path() + ": " + err.Error())
 				return
@@ -85,67 +86,32 @@ func Process(profile license.EncryptionProfile, encrypter crypto.Encrypter, read
 }
 
 // Do encrypts when necessary the resources of an EPUB package
-// It is called for EPUB files only
-// FIXME: try to merge Process() and Do()
+// and returns its encryption manifest.
+// It is a shortcut to Process for EPUB files.
 func Do(encrypter crypto.Encrypter, ep epub.Epub, w io.Writer) (enc *xmlenc.Manifest, key crypto.ContentKey, err error) {
+	return DoEPUB(encrypter, &EPUBReader{epub: ep}, w)
+}
 
-	// generate an encryption key
-	key, err = encrypter.GenerateKey()
-	if err != nil {
-		log.Println("Error generating a key")
-		return
-	}
-
-	// initialise the target publication
-	ew := epub.NewWriter(w)
-	ew.WriteHeader()
-	if ep.Encryption == nil {
-		ep.Encryption = &xmlenc.Manifest{}
-	}
+// DoEPUB is the same as Do, for an EPUB package reader whose options (e.g. font obfuscation) are set
+func DoEPUB(encrypter crypto.Encrypter, reader *EPUBReader, w io.Writer) (enc *xmlenc.Manifest, key crypto.ContentKey, err error) {
 
-	// create a compressing tool
-	var buf bytes.Buffer
-	compressor, err := flate.NewWriter(&buf, flate.BestCompression)
+	writer, err := reader.NewWriter(w)
 	if err != nil {
 		return
 	}
-
-	for _, res := range ep.Resource {
-		if _, alreadyEncrypted := ep.Encryption.DataForFile(res.Path); !alreadyEncrypted && canEncrypt(res, ep) {
-			compress := mustCompressBeforeEncryption(*res, ep)
-			// encrypt the resource after optionally compressing it
-			err = encryptEPUBResource(compressor, compress, encrypter, key, ep.Encryption, res, ew)
-			if err != nil {
-				log.Println("Error encrypting " + res.Path + ": " + err.Error())
-				return
-			}
-		} else {
-			// copy the resource as-is to the target publication
-			err = ew.Copy(res)
-			if err != nil {
-				log.Println("Error copying the file")
-				return
-			}
-		}
-	}
-
-	// save the encryption manifest
-	ew.WriteEncryption(ep.Encryption)
-
-	// close the compressor
-	if err = compressor.Close(); err != nil {
+	// the profile is not used in EPUB files, where it only appears in the license
+	key, err = Process(license.BasicProfile, encrypter, reader, writer)
+	if err != nil {
 		return
 	}
-
-	return ep.Encryption, key, ew.Close()
+	err = writer.Close()
+	return writer.(*EPUBWriter).Encryption(), key, err
 }
 
-// mustCompressBeforeEncryption checks is a resource must be compressed before encryption.
+// compressBeforeEncryption checks if a resource must be compressed before encryption.
 // We don't want to compress files if that might cause streaming (byte range requests) issues.
 // The test is applied on the resource media-type; image, video, audio, pdf are stored without compression.
-func mustCompressBeforeEncryption(file epub.Resource, ep epub.Epub) bool {
-
-	mimetype := file.ContentType
+func compressBeforeEncryption(mimetype string) bool {
 
 	if mimetype == "" {
 		return true
@@ -160,13 +126,8 @@ const (
 	Deflate       = 8
 )
 
-// canEncrypt checks if a resource should be encrypted
-func canEncrypt(file *epub.Resource, ep epub.Epub) bool {
-	return ep.CanEncrypt(file.Path)
-}
-
-// encryptRPFResource encrypts a resource in a Readium Package
-func encryptRPFResource(compressor *flate.Writer, profile license.EncryptionProfile, encrypter crypto.Encrypter, key crypto.ContentKey, resource Resource, packageWriter PackageWriter) error {
+// encryptResource encrypts a resource in a package, after compressing it if needed
+func encryptResource(compressor *flate.Writer, profile license.EncryptionProfile, encrypter crypto.Encrypter, key crypto.ContentKey, resource Resource, packageWriter PackageWriter) error {
 
 	// add the file to the package writer
 	// note: the file is stored as-is because compression, when applied, is applied *before* encryption
@@ -180,8 +141,8 @@ func encryptRPFResource(compressor *flate.Writer, profile license.EncryptionProf
 	}
 	var reader io.Reader = resourceReader
 
-	// FIXME: CompressBeforeEncryption() is currently always set to false
-	if resource.CompressBeforeEncryption() {
+	compressed := resource.CompressBeforeEncryption()
+	if compressed {
 
 		// use a new buffer as target of the compressor
 		var buf bytes.Buffer
@@ -199,69 +160,11 @@ func encryptRPFResource(compressor *flate.Writer, profile license.EncryptionProf
 	resourceReader.Close()
 	file.Close()
 
-	packageWriter.MarkAsEncrypted(resource.Path(), resource.Size(), profile, encrypter.Signature())
+	packageWriter.MarkAsEncrypted(resource.Path(), resource.Size(), compressed, profile, encrypter.Signature())
 
 	return err
 }
 
-// encryptEPUBResource encrypts a file in an EPUB package
-func encryptEPUBResource(compressor *flate.Writer, compress bool, encrypter crypto.Encrypter, key []byte, m *xmlenc.Manifest, file *epub.Resource, w *epub.Writer) error {
-
-	// set encryption properties for the resource
-	data := xmlenc.Data{}
-	data.Method.Algorithm = xmlenc.URI(encrypter.Signature())
-	data.KeyInfo = &xmlenc.KeyInfo{}
-	data.KeyInfo.RetrievalMethod.URI = "license.lcpl#/encryption/content_key"
-	data.KeyInfo.RetrievalMethod.Type = "http://readium.org/2014/01/lcp#EncryptedContentKey"
-
-	uri, err := url.Parse(file.Path)
-	if err != nil {
-		return err
-	}
-	data.CipherData.CipherReference.URI = xmlenc.URI(uri.EscapedPath())
-
-	// declare to the reading software that the content is compressed before encryption
-	method := NoCompression
-	if compress {
-		method = Deflate
-	}
-	data.Properties = &xmlenc.EncryptionProperties{
-		Properties: []xmlenc.EncryptionProperty{
-			{Compression: xmlenc.Compression{Method: method, OriginalLength: file.OriginalSize}},
-		},
-	}
-
-	m.Data = append(m.Data, data)
-
-	// by default, the source file is the source of the encryption
-	input := file.Contents
-
-	// if the content has to be compressed before encryption
-	if compress {
-		// use a new buffer as target of the compressor
-		var buf bytes.Buffer
-		compressor.Reset(&buf)
-		io.Copy(compressor, file.Contents)
-		if err := compressor.Close(); err != nil {
-			return err
-		}
-		//file.ContentsSize = uint64(buf.Len())
-		// use the buffer as source of the encryption
-		input = &buf
-	}
-
-	// note: the file is stored as-is in the zip because compression, when applied, is applied before encryption
-	// and therefore *before* storage.
-	file.StorageMethod = NoCompression
-
-	fw, err := w.AddResource(file.Path, NoCompression)
-	if err != nil {
-		return err
-	}
-	// encrypt the buffer and store the resulting resource in the target publication
-	return encrypter.Encrypt(key, input, fw)
-}
-
 // FindFile finds a file in an EPUB object
 func FindFile(name string, ep epub.Epub) (*epub.Resource, bool) {
 
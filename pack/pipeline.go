@@ -6,19 +6,24 @@ package pack
 
 import (
 	"archive/zip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 
+	"github.com/omani/readium-lcp-server/config"
 	"github.com/omani/readium-lcp-server/crypto"
 	"github.com/omani/readium-lcp-server/epub"
 	"github.com/omani/readium-lcp-server/index"
+	"github.com/omani/readium-lcp-server/metrics"
 	"github.com/omani/readium-lcp-server/storage"
 )
 
@@ -33,6 +38,10 @@ type Task struct {
 	Body io.ReaderAt
 	Size int64
 	done chan Result
+	// id is the content id of the encrypted publication; generated by the packager if empty
+	id string
+	// progress is called when the packager enters a new stage; optional
+	progress func(stage string)
 }
 
 // EncryptedFileInfo contains a file, its size and sha256
@@ -65,6 +74,21 @@ func (t *Task) Done(r Result) {
 	t.done <- r
 }
 
+// Stages of the encryption of a task, reported as its progress
+const (
+	StageReading    = "reading"
+	StageValidating = "validating"
+	StageEncrypting = "encrypting"
+	StageStoring    = "storing"
+	StageIndexing   = "indexing"
+)
+
+func (t *Task) report(stage string) {
+	if t.progress != nil {
+		t.progress(stage)
+	}
+}
+
 // ManualSource is a struc
 type ManualSource struct {
 	ch chan<- *Task
@@ -87,25 +111,70 @@ type Packager struct {
 	done     chan struct{}
 	store    storage.Store
 	idx      index.Index
+	// workers counts the running workers, stop stops them once
+	workers *sync.WaitGroup
+	stop    *sync.Once
 }
 
+var (
+	// encryptionJobs counts the encryption tasks processed by the packager, by status (success or error)
+	encryptionJobs = metrics.NewCounterVec("pack_encryption_jobs_total",
+		"Number of encryption tasks processed by the packager, by status", "status")
+	// encryptionDuration measures the processing time of the encryption tasks, from reading to indexing
+	encryptionDuration = metrics.NewHistogramVec("pack_encryption_duration_seconds",
+		"Processing time of the encryption tasks of the packager, by status",
+		[]float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "status")
+)
+
 func (p Packager) work() {
-	for t := range p.Incoming {
-		log.Println("Packager working on an incoming EPUB, encryption task")
-		r := Result{}
-		p.genKey(&r)
-		zr := p.readZip(&r, t.Body, t.Size)
-		ep := p.readEpub(&r, zr)
-		encrypted, key := p.encrypt(&r, ep)
-		p.addToStore(&r, encrypted)
-		p.addToIndex(&r, key, t.Name, encrypted, epub.ContentType_EPUB)
+	defer p.workers.Done()
+	for {
+		select {
+		case <-p.done:
+			return
+		case t := <-p.Incoming:
+			p.process(t)
+		}
+	}
+}
 
-		t.Done(r)
+// process encrypts the publication of a task, stores it and adds it to the index
+func (p Packager) process(t *Task) {
+	log.Println("Packager working on an incoming EPUB, encryption task")
+	start := time.Now()
+	r := Result{ID: t.id}
+	p.genKey(&r)
+	t.report(StageReading)
+	zr := p.readZip(&r, t.Body, t.Size)
+	t.report(StageValidating)
+	p.validate(&r, t.Name, zr)
+	ep := p.readEpub(&r, zr)
+	thumbnails := p.makeThumbnails(&r, t.Name, ep)
+	t.report(StageEncrypting)
+	encrypted, key := p.encrypt(&r, ep)
+	if encrypted != nil {
+		// the encrypted file is temporary, whatever the outcome of the task
+		defer removeTempFile(encrypted.File)
 	}
+	t.report(StageStoring)
+	p.addToStore(&r, encrypted)
+	p.addMetadata(&r, ep)
+	p.addThumbnails(&r, thumbnails)
+	t.report(StageIndexing)
+	p.addToIndex(&r, key, t.Name, encrypted, epub.ContentType_EPUB)
+
+	r.Elapsed = time.Since(start)
+	status := "success"
+	if r.Error != nil {
+		status = "error"
+	}
+	encryptionJobs.With(status).Inc()
+	encryptionDuration.With(status).Observe(r.Elapsed.Seconds())
+	t.Done(r)
 }
 
 func (p Packager) genKey(r *Result) {
-	if r.Error != nil {
+	if r.Error != nil || r.ID != "" {
 		return
 	}
 
@@ -123,6 +192,22 @@ func (p Packager) readZip(r *Result, in io.ReaderAt, size int64) *zip.Reader {
 	return zr
 }
 
+// validate checks the structure of the EPUB file; issues are logged,
+// and errors fail the task if the packager is strict
+func (p Packager) validate(r *Result, name string, zr *zip.Reader) {
+	if r.Error != nil {
+		return
+	}
+
+	report := epub.Validate(zr)
+	for _, issue := range report.Issues {
+		log.Println(name + ": " + issue.String())
+	}
+	if errs := report.Errors(); len(errs) > 0 && config.Config.Packager.Strict {
+		r.Error = fmt.Errorf("invalid EPUB, %d errors, first: %s", len(errs), errs[0])
+	}
+}
+
 func (p Packager) readEpub(r *Result, zr *zip.Reader) epub.Epub {
 	if r.Error != nil {
 		return epub.Epub{}
@@ -134,6 +219,20 @@ func (p Packager) readEpub(r *Result, zr *zip.Reader) epub.Epub {
 	return ep
 }
 
+// makeThumbnails resizes the cover of the EPUB before its encryption;
+// a cover which cannot be decoded is logged but does not fail the task
+func (p Packager) makeThumbnails(r *Result, name string, ep epub.Epub) []Thumbnail {
+	if r.Error != nil {
+		return nil
+	}
+
+	thumbnails, err := CoverThumbnails(&EPUBReader{epub: ep})
+	if err != nil {
+		log.Println(name + ": no cover thumbnail, " + err.Error())
+	}
+	return thumbnails
+}
+
 func (p Packager) encrypt(r *Result, ep epub.Epub) (*EncryptedFileInfo, []byte) {
 	if r.Error != nil {
 		return nil, nil
@@ -143,8 +242,16 @@ func (p Packager) encrypt(r *Result, ep epub.Epub) (*EncryptedFileInfo, []byte)
 		r.Error = err
 		return nil, nil
 	}
+	reader := &EPUBReader{epub: ep}
+	if config.Config.Packager.ObfuscateFonts {
+		if err = reader.ObfuscateFonts(); err != nil {
+			removeTempFile(tmpFile)
+			r.Error = err
+			return nil, nil
+		}
+	}
 	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
-	_, key, err := Do(encrypter, ep, tmpFile)
+	_, key, err := DoEPUB(encrypter, reader, tmpFile)
 	r.Error = err
 	var encryptedFileInfo EncryptedFileInfo
 	encryptedFileInfo.File = tmpFile
@@ -154,6 +261,7 @@ func (p Packager) encrypt(r *Result, ep epub.Epub) (*EncryptedFileInfo, []byte)
 	written, err := io.Copy(hasher, encryptedFileInfo.File)
 	//hasher.Write(s)
 	if err != nil {
+		removeTempFile(tmpFile)
 		r.Error = err
 		return nil, nil
 	}
@@ -169,10 +277,31 @@ func (p Packager) addToStore(r *Result, info *EncryptedFileInfo) {
 		return
 	}
 
-	_, r.Error = p.store.Add(r.ID, info.File)
+	_, r.Error = p.store.Add(context.Background(), r.ID, info.File, info.Size, epub.ContentType_EPUB)
+}
 
-	info.File.Close()
-	os.Remove(info.File.Name())
+// removeTempFile closes and removes a temporary file
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// addMetadata stores the metadata document of the publication alongside the encrypted content
+func (p Packager) addMetadata(r *Result, ep epub.Epub) {
+	if r.Error != nil {
+		return
+	}
+
+	r.Error = StoreMetadata(context.Background(), p.store, r.ID, EPUBMetadata(ep))
+}
+
+// addThumbnails stores the cover thumbnails alongside the encrypted content
+func (p Packager) addThumbnails(r *Result, thumbnails []Thumbnail) {
+	if r.Error != nil {
+		return
+	}
+
+	r.Error = StoreThumbnails(context.Background(), p.store, r.ID, thumbnails)
 }
 
 func (p Packager) addToIndex(r *Result, key []byte, name string, info *EncryptedFileInfo, contentType string) {
@@ -189,11 +318,32 @@ func NewPackager(store storage.Store, idx index.Index, concurrency int) *Package
 		done:     make(chan struct{}),
 		store:    store,
 		idx:      idx,
+		workers:  &sync.WaitGroup{},
+		stop:     &sync.Once{},
 	}
 
+	packager.workers.Add(concurrency)
 	for i := 0; i < concurrency; i++ {
 		go packager.work()
 	}
 
 	return &packager
 }
+
+// Shutdown stops the workers of the packager once their current task is done.
+// It returns the error of ctx if the tasks are not done before ctx ends.
+// No task must be sent to the packager once it is shut down.
+func (p *Packager) Shutdown(ctx context.Context) error {
+	p.stop.Do(func() { close(p.done) })
+	stopped := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
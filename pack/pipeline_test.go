@@ -0,0 +1,100 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// blockingReader blocks reads until it is released, then fails them
+type blockingReader struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) ReadAt(p []byte, off int64) (int, error) {
+	select {
+	case r.started <- struct{}{}:
+	default:
+	}
+	<-r.release
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestPackagerShutdown(t *testing.T) {
+	packager := NewPackager(nil, nil, 2)
+	var source ManualSource
+	source.Feed(packager.Incoming)
+
+	body := &blockingReader{started: make(chan struct{}, 1), release: make(chan struct{})}
+	results := make(chan Result, 1)
+	go func() {
+		results <- source.Post(NewTask("blocked.epub", body, 100))
+	}()
+	<-body.started
+
+	// the task in progress is waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := packager.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the shutdown to time out while a task is in progress, got %v", err)
+	}
+
+	close(body.release)
+	if r := <-results; r.Error == nil {
+		t.Error("Expected the task to fail on an invalid publication")
+	}
+	if err := packager.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected the workers to stop, got %v", err)
+	}
+}
+
+// failingStore fails every addition
+type failingStore struct {
+	storage.Store
+}
+
+func (s failingStore) Add(ctx context.Context, key string, r io.Reader, size int64, contentType string) (storage.Item, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+func TestPackagerRemovesTempFile(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	f, err := os.Open("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packager := NewPackager(failingStore{}, nil, 1)
+	defer packager.Shutdown(context.Background())
+	var source ManualSource
+	source.Feed(packager.Incoming)
+
+	if r := source.Post(NewTask("sample.epub", f, fi.Size())); r.Error == nil {
+		t.Fatal("Expected the task to fail on a storage error")
+	}
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected the encrypted file to be removed, found %d files", len(entries))
+	}
+}
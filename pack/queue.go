@@ -0,0 +1,451 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/omani/readium-lcp-server/config"
+	"github.com/omani/readium-lcp-server/epub"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// ErrNoJob signals that no job is waiting in the queue
+var ErrNoJob = errors.New("No job in the queue")
+
+// ErrJobNotFound signals job not found
+var ErrJobNotFound = errors.New("Job not found")
+
+// ErrClaimLost signals that a job is no longer running on behalf of the worker which claimed it,
+// e.g. because it has been claimed again by another worker
+var ErrClaimLost = errors.New("Job claimed by another worker")
+
+// Job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// JobInputPrefix prefixes the storage key of the publications waiting to be encrypted by a worker
+const JobInputPrefix = "job-"
+
+// MaxJobAttempts is the number of times a job may be claimed before it is considered as failed.
+// A running job is claimed again by another worker if it hasn't been updated for StaleJobTimeout,
+// e.g. because the worker processing it has been stopped; a failed job is queued again.
+const MaxJobAttempts = 3
+
+// StaleJobTimeout is the delay after which a running job without progress is claimed again
+const StaleJobTimeout = 30 * time.Minute
+
+// heartbeatInterval is the delay between two updates of a running job, while it is processed
+const heartbeatInterval = StaleJobTimeout / 3
+
+// Job is an encryption task stored in a durable queue
+type Job struct {
+	ID string `json:"id"`
+	// Name is the file name of the publication
+	Name string `json:"name"`
+	// ContentID is the id of the encrypted publication, allocated when the job is queued
+	ContentID string `json:"content_id"`
+	Status    string `json:"status"`
+	// Stage is the last stage reported by the packager, see StageReading and al.
+	Stage    string    `json:"stage,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Worker   string    `json:"worker,omitempty"`
+	Attempts int       `json:"attempts"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Queue is a durable queue of encryption jobs, shared by the License server and the encryption workers
+type Queue interface {
+	Add(j Job) error
+	Get(id string) (Job, error)
+	// Claim assigns the oldest waiting job to a worker; it returns ErrNoJob if no job is waiting
+	Claim(worker string) (Job, error)
+	// Progress records the stage of a claimed job
+	Progress(j Job, stage string) error
+	// Heartbeat signals that a claimed job is still processed, so that it is not claimed again
+	Heartbeat(j Job) error
+	// Finish records the end of a claimed job. If err is not nil, the job is queued again,
+	// or failed once it has been claimed MaxJobAttempts times.
+	Finish(j Job, err error) error
+	// Release gives up a claimed job, e.g. when its worker stops; the job is queued again,
+	// and the attempt is not counted.
+	// Progress, Heartbeat, Finish and Release return ErrClaimLost if the job is no longer running on behalf of the worker.
+	Release(j Job) error
+}
+
+type dbQueue struct {
+	db        *sql.DB
+	get       *sql.Stmt
+	candidate *sql.Stmt
+}
+
+const jobColumns = "id,name,content_id,status,stage,error,worker,attempts,created,updated"
+
+func (q dbQueue) Add(j Job) error {
+	now := time.Now().UTC()
+	_, err := q.db.Exec("INSERT INTO job ("+jobColumns+") VALUES (?, ?, ?, ?, '', '', '', 0, ?, ?)",
+		j.ID, j.Name, j.ContentID, JobQueued, now, now)
+	return err
+}
+
+func (q dbQueue) Get(id string) (Job, error) {
+	records, err := q.get.Query(id)
+	if err != nil {
+		return Job{}, err
+	}
+	defer records.Close()
+	if records.Next() {
+		var j Job
+		err = records.Scan(&j.ID, &j.Name, &j.ContentID, &j.Status, &j.Stage, &j.Error, &j.Worker, &j.Attempts, &j.Created, &j.Updated)
+		return j, err
+	}
+
+	return Job{}, ErrJobNotFound
+}
+
+// Claim selects a candidate job, then tries to update it; the number of attempts is used as a version number,
+// so that two workers never claim the same job, without relying on row locks.
+func (q dbQueue) Claim(worker string) (Job, error) {
+	for {
+		now := time.Now().UTC()
+		var id string
+		var attempts int
+		err := q.candidate.QueryRow(JobQueued, JobRunning, now.Add(-StaleJobTimeout)).Scan(&id, &attempts)
+		if err == sql.ErrNoRows {
+			return Job{}, ErrNoJob
+		}
+		if err != nil {
+			return Job{}, err
+		}
+
+		var res sql.Result
+		if attempts >= MaxJobAttempts {
+			res, err = q.db.Exec("UPDATE job SET status=?, error=?, updated=? WHERE id=? AND attempts=?",
+				JobFailed, "abandoned after too many attempts", now, id, attempts)
+		} else {
+			res, err = q.db.Exec("UPDATE job SET status=?, stage='', worker=?, attempts=attempts+1, updated=? WHERE id=? AND attempts=?",
+				JobRunning, worker, now, id, attempts)
+		}
+		if err != nil {
+			return Job{}, err
+		}
+		claimed, err := res.RowsAffected()
+		if err != nil {
+			return Job{}, err
+		}
+		// another worker got the job first, or the job has been abandoned: try the next one
+		if claimed == 0 || attempts >= MaxJobAttempts {
+			continue
+		}
+		return q.Get(id)
+	}
+}
+
+func (q dbQueue) Progress(j Job, stage string) error {
+	return q.updateClaimed(j, "stage=?, updated=?", stage, time.Now().UTC())
+}
+
+func (q dbQueue) Heartbeat(j Job) error {
+	return q.updateClaimed(j, "updated=?", time.Now().UTC())
+}
+
+func (q dbQueue) Finish(j Job, jobErr error) error {
+	status, message := JobDone, ""
+	if jobErr != nil {
+		status, message = JobFailed, jobErr.Error()
+		if j.Attempts < MaxJobAttempts {
+			status = JobQueued
+		}
+	}
+	return q.updateClaimed(j, "status=?, error=?, updated=?", status, message, time.Now().UTC())
+}
+
+func (q dbQueue) Release(j Job) error {
+	return q.updateClaimed(j, "status=?, worker='', attempts=attempts-1, updated=?", JobQueued, time.Now().UTC())
+}
+
+// updateClaimed updates a job, as long as it is running on behalf of the worker which claimed it;
+// the number of attempts identifies the claim, as in Claim.
+func (q dbQueue) updateClaimed(j Job, set string, args ...interface{}) error {
+	args = append(args, j.ID, JobRunning, j.Worker, j.Attempts)
+	res, err := q.db.Exec("UPDATE job SET "+set+" WHERE id=? AND status=? AND worker=? AND attempts=?", args...)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+// OpenQueue opens the job queue stored in an SQL database
+func OpenQueue(db *sql.DB) (q Queue, err error) {
+	// if sqlite, create the job table in the lcp db if it does not exist
+	if strings.HasPrefix(config.Config.LcpServer.Database, "sqlite") {
+		_, err = db.Exec(jobTableDef)
+		if err != nil {
+			return
+		}
+	}
+
+	get, err := db.Prepare("SELECT " + jobColumns + " FROM job WHERE id = ? LIMIT 1")
+	if err != nil {
+		return
+	}
+	candidate, err := db.Prepare("SELECT id,attempts FROM job WHERE status = ? OR (status = ? AND updated < ?) ORDER BY created LIMIT 1")
+	if err != nil {
+		return
+	}
+	q = dbQueue{db, get, candidate}
+	return
+}
+
+const jobTableDef = "CREATE TABLE IF NOT EXISTS job (" +
+	"id varchar(255) PRIMARY KEY," +
+	"name text NOT NULL," +
+	"content_id varchar(255) NOT NULL," +
+	"status varchar(16) NOT NULL," +
+	"stage varchar(32) NOT NULL," +
+	"error text NOT NULL," +
+	"worker varchar(255) NOT NULL," +
+	"attempts int NOT NULL," +
+	"created datetime NOT NULL," +
+	"updated datetime NOT NULL)"
+
+// PostJob stores a publication in the storage and queues its encryption.
+// The content id of the encrypted publication is allocated at once.
+// The content type of the publication is EPUB if not set.
+func PostJob(ctx context.Context, q Queue, store storage.Store, name string, body io.Reader, size int64, contentType string) (Job, error) {
+	if contentType == "" {
+		contentType = epub.ContentType_EPUB
+	}
+	j := Job{ID: uuid.NewV4().String(), Name: name, ContentID: uuid.NewV4().String()}
+	if _, err := store.Add(ctx, JobInputPrefix+j.ID, body, size, contentType); err != nil {
+		return Job{}, err
+	}
+	if err := q.Add(j); err != nil {
+		store.Remove(ctx, JobInputPrefix+j.ID)
+		return Job{}, err
+	}
+	return q.Get(j.ID)
+}
+
+// QueueSource feeds a Packager with the jobs claimed in a durable queue
+type QueueSource struct {
+	queue             Queue
+	store             storage.Store
+	worker            string
+	concurrency       int
+	interval          time.Duration
+	heartbeatInterval time.Duration
+	// stop is closed to stop claiming jobs, pollers counts the running pollers
+	stop     chan struct{}
+	stopOnce sync.Once
+	pollers  sync.WaitGroup
+	// running holds the jobs in progress, by id
+	mu      sync.Mutex
+	running map[string]Job
+}
+
+// NewQueueSource creates a source claiming jobs on behalf of a worker.
+// concurrency should match the concurrency of the packager;
+// the queue is polled every interval when no job is waiting.
+func NewQueueSource(q Queue, store storage.Store, worker string, concurrency int, interval time.Duration) *QueueSource {
+	return &QueueSource{
+		queue:             q,
+		store:             store,
+		worker:            worker,
+		concurrency:       concurrency,
+		interval:          interval,
+		heartbeatInterval: heartbeatInterval,
+		stop:              make(chan struct{}),
+		running:           make(map[string]Job),
+	}
+}
+
+// Feed starts polling the queue
+func (s *QueueSource) Feed(ch chan<- *Task) {
+	s.pollers.Add(s.concurrency)
+	for i := 0; i < s.concurrency; i++ {
+		go s.poll(ch)
+	}
+}
+
+func (s *QueueSource) poll(ch chan<- *Task) {
+	defer s.pollers.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		job, err := s.queue.Claim(s.worker)
+		if err != nil {
+			if err != ErrNoJob {
+				log.Println("Error claiming a job: " + err.Error())
+			}
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(s.interval):
+			}
+			continue
+		}
+		if !s.start(job) {
+			// the source has been shut down while the job was claimed
+			s.release(job)
+			return
+		}
+		s.run(job, ch)
+		s.mu.Lock()
+		delete(s.running, job.ID)
+		s.mu.Unlock()
+	}
+}
+
+// start records a job in progress, unless the source has been shut down
+func (s *QueueSource) start(job Job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+	s.running[job.ID] = job
+	return true
+}
+
+func (s *QueueSource) release(job Job) {
+	if err := s.queue.Release(job); err != nil {
+		log.Println("Error releasing job " + job.ID + ": " + err.Error())
+		return
+	}
+	log.Println("Worker " + s.worker + " released job " + job.ID)
+}
+
+// Shutdown stops claiming jobs and waits for the jobs in progress.
+// If they are not done before ctx ends, they are released so that another worker can claim them at once,
+// and the error of ctx is returned.
+func (s *QueueSource) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.pollers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.running {
+		s.release(job)
+	}
+	return ctx.Err()
+}
+
+// run processes a job and records its result.
+// The input of the job is removed from the storage once encrypted; it is kept if the job failed,
+// for another attempt or for investigation.
+func (s *QueueSource) run(job Job, ch chan<- *Task) {
+	log.Println("Worker " + s.worker + " processing job " + job.ID + " (" + job.Name + ")")
+	jobErr := s.process(job, ch)
+	if jobErr != nil {
+		log.Println("Job " + job.ID + " failed: " + jobErr.Error())
+	}
+	if err := s.queue.Finish(job, jobErr); err != nil {
+		log.Println("Error recording the end of job " + job.ID + ": " + err.Error())
+		return
+	}
+	if jobErr != nil {
+		return
+	}
+	if err := s.store.Remove(context.Background(), JobInputPrefix+job.ID); err != nil {
+		log.Println("Error removing the input of job " + job.ID + ": " + err.Error())
+	}
+}
+
+// process copies the input of a job to a temporary file, then sends it to the packager
+func (s *QueueSource) process(job Job, ch chan<- *Task) error {
+	ctx := context.Background()
+	item, err := s.store.Get(ctx, JobInputPrefix+job.ID)
+	if err != nil {
+		return err
+	}
+	contents, err := item.Contents(ctx)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	f, err := ioutil.TempFile(os.TempDir(), "readium-lcp-job")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	size, err := io.Copy(f, contents)
+	if err != nil {
+		return err
+	}
+
+	t := NewTask(job.Name, f, size)
+	t.id = job.ContentID
+	t.progress = func(stage string) {
+		if err := s.queue.Progress(job, stage); err != nil {
+			log.Println("Error recording the progress of job " + job.ID + ": " + err.Error())
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.heartbeat(job, stop)
+	ch <- t
+	return t.Wait().Error
+}
+
+// heartbeat updates a running job until stop is closed, so that a long stage doesn't make it stale
+func (s *QueueSource) heartbeat(job Job, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.queue.Heartbeat(job); err != nil {
+				log.Println("Error updating job " + job.ID + ": " + err.Error())
+			}
+		}
+	}
+}
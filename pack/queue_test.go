@@ -0,0 +1,263 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/omani/readium-lcp-server/config"
+	"github.com/omani/readium-lcp-server/index"
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+func openTestQueue(t *testing.T, dir string) (*sql.DB, Queue) {
+	config.Config.LcpServer.Database = "sqlite3://file:" + filepath.Join(dir, "lcp.sqlite")
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "lcp.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := OpenQueue(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, q
+}
+
+func TestQueueClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, q := openTestQueue(t, dir)
+	defer db.Close()
+
+	if _, err = q.Claim("w1"); err != ErrNoJob {
+		t.Fatalf("Expected no job, got %v", err)
+	}
+	if err = q.Add(Job{ID: "j1", Name: "book.epub", ContentID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := q.Claim("w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != "j1" || j.Status != JobRunning || j.Worker != "w1" || j.Attempts != 1 {
+		t.Errorf("Unexpected claimed job %+v", j)
+	}
+	if _, err = q.Claim("w2"); err != ErrNoJob {
+		t.Errorf("Expected a running job not to be claimed twice, got %v", err)
+	}
+
+	first := j
+
+	// the first worker stopped reporting progress
+	if _, err = db.Exec("UPDATE job SET updated=? WHERE id=?", time.Now().UTC().Add(-2*StaleJobTimeout), "j1"); err != nil {
+		t.Fatal(err)
+	}
+	j, err = q.Claim("w2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Worker != "w2" || j.Attempts != 2 {
+		t.Errorf("Expected a stale job to be claimed again, got %+v", j)
+	}
+
+	// the first worker can't record anything once the job has been claimed again
+	if err = q.Progress(first, StageEncrypting); err != ErrClaimLost {
+		t.Errorf("Expected ErrClaimLost, got %v", err)
+	}
+	if err = q.Finish(first, nil); err != ErrClaimLost {
+		t.Errorf("Expected ErrClaimLost, got %v", err)
+	}
+
+	if err = q.Heartbeat(j); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Finish(j, ErrNoJob); err != nil {
+		t.Fatal(err)
+	}
+	j, err = q.Get("j1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != JobQueued || j.Error != ErrNoJob.Error() {
+		t.Errorf("Expected a failed job to be queued again, got %+v", j)
+	}
+
+	j, err = q.Claim("w3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Progress(j, StageEncrypting); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Finish(j, ErrNoJob); err != nil {
+		t.Fatal(err)
+	}
+	j, err = q.Get("j1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != JobFailed || j.Stage != StageEncrypting || j.Error != ErrNoJob.Error() || j.Attempts != MaxJobAttempts {
+		t.Errorf("Unexpected failed job %+v", j)
+	}
+	if err = q.Heartbeat(j); err != ErrClaimLost {
+		t.Errorf("Expected ErrClaimLost on a finished job, got %v", err)
+	}
+	if _, err = q.Get("unknown"); err != ErrJobNotFound {
+		t.Errorf("Expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestQueueSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, q := openTestQueue(t, dir)
+	defer db.Close()
+	idx, err := index.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewFileSystem(filepath.Join(dir, "files"), "http://localhost/files")
+
+	ctx := context.Background()
+	f, err := os.Open("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	job, err := PostJob(ctx, q, store, "sample.epub", f, storage.UnknownSize, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := PostJob(ctx, q, store, "bad.epub", strings.NewReader("not a zip file"), storage.UnknownSize, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packager := NewPackager(store, idx, 1)
+	source := NewQueueSource(q, store, "test", 1, 10*time.Millisecond)
+	source.heartbeatInterval = time.Millisecond
+	source.Feed(packager.Incoming)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for _, id := range []string{job.ID, bad.ID} {
+		for {
+			j, err := q.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j.Status == JobDone || j.Status == JobFailed {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Job %s not processed in time: %+v", id, j)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	job, _ = q.Get(job.ID)
+	if job.Status != JobDone || job.Stage != StageIndexing || job.Error != "" {
+		t.Errorf("Unexpected job %+v", job)
+	}
+	c, err := idx.Get(job.ContentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Location != "sample.epub" || c.Length == 0 || c.Sha256 == "" {
+		t.Errorf("Unexpected indexed content %+v", c)
+	}
+	if _, err = store.Get(ctx, job.ContentID); err != nil {
+		t.Errorf("Expected the encrypted publication to be stored, got %v", err)
+	}
+
+	bad, _ = q.Get(bad.ID)
+	if bad.Status != JobFailed || bad.Error == "" || bad.Attempts != MaxJobAttempts {
+		t.Errorf("Expected the job to fail, got %+v", bad)
+	}
+	if _, err = idx.Get(bad.ContentID); err != index.ErrNotFound {
+		t.Errorf("Expected a failed job not to be indexed, got %v", err)
+	}
+
+	if _, err = store.Get(ctx, JobInputPrefix+job.ID); err != storage.ErrNotFound {
+		t.Errorf("Expected the input of a done job to be removed, got %v", err)
+	}
+	input, err := store.Get(ctx, JobInputPrefix+bad.ID)
+	if err != nil {
+		t.Fatalf("Expected the input of a failed job to be kept, got %v", err)
+	}
+	if input.Stat().ContentType != "application/octet-stream" {
+		t.Errorf("Expected the content type of the request, got %s", input.Stat().ContentType)
+	}
+}
+
+func TestQueueSourceShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, q := openTestQueue(t, dir)
+	defer db.Close()
+	store := storage.NewFileSystem(filepath.Join(dir, "files"), "http://localhost/files")
+
+	// an idle source stops at once
+	idle := NewQueueSource(q, store, "idle", 2, time.Hour)
+	idle.Feed(make(chan *Task))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = idle.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected an idle source to stop, got %v", err)
+	}
+
+	job, err := PostJob(context.Background(), q, store, "book.epub", strings.NewReader("content"), 7, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody processes the tasks of this source
+	source := NewQueueSource(q, store, "busy", 1, 10*time.Millisecond)
+	source.Feed(make(chan *Task))
+	for {
+		j, err := q.Get(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == JobRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = source.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the shutdown to time out while a job is in progress, got %v", err)
+	}
+	j, err := q.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != JobQueued || j.Worker != "" || j.Attempts != 0 {
+		t.Errorf("Expected the job to be released, got %+v", j)
+	}
+	if _, err = store.Get(context.Background(), JobInputPrefix+job.ID); err != nil {
+		t.Errorf("Expected the input of a released job to be kept, got %v", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"text/template"
 
@@ -125,19 +126,42 @@ func (reader *RPFReader) Resources() []Resource {
 	return resources
 }
 
+// Cover returns the content of the resource whose rel is cover, nil if the package has no cover
+func (reader *RPFReader) Cover() ([]byte, error) {
+	link, err := reader.manifest.Cover()
+	if err != nil {
+		return nil, nil
+	}
+	for _, file := range reader.zipArchive.File {
+		if file.Name == link.Href {
+			rc, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+	}
+	return nil, nil
+}
+
 type rwpResource struct {
 	isEncrypted bool
 	contentType string
 	file        *zip.File
 }
 
-func (resource *rwpResource) Path() string                   { return resource.file.Name }
-func (resource *rwpResource) ContentType() string            { return resource.contentType }
-func (resource *rwpResource) Size() int64                    { return int64(resource.file.UncompressedSize64) }
-func (resource *rwpResource) Encrypted() bool                { return resource.isEncrypted }
-func (resource *rwpResource) Open() (io.ReadCloser, error)   { return resource.file.Open() }
-func (resource *rwpResource) CompressBeforeEncryption() bool { return false }
-func (resource *rwpResource) CanBeEncrypted() bool           { return true }
+func (resource *rwpResource) Path() string                 { return resource.file.Name }
+func (resource *rwpResource) ContentType() string          { return resource.contentType }
+func (resource *rwpResource) Size() int64                  { return int64(resource.file.UncompressedSize64) }
+func (resource *rwpResource) Encrypted() bool              { return resource.isEncrypted }
+func (resource *rwpResource) Open() (io.ReadCloser, error) { return resource.file.Open() }
+func (resource *rwpResource) CanBeEncrypted() bool         { return true }
+
+// CompressBeforeEncryption follows the same rules as for EPUB resources
+func (resource *rwpResource) CompressBeforeEncryption() bool {
+	return compressBeforeEncryption(resource.contentType)
+}
 
 func (resource *rwpResource) CopyTo(packageWriter PackageWriter) error {
 
@@ -186,40 +210,58 @@ func (writer *RPFWriter) NewFile(path string, contentType string, storageMethod
 	})
 
 	// add an entry to the writer reading order if missing
-	found := false
-	for _, resource := range writer.manifest.ReadingOrder {
-		if path == resource.Href {
-			found = true
-			break
-		}
-	}
-	if !found {
+	if writer.link(path) == nil {
 		writer.manifest.ReadingOrder = append(writer.manifest.ReadingOrder, rwpm.Link{Href: path, Type: contentType})
 	}
 
 	return &NopWriteCloser{w}, err
 }
 
-// MarkAsEncrypted marks a resource as encrypted (with an lcp profile and algorithm), in the writer manifest
-// FIXME: currently only looks into the reading order. Add "alternates", think about adding "resources"
-// FIXME: process resources which are compressed before encryption -> add Compression and OriginalLength properties in this case
-func (writer *RPFWriter) MarkAsEncrypted(path string, originalSize int64, profile license.EncryptionProfile, algorithm string) {
-
-	for i, resource := range writer.manifest.ReadingOrder {
-		if path == resource.Href {
-			// add encryption properties
-			if resource.Properties == nil {
-				writer.manifest.ReadingOrder[i].Properties = new(rwpm.Properties)
-			}
-			writer.manifest.ReadingOrder[i].Properties.Encrypted = &rwpm.Encrypted{
-				Scheme: "http://readium.org/2014/01/lcp",
-				// profile data is not useful and even misleading: the same encryption algorithm applies to basic and 1.0 profiles.
-				//Profile:   profile.String(),
-				Algorithm: algorithm,
-			}
+// link returns the link to a resource in the writer manifest, looked for in the reading order,
+// the resources and their alternates and children; nil if the resource is not listed
+func (writer *RPFWriter) link(path string) *rwpm.Link {
+	if link := searchLinks(writer.manifest.ReadingOrder, path); link != nil {
+		return link
+	}
+	return searchLinks(writer.manifest.Resources, path)
+}
 
-			break
+func searchLinks(links []rwpm.Link, path string) *rwpm.Link {
+	for i := range links {
+		if links[i].Href == path {
+			return &links[i]
+		}
+		if link := searchLinks(links[i].Alternate, path); link != nil {
+			return link
 		}
+		if link := searchLinks(links[i].Children, path); link != nil {
+			return link
+		}
+	}
+	return nil
+}
+
+// MarkAsEncrypted marks a resource as encrypted (with an lcp profile and algorithm), in the writer manifest
+func (writer *RPFWriter) MarkAsEncrypted(path string, originalSize int64, compressed bool, profile license.EncryptionProfile, algorithm string) {
+
+	resource := writer.link(path)
+	if resource == nil {
+		return
+	}
+	// add encryption properties
+	if resource.Properties == nil {
+		resource.Properties = new(rwpm.Properties)
+	}
+	resource.Properties.Encrypted = &rwpm.Encrypted{
+		Scheme: "http://readium.org/2014/01/lcp",
+		// profile data is not useful and even misleading: the same encryption algorithm applies to basic and 1.0 profiles.
+		//Profile:   profile.String(),
+		Algorithm: algorithm,
+	}
+	// declare to the reading software that the content is compressed before encryption
+	if compressed {
+		resource.Properties.Encrypted.Compression = "deflate"
+		resource.Properties.Encrypted.OriginalLength = int(originalSize)
 	}
 }
 
@@ -7,6 +7,7 @@ package pack
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"testing"
 	"time"
@@ -59,7 +60,7 @@ func TestWriteRPFackage(t *testing.T) {
 		t.Fatalf("Could not close file, %s", err)
 	}
 
-	writer.MarkAsEncrypted("test.pdf", 4, license.BasicProfile, "http://www.w3.org/2001/04/xmlenc#aes256-cbc")
+	writer.MarkAsEncrypted("test.pdf", 4, false, license.BasicProfile, "http://www.w3.org/2001/04/xmlenc#aes256-cbc")
 
 	err = writer.Close()
 	if err != nil {
@@ -105,6 +106,72 @@ func TestWriteRPFackage(t *testing.T) {
 	}
 }
 
+func TestMarkAsEncryptedOutsideReadingOrder(t *testing.T) {
+	var manifest rwpm.Publication
+	manifest.ReadingOrder = []rwpm.Link{{Href: "page.html", Type: "text/html", Alternate: []rwpm.Link{{Href: "page.txt", Type: "text/plain"}}}}
+	manifest.Resources = []rwpm.Link{{Href: "style.css", Type: "text/css"}}
+
+	var src bytes.Buffer
+	zw := zip.NewWriter(&src)
+	for _, name := range []string{"page.html", "page.txt", "style.css"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name))
+	}
+	w, err := zw.Create(ManifestLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.NewEncoder(w).Encode(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewRPFReader(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	writer, err := reader.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.MarkAsEncrypted("style.css", 100, true, license.BasicProfile, "http://www.w3.org/2001/04/xmlenc#aes256-cbc")
+	writer.MarkAsEncrypted("page.txt", 50, true, license.BasicProfile, "http://www.w3.org/2001/04/xmlenc#aes256-cbc")
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err = zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err = NewRPFReader(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(reader.manifest.ReadingOrder); l != 1 {
+		t.Errorf("Expected the reading order to be left untouched, got %d items", l)
+	}
+	for _, link := range []rwpm.Link{reader.manifest.Resources[0], reader.manifest.ReadingOrder[0].Alternate[0]} {
+		if link.Properties == nil || link.Properties.Encrypted == nil {
+			t.Errorf("Expected %s to be marked as encrypted", link.Href)
+			continue
+		}
+		if link.Properties.Encrypted.Compression != "deflate" || link.Properties.Encrypted.OriginalLength == 0 {
+			t.Errorf("Expected %s to be marked as compressed, got %+v", link.Href, link.Properties.Encrypted)
+		}
+	}
+}
+
 func TestRWPM(t *testing.T) {
 	var manifest rwpm.Publication
 
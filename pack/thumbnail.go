@@ -0,0 +1,151 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	"github.com/omani/readium-lcp-server/storage"
+)
+
+// ContentType_JPEG is the media type of the cover thumbnails
+const ContentType_JPEG = "image/jpeg"
+
+// ThumbnailSizes are the sizes, in pixels, of the boxes in which cover thumbnails are generated
+var ThumbnailSizes = []int{100, 200, 400}
+
+// Thumbnail is a resized cover, encoded in JPEG, which fits in a box of Size x Size pixels
+type Thumbnail struct {
+	Size int    `json:"size"`
+	Data []byte `json:"data"`
+}
+
+// ThumbnailKey returns the storage key of a cover thumbnail of a content
+func ThumbnailKey(contentID string, size int) string {
+	return storage.DerivedKey(contentID, fmt.Sprintf("cover-%d.jpg", size))
+}
+
+// ThumbnailSize returns the smallest thumbnail size which is at least the requested size,
+// or the largest one if the request exceeds every size
+func ThumbnailSize(requested int) int {
+	for _, size := range ThumbnailSizes {
+		if size >= requested {
+			return size
+		}
+	}
+	return ThumbnailSizes[len(ThumbnailSizes)-1]
+}
+
+// coverReader is implemented by the package readers which can locate the cover of their publication
+type coverReader interface {
+	Cover() ([]byte, error)
+}
+
+// CoverThumbnails generates the thumbnails of the cover of a publication, before its encryption.
+// No thumbnail is returned if the package has no cover.
+func CoverThumbnails(reader PackageReader) ([]Thumbnail, error) {
+	cr, ok := reader.(coverReader)
+	if !ok {
+		return nil, nil
+	}
+	cover, err := cr.Cover()
+	if err != nil || cover == nil {
+		return nil, err
+	}
+	return MakeThumbnails(bytes.NewReader(cover))
+}
+
+// MakeThumbnails decodes a cover image (jpeg, png or gif) and resizes it into every thumbnail size.
+// Images are never enlarged; transparent areas are rendered in white.
+func MakeThumbnails(cover io.Reader) ([]Thumbnail, error) {
+	src, _, err := image.Decode(cover)
+	if err != nil {
+		return nil, err
+	}
+
+	// flatten the image on a white background, in a format whose pixels can be read directly
+	b := src.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, b.Min, draw.Over)
+
+	var thumbnails []Thumbnail
+	for _, size := range ThumbnailSizes {
+		width, height := fitIn(b.Dx(), b.Dy(), size)
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, resize(flat, width, height), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		thumbnails = append(thumbnails, Thumbnail{Size: size, Data: buf.Bytes()})
+	}
+	return thumbnails, nil
+}
+
+// fitIn returns the dimensions of an image scaled down to fit in a box of size x size pixels
+func fitIn(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// resize scales an image down by averaging the source pixels covered by every target pixel
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if width == sw && height == sh {
+		copy(dst.Pix, src.Pix)
+		return dst
+	}
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, max((y+1)*sh/height, y*sh/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, max((x+1)*sw/width, x*sw/width+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			o := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[o+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// StoreThumbnails stores the cover thumbnails of a content
+func StoreThumbnails(ctx context.Context, store storage.Store, contentID string, thumbnails []Thumbnail) error {
+	for _, t := range thumbnails {
+		if _, err := store.Add(ctx, ThumbnailKey(contentID, t.Size), bytes.NewReader(t.Data), int64(len(t.Data)), ContentType_JPEG); err != nil {
+			return err
+		}
+	}
+	return nil
+}
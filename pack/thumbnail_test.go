@@ -0,0 +1,131 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package pack
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omani/readium-lcp-server/crypto"
+)
+
+func TestMakeThumbnails(t *testing.T) {
+	thumbnails, err := MakeThumbnails(bytes.NewReader(pngImage(t, 300, 600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thumbnails) != len(ThumbnailSizes) {
+		t.Fatalf("Expected %d thumbnails, got %d", len(ThumbnailSizes), len(thumbnails))
+	}
+	// the largest size would enlarge the image
+	expected := []image.Point{{50, 100}, {100, 200}, {200, 400}}
+	for i, th := range thumbnails {
+		config, err := jpeg.DecodeConfig(bytes.NewReader(th.Data))
+		if err != nil {
+			t.Fatalf("Invalid thumbnail %d, %s", th.Size, err)
+		}
+		if th.Size != ThumbnailSizes[i] || config.Width != expected[i].X || config.Height != expected[i].Y {
+			t.Errorf("Unexpected thumbnail %d: %dx%d", th.Size, config.Width, config.Height)
+		}
+	}
+
+	thumbnails, err = MakeThumbnails(bytes.NewReader(pngImage(t, 150, 120)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := jpeg.DecodeConfig(bytes.NewReader(thumbnails[2].Data))
+	if config.Width != 150 || config.Height != 120 {
+		t.Errorf("Expected a small image not to be enlarged, got %dx%d", config.Width, config.Height)
+	}
+
+	if _, err = MakeThumbnails(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Error("Expected an error for an invalid image")
+	}
+}
+
+func TestThumbnailSize(t *testing.T) {
+	for requested, expected := range map[int]int{1: 100, 100: 100, 150: 200, 400: 400, 1000: 400} {
+		if size := ThumbnailSize(requested); size != expected {
+			t.Errorf("ThumbnailSize(%d): expected %d, got %d", requested, expected, size)
+		}
+	}
+}
+
+func TestEPUBCoverThumbnails(t *testing.T) {
+	reader, err := OpenEPUB("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnails, err := CoverThumbnails(reader)
+	if err != nil || len(thumbnails) != len(ThumbnailSizes) {
+		t.Fatalf("Expected cover thumbnails, got %d, %v", len(thumbnails), err)
+	}
+
+	// the cover must still be copied into the encrypted package
+	var b bytes.Buffer
+	if _, _, err = Do(crypto.NewAESEncrypter_PUBLICATION_RESOURCES(), reader.Epub(), &b); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := NewEPUBReader(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover, err := encrypted.Cover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = image.DecodeConfig(bytes.NewReader(cover)); err != nil {
+		t.Errorf("Expected the cover to be copied in clear, %s", err)
+	}
+
+	// a package without cover has no thumbnail
+	reader, err = OpenEPUB("../test/samples/lorem.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbnails, err = CoverThumbnails(reader); err != nil || thumbnails != nil {
+		t.Errorf("Expected no thumbnail, got %d, %v", len(thumbnails), err)
+	}
+}
+
+func TestRPFCoverThumbnails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first page of a Divina publication is its cover
+	pages := filepath.Join(dir, "pages")
+	os.Mkdir(pages, 0755)
+	ioutil.WriteFile(filepath.Join(pages, "1.png"), pngImage(t, 800, 400), 0644)
+	ioutil.WriteFile(filepath.Join(pages, "2.png"), pngImage(t, 10, 10), 0644)
+	output := filepath.Join(dir, "test.divina")
+	if err = BuildDivina(pages, output); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenRPF(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnails, err := CoverThumbnails(reader)
+	if err != nil || len(thumbnails) != len(ThumbnailSizes) {
+		t.Fatalf("Expected cover thumbnails, got %d, %v", len(thumbnails), err)
+	}
+	config, _ := jpeg.DecodeConfig(bytes.NewReader(thumbnails[0].Data))
+	if config.Width != 100 || config.Height != 50 {
+		t.Errorf("Unexpected thumbnail %dx%d", config.Width, config.Height)
+	}
+}
@@ -141,8 +141,8 @@ func generateRWPManifest(w3cman rwpm.W3CPublication) (manifest rwpm.Publication)
 	manifest.Context = []string{"https://readium.org/webpub-manifest/context.jsonld"}
 
 	if w3cman.ConformsTo == "https://www.w3.org/TR/audiobooks/" {
-		manifest.Metadata.Type = "https://schema.org/Audiobook"
-		manifest.Metadata.ConformsTo = "https://readium.org/webpub-manifest/profiles/audiobook"
+		manifest.Metadata.Type = AudiobookType
+		manifest.Metadata.ConformsTo = AudiobookConformsTo
 	} else {
 		manifest.Metadata.Type = "https://schema.org/CreativeWork"
 	}
@@ -191,8 +191,6 @@ func generateRWPManifest(w3cman rwpm.W3CPublication) (manifest rwpm.Publication)
 	manifest.ReadingOrder = mapLinks(w3cman.ReadingOrder)
 	manifest.Resources = mapLinks(w3cman.Resources)
 
-	// FIXME: add to the Readium manifest the ToC from index.html
-
 	return
 }
 
@@ -209,7 +207,9 @@ func BuildRPFFromLPF(lpfPath string, rwppPath string) error {
 	// extract the W3C manifest from the LPF
 	var w3cManifest rwpm.W3CPublication
 	found := false
+	files := map[string]sourceFile{}
 	for _, file := range lpfFile.File {
+		files[file.Name] = sourceFile{name: file.Name, open: file.Open}
 		if file.Name == W3CManifestName {
 			m, err := file.Open()
 			if err != nil {
@@ -229,12 +229,13 @@ func BuildRPFFromLPF(lpfPath string, rwppPath string) error {
 		return fmt.Errorf("W3C LPF %s: missing publication.json", lpfPath)
 	}
 
-	// extract the primary entry page from the LPF
-	// FIXME: extract the primary entry page from the LPF
-
 	// generate a Readium manifest out of the W3C manifest
-	// and primary entry page
+	// and the table of contents of the primary entry page
 	rwpManifest := generateRWPManifest(w3cManifest)
+	rwpManifest.TOC, err = entryPageTOC(w3cManifest, files)
+	if err != nil {
+		return err
+	}
 
 	// marshal the Readium manifest
 	rwpJSON, err := json.MarshalIndent(rwpManifest, "", " ")
@@ -37,9 +37,8 @@ import (
 	"runtime/debug"
 	"strings"
 
-	"github.com/technoweenie/grohl"
-
 	"github.com/omani/readium-lcp-server/localization"
+	"github.com/omani/readium-lcp-server/logging"
 )
 
 const (
@@ -54,6 +53,8 @@ type Problem struct {
 	Detail   string `json:"detail,omitempty"`
 	Instance string `json:"instance,omitempty"`
 	//Additional members
+	// RequestID identifies the request which caused the problem, and correlates it with the logs
+	RequestID string `json:"request_id,omitempty"`
 }
 
 const ERROR_BASE_URL = "http://readium.org/license-status-document/error/"
@@ -75,6 +76,7 @@ func Error(w http.ResponseWriter, r *http.Request, problem Problem, status int)
 	w.WriteHeader(status)
 
 	problem.Status = status
+	problem.RequestID = logging.RequestID(r.Context())
 
 	if problem.Type == "about:blank" || problem.Type == "" { // lookup Title  statusText should match http status
 		localization.LocalizeMessage(acceptLanguages, &problem.Title, http.StatusText(status))
@@ -91,7 +93,12 @@ func Error(w http.ResponseWriter, r *http.Request, problem Problem, status int)
 	// debug only
 	//PrintStack()
 
-	log.Print(string(jsonError))
+	level := logging.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = logging.LevelError
+	}
+	logging.FromContext(r.Context()).Log(level, "problem", "method", r.Method, "path", r.URL.Path,
+		"status", status, "title", problem.Title, "detail", problem.Detail)
 }
 
 func PrintStack() {
@@ -113,23 +120,14 @@ func PrintStack() {
 }
 
 func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
-	grohl.Log(grohl.Data{"method": r.Method, "path": r.URL.Path, "status": "404"})
 	Error(w, r, Problem{}, http.StatusNotFound)
 }
 
 func PanicReport(err interface{}) {
 	switch t := err.(type) {
 	case error:
-		errorr, found := err.(error)
-		if found { // should always be true
-			grohl.Log(grohl.Data{"panic recovery (error)": errorr.Error()})
-		}
-	case string:
-		errorr, found := err.(string)
-		if found { // should always be true
-			grohl.Log(grohl.Data{"panic recovery (string)": errorr})
-		}
+		logging.Error("panic recovery", "error", t)
 	default:
-		grohl.Log(grohl.Data{"panic recovery (other type)": t})
+		logging.Error("panic recovery", "error", fmt.Sprint(t))
 	}
 }
@@ -0,0 +1,33 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/omani/readium-lcp-server/logging"
+)
+
+func TestErrorRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/contents/c1", nil)
+	r = r.WithContext(logging.WithRequestID(r.Context(), "req-1"))
+	w := httptest.NewRecorder()
+
+	Error(w, r, Problem{Detail: "not found", Instance: "c1"}, http.StatusNotFound)
+
+	var p Problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Instance != "c1" {
+		t.Errorf("Expected the instance to be kept, got %q", p.Instance)
+	}
+	if p.RequestID != "req-1" || p.Status != http.StatusNotFound {
+		t.Errorf("Unexpected problem %+v", p)
+	}
+}
@@ -15,6 +15,7 @@ type Metadata struct {
 	Type               string        `json:"@type,omitempty"`
 	ConformsTo         string        `json:"conformsTo,omitempty"`
 	Identifier         string        `json:"identifier,omitempty"`
+	AltIdentifier      []string      `json:"altIdentifier,omitempty"`
 	Title              MultiLanguage `json:"title"`
 	Subtitle           MultiLanguage `json:"subtitle,omitempty"`
 	SortAs             string        `json:"sortAs,omitempty"`
@@ -8,38 +8,171 @@ package sign
 import (
 	"bytes"
 	"encoding/json"
-	"io"
-	"strings"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
+// Canon returns the canonical form of a json document, as required for license signatures.
+// The value is marshaled, then serialized following the rules of the LCP specification,
+// which are those of the JSON Canonicalization Scheme (RFC 8785):
+// no whitespace, object properties sorted by their UTF-16 code units,
+// strings in UTF-8 with the minimal escaping, numbers in their ECMAScript representation.
 func Canon(in interface{}) ([]byte, error) {
-	// the easiest way to canonicalize is to marshal it and reify it as a map
-	// which will sort stuff correctly
-	b, err1 := json.Marshal(in)
-	if err1 != nil {
-		return b, err1
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
 	}
 
-	var jsonObj interface{} // map[string]interface{} ==> auto sorting
-
-	dec := json.NewDecoder(strings.NewReader(string(b)))
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// keep numbers as written, they are converted by the canonical encoder
 	dec.UseNumber()
-	for {
-		if err2 := dec.Decode(&jsonObj); err2 == io.EOF {
-			break
-		} else if err2 != nil {
-			return nil, err2
-		}
+	if err = dec.Decode(&doc); err != nil {
+		return nil, err
 	}
+
 	var buf bytes.Buffer
-	enc := json.NewEncoder(&buf)
-	// do not escape characters
-	enc.SetEscapeHTML(false)
-	err := enc.Encode(jsonObj)
-	if err != nil {
+	if err = writeCanonical(&buf, doc); err != nil {
 		return nil, err
 	}
-	// remove the trailing newline, added by encode
-	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		n, err := canonicalNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(n)
+	case string:
+		writeCanonicalString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return errors.New("canon: unexpected json value")
+	}
+	return nil
+}
 
+// lessUTF16 compares strings by their UTF-16 code units, which differs from the order of their
+// UTF-8 bytes for characters above U+FFFF compared to characters between U+E000 and U+FFFF
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeCanonicalString escapes the quotation mark, the reverse solidus and control characters only,
+// with their short form if there is one. Other characters, non-ASCII ones included, are written as is.
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			// json.Marshal replaces invalid UTF-8, this is only a safeguard
+			if r == utf8.RuneError && size == 1 {
+				buf.WriteString("\ufffd")
+			} else {
+				buf.WriteString(s[i : i+size])
+			}
+			i += size
+			continue
+		}
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[c>>4])
+				buf.WriteByte(hexDigits[c&0xF])
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+		i++
+	}
+	buf.WriteByte('"')
+}
+
+// canonicalNumber returns the ECMAScript representation of a number (Number.prototype.toString):
+// the shortest decimal which converts back to the same IEEE 754 double,
+// without exponent between 1e-6 (included) and 1e21 (excluded)
+func canonicalNumber(n json.Number) (string, error) {
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return "", errors.New("canon: number out of range: " + string(n))
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", errors.New("canon: invalid number: " + string(n))
+	}
+	// also covers negative zero
+	if f == 0 {
+		return "0", nil
+	}
+	if abs := math.Abs(f); abs < 1e-6 || abs >= 1e21 {
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		// Go writes at least two exponent digits (1e-07), ECMAScript does not (1e-7)
+		if i := len(s) - 2; s[i] == '0' && (s[i-1] == '-' || s[i-1] == '+') {
+			s = s[:i] + s[i+1:]
+		}
+		return s, nil
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
 }
@@ -27,6 +27,10 @@ package sign
 
 import (
 	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -77,3 +81,65 @@ func TestCanonInnerStruct(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, out)
 	}
 }
+
+// TestCanonCorpus checks the canonical form of the json documents of testdata/canon (.json)
+// against their expected canonical form (.canon), byte for byte.
+// The corpus holds the examples of RFC 8785, number and string edge cases and LCP licenses.
+func TestCanonCorpus(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/canon/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("Empty canonicalization corpus")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		in, err := ioutil.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := ioutil.ReadFile(strings.TrimSuffix(input, ".json") + ".canon")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := Canon(json.RawMessage(in))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("%s:\nexpected %s\ngot      %s", name, expected, out)
+		}
+		// the canonical form is stable
+		again, err := Canon(json.RawMessage(out))
+		if err != nil || !bytes.Equal(again, out) {
+			t.Errorf("%s: the canonical form should not change when canonicalized again, got %s", name, again)
+		}
+	}
+}
+
+func TestCanonGoValues(t *testing.T) {
+	input := struct {
+		Name  string  `json:"name"`
+		Hint  string  `json:"hint"`
+		Ratio float64 `json:"ratio"`
+		Print int32   `json:"print"`
+	}{"Ren\u00e9e <L\u00e9v\u00eaque> & co\u2028", "\b\f\x01", 1e-7, 10}
+
+	expected := "{\"hint\":\"\\b\\f\\u0001\",\"name\":\"Ren\u00e9e <L\u00e9v\u00eaque> & co\u2028\",\"print\":10,\"ratio\":1e-7}"
+	out, err := Canon(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestCanonInvalidNumber(t *testing.T) {
+	if _, err := Canon(json.RawMessage(`{"length":1e400}`)); err == nil {
+		t.Error("Expected an error for a number out of the range of doubles")
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omani/readium-lcp-server/config"
+)
+
+// Selection policies of the certificate which signs licenses
+const (
+	// SelectNewest selects the currently valid certificate issued last, so that licenses move
+	// to a new certificate as soon as it becomes valid
+	SelectNewest = "newest"
+	// SelectFirst selects the main certificate of the configuration
+	SelectFirst = "first"
+)
+
+// CertificateInfo describes a provider certificate, e.g. to monitor its expiry
+type CertificateInfo struct {
+	Subject       string    `json:"subject"`
+	Issuer        string    `json:"issuer"`
+	SerialNumber  string    `json:"serial_number"`
+	Fingerprint   string    `json:"sha256_fingerprint"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	ExpiresInDays int       `json:"expires_in_days"`
+	File          string    `json:"file"`
+	Provider      string    `json:"provider"`
+	Signing       bool      `json:"signing"`
+}
+
+type certificateEntry struct {
+	cert *tls.Certificate
+	conf config.Certificate
+}
+
+// Certificates holds the provider certificates of a server, which may be reloaded without restart.
+// The main certificate and the additional certificates of the configuration are all active;
+// the selection policy chooses the one which signs licenses.
+type Certificates struct {
+	mu sync.RWMutex
+	// reloading serializes the reloads, e.g. on SIGHUP while the files are watched
+	reloading sync.Mutex
+	load      func() (config.Certificate, error)
+	files     []string
+	entries   []certificateEntry
+	verifier  *Verifier
+	policy    string
+	interval  time.Duration
+	modTimes  map[string]time.Time
+	now       func() time.Time
+}
+
+// NewCertificates loads the certificates of the configuration returned by load.
+// Files are additional files watched for changes, e.g. the configuration file.
+func NewCertificates(load func() (config.Certificate, error), files ...string) (*Certificates, error) {
+	c := &Certificates{load: load, files: files, now: time.Now}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the configuration, the certificates and the verifier (provider CA and CRLs) again.
+// On error, the current certificates are kept.
+func (c *Certificates) Reload() error {
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+
+	conf, err := c.load()
+	if err != nil {
+		return err
+	}
+	switch conf.Selection {
+	case "":
+		conf.Selection = SelectNewest
+	case SelectNewest, SelectFirst:
+	default:
+		return errors.New("unknown certificate selection policy " + conf.Selection)
+	}
+
+	// the modification times are taken before loading, so that a change during the load triggers a new reload
+	modTimes := c.modificationTimes(conf)
+	var entries []certificateEntry
+	for _, cc := range append([]config.Certificate{conf}, conf.Certificates...) {
+		cert, err := c.loadCertificate(cc)
+		if err == nil && cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err != nil {
+			closeSigners(entries, c.entries)
+			return errors.New(cc.Cert + ": " + err.Error())
+		}
+		entries = append(entries, certificateEntry{cert: cert, conf: cc})
+	}
+	verifier, err := LoadVerifier(conf.CA, conf.CRL)
+	if err != nil {
+		closeSigners(entries, c.entries)
+		return err
+	}
+
+	c.mu.Lock()
+	previous := c.entries
+	c.entries = entries
+	c.verifier = verifier
+	c.policy = conf.Selection
+	c.modTimes = modTimes
+	switch {
+	case conf.ReloadInterval < 0:
+		c.interval = 0
+	case conf.ReloadInterval == 0:
+		c.interval = time.Minute
+	default:
+		c.interval = time.Duration(conf.ReloadInterval) * time.Second
+	}
+	c.mu.Unlock()
+
+	// release the token sessions of the replaced keys
+	closeSigners(previous, entries)
+	return nil
+}
+
+// loadCertificate loads a certificate of the configuration.
+// The key held by a token or a remote service is reused if its configuration and its public key are unchanged,
+// so that a reload doesn't open a new session on the token.
+func (c *Certificates) loadCertificate(cc config.Certificate) (*tls.Certificate, error) {
+	if cc.Provider != ProviderPKCS11 && cc.Provider != ProviderRemote {
+		return LoadCertificate(cc)
+	}
+	c.mu.RLock()
+	var signer crypto.Signer
+	for _, e := range c.entries {
+		if e.conf.Provider == cc.Provider && e.conf.PKCS11 == cc.PKCS11 && e.conf.Remote == cc.Remote {
+			signer, _ = e.cert.PrivateKey.(crypto.Signer)
+			break
+		}
+	}
+	c.mu.RUnlock()
+	if signer == nil {
+		return LoadCertificate(cc)
+	}
+	cert, err := loadCertificateChain(cc.Cert)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := cert.Leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(signer.Public()) {
+		// the certificate was issued for another key of the token
+		return LoadCertificate(cc)
+	}
+	cert.PrivateKey = signer
+	if err = CheckKey(cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// closeSigners closes the keys of entries which are not used by the kept entries, e.g. to close a token session
+func closeSigners(entries, kept []certificateEntry) {
+	for _, e := range entries {
+		closer, ok := e.cert.PrivateKey.(io.Closer)
+		if !ok || usesKey(kept, e.cert.PrivateKey) {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			log.Println("Error closing the key of " + e.conf.Cert + ": " + err.Error())
+		}
+	}
+}
+
+func usesKey(entries []certificateEntry, key crypto.PrivateKey) bool {
+	for _, e := range entries {
+		if e.cert.PrivateKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Certificates) modificationTimes(conf config.Certificate) map[string]time.Time {
+	files := append(append([]string{conf.CA}, conf.CRL...), c.files...)
+	for _, cc := range append([]config.Certificate{conf}, conf.Certificates...) {
+		files = append(files, cc.Cert, cc.PrivateKey)
+	}
+	modTimes := make(map[string]time.Time)
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil {
+			modTimes[f] = fi.ModTime()
+		} else {
+			modTimes[f] = time.Time{}
+		}
+	}
+	return modTimes
+}
+
+// Changed tells if a certificate, key or watched file has changed since the last reload
+func (c *Certificates) Changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for f, t := range c.modTimes {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// a file being replaced may be missing for a moment
+			continue
+		}
+		if !fi.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificates when their files change, until stop is closed.
+// The interval between two checks is given by the configuration.
+func (c *Certificates) Watch(stop <-chan struct{}) {
+	for {
+		c.mu.RLock()
+		interval := c.interval
+		c.mu.RUnlock()
+		if interval == 0 {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if c.Changed() {
+			if err := c.Reload(); err != nil {
+				log.Println("Certificates not reloaded:", err)
+			} else {
+				log.Println("Certificates reloaded")
+			}
+		}
+	}
+}
+
+// Verifier returns the verifier of licenses, built from the provider CA chain and revocation lists
+func (c *Certificates) Verifier() *Verifier {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.verifier
+}
+
+// Current returns the certificate which signs licenses
+func (c *Certificates) Current() *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries[c.current()].cert
+}
+
+// current returns the index of the selected certificate; the caller must hold the lock
+func (c *Certificates) current() int {
+	selected := 0
+	if c.policy == SelectNewest {
+		now := c.now()
+		newest := -1
+		for i, e := range c.entries {
+			leaf := e.cert.Leaf
+			if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+				continue
+			}
+			if newest < 0 || leaf.NotBefore.After(c.entries[newest].cert.Leaf.NotBefore) {
+				newest = i
+			}
+		}
+		// if no certificate is valid, the main one is used
+		if newest >= 0 {
+			selected = newest
+		}
+	}
+	return selected
+}
+
+// Check returns an error if the certificate which signs licenses is not valid at the current time
+func (c *Certificates) Check() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	leaf := c.entries[c.current()].cert.Leaf
+	now := c.now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("the signing certificate %s is not valid before %s", leaf.Subject, leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("the signing certificate %s expired on %s", leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Info describes the active certificates
+func (c *Certificates) Info() []CertificateInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := c.now()
+	current := c.current()
+	infos := make([]CertificateInfo, len(c.entries))
+	for i, e := range c.entries {
+		leaf := e.cert.Leaf
+		fingerprint := sha256.Sum256(leaf.Raw)
+		provider := e.conf.Provider
+		if provider == "" {
+			provider = ProviderFile
+		}
+		infos[i] = CertificateInfo{
+			Subject:       leaf.Subject.String(),
+			Issuer:        leaf.Issuer.String(),
+			SerialNumber:  leaf.SerialNumber.String(),
+			Fingerprint:   hex.EncodeToString(fingerprint[:]),
+			NotBefore:     leaf.NotBefore,
+			NotAfter:      leaf.NotAfter,
+			ExpiresInDays: int(leaf.NotAfter.Sub(now).Hours() / 24),
+			File:          e.conf.Cert,
+			Provider:      provider,
+			Signing:       i == current,
+		}
+	}
+	return infos
+}
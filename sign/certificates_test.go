@@ -0,0 +1,246 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omani/readium-lcp-server/config"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key in dir, and returns their configuration
+func writeTestCertificate(t *testing.T, dir, name string, notBefore, notAfter time.Time) config.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(notBefore.Unix()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.Certificate{Cert: filepath.Join(dir, name+".crt"), PrivateKey: filepath.Join(dir, name+".pem")}
+	if err = ioutil.WriteFile(c.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(c.PrivateKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCertificatesSelection(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := writeTestCertificate(t, dir, "old", now.AddDate(-2, 0, 0), now.AddDate(0, 1, 0))
+	next := writeTestCertificate(t, dir, "new", now.AddDate(0, 0, -1), now.AddDate(2, 0, 0))
+	future := writeTestCertificate(t, dir, "future", now.AddDate(0, 0, 1), now.AddDate(3, 0, 0))
+
+	conf := old
+	conf.Certificates = []config.Certificate{next, future}
+	certs, err := NewCertificates(func() (config.Certificate, error) { return conf, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.now = func() time.Time { return now }
+
+	// the newest valid certificate signs licenses, a certificate not yet valid is not selected
+	if cn := certs.Current().Leaf.Subject.CommonName; cn != "new" {
+		t.Errorf("Expected the new certificate, got %s", cn)
+	}
+	info := certs.Info()
+	if len(info) != 3 {
+		t.Fatalf("Expected 3 certificates, got %d", len(info))
+	}
+	if !info[1].Signing || info[0].Signing || info[2].Signing {
+		t.Error("Expected the new certificate only to be flagged as signing")
+	}
+	if info[0].ExpiresInDays != 30 {
+		t.Errorf("Expected the old certificate to expire in 30 days, got %d", info[0].ExpiresInDays)
+	}
+	if info[0].Provider != ProviderFile || info[0].File != old.Cert {
+		t.Errorf("Unexpected description of the old certificate: %+v", info[0])
+	}
+
+	conf.Selection = SelectFirst
+	if err = certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := certs.Current().Leaf.Subject.CommonName; cn != "old" {
+		t.Errorf("Expected the main certificate, got %s", cn)
+	}
+
+	conf.Selection = "random"
+	if err = certs.Reload(); err == nil {
+		t.Error("Expected an error for an unknown selection policy")
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	conf := writeTestCertificate(t, dir, "first", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0))
+	var loadErr error
+	certs, err := NewCertificates(func() (config.Certificate, error) { return conf, loadErr })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs.Changed() {
+		t.Error("Expected no change after a reload")
+	}
+
+	// the certificate and key files are replaced in place
+	replaced := writeTestCertificate(t, dir, "first", now.AddDate(0, 0, -1), now.AddDate(2, 0, 0))
+	later := now.Add(time.Minute)
+	os.Chtimes(replaced.Cert, later, later)
+	os.Chtimes(replaced.PrivateKey, later, later)
+	if !certs.Changed() {
+		t.Fatal("Expected a change of the certificate files")
+	}
+	if err = certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !certs.Current().Leaf.NotAfter.Equal(now.AddDate(2, 0, 0).Truncate(time.Second)) {
+		t.Errorf("Expected the replaced certificate, got one expiring on %s", certs.Current().Leaf.NotAfter)
+	}
+
+	// on error, the current certificates are kept
+	current := certs.Current()
+	loadErr = errors.New("invalid configuration")
+	if err = certs.Reload(); err == nil {
+		t.Error("Expected a reload error")
+	}
+	loadErr = nil
+	conf.PrivateKey = filepath.Join(dir, "missing.pem")
+	if err = certs.Reload(); err == nil {
+		t.Error("Expected an error for a missing key")
+	}
+	if certs.Current() != current {
+		t.Error("Expected the current certificate to be kept after a failed reload")
+	}
+}
+
+func TestCertificatesCheck(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	conf := writeTestCertificate(t, dir, "main", now.AddDate(-1, 0, 0), now.AddDate(0, 1, 0))
+	certs, err := NewCertificates(func() (config.Certificate, error) { return conf, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.now = func() time.Time { return now }
+	if err = certs.Check(); err != nil {
+		t.Errorf("Expected a valid certificate, got %v", err)
+	}
+	certs.now = func() time.Time { return now.AddDate(0, 2, 0) }
+	if err = certs.Check(); err == nil {
+		t.Error("Expected an error for an expired certificate")
+	}
+}
+
+// closingSigner records that its session was closed
+type closingSigner struct {
+	crypto.Signer
+	closed bool
+}
+
+func (s *closingSigner) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestCertificatesReloadSigners(t *testing.T) {
+	cert, _ := loadSample(t, "ecdsa")
+	service := httptest.NewServer(RemoteSigningHandler("lcp", cert.PrivateKey.(crypto.Signer)))
+	defer service.Close()
+
+	conf := config.Certificate{Cert: "cert/sample_ecdsa.crt", Provider: ProviderRemote}
+	conf.Remote.URL = service.URL
+	conf.Remote.KeyID = "lcp"
+	certs, err := NewCertificates(func() (config.Certificate, error) { return conf, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key of an unchanged provider configuration is reused, e.g. to keep a token session
+	signer := certs.Current().PrivateKey
+	if err = certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if certs.Current().PrivateKey != signer {
+		t.Error("Expected the signer to be reused after a reload")
+	}
+	conf.Remote.KeyID = "lcp-2"
+	if err = certs.Reload(); err == nil {
+		t.Error("Expected an error for an unknown remote key")
+	}
+	if certs.Current().PrivateKey != signer {
+		t.Error("Expected the signer to be kept after a failed reload")
+	}
+
+	// the replaced keys are closed, the kept ones are not
+	replaced := &closingSigner{Signer: cert.PrivateKey.(crypto.Signer)}
+	kept := &closingSigner{Signer: cert.PrivateKey.(crypto.Signer)}
+	previous := []certificateEntry{{cert: &tls.Certificate{PrivateKey: replaced}}, {cert: &tls.Certificate{PrivateKey: kept}}}
+	closeSigners(previous, []certificateEntry{{cert: &tls.Certificate{PrivateKey: kept}}})
+	if !replaced.closed || kept.closed {
+		t.Errorf("Expected the replaced signer only to be closed, got %v and %v", replaced.closed, kept.closed)
+	}
+}
+
+func TestCertificatesReloadVerifier(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	conf := writeTestCertificate(t, dir, "main", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0))
+	ca := writeTestCertificate(t, dir, "ca", now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0))
+	certs, err := NewCertificates(func() (config.Certificate, error) { return conf, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs.Verifier() == nil || certs.Verifier().roots != nil {
+		t.Fatal("Expected a verifier without provider CA")
+	}
+
+	// the provider CA and revocation lists are reloaded with the certificates
+	conf.CA = ca.Cert
+	if err = certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if certs.Verifier().roots == nil {
+		t.Error("Expected the provider CA to be loaded")
+	}
+	conf.CRL = []string{filepath.Join(dir, "missing.crl")}
+	if err = certs.Reload(); err == nil {
+		t.Error("Expected an error for a missing CRL")
+	}
+	if certs.Verifier().roots == nil {
+		t.Error("Expected the verifier to be kept after a failed reload")
+	}
+}
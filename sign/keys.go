@@ -0,0 +1,141 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/omani/readium-lcp-server/config"
+)
+
+// Key providers, selected by the certificate/provider configuration option
+const (
+	ProviderFile   = "file"
+	ProviderPKCS11 = "pkcs11"
+	ProviderRemote = "remote"
+)
+
+// ErrSignerUnavailable is returned when the private key cannot be reached, e.g. the HSM or the remote signing service is down
+var ErrSignerUnavailable = errors.New("signing key unavailable")
+
+// PKCS11Params selects a private key on a PKCS#11 token
+type PKCS11Params struct {
+	Module     string // path to the PKCS#11 module (shared library)
+	TokenLabel string
+	PIN        string
+	KeyLabel   string
+	KeyID      []byte
+}
+
+// LoadCertificate loads the provider certificate and its private key from the configured provider.
+// With an HSM or a remote signing service, the key stays in the device or service:
+// the PrivateKey of the certificate is a crypto.Signer delegating signatures to it.
+// The key is checked by signing a test document, so that an unavailable or mismatched key is reported at startup.
+func LoadCertificate(c config.Certificate) (*tls.Certificate, error) {
+	if c.Cert == "" {
+		return nil, errors.New("must specify a certificate")
+	}
+
+	var cert *tls.Certificate
+	var err error
+	switch c.Provider {
+	case "", ProviderFile:
+		if c.PrivateKey == "" {
+			return nil, errors.New("must specify a private key")
+		}
+		var pair tls.Certificate
+		if pair, err = tls.LoadX509KeyPair(c.Cert, c.PrivateKey); err != nil {
+			return nil, err
+		}
+		cert = &pair
+	case ProviderPKCS11:
+		if cert, err = loadCertificateChain(c.Cert); err != nil {
+			return nil, err
+		}
+		params := PKCS11Params{Module: c.PKCS11.Module, TokenLabel: c.PKCS11.TokenLabel, PIN: c.PKCS11.PIN, KeyLabel: c.PKCS11.KeyLabel}
+		if params.KeyID, err = hex.DecodeString(c.PKCS11.KeyID); err != nil {
+			return nil, fmt.Errorf("invalid pkcs11 key_id: %w", err)
+		}
+		if params.Module == "" || (params.KeyLabel == "" && len(params.KeyID) == 0) {
+			return nil, errors.New("the pkcs11 provider requires a module and a key_label or key_id")
+		}
+		if cert.PrivateKey, err = NewPKCS11Signer(params, cert.Leaf.PublicKey); err != nil {
+			return nil, err
+		}
+	case ProviderRemote:
+		if cert, err = loadCertificateChain(c.Cert); err != nil {
+			return nil, err
+		}
+		if c.Remote.URL == "" {
+			return nil, errors.New("the remote provider requires a url")
+		}
+		timeout := time.Duration(c.Remote.Timeout) * time.Second
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		remote := NewRemoteSigner(c.Remote.URL, c.Remote.KeyID, cert.Leaf.PublicKey, &http.Client{Timeout: timeout})
+		remote.SetBasicAuth(c.Remote.Username, c.Remote.Password)
+		cert.PrivateKey = remote
+	default:
+		return nil, errors.New("unknown certificate provider " + c.Provider)
+	}
+
+	if err = CheckKey(cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// loadCertificateChain reads a PEM file holding the provider certificate, possibly followed by intermediate certificates
+func loadCertificateChain(certFile string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	var cert tls.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate found in " + certFile)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// CheckKey signs a test document with the private key of a certificate and checks the signature against the certificate
+func CheckKey(cert *tls.Certificate) error {
+	signer, err := NewSigner(cert)
+	if err != nil {
+		return err
+	}
+	probe := map[string]string{"probe": time.Now().UTC().Format(time.RFC3339)}
+	sig, err := signer.Sign(probe)
+	if err != nil {
+		return fmt.Errorf("cannot sign with the private key: %w", err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	if err = checkSignature(leaf, probe, sig); err != nil {
+		return errors.New("the private key does not match the certificate")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/omani/readium-lcp-server/config"
+)
+
+func loadSample(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	cert, err := tls.LoadX509KeyPair("cert/sample_"+name+".crt", "cert/sample_"+name+".pem")
+	if err != nil {
+		t.Fatal("Couldn't load sample certificate ", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, leaf
+}
+
+func TestRemoteSigner(t *testing.T) {
+	input := map[string]string{"test": "test"}
+
+	for _, name := range []string{"rsa", "ecdsa"} {
+		cert, leaf := loadSample(t, name)
+		service := httptest.NewServer(RemoteSigningHandler("provider-key", cert.PrivateKey.(crypto.Signer)))
+
+		remote := &tls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  NewRemoteSigner(service.URL, "provider-key", leaf.PublicKey, nil),
+		}
+		if err := CheckKey(remote); err != nil {
+			t.Errorf("%s: expected a valid remote key, got %s", name, err)
+		}
+		signer, err := NewSigner(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = NewVerifier(nil, nil, nil).Verify(input, sig, leaf.NotBefore.Add(time.Hour)); err != nil {
+			t.Errorf("%s: expected a valid signature, got %s", name, err)
+		}
+
+		// unknown key
+		remote.PrivateKey = NewRemoteSigner(service.URL, "other-key", leaf.PublicKey, nil)
+		if err = CheckKey(remote); err == nil || errors.Is(err, ErrSignerUnavailable) {
+			t.Errorf("%s: expected an unknown key error, got %v", name, err)
+		}
+
+		// service down
+		service.Close()
+		remote.PrivateKey = NewRemoteSigner(service.URL, "provider-key", leaf.PublicKey, nil)
+		if err = CheckKey(remote); !errors.Is(err, ErrSignerUnavailable) {
+			t.Errorf("%s: expected an unavailable signer, got %v", name, err)
+		}
+	}
+}
+
+func TestRemoteSignerUnavailable(t *testing.T) {
+	cert, leaf := loadSample(t, "rsa")
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "HSM offline", http.StatusServiceUnavailable)
+	}))
+	defer service.Close()
+
+	remote := &tls.Certificate{Certificate: cert.Certificate, PrivateKey: NewRemoteSigner(service.URL, "", leaf.PublicKey, nil)}
+	if err := CheckKey(remote); !errors.Is(err, ErrSignerUnavailable) {
+		t.Errorf("Expected an unavailable signer, got %v", err)
+	}
+}
+
+func TestCheckKeyMismatch(t *testing.T) {
+	rsaCert, _ := loadSample(t, "rsa")
+	other, err := tls.LoadX509KeyPair("cert/sample_rsa.crt", "cert/sample_rsa.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaCert, _ := loadSample(t, "ecdsa")
+
+	// an RSA certificate with an ECDSA key
+	other.PrivateKey = ecdsaCert.PrivateKey
+	if err = CheckKey(&other); err == nil {
+		t.Error("Expected an error for a key not matching the certificate")
+	}
+	if err = CheckKey(&rsaCert); err != nil {
+		t.Errorf("Expected a valid key, got %s", err)
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	cert, _ := loadSample(t, "ecdsa")
+	service := httptest.NewServer(RemoteSigningHandler("lcp", cert.PrivateKey.(crypto.Signer)))
+	defer service.Close()
+
+	c := config.Certificate{Cert: "cert/sample_ecdsa.crt", PrivateKey: "cert/sample_ecdsa.pem"}
+	if _, err := LoadCertificate(c); err != nil {
+		t.Errorf("file provider: %s", err)
+	}
+
+	c = config.Certificate{Cert: "cert/sample_ecdsa.crt", Provider: ProviderRemote}
+	c.Remote.URL = service.URL
+	c.Remote.KeyID = "lcp"
+	loaded, err := LoadCertificate(c)
+	if err != nil {
+		t.Fatalf("remote provider: %s", err)
+	}
+	if _, ok := loaded.PrivateKey.(*RemoteSigner); !ok {
+		t.Errorf("Expected a remote signer, got %T", loaded.PrivateKey)
+	}
+
+	c = config.Certificate{Cert: "cert/sample_ecdsa.crt", Provider: "unknown"}
+	if _, err = LoadCertificate(c); err == nil {
+		t.Error("Expected an error for an unknown provider")
+	}
+}
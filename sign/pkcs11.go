@@ -0,0 +1,268 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+//go:build pkcs11
+// +build pkcs11
+
+package sign
+
+/*
+#cgo CFLAGS: -I/usr/include/p11-kit-1
+#cgo LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+#include <p11-kit/pkcs11.h>
+
+static CK_RV p11_load(const char *path, void **handle, CK_FUNCTION_LIST_PTR *fl) {
+	CK_C_GetFunctionList get;
+	*handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (*handle == NULL) {
+		return CKR_GENERAL_ERROR;
+	}
+	get = (CK_C_GetFunctionList) dlsym(*handle, "C_GetFunctionList");
+	if (get == NULL) {
+		dlclose(*handle);
+		*handle = NULL;
+		return CKR_GENERAL_ERROR;
+	}
+	return get(fl);
+}
+
+static CK_RV p11_initialize(CK_FUNCTION_LIST_PTR fl) {
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof(args));
+	args.flags = CKF_OS_LOCKING_OK;
+	return fl->C_Initialize(&args);
+}
+
+// p11_find_slot returns the first slot holding a token with the given label (space padded to 32 bytes)
+static CK_RV p11_find_slot(CK_FUNCTION_LIST_PTR fl, const unsigned char *label, CK_SLOT_ID *slot) {
+	CK_SLOT_ID slots[64];
+	CK_ULONG count = 64, i;
+	CK_TOKEN_INFO info;
+	CK_RV rv = fl->C_GetSlotList(CK_TRUE, slots, &count);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	for (i = 0; i < count; i++) {
+		if (fl->C_GetTokenInfo(slots[i], &info) == CKR_OK && memcmp(info.label, label, 32) == 0) {
+			*slot = slots[i];
+			return CKR_OK;
+		}
+	}
+	return CKR_TOKEN_NOT_PRESENT;
+}
+
+static CK_RV p11_open_session(CK_FUNCTION_LIST_PTR fl, CK_SLOT_ID slot, unsigned char *pin, CK_ULONG pin_len, CK_SESSION_HANDLE *session) {
+	CK_RV rv = fl->C_OpenSession(slot, CKF_SERIAL_SESSION, NULL, NULL, session);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	rv = fl->C_Login(*session, CKU_USER, pin, pin_len);
+	if (rv == CKR_USER_ALREADY_LOGGED_IN) {
+		rv = CKR_OK;
+	}
+	if (rv != CKR_OK) {
+		fl->C_CloseSession(*session);
+	}
+	return rv;
+}
+
+// p11_find_key returns the private key with the given label and/or id
+static CK_RV p11_find_key(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE session, unsigned char *label, CK_ULONG label_len, unsigned char *id, CK_ULONG id_len, CK_OBJECT_HANDLE *key) {
+	CK_OBJECT_CLASS class = CKO_PRIVATE_KEY;
+	CK_ATTRIBUTE templ[3];
+	CK_ULONG n = 0, found = 0;
+	CK_RV rv;
+
+	templ[n].type = CKA_CLASS; templ[n].pValue = &class; templ[n].ulValueLen = sizeof(class); n++;
+	if (label_len > 0) {
+		templ[n].type = CKA_LABEL; templ[n].pValue = label; templ[n].ulValueLen = label_len; n++;
+	}
+	if (id_len > 0) {
+		templ[n].type = CKA_ID; templ[n].pValue = id; templ[n].ulValueLen = id_len; n++;
+	}
+	rv = fl->C_FindObjectsInit(session, templ, n);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	rv = fl->C_FindObjects(session, key, 1, &found);
+	fl->C_FindObjectsFinal(session);
+	if (rv == CKR_OK && found == 0) {
+		rv = CKR_KEY_HANDLE_INVALID;
+	}
+	return rv;
+}
+
+static CK_RV p11_sign(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key, CK_MECHANISM_TYPE mechanism, unsigned char *data, CK_ULONG data_len, unsigned char *sig, CK_ULONG *sig_len) {
+	CK_MECHANISM mech;
+	CK_RV rv;
+	memset(&mech, 0, sizeof(mech));
+	mech.mechanism = mechanism;
+	rv = fl->C_SignInit(session, &mech, key);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	return fl->C_Sign(session, data, data_len, sig, sig_len);
+}
+
+static void p11_close(CK_FUNCTION_LIST_PTR fl, CK_SESSION_HANDLE session) {
+	fl->C_Logout(session);
+	fl->C_CloseSession(session);
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"unsafe"
+)
+
+// DigestInfo prefix of a SHA-256 hash, prepended to the digest for CKM_RSA_PKCS
+var sha256DigestInfo = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	handle  unsafe.Pointer
+	fl      C.CK_FUNCTION_LIST_PTR
+	slot    C.CK_SLOT_ID
+	session C.CK_SESSION_HANDLE
+	key     C.CK_OBJECT_HANDLE
+	open    bool
+	closed  bool
+	params  PKCS11Params
+	public  crypto.PublicKey
+}
+
+// NewPKCS11Signer opens a session on the token of a PKCS#11 module and finds the private key
+// matching the public key of the provider certificate.
+func NewPKCS11Signer(params PKCS11Params, public crypto.PublicKey) (crypto.Signer, error) {
+	s := &pkcs11Signer{params: params, public: public}
+
+	path := C.CString(params.Module)
+	defer C.free(unsafe.Pointer(path))
+	if rv := C.p11_load(path, &s.handle, &s.fl); rv != C.CKR_OK {
+		return nil, fmt.Errorf("%w: cannot load the PKCS#11 module %s (0x%x)", ErrSignerUnavailable, params.Module, uint64(rv))
+	}
+	if rv := C.p11_initialize(s.fl); rv != C.CKR_OK && rv != C.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+		return nil, pkcs11Error("initialize", rv)
+	}
+	var label [32]byte
+	copy(label[:], fmt.Sprintf("%-32s", params.TokenLabel))
+	if rv := C.p11_find_slot(s.fl, (*C.uchar)(unsafe.Pointer(&label[0])), &s.slot); rv != C.CKR_OK {
+		return nil, pkcs11Error("find the token "+params.TokenLabel, rv)
+	}
+	if err := s.openSession(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openSession logs in the token and finds the key; the caller must hold the lock, if any
+func (s *pkcs11Signer) openSession() error {
+	pin := []byte(s.params.PIN)
+	if rv := C.p11_open_session(s.fl, s.slot, bytesPtr(pin), C.CK_ULONG(len(pin)), &s.session); rv != C.CKR_OK {
+		return pkcs11Error("open a session", rv)
+	}
+	label, id := []byte(s.params.KeyLabel), s.params.KeyID
+	if rv := C.p11_find_key(s.fl, s.session, bytesPtr(label), C.CK_ULONG(len(label)), bytesPtr(id), C.CK_ULONG(len(id)), &s.key); rv != C.CKR_OK {
+		C.p11_close(s.fl, s.session)
+		return pkcs11Error("find the private key", rv)
+	}
+	s.open = true
+	return nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs a digest, SHA-256 for RSA keys; the signature is returned in the format of crypto.Signer:
+// PKCS#1 v1.5 for RSA keys, ASN.1 DER for ECDSA keys
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism C.CK_MECHANISM_TYPE
+	var data []byte
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		if opts.HashFunc() != crypto.SHA256 {
+			return nil, errors.New("pkcs11: only SHA-256 digests are supported with RSA keys")
+		}
+		mechanism, data = C.CKM_RSA_PKCS, append(append([]byte{}, sha256DigestInfo...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism, data = C.CKM_ECDSA, digest
+	default:
+		return nil, errors.New("pkcs11: unsupported key type")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("%w: pkcs11: the session is closed", ErrSignerUnavailable)
+	}
+	sig, rv := s.sign(mechanism, data)
+	if rv == C.CKR_SESSION_HANDLE_INVALID || rv == C.CKR_SESSION_CLOSED || rv == C.CKR_USER_NOT_LOGGED_IN {
+		// the session was lost (e.g. the HSM restarted): open a new one and try again
+		s.open = false
+		if err := s.openSession(); err != nil {
+			return nil, err
+		}
+		sig, rv = s.sign(mechanism, data)
+	}
+	if rv != C.CKR_OK {
+		return nil, pkcs11Error("sign", rv)
+	}
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns r||s
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])})
+	}
+	return sig, nil
+}
+
+// Close logs out and closes the session; the signer can't be used afterwards.
+// The module stays loaded, as other signers may use it.
+func (s *pkcs11Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open {
+		C.p11_close(s.fl, s.session)
+		s.open = false
+	}
+	s.closed = true
+	return nil
+}
+
+func (s *pkcs11Signer) sign(mechanism C.CK_MECHANISM_TYPE, data []byte) ([]byte, C.CK_RV) {
+	if !s.open {
+		return nil, C.CKR_SESSION_CLOSED
+	}
+	sig := make([]byte, 1024)
+	sigLen := C.CK_ULONG(len(sig))
+	rv := C.p11_sign(s.fl, s.session, s.key, mechanism, bytesPtr(data), C.CK_ULONG(len(data)), bytesPtr(sig), &sigLen)
+	return sig[:sigLen], rv
+}
+
+func bytesPtr(b []byte) *C.uchar {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.uchar)(unsafe.Pointer(&b[0]))
+}
+
+// pkcs11Error reports errors of the token as an unavailable signer, except a wrong PIN
+func pkcs11Error(op string, rv C.CK_RV) error {
+	if rv == C.CKR_PIN_INCORRECT {
+		return fmt.Errorf("pkcs11: %s: incorrect PIN", op)
+	}
+	return fmt.Errorf("%w: pkcs11: %s failed (0x%x)", ErrSignerUnavailable, op, uint64(rv))
+}
@@ -0,0 +1,18 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+//go:build !pkcs11
+// +build !pkcs11
+
+package sign
+
+import (
+	"crypto"
+	"errors"
+)
+
+// NewPKCS11Signer is not available: the PKCS#11 key provider requires cgo and is built with -tags pkcs11
+func NewPKCS11Signer(params PKCS11Params, public crypto.PublicKey) (crypto.Signer, error) {
+	return nil, errors.New("the pkcs11 certificate provider is not built in, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Remote signing protocol: the client posts a SignRequest as json, the service answers with a SignResponse.
+// The signature is in the format of crypto.Signer: PKCS#1 v1.5 for RSA keys, ASN.1 DER for ECDSA keys.
+// Errors are returned with an http error status; 5xx statuses mean that the key is unavailable.
+
+// remoteHashes are the hash functions of the digests sent to a remote signing service, by name
+var remoteHashes = map[string]crypto.Hash{
+	crypto.SHA256.String(): crypto.SHA256,
+	crypto.SHA384.String(): crypto.SHA384,
+	crypto.SHA512.String(): crypto.SHA512,
+}
+
+// SignRequest is the body of a request to a remote signing service
+type SignRequest struct {
+	KeyID  string `json:"key_id,omitempty"`
+	Hash   string `json:"hash"`
+	Digest []byte `json:"digest"`
+}
+
+// SignResponse is the body of the response of a remote signing service
+type SignResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// RemoteSigner is a crypto.Signer delegating signatures to a remote signing service
+type RemoteSigner struct {
+	url      string
+	keyID    string
+	username string
+	password string
+	public   crypto.PublicKey
+	client   *http.Client
+}
+
+// NewRemoteSigner creates a signer for a key of a remote signing service; public is the public key of the provider certificate
+func NewRemoteSigner(url, keyID string, public crypto.PublicKey, client *http.Client) *RemoteSigner {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteSigner{url: url, keyID: keyID, public: public, client: client}
+}
+
+// SetBasicAuth sets the credentials sent to the remote signing service
+func (s *RemoteSigner) SetBasicAuth(username, password string) {
+	s.username = username
+	s.password = password
+}
+
+func (s *RemoteSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign sends a digest to the remote signing service
+func (s *RemoteSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if _, ok := remoteHashes[hash.String()]; !ok {
+		return nil, errors.New("remote signer: only SHA-256, SHA-384 and SHA-512 digests are supported")
+	}
+	body, err := json.Marshal(SignRequest{KeyID: s.keyID, Hash: hash.String(), Digest: digest})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSignerUnavailable, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("%w: the remote signing service returned %s", ErrSignerUnavailable, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("the remote signing service returned " + resp.Status)
+	}
+	var res SignResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Signature) == 0 {
+		return nil, errors.New("the remote signing service returned no signature")
+	}
+	return res.Signature, nil
+}
+
+// RemoteSigningHandler serves the remote signing protocol with a local key.
+// It is a stand-in for a remote signing service in tests and development environments.
+func RemoteSigningHandler(keyID string, key crypto.Signer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req SignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.KeyID != keyID {
+			http.Error(w, "unknown key "+req.KeyID, http.StatusNotFound)
+			return
+		}
+		hash, ok := remoteHashes[req.Hash]
+		if !ok || len(req.Digest) != hash.Size() {
+			http.Error(w, "a SHA-256, SHA-384 or SHA-512 digest is expected", http.StatusBadRequest)
+			return
+		}
+		sig, err := key.Sign(rand.Reader, req.Digest, hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SignResponse{Signature: sig})
+	})
+}
@@ -28,14 +28,57 @@ package sign
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"crypto/tls"
+	"encoding/asn1"
 	"errors"
 	"math"
+	"math/big"
 )
 
+const (
+	AlgorithmRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	AlgorithmECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	AlgorithmECDSASHA384 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384"
+	AlgorithmECDSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+	// Ed25519 signatures (RFC 9231) are not part of the LCP specification: they are only used with test profiles
+	AlgorithmEd25519 = "http://www.w3.org/2021/04/xmldsig-more#eddsa-ed25519"
+)
+
+// signatureAlgorithm returns the signature algorithm matching a public key, and the hash it uses.
+// The hash of an ECDSA signature matches the size of the curve.
+func signatureAlgorithm(pub crypto.PublicKey) (string, crypto.Hash, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return AlgorithmRSASHA256, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return AlgorithmECDSASHA256, crypto.SHA256, nil
+		case elliptic.P384():
+			return AlgorithmECDSASHA384, crypto.SHA384, nil
+		case elliptic.P521():
+			return AlgorithmECDSASHA512, crypto.SHA512, nil
+		}
+		return "", 0, errors.New("Unsupported elliptic curve " + k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return AlgorithmEd25519, 0, nil
+	}
+	return "", 0, errors.New("Unsupported certificate type")
+}
+
+// digest hashes a canonical document with the given hash function
+func digest(hash crypto.Hash, plain []byte) []byte {
+	h := hash.New()
+	h.Write(plain)
+	return h.Sum(nil)
+}
+
 type Signer interface {
 	Sign(interface{}) (Signature, error)
 }
@@ -48,8 +91,10 @@ type Signature struct {
 
 // ECDSA
 type ecdsaSigner struct {
-	key  *ecdsa.PrivateKey
-	cert *tls.Certificate
+	key       *ecdsa.PrivateKey
+	cert      *tls.Certificate
+	algorithm string
+	hash      crypto.Hash
 }
 
 // Used to fill the resulting output according to the XMLDSIG spec
@@ -67,8 +112,7 @@ func (signer *ecdsaSigner) Sign(in interface{}) (sig Signature, err error) {
 		return
 	}
 
-	hashed := sha256.Sum256(plain)
-	r, s, err := ecdsa.Sign(rand.Reader, signer.key, hashed[:])
+	r, s, err := ecdsa.Sign(rand.Reader, signer.key, digest(signer.hash, plain))
 	if err != nil {
 		return
 	}
@@ -81,7 +125,7 @@ func (signer *ecdsaSigner) Sign(in interface{}) (sig Signature, err error) {
 	copyWithLeftPad(sig.Value[0:curveSizeInBytes], r.Bytes())
 	copyWithLeftPad(sig.Value[curveSizeInBytes:], s.Bytes())
 
-	sig.Algorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	sig.Algorithm = signer.algorithm
 	sig.Certificate = signer.cert.Certificate[0]
 	return
 }
@@ -98,26 +142,99 @@ func (signer *rsaSigner) Sign(in interface{}) (sig Signature, err error) {
 		return
 	}
 
-	hashed := sha256.Sum256(plain)
-	sig.Value, err = rsa.SignPKCS1v15(rand.Reader, signer.key, crypto.SHA256, hashed[:])
+	sig.Value, err = rsa.SignPKCS1v15(rand.Reader, signer.key, crypto.SHA256, digest(crypto.SHA256, plain))
+	if err != nil {
+		return
+	}
+
+	sig.Algorithm = AlgorithmRSASHA256
+	sig.Certificate = signer.cert.Certificate[0]
+
+	return
+}
+
+// Ed25519, for test profiles only
+type ed25519Signer struct {
+	key  ed25519.PrivateKey
+	cert *tls.Certificate
+}
+
+func (signer *ed25519Signer) Sign(in interface{}) (sig Signature, err error) {
+	plain, err := Canon(in)
 	if err != nil {
 		return
 	}
 
-	sig.Algorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	// Ed25519 signs the message itself, not a digest
+	sig.Value = ed25519.Sign(signer.key, plain)
+	sig.Algorithm = AlgorithmEd25519
 	sig.Certificate = signer.cert.Certificate[0]
+	return
+}
+
+// Any other private key, e.g. held by an HSM or a remote signing service
+type keySigner struct {
+	key       crypto.Signer
+	cert      *tls.Certificate
+	algorithm string
+	hash      crypto.Hash
+}
+
+func (signer *keySigner) Sign(in interface{}) (sig Signature, err error) {
+	plain, err := Canon(in)
+	if err != nil {
+		return
+	}
 
+	value, err := signer.key.Sign(rand.Reader, digest(signer.hash, plain), signer.hash)
+	if err != nil {
+		return
+	}
+
+	switch pub := signer.key.Public().(type) {
+	case *rsa.PublicKey:
+		sig.Value = value
+	case *ecdsa.PublicKey:
+		// crypto.Signer returns an ASN.1 structure, converted to the XMLDSIG format as by ecdsaSigner
+		var rs struct{ R, S *big.Int }
+		if _, err = asn1.Unmarshal(value, &rs); err != nil {
+			return
+		}
+		curveSizeInBytes := int(math.Ceil(float64(pub.Curve.Params().BitSize) / 8))
+		sig.Value = make([]byte, 2*curveSizeInBytes)
+		copyWithLeftPad(sig.Value[0:curveSizeInBytes], rs.R.Bytes())
+		copyWithLeftPad(sig.Value[curveSizeInBytes:], rs.S.Bytes())
+	}
+	sig.Algorithm = signer.algorithm
+	sig.Certificate = signer.cert.Certificate[0]
 	return
 }
 
 // Creates a new signer given the certificate type. Currently supports
-// RSA (PKCS1v15) and ECDSA (SHA256 is used in both cases)
+// RSA (PKCS1v15 with SHA256), ECDSA on the P-256, P-384 and P-521 curves
+// (with SHA256, SHA384 and SHA512 respectively) and Ed25519.
+// The private key may be any crypto.Signer holding an RSA or ECDSA key, e.g. a key held by an HSM.
 func NewSigner(certificate *tls.Certificate) (Signer, error) {
 	switch k := certificate.PrivateKey.(type) {
 	case *ecdsa.PrivateKey:
-		return &ecdsaSigner{k, certificate}, nil
+		algorithm, hash, err := signatureAlgorithm(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsaSigner{k, certificate, algorithm, hash}, nil
 	case *rsa.PrivateKey:
 		return &rsaSigner{k, certificate}, nil
+	case ed25519.PrivateKey:
+		return &ed25519Signer{k, certificate}, nil
+	case crypto.Signer:
+		switch k.Public().(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			algorithm, hash, err := signatureAlgorithm(k.Public())
+			if err != nil {
+				return nil, err
+			}
+			return &keySigner{k, certificate, algorithm, hash}, nil
+		}
 	}
 
 	return nil, errors.New("Unsupported certificate type")
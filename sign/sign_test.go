@@ -28,13 +28,61 @@ package sign
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"math/big"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
+// generateCertificate creates a self-signed certificate holding a key of the given type:
+// rsa, p256, p384, p521 or ed25519
+func generateCertificate(t *testing.T, keyType string) (*tls.Certificate, *x509.Certificate) {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "p256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "p384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "p521":
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatal("unknown key type " + keyType)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: keyType},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
 func TestSigningRSA(t *testing.T) {
 	cert, err := tls.LoadX509KeyPair("cert/sample_rsa.crt", "cert/sample_rsa.pem")
 	if err != nil {
@@ -84,14 +132,15 @@ func TestSigningECDSA(t *testing.T) {
 		t.Error(err)
 	}
 
-	if expected := "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"; sig.Algorithm != expected {
+	// the sample certificate holds a P-521 key, hashed with SHA-512
+	if expected := "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"; sig.Algorithm != expected {
 		t.Errorf("Expected '%s', got '%s'", expected, sig.Algorithm)
 	}
 
 	r, s := getParamsFromECDSASignature(sig.Value)
 
 	canon, _ := Canon(input)
-	hashed := sha256.Sum256(canon)
+	hashed := sha512.Sum512(canon)
 
 	if privKey, ok := cert.PrivateKey.(*ecdsa.PrivateKey); ok {
 		if publicKey, ok := privKey.Public().(*ecdsa.PublicKey); ok {
@@ -112,3 +161,77 @@ func getParamsFromECDSASignature(b []byte) (*big.Int, *big.Int) {
 
 	return r, s
 }
+
+func TestSigningKeyTypes(t *testing.T) {
+	input := map[string]string{"test": "test"}
+
+	for _, test := range []struct {
+		keyType   string
+		algorithm string
+		size      int
+	}{
+		{"rsa", AlgorithmRSASHA256, 256},
+		{"p256", AlgorithmECDSASHA256, 64},
+		{"p384", AlgorithmECDSASHA384, 96},
+		{"p521", AlgorithmECDSASHA512, 132},
+		{"ed25519", AlgorithmEd25519, ed25519.SignatureSize},
+	} {
+		cert, leaf := generateCertificate(t, test.keyType)
+		signer, err := NewSigner(cert)
+		if err != nil {
+			t.Fatalf("%s: %s", test.keyType, err)
+		}
+		sig, err := signer.Sign(input)
+		if err != nil {
+			t.Fatalf("%s: %s", test.keyType, err)
+		}
+		if sig.Algorithm != test.algorithm {
+			t.Errorf("%s: expected '%s', got '%s'", test.keyType, test.algorithm, sig.Algorithm)
+		}
+		if len(sig.Value) != test.size {
+			t.Errorf("%s: expected a signature of %d bytes, got %d", test.keyType, test.size, len(sig.Value))
+		}
+		if err = checkSignature(leaf, input, sig); err != nil {
+			t.Errorf("%s: expected a valid signature, got %s", test.keyType, err)
+		}
+
+		// the algorithm must match the key of the certificate
+		sig.Algorithm = AlgorithmECDSASHA256
+		if test.algorithm != AlgorithmECDSASHA256 && checkSignature(leaf, input, sig) == nil {
+			t.Errorf("%s: expected an invalid signature for a mismatching algorithm", test.keyType)
+		}
+	}
+}
+
+func TestSigningRemoteKeyTypes(t *testing.T) {
+	input := map[string]string{"test": "test"}
+
+	for _, keyType := range []string{"rsa", "p384", "p521"} {
+		cert, leaf := generateCertificate(t, keyType)
+		service := httptest.NewServer(RemoteSigningHandler("", cert.PrivateKey.(crypto.Signer)))
+		remote := &tls.Certificate{Certificate: cert.Certificate, PrivateKey: NewRemoteSigner(service.URL, "", leaf.PublicKey, nil)}
+
+		signer, err := NewSigner(remote)
+		if err != nil {
+			t.Fatalf("%s: %s", keyType, err)
+		}
+		sig, err := signer.Sign(input)
+		service.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", keyType, err)
+		}
+		if err = checkSignature(leaf, input, sig); err != nil {
+			t.Errorf("%s: expected a valid signature, got %s", keyType, err)
+		}
+	}
+}
+
+func TestSigningUnsupportedCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSigner(&tls.Certificate{PrivateKey: key}); err == nil {
+		t.Error("Expected an error for a P-224 key")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrNoSignature        = errors.New("no signature")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrInvalidCertificate = errors.New("invalid certificate")
+	ErrRevokedCertificate = errors.New("revoked certificate")
+)
+
+// Verifier checks signatures produced by a Signer, and the certificate embedded in them.
+// Without a provider CA (or with a nil Verifier), only the signature and the validity period of the certificate are checked.
+type Verifier struct {
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+	crls          []*pkix.CertificateList
+}
+
+// NewVerifier creates a verifier which validates certificates against a provider CA chain (roots and intermediates)
+// and a set of certificate revocation lists. Every parameter is optional.
+func NewVerifier(roots, intermediates *x509.CertPool, crls []*pkix.CertificateList) *Verifier {
+	return &Verifier{roots: roots, intermediates: intermediates, crls: crls}
+}
+
+// LoadVerifier creates a verifier from a PEM file holding the provider CA chain and from CRL files (PEM or DER).
+// Self-signed certificates of the chain are roots, the others intermediates.
+func LoadVerifier(caFile string, crlFiles []string) (*Verifier, error) {
+	v := &Verifier{}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		v.roots = x509.NewCertPool()
+		v.intermediates = x509.NewCertPool()
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+				v.roots.AddCert(cert)
+			} else {
+				v.intermediates.AddCert(cert)
+			}
+		}
+		if len(v.roots.Subjects()) == 0 {
+			return nil, errors.New("no root certificate found in " + caFile)
+		}
+	}
+	for _, crlFile := range crlFiles {
+		data, err := ioutil.ReadFile(crlFile)
+		if err != nil {
+			return nil, err
+		}
+		crl, err := x509.ParseCRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", crlFile, err)
+		}
+		v.crls = append(v.crls, crl)
+	}
+	return v, nil
+}
+
+// Verify checks the signature of a document, which must not hold the signature itself.
+// The certificate must be valid at the time the document was signed.
+func (v *Verifier) Verify(in interface{}, sig Signature, signedAt time.Time) error {
+	if len(sig.Value) == 0 || len(sig.Certificate) == 0 {
+		return ErrNoSignature
+	}
+	cert, err := x509.ParseCertificate(sig.Certificate)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCertificate, err.Error())
+	}
+	if err = v.verifyCertificate(cert, signedAt); err != nil {
+		return err
+	}
+
+	return checkSignature(cert, in, sig)
+}
+
+// checkSignature checks the signature of a document with the public key of a certificate
+func checkSignature(cert *x509.Certificate, in interface{}, sig Signature) error {
+	plain, err := Canon(in)
+	if err != nil {
+		return err
+	}
+	algorithm, hash, err := signatureAlgorithm(cert.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+	if sig.Algorithm != algorithm {
+		return fmt.Errorf("%w: algorithm %s does not match the key of the certificate", ErrInvalidSignature, sig.Algorithm)
+	}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(pub, hash, digest(hash, plain), sig.Value); err != nil {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		// the signature is the concatenation of r and s, see ecdsaSigner
+		half := len(sig.Value) / 2
+		r := new(big.Int).SetBytes(sig.Value[:half])
+		s := new(big.Int).SetBytes(sig.Value[half:])
+		if !ecdsa.Verify(pub, digest(hash, plain), r, s) {
+			return ErrInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, plain, sig.Value) {
+			return ErrInvalidSignature
+		}
+	}
+	return nil
+}
+
+// verifyCertificate checks the validity period of a certificate, its chain up to the provider CA and its revocation
+func (v *Verifier) verifyCertificate(cert *x509.Certificate, at time.Time) error {
+	if at.Before(cert.NotBefore) || at.After(cert.NotAfter) {
+		return fmt.Errorf("%w: not valid on %s", ErrInvalidCertificate, at.Format(time.RFC3339))
+	}
+	if v == nil || v.roots == nil {
+		return nil
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: v.intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCertificate, err.Error())
+	}
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			if err = v.checkRevocation(chain[i], chain[i+1], at); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// crlReasonCode is the object identifier of the reason code extension of a CRL entry
+var crlReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// reason codes of a CRL entry which don't imply a compromised key, see RFC 5280 section 5.3.1
+const (
+	reasonSuperseded           = 4
+	reasonCessationOfOperation = 5
+)
+
+// checkRevocation looks for a certificate in the CRLs signed by its issuer.
+// A revoked certificate invalidates every signature, as the time of a signature is taken from the signed document.
+// Only a certificate superseded or no longer in use, i.e. whose key is not compromised,
+// keeps the signatures made before its revocation valid.
+func (v *Verifier) checkRevocation(cert, issuer *x509.Certificate, at time.Time) error {
+	for _, crl := range v.crls {
+		if issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+				continue
+			}
+			reason := revocationReason(revoked)
+			if (reason == reasonSuperseded || reason == reasonCessationOfOperation) && at.Before(revoked.RevocationTime) {
+				continue
+			}
+			return fmt.Errorf("%w: %s, serial number %s", ErrRevokedCertificate, cert.Subject.CommonName, cert.SerialNumber.String())
+		}
+	}
+	return nil
+}
+
+// revocationReason returns the reason code of a CRL entry, or -1 if it is missing or invalid
+func revocationReason(revoked pkix.RevokedCertificate) int {
+	for _, ext := range revoked.Extensions {
+		if !ext.Id.Equal(crlReasonCode) {
+			continue
+		}
+		var reason asn1.Enumerated
+		if rest, err := asn1.Unmarshal(ext.Value, &reason); err != nil || len(rest) != 0 {
+			return -1
+		}
+		return int(reason)
+	}
+	return -1
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a self-signed CA, or a certificate issued by a CA if parent is not nil
+func testCertificate(t *testing.T, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func signWith(t *testing.T, cert *x509.Certificate, key *ecdsa.PrivateKey, in interface{}) Signature {
+	signer, err := NewSigner(&tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestVerifySampleCertificates(t *testing.T) {
+	input := map[string]string{"test": "test"}
+
+	for _, name := range []string{"rsa", "ecdsa"} {
+		cert, err := tls.LoadX509KeyPair("cert/sample_"+name+".crt", "cert/sample_"+name+".pem")
+		if err != nil {
+			t.Fatal("Couldn't load sample certificate ", err)
+		}
+		signer, err := NewSigner(&cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x509Cert, _ := x509.ParseCertificate(cert.Certificate[0])
+		signedAt := x509Cert.NotBefore.Add(time.Hour)
+
+		v := NewVerifier(nil, nil, nil)
+		if err = v.Verify(input, sig, signedAt); err != nil {
+			t.Errorf("%s: expected a valid signature, got %s", name, err)
+		}
+		if err = v.Verify(map[string]string{"test": "tampered"}, sig, signedAt); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected an invalid signature, got %v", name, err)
+		}
+		if err = v.Verify(input, sig, x509Cert.NotAfter.Add(time.Hour)); !errors.Is(err, ErrInvalidCertificate) {
+			t.Errorf("%s: expected an expired certificate, got %v", name, err)
+		}
+	}
+}
+
+func TestVerifyCertificateChain(t *testing.T) {
+	input := map[string]string{"test": "test"}
+	ca, caKey := testCertificate(t, "Provider CA", 1, nil, nil)
+	provider, providerKey := testCertificate(t, "Provider", 2, ca, caKey)
+	other, otherKey := testCertificate(t, "Other CA", 3, nil, nil)
+	sig := signWith(t, provider, providerKey, input)
+	signedAt := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if err := NewVerifier(roots, nil, nil).Verify(input, sig, signedAt); err != nil {
+		t.Errorf("Expected a valid signature, got %s", err)
+	}
+
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(other)
+	if err := NewVerifier(otherRoots, nil, nil).Verify(input, sig, signedAt); !errors.Is(err, ErrInvalidCertificate) {
+		t.Errorf("Expected an untrusted certificate, got %v", err)
+	}
+
+	// a certificate issued by another CA does not match a signature of the provider
+	forged := signWith(t, other, otherKey, input)
+	forged.Certificate = provider.Raw
+	if err := NewVerifier(roots, nil, nil).Verify(input, forged, signedAt); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected an invalid signature, got %v", err)
+	}
+
+	revokedAt := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	revocationList := func(entry pkix.RevokedCertificate) []*pkix.CertificateList {
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:              big.NewInt(1),
+			ThisUpdate:          revokedAt,
+			NextUpdate:          revokedAt.AddDate(1, 0, 0),
+			RevokedCertificates: []pkix.RevokedCertificate{entry},
+		}, ca, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crl, err := x509.ParseCRL(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*pkix.CertificateList{crl}
+	}
+
+	// the date of a signature is part of the signed document, a revoked key could backdate it
+	v := NewVerifier(roots, nil, revocationList(pkix.RevokedCertificate{SerialNumber: provider.SerialNumber, RevocationTime: revokedAt}))
+	if err := v.Verify(input, sig, signedAt); !errors.Is(err, ErrRevokedCertificate) {
+		t.Errorf("Expected a revoked certificate before the revocation, got %v", err)
+	}
+	if err := v.Verify(input, sig, revokedAt.Add(time.Hour)); !errors.Is(err, ErrRevokedCertificate) {
+		t.Errorf("Expected a revoked certificate, got %v", err)
+	}
+
+	// a superseded certificate only invalidates the signatures made after its revocation
+	superseded, err := asn1.Marshal(asn1.Enumerated(reasonSuperseded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = NewVerifier(roots, nil, revocationList(pkix.RevokedCertificate{
+		SerialNumber:   provider.SerialNumber,
+		RevocationTime: revokedAt,
+		Extensions:     []pkix.Extension{{Id: crlReasonCode, Value: superseded}},
+	}))
+	if err = v.Verify(input, sig, signedAt); err != nil {
+		t.Errorf("Expected a valid signature before the revocation, got %s", err)
+	}
+	if err = v.Verify(input, sig, revokedAt.Add(time.Hour)); !errors.Is(err, ErrRevokedCertificate) {
+		t.Errorf("Expected a revoked certificate, got %v", err)
+	}
+}
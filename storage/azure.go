@@ -0,0 +1,392 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the version of the Azure Blob REST API used by the storage
+const azureAPIVersion = "2020-10-02"
+
+// azureMaxPutSize is the maximum size of a blob uploaded in a single request;
+// larger blobs, and blobs of unknown size, are uploaded as a list of blocks
+const azureMaxPutSize = 256 << 20
+
+// azureBlockSize is the size of an uploaded block
+const azureBlockSize = 8 << 20
+
+type azureStore struct {
+	account   string
+	key       []byte
+	sasToken  string
+	container string
+	endpoint  string
+	publicURL string
+	client    *http.Client
+}
+
+// azureError is returned when the Azure Blob service replies with an unexpected status
+type azureError struct {
+	status int
+	method string
+	path   string
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("Azure storage error %d on %s %s", e.status, e.method, e.path)
+}
+
+type azureItem struct {
+	info  ItemInfo
+	store *azureStore
+}
+
+func (i azureItem) Key() string {
+	return i.info.Key
+}
+
+func (i azureItem) PublicURL() string {
+	if i.store.publicURL != "" {
+		return i.store.publicURL + "/" + url.PathEscape(i.info.Key)
+	}
+	return i.store.blobURL(i.info.Key)
+}
+
+func (i azureItem) Stat() ItemInfo {
+	return i.info
+}
+
+func (i azureItem) Contents(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := i.store.do(ctx, "GET", i.store.blobURL(i.info.Key), nil, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// blobURL returns the URL of a blob, without authentication parameters
+func (s *azureStore) blobURL(key string) string {
+	return s.endpoint + "/" + s.container + "/" + url.PathEscape(key)
+}
+
+// do sends a request to the Azure Blob service, authenticated by a shared key or a SAS token.
+// A response status other than 2xx is returned as an error; 404 is returned as ErrNotFound.
+func (s *azureStore) do(ctx context.Context, method, rawURL string, body io.Reader, length int64, headers map[string]string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if s.sasToken != "" {
+		sas, err := url.ParseQuery(strings.TrimPrefix(s.sasToken, "?"))
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		for k, v := range sas {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if s.sasToken == "" {
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+s.signature(req))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, &azureError{status: resp.StatusCode, method: method, path: u.Path}
+	}
+	return resp, nil
+}
+
+// signature computes the Shared Key signature of a request
+// see https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (s *azureStore) signature(req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	var sb strings.Builder
+	for _, v := range []string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	} {
+		sb.WriteString(v)
+		sb.WriteString("\n")
+	}
+
+	// canonicalized headers
+	var msHeaders []string
+	for k := range h {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk)
+		}
+	}
+	sort.Strings(msHeaders)
+	for _, k := range msHeaders {
+		sb.WriteString(k + ":" + strings.TrimSpace(h.Get(k)) + "\n")
+	}
+
+	// canonicalized resource
+	sb.WriteString("/" + s.account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	var params []string
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := query[k]
+		sort.Strings(values)
+		sb.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(sb.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *azureStore) Add(ctx context.Context, key string, r io.Reader, size int64, contentType string) (Item, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	var err error
+	if size != UnknownSize && size <= azureMaxPutSize {
+		var resp *http.Response
+		resp, err = s.do(ctx, "PUT", s.blobURL(key), r, size, map[string]string{
+			"x-ms-blob-type": "BlockBlob",
+			"Content-Type":   contentType,
+		})
+		if err == nil {
+			resp.Body.Close()
+		}
+	} else {
+		err = s.putBlocks(ctx, key, r, size, contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, key)
+}
+
+// putBlocks uploads a blob as a list of blocks, then commits the list.
+// If size is known and doesn't match the number of bytes read, the list is not committed:
+// a previous version of the blob is left untouched, and the uncommitted blocks are discarded by Azure.
+func (s *azureStore) putBlocks(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	var written int64
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	buf := make([]byte, azureBlockSize)
+	for i := 0; ; i++ {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			// block ids must have the same length in a blob
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", i)))
+			resp, err := s.do(ctx, "PUT", s.blobURL(key)+"?comp=block&blockid="+url.QueryEscape(id), bytes.NewReader(buf[:n]), int64(n), nil)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			blockList.WriteString("<Latest>" + id + "</Latest>")
+			written += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	if size != UnknownSize && written != size {
+		return fmt.Errorf("Unexpected size for %s: %d bytes read, %d expected", key, written, size)
+	}
+	blockList.WriteString("</BlockList>")
+
+	resp, err := s.do(ctx, "PUT", s.blobURL(key)+"?comp=blocklist", &blockList, int64(blockList.Len()), map[string]string{
+		"x-ms-blob-content-type": contentType,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *azureStore) Get(ctx context.Context, key string) (Item, error) {
+	resp, err := s.do(ctx, "HEAD", s.blobURL(key), nil, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	info := ItemInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        strings.Trim(resp.Header.Get("ETag"), `"`),
+	}
+	info.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return azureItem{info: info, store: s}, nil
+}
+
+func (s *azureStore) Remove(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, "DELETE", s.blobURL(key), nil, -1, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type azureBlobList struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string `xml:"Name"`
+			Properties struct {
+				LastModified  string `xml:"Last-Modified"`
+				ETag          string `xml:"Etag"`
+				ContentLength int64  `xml:"Content-Length"`
+				ContentType   string `xml:"Content-Type"`
+			} `xml:"Properties"`
+		} `xml:"Blob"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *azureStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	query := url.Values{}
+	query.Set("restype", "container")
+	query.Set("comp", "list")
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Token != "" {
+		query.Set("marker", opts.Token)
+	}
+	if opts.Limit > 0 {
+		query.Set("maxresults", strconv.Itoa(opts.Limit))
+	}
+	resp, err := s.do(ctx, "GET", s.endpoint+"/"+s.container+"?"+query.Encode(), nil, -1, nil)
+	if err != nil {
+		return ListPage{}, err
+	}
+	var list azureBlobList
+	err = xml.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	page := ListPage{NextToken: list.NextMarker}
+	for _, b := range list.Blobs.Blob {
+		info := ItemInfo{
+			Key:         b.Name,
+			Size:        b.Properties.ContentLength,
+			ContentType: b.Properties.ContentType,
+			ETag:        strings.Trim(b.Properties.ETag, `"`),
+		}
+		info.LastModified, _ = http.ParseTime(b.Properties.LastModified)
+		page.Items = append(page.Items, azureItem{info: info, store: s})
+	}
+	return page, nil
+}
+
+// createContainer creates the container of the store if it doesn't exist yet
+func (s *azureStore) createContainer() error {
+	resp, err := s.do(context.Background(), "PUT", s.endpoint+"/"+s.container+"?restype=container", nil, 0, nil)
+	if err != nil {
+		// the container already exists
+		if e, ok := err.(*azureError); ok && e.status == http.StatusConflict {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// AzureConfig structure
+type AzureConfig struct {
+	Account   string
+	Key       string
+	SASToken  string
+	Container string
+	// Endpoint is optional, https://<account>.blob.core.windows.net by default.
+	// For the Azurite emulator, it is of the form http://127.0.0.1:10000/devstoreaccount1
+	Endpoint string
+	// PublicBaseURL is optional, e.g. the URL of a CDN in front of the container
+	PublicBaseURL string
+}
+
+// Azure inits an Azure Blob storage
+func Azure(config AzureConfig) (Store, error) {
+	if config.Account == "" || config.Container == "" {
+		return nil, errors.New("Azure storage: account and container are required")
+	}
+	if config.Key == "" && config.SASToken == "" {
+		return nil, errors.New("Azure storage: a shared key or a SAS token is required")
+	}
+	key, err := base64.StdEncoding.DecodeString(config.Key)
+	if err != nil {
+		return nil, errors.New("Azure storage: the shared key must be base64 encoded")
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + config.Account + ".blob.core.windows.net"
+	}
+
+	return &azureStore{
+		account:   config.Account,
+		key:       key,
+		sasToken:  config.SASToken,
+		container: config.Container,
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		publicURL: strings.TrimRight(config.PublicBaseURL, "/"),
+		client:    &http.Client{},
+	}, nil
+}
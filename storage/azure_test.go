@@ -0,0 +1,50 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestAzurePutBlocksSize(t *testing.T) {
+	var mu sync.Mutex
+	var committed int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("comp") == "blocklist" {
+			mu.Lock()
+			committed++
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	store, err := Azure(AzureConfig{Account: "test", SASToken: "sig=test", Container: "test", Endpoint: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*azureStore)
+	ctx := context.Background()
+
+	// a truncated upload must not be committed
+	if err = s.putBlocks(ctx, "test", bytes.NewReader([]byte("test1234")), 16, "text/plain"); err == nil {
+		t.Error("expected an error on a truncated upload")
+	}
+	if committed != 0 {
+		t.Errorf("expected the block list not to be committed, got %d commits", committed)
+	}
+
+	if err = s.putBlocks(ctx, "test", bytes.NewReader([]byte("test1234")), 8, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if committed != 1 {
+		t.Errorf("expected the block list to be committed, got %d commits", committed)
+	}
+}
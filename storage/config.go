@@ -0,0 +1,68 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"os"
+
+	"github.com/omani/readium-lcp-server/config"
+)
+
+// FromConfig opens the store described by the storage section of the configuration.
+// publicBaseURL is the base URL of the items of a file system storage.
+// The latency of the operations of the store is measured.
+func FromConfig(c config.Storage, publicBaseURL string) (Store, error) {
+	s, err := fromConfig(c, publicBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	backend := c.Mode
+	if backend == "" {
+		backend = "fs"
+	}
+	return Instrument(s, backend), nil
+}
+
+func fromConfig(c config.Storage, publicBaseURL string) (Store, error) {
+	switch c.Mode {
+	case "s3":
+		return S3(S3Config{
+			ID:             c.AccessId,
+			Secret:         c.Secret,
+			Token:          c.Token,
+			Endpoint:       c.Endpoint,
+			Bucket:         c.Bucket,
+			Region:         c.Region,
+			DisableSSL:     c.DisableSSL,
+			ForcePathStyle: c.PathStyle,
+		})
+	case "azure":
+		return Azure(AzureConfig{
+			Account:       c.Azure.Account,
+			Key:           c.Azure.Key,
+			SASToken:      c.Azure.SASToken,
+			Container:     c.Azure.Container,
+			Endpoint:      c.Azure.Endpoint,
+			PublicBaseURL: c.Azure.PublicBaseUrl,
+		})
+	case "gcs":
+		return GCS(GCSConfig{
+			Bucket:          c.GCS.Bucket,
+			CredentialsFile: c.GCS.CredentialsFile,
+			Endpoint:        c.GCS.Endpoint,
+			PublicBaseURL:   c.GCS.PublicBaseUrl,
+		})
+	default:
+		storagePath := c.FileSystem.Directory
+		if storagePath == "" {
+			storagePath = "files"
+		}
+		os.MkdirAll(storagePath, os.ModePerm) //ignore the error, the folder can already exist
+		if c.FileSystem.Sharded {
+			return NewShardedFileSystem(storagePath, publicBaseURL), nil
+		}
+		return NewFileSystem(storagePath, publicBaseURL), nil
+	}
+}
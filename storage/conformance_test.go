@@ -0,0 +1,227 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The conformance suite is run against every storage backend.
+// The file system backend is always tested; other backends are tested against local emulators,
+// when the corresponding environment variable is set:
+//   LCP_TEST_S3_ENDPOINT: e.g. http://127.0.0.1:9000 for MinIO (LCP_TEST_S3_ID and LCP_TEST_S3_SECRET default to minioadmin)
+//   LCP_TEST_AZURE_ENDPOINT: e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite
+//   LCP_TEST_GCS_ENDPOINT: e.g. http://127.0.0.1:4443 for fake-gcs-server (-scheme http)
+
+// azuriteKey is the well-known shared key of the Azurite emulator account (devstoreaccount1)
+const azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// testBucket is the bucket or container used by the conformance tests
+const testBucket = "lcp-conformance"
+
+func readItem(t *testing.T, item Item) string {
+	contents, err := item.Contents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	b, err := ioutil.ReadAll(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// testStoreConformance checks the behavior expected from any Store implementation
+func testStoreConformance(t *testing.T, store Store) {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("conformance-%d-", time.Now().UnixNano())
+	key := prefix + "a"
+
+	if _, err := store.Get(ctx, key); err != ErrNotFound {
+		t.Fatalf("Get on a missing item: expected ErrNotFound, got %v", err)
+	}
+
+	item, err := store.Add(ctx, key, strings.NewReader("first version"), 13, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Key() != key {
+		t.Errorf("expected key %s, got %s", key, item.Key())
+	}
+	u, err := url.Parse(item.PublicURL())
+	if err != nil || !u.IsAbs() || !strings.HasSuffix(u.Path, "/"+key) {
+		t.Errorf("expected an absolute public URL ending with the key, got %s", item.PublicURL())
+	}
+
+	item, err = store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := readItem(t, item); c != "first version" {
+		t.Errorf("expected 'first version', got '%s'", c)
+	}
+	info := item.Stat()
+	if info.Key != key || info.Size != 13 || !strings.HasPrefix(info.ContentType, "text/plain") {
+		t.Errorf("unexpected item info %+v", info)
+	}
+	if info.ETag == "" || info.LastModified.IsZero() {
+		t.Errorf("expected an ETag and a modification time, got %+v", info)
+	}
+
+	// replace the item by a content of unknown length; the reader is not seekable
+	if _, err = store.Add(ctx, key, io.MultiReader(strings.NewReader("second "), strings.NewReader("version")), UnknownSize, ""); err != nil {
+		t.Fatal(err)
+	}
+	item, err = store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := readItem(t, item); c != "second version" {
+		t.Errorf("expected 'second version', got '%s'", c)
+	}
+	if item.Stat().ETag == info.ETag {
+		t.Error("expected the ETag to change with the content")
+	}
+
+	// paginated listing
+	for _, k := range []string{prefix + "b", prefix + "c"} {
+		if _, err = store.Add(ctx, k, bytes.NewReader([]byte(k)), int64(len(k)), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	opts := ListOptions{Prefix: prefix, Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatal("too many pages")
+		}
+		page, err := store.List(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) > 2 {
+			t.Errorf("expected at most 2 items per page, got %d", len(page.Items))
+		}
+		for _, it := range page.Items {
+			keys = append(keys, it.Key())
+			if it.Stat().Size != int64(len(readItem(t, it))) {
+				t.Errorf("unexpected size in the list for %s", it.Key())
+			}
+		}
+		if page.NextToken == "" {
+			break
+		}
+		opts.Token = page.NextToken
+	}
+	if strings.Join(keys, ",") != prefix+"a,"+prefix+"b,"+prefix+"c" {
+		t.Errorf("unexpected list %v", keys)
+	}
+
+	// a canceled upload doesn't create an item
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = store.Add(canceled, prefix+"d", strings.NewReader("canceled"), 8, ""); err == nil {
+		t.Error("expected an error on a canceled upload")
+	}
+	if _, err = store.Get(ctx, prefix+"d"); err != ErrNotFound {
+		t.Errorf("Get on a canceled upload: expected ErrNotFound, got %v", err)
+	}
+
+	for _, k := range []string{prefix + "a", prefix + "b", prefix + "c"} {
+		if err = store.Remove(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = store.Get(ctx, key); err != ErrNotFound {
+		t.Errorf("Get on a removed item: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFileSystemConformance(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	testStoreConformance(t, NewFileSystem(dir, "http://localhost/assets"))
+}
+
+func TestS3Conformance(t *testing.T) {
+	endpoint := os.Getenv("LCP_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("LCP_TEST_S3_ENDPOINT is not set")
+	}
+	id, secret := os.Getenv("LCP_TEST_S3_ID"), os.Getenv("LCP_TEST_S3_SECRET")
+	if id == "" {
+		id, secret = "minioadmin", "minioadmin"
+	}
+	store, err := S3(S3Config{
+		Bucket:         testBucket,
+		Endpoint:       endpoint,
+		Region:         "us-east-1",
+		ID:             id,
+		Secret:         secret,
+		DisableSSL:     strings.HasPrefix(endpoint, "http:"),
+		ForcePathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bucket may already exist
+	store.(*s3store).client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(testBucket)})
+
+	testStoreConformance(t, store)
+}
+
+func TestAzureConformance(t *testing.T) {
+	endpoint := os.Getenv("LCP_TEST_AZURE_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("LCP_TEST_AZURE_ENDPOINT is not set")
+	}
+	store, err := Azure(AzureConfig{
+		Account:   "devstoreaccount1",
+		Key:       azuriteKey,
+		Container: testBucket,
+		Endpoint:  endpoint,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.(*azureStore).createContainer(); err != nil {
+		t.Fatal(err)
+	}
+
+	testStoreConformance(t, store)
+}
+
+func TestGCSConformance(t *testing.T) {
+	endpoint := os.Getenv("LCP_TEST_GCS_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("LCP_TEST_GCS_ENDPOINT is not set")
+	}
+	store, err := GCS(GCSConfig{
+		Bucket:   testBucket,
+		Endpoint: endpoint,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.(*gcsStore).createBucket("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	testStoreConformance(t, store)
+}
@@ -26,86 +26,437 @@
 package storage
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// checksumExt is the extension of the sidecar file holding the sha256 checksum of an item
+const checksumExt = ".sha256"
+
+// contentTypeExt is the extension of the sidecar file holding the content type of an item, if known
+const contentTypeExt = ".type"
+
+// tmpPrefix is the prefix of temporary files created during an atomic write
+const tmpPrefix = ".tmp-"
+
+// fsDefaultPageSize is the number of items in a page, if not specified
+const fsDefaultPageSize = 1000
+
 type fsStorage struct {
-	fspath string
-	url    string
+	fspath  string
+	url     string
+	sharded bool
 }
 
 type fsItem struct {
-	name       string
-	storageDir string
-	baseURL    string
+	info    ItemInfo
+	path    string
+	baseURL string
+	relPath string
 }
 
 func (i fsItem) Key() string {
-	return i.name
+	return i.info.Key
 }
 
 func (i fsItem) PublicURL() string {
-	return i.baseURL + "/" + i.name
+	return i.baseURL + "/" + i.relPath
 }
 
-func (i fsItem) Contents() (io.ReadCloser, error) {
-	return os.Open(filepath.Join(i.storageDir, i.name))
-	// FIXME: process errors
+func (i fsItem) Stat() ItemInfo {
+	return i.info
 }
 
-func (s fsStorage) Add(key string, r io.ReadSeeker) (Item, error) {
-	file, err := os.Create(filepath.Join(s.fspath, key))
+func (i fsItem) Contents(ctx context.Context) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(i.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	io.Copy(file, r)
-
+	expected, err := ioutil.ReadFile(i.path + checksumExt)
 	if err != nil {
+		// a missing checksum only disables the verification
+		if os.IsNotExist(err) {
+			return file, nil
+		}
+		file.Close()
 		return nil, err
 	}
-	return &fsItem{name: key, storageDir: s.fspath, baseURL: s.url}, nil
+	return &checksumReader{file: file, hasher: sha256.New(), expected: strings.TrimSpace(string(expected))}, nil
 }
 
-// Get returns an Item in the storage, by its key
-// the key is the file name
-//
-func (s fsStorage) Get(key string) (Item, error) {
-	_, err := os.Stat(filepath.Join(s.fspath, key))
+// checksumReader verifies the content of a file against its checksum while it is read;
+// the reader fails with ErrCorrupted instead of io.EOF if they don't match
+type checksumReader struct {
+	file     *os.File
+	hasher   hash.Hash
+	expected string
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.file.Read(p)
+	cr.hasher.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(cr.hasher.Sum(nil)) != cr.expected {
+		return n, ErrCorrupted
+	}
+	return n, err
+}
+
+func (cr *checksumReader) Close() error {
+	return cr.file.Close()
+}
+
+// checkKey verifies that a key can be used as a file name inside the storage
+func checkKey(key string) error {
+	if key == "" || key != filepath.Base(key) || !isItemFile(key) {
+		return errors.New("Invalid storage key " + key)
+	}
+	return nil
+}
+
+// isItemFile indicates if a file name is the name of a stored item (vs a sidecar or temporary file)
+func isItemFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, checksumExt) && !strings.HasSuffix(name, contentTypeExt)
+}
+
+// shardDir returns the directory holding an item, derived from the hash of its key.
+// Two levels of sub-directories are used, e.g. <root>/3f/a2/<key>,
+// which keeps the number of entries per directory low.
+func shardDir(root, key string) string {
+	h := sha256.Sum256([]byte(key))
+	hx := hex.EncodeToString(h[:])
+	return filepath.Join(root, hx[0:2], hx[2:4])
+}
+
+// itemPath returns the path of an item in the layout of the storage
+func (s fsStorage) itemPath(key string) string {
+	if s.sharded {
+		return filepath.Join(shardDir(s.fspath, key), key)
+	}
+	return filepath.Join(s.fspath, key)
+}
+
+// otherPath returns the path of an item in the layout the storage doesn't use,
+// where it may have been stored before the layout was changed.
+func (s fsStorage) otherPath(key string) string {
+	if s.sharded {
+		return filepath.Join(s.fspath, key)
+	}
+	return filepath.Join(shardDir(s.fspath, key), key)
+}
+
+// locate returns the path of an existing item.
+// Items stored in the other layout, e.g. before a migration, are still found.
+func (s fsStorage) locate(key string) (string, error) {
+	path := s.itemPath(key)
+	_, err := os.Stat(path)
+	if err == nil {
+		return path, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	otherPath := s.otherPath(key)
+	_, err = os.Stat(otherPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	return otherPath, nil
+}
+
+// item returns the Item stored at path; its public URL mirrors its location in the storage directory
+func (s fsStorage) item(info ItemInfo, path string) *fsItem {
+	relPath, err := filepath.Rel(s.fspath, path)
+	if err != nil {
+		relPath = info.Key
+	}
+	return &fsItem{info: info, path: path, baseURL: s.url, relPath: filepath.ToSlash(relPath)}
+}
+
+// removeFiles removes an item stored at path and its sidecar files
+func removeFiles(path string) error {
+	err := os.Remove(path)
+	os.Remove(path + checksumExt)
+	os.Remove(path + contentTypeExt)
+	return err
+}
+
+// stat collects the information about an item stored at path
+func (s fsStorage) stat(key, path string) (ItemInfo, error) {
+	fi, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, ErrNotFound
+			return ItemInfo{}, ErrNotFound
 		}
+		return ItemInfo{}, err
+	}
+	info := ItemInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}
+	if sum, err := ioutil.ReadFile(path + checksumExt); err == nil {
+		info.ETag = strings.TrimSpace(string(sum))
+	} else {
+		info.ETag = fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+	}
+	if contentType, err := ioutil.ReadFile(path + contentTypeExt); err == nil {
+		info.ContentType = strings.TrimSpace(string(contentType))
+	}
+	return info, nil
+}
+
+// Add stores a new item, or replaces an existing one.
+// The content is first written to a temporary file in the target directory, synced to disk,
+// then renamed; a crash or a cancellation during the write never leaves a truncated item in the storage.
+func (s fsStorage) Add(ctx context.Context, key string, r io.Reader, size int64, contentType string) (Item, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	path := s.itemPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return nil, err
 	}
-	return &fsItem{name: key, storageDir: s.fspath, baseURL: s.url}, nil
+
+	sum, err := writeAtomic(path, contextReader{ctx, r}, size)
+	if err != nil {
+		return nil, err
+	}
+	// the checksum is written after the content, a missing checksum only disables the verification
+	if _, err = writeAtomic(path+checksumExt, strings.NewReader(sum), UnknownSize); err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		if _, err = writeAtomic(path+contentTypeExt, strings.NewReader(contentType), UnknownSize); err != nil {
+			return nil, err
+		}
+	} else {
+		os.Remove(path + contentTypeExt)
+	}
+	// remove a copy of the item stored in the other layout, which would be out of date
+	removeFiles(s.otherPath(key))
+
+	info, err := s.stat(key, path)
+	if err != nil {
+		return nil, err
+	}
+	return s.item(info, path), nil
 }
 
+// writeAtomic writes the content of r to path via a temporary file, and returns its hex encoded sha256.
+// If size is known and doesn't match the number of bytes read, the temporary file is discarded
+// and a previous version of the file is left untouched.
+func writeAtomic(path string, r io.Reader, size int64) (string, error) {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, tmpPrefix)
+	if err != nil {
+		return "", err
+	}
+	// no effect once the temp file has been renamed
+	defer os.Remove(tmp.Name())
 
-func (s fsStorage) Remove(key string) error {
-	return os.Remove(filepath.Join(s.fspath, key))
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if size != UnknownSize && written != size {
+		tmp.Close()
+		return "", fmt.Errorf("Unexpected size for %s: %d bytes read, %d expected", filepath.Base(path), written, size)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	// remove the checksum of a previous version before the content changes
+	if isItemFile(filepath.Base(path)) {
+		os.Remove(path + checksumExt)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	syncDir(dir)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func (s fsStorage) List() ([]Item, error) {
-	var items []Item
+// syncDir flushes a directory entry to disk.
+// This is a best effort, as syncing a directory is not supported on every platform.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
 
-	files, err := ioutil.ReadDir(s.fspath)
+// Get returns an Item in the storage, by its key
+// the key is the file name.
+// The content of the item is verified against the checksum recorded when it was added, as it is read.
+func (s fsStorage) Get(ctx context.Context, key string) (Item, error) {
+	if err := checkKey(key); err != nil {
+		return nil, ErrNotFound
+	}
+	path, err := s.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.stat(key, path)
 	if err != nil {
 		return nil, err
 	}
+	return s.item(info, path), nil
+}
+
+func (s fsStorage) Remove(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return ErrNotFound
+	}
+	path, err := s.locate(key)
+	if err != nil {
+		return err
+	}
+	return removeFiles(path)
+}
+
+// List walks through the storage directory; items are sorted by key,
+// the token is the key of the last item of the previous page.
+func (s fsStorage) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	paths := make(map[string]string)
+	var keys []string
+
+	err := filepath.Walk(s.fspath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() || !isItemFile(name) || !strings.HasPrefix(name, opts.Prefix) || name <= opts.Token {
+			return nil
+		}
+		keys = append(keys, name)
+		paths[name] = path
+		return nil
+	})
+	if err != nil {
+		return ListPage{}, err
+	}
+	sort.Strings(keys)
 
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = fsDefaultPageSize
+	}
+	var page ListPage
+	if len(keys) > limit {
+		keys = keys[:limit]
+		page.NextToken = keys[limit-1]
+	}
+	for _, key := range keys {
+		info, err := s.stat(key, paths[key])
+		if err != nil {
+			return ListPage{}, err
+		}
+		page.Items = append(page.Items, s.item(info, paths[key]))
+	}
+	return page, nil
+}
+
+// MigrateFileSystem moves the items of a flat storage directory into sharded sub-directories
+// and computes their checksum. The checksum is written before the item is moved,
+// so that a migrated item is always verified; the migration can be interrupted and run again.
+// It returns the number of migrated items.
+func MigrateFileSystem(dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
 	for _, fi := range files {
-		items = append(items, &fsItem{name: fi.Name(), storageDir: s.fspath, baseURL: s.url})
+		if fi.IsDir() || checkKey(fi.Name()) != nil {
+			continue
+		}
+		key := fi.Name()
+		shard := shardDir(dir, key)
+		if err = os.MkdirAll(shard, os.ModePerm); err != nil {
+			return count, err
+		}
+		path := filepath.Join(shard, key)
+		file, err := os.Open(filepath.Join(dir, key))
+		if err != nil {
+			return count, err
+		}
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, file)
+		file.Close()
+		if err != nil {
+			return count, err
+		}
+		if _, err = writeAtomic(path+checksumExt, strings.NewReader(hex.EncodeToString(hasher.Sum(nil))), UnknownSize); err != nil {
+			return count, err
+		}
+		legacyPath := filepath.Join(dir, key)
+		if err = os.Rename(legacyPath+contentTypeExt, path+contentTypeExt); err != nil && !os.IsNotExist(err) {
+			return count, err
+		}
+		if err = os.Rename(legacyPath, path); err != nil {
+			return count, err
+		}
+		os.Remove(legacyPath + checksumExt)
+		syncDir(dir)
+		count++
 	}
+	return count, nil
+}
 
-	return items, nil
+// Check checks that the storage directory exists and, if writable is set, that files can be created in it
+func (s fsStorage) Check(ctx context.Context, writable bool) error {
+	info, err := os.Stat(s.fspath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(s.fspath + " is not a directory")
+	}
+	if !writable {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(s.fspath, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
 }
 
-// NewFileSystem creates a new storage
-//
+// NewFileSystem creates a new storage, in which items are stored in a flat directory
 func NewFileSystem(dir, basePath string) Store {
-	return fsStorage{dir, basePath}
+	return fsStorage{fspath: dir, url: basePath}
+}
+
+// NewShardedFileSystem creates a new storage, in which items are stored in two levels
+// of sub-directories derived from the hash of their key
+func NewShardedFileSystem(dir, basePath string) Store {
+	return fsStorage{fspath: dir, url: basePath, sharded: true}
 }
@@ -27,8 +27,10 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -48,7 +50,7 @@ func TestFileSystemStorage(t *testing.T) {
 
 	store := NewFileSystem(dir, "http://localhost/assets")
 
-	item, err := store.Add("test", bytes.NewReader([]byte("test1234")))
+	item, err := store.Add(context.Background(), "test", bytes.NewReader([]byte("test1234")), 8, "text/plain")
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -73,7 +75,7 @@ func TestFileSystemStorage(t *testing.T) {
 	}
 
 	var buf [8]byte
-	contents, err := item.Contents()
+	contents, err := item.Contents(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,7 +87,7 @@ func TestFileSystemStorage(t *testing.T) {
 		}
 	}
 
-	results, err := store.List()
+	results, err := ListAll(context.Background(), store, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,3 +97,214 @@ func TestFileSystemStorage(t *testing.T) {
 	}
 
 }
+
+func newTestDir(t *testing.T) string {
+	dir := filepath.Join(os.TempDir(), "lcpserve_test_store", fmt.Sprintf("%d", rand.New(rand.NewSource(time.Now().UnixNano())).Int()))
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal("Could not create temp directory for test", err)
+	}
+	return dir
+}
+
+func TestFileSystemShardingAndChecksum(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	store := NewShardedFileSystem(dir, "http://localhost/assets")
+
+	added, err := store.Add(context.Background(), "test", bytes.NewReader([]byte("test1234")), 8, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(shardDir(dir, "test"), "test")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the item to be stored in %s, got %s", path, err)
+	}
+	rel, _ := filepath.Rel(dir, path)
+	if expected := "http://localhost/assets/" + filepath.ToSlash(rel); added.PublicURL() != expected {
+		t.Errorf("expected item url to be %s, got %s", expected, added.PublicURL())
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected the item, its checksum and its content type only, got %d files", len(entries))
+	}
+
+	if _, err := store.Get(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the item behind the back of the storage
+	if err := ioutil.WriteFile(path, []byte("test12"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	item, err := store.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := item.Contents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(contents)
+	contents.Close()
+	if err != ErrCorrupted {
+		t.Errorf("expected ErrCorrupted, got %v", err)
+	}
+	if string(b) != "test12" {
+		t.Errorf("expected the content to be streamed before the verification, got %s", b)
+	}
+
+	if err := store.Remove(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(context.Background(), "test"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Add(context.Background(), "../test", bytes.NewReader([]byte("test1234")), 8, ""); err == nil {
+		t.Error("expected an error on an invalid key")
+	}
+}
+
+func TestFileSystemTruncatedUpload(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	store := NewShardedFileSystem(dir, "http://localhost/assets")
+
+	if _, err := store.Add(context.Background(), "test", bytes.NewReader([]byte("test1234")), 8, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	// a truncated re-upload fails and leaves the previous version untouched
+	if _, err := store.Add(context.Background(), "test", bytes.NewReader([]byte("new")), 8, "text/plain"); err == nil {
+		t.Fatal("expected an error on a size mismatch")
+	}
+	item, err := store.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := item.Contents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	b, err := ioutil.ReadAll(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "test1234" {
+		t.Errorf("expected the previous version, got %s", b)
+	}
+	entries, err := ioutil.ReadDir(shardDir(dir, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected no temporary file to be left, got %d files", len(entries))
+	}
+}
+
+func TestMigrateFileSystem(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("content "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewShardedFileSystem(dir, "http://localhost/assets")
+	// legacy items are still accessible before the migration
+	if _, err := store.Get(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := MigrateFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 migrated items, got %d", count)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Error("expected a to be moved out of the root directory")
+	}
+
+	results, err := ListAll(context.Background(), store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Errorf("expected 3 items, got %d", len(results))
+	}
+	item, err := store.Get(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := item.Contents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer contents.Close()
+	b, _ := ioutil.ReadAll(contents)
+	if string(b) != "content b" {
+		t.Errorf("expected 'content b', got %s", b)
+	}
+	if _, err := os.Stat(filepath.Join(shardDir(dir, "b"), "b"+checksumExt)); err != nil {
+		t.Errorf("expected the checksum to be moved with the item, got %v", err)
+	}
+}
+
+func TestFileSystemLayoutChange(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	flat := NewFileSystem(dir, "http://localhost/assets")
+	if _, err := flat.Add(context.Background(), "test", bytes.NewReader([]byte("test1234")), 8, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sharded storage finds the flat item, and replaces it along with its sidecar files
+	sharded := NewShardedFileSystem(dir, "http://localhost/assets")
+	item, err := sharded.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.PublicURL() != "http://localhost/assets/test" {
+		t.Errorf("expected the url of the flat item, got %s", item.PublicURL())
+	}
+	if _, err := sharded.Add(context.Background(), "test", bytes.NewReader([]byte("test5678")), 8, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			t.Errorf("expected the flat item and its sidecar files to be removed, found %s", entry.Name())
+		}
+	}
+}
+
+func TestFileSystemCheck(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileSystem(dir, "http://localhost/files")
+
+	if err := Check(context.Background(), s, true); err != nil {
+		t.Errorf("Expected a writable storage, got %v", err)
+	}
+	// the check leaves no file behind
+	if page, err := s.List(context.Background(), ListOptions{}); err != nil || len(page.Items) != 0 {
+		t.Errorf("Expected an empty storage, got %d items, %v", len(page.Items), err)
+	}
+	if err := Check(context.Background(), NewFileSystem(filepath.Join(dir, "missing"), ""), false); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
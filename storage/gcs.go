@@ -0,0 +1,486 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsDefaultEndpoint is the endpoint of the Google Cloud Storage JSON API
+const gcsDefaultEndpoint = "https://storage.googleapis.com"
+
+// gcsScope is the OAuth2 scope requested for the storage
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsMetadataTokenURL is the URL of the access token of the default service account,
+// provided by the metadata server when running on Google Cloud
+const gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+type gcsStore struct {
+	bucket    string
+	endpoint  string
+	publicURL string
+	client    *http.Client
+	tokens    gcsTokenSource
+}
+
+type gcsItem struct {
+	info  ItemInfo
+	store *gcsStore
+}
+
+// gcsError is returned when the Google Cloud Storage service replies with an unexpected status
+type gcsError struct {
+	status int
+	method string
+	path   string
+}
+
+func (e *gcsError) Error() string {
+	return fmt.Sprintf("GCS storage error %d on %s %s", e.status, e.method, e.path)
+}
+
+func (i gcsItem) Key() string {
+	return i.info.Key
+}
+
+func (i gcsItem) PublicURL() string {
+	if i.store.publicURL != "" {
+		return i.store.publicURL + "/" + url.PathEscape(i.info.Key)
+	}
+	return i.store.endpoint + "/" + i.store.bucket + "/" + url.PathEscape(i.info.Key)
+}
+
+func (i gcsItem) Stat() ItemInfo {
+	return i.info
+}
+
+func (i gcsItem) Contents(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := i.store.do(ctx, "GET", i.store.objectURL(i.info.Key)+"?alt=media", nil, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// objectURL returns the JSON API URL of an object
+func (s *gcsStore) objectURL(key string) string {
+	return s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(key)
+}
+
+// do sends an authenticated request to the storage service.
+// A response status other than 2xx (or 308, used by resumable uploads) is returned as an error;
+// 404 is returned as ErrNotFound.
+func (s *gcsStore) do(ctx context.Context, method, rawURL string, body io.Reader, length int64, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if s.tokens != nil {
+		token, err := s.tokens.token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusPermanentRedirect {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, &gcsError{status: resp.StatusCode, method: method, path: req.URL.Path}
+	}
+	return resp, nil
+}
+
+// gcsObject is the resource describing an object in the JSON API
+type gcsObject struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size,string"`
+	ContentType string    `json:"contentType"`
+	ETag        string    `json:"etag"`
+	Updated     time.Time `json:"updated"`
+}
+
+func (s *gcsStore) item(o gcsObject) Item {
+	return gcsItem{
+		info: ItemInfo{
+			Key:          o.Name,
+			Size:         o.Size,
+			ContentType:  o.ContentType,
+			ETag:         o.ETag,
+			LastModified: o.Updated,
+		},
+		store: s,
+	}
+}
+
+// Add uploads an object in a single request if its size is known,
+// or via a resumable upload, chunk by chunk, if its size is unknown.
+func (s *gcsStore) Add(ctx context.Context, key string, r io.Reader, size int64, contentType string) (Item, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	uploadURL := s.endpoint + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?name=" + url.QueryEscape(key)
+
+	var resp *http.Response
+	var err error
+	if size != UnknownSize {
+		resp, err = s.do(ctx, "POST", uploadURL+"&uploadType=media", r, size, map[string]string{"Content-Type": contentType})
+	} else {
+		resp, err = s.uploadChunks(ctx, uploadURL+"&uploadType=resumable", r, contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var o gcsObject
+	if err = json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return nil, err
+	}
+	return s.item(o), nil
+}
+
+// gcsChunkSize is the size of a chunk in a resumable upload, a multiple of 256 KiB
+const gcsChunkSize = 8 << 20
+
+// uploadChunks sends a content of unknown length through a resumable upload session
+// and returns the final response, which describes the object
+func (s *gcsStore) uploadChunks(ctx context.Context, sessionURL string, r io.Reader, contentType string) (*http.Response, error) {
+	resp, err := s.do(ctx, "POST", sessionURL, nil, 0, map[string]string{"X-Upload-Content-Type": contentType})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, errors.New("GCS storage: missing resumable upload location")
+	}
+
+	br := bufio.NewReaderSize(r, gcsChunkSize)
+	buf := make([]byte, gcsChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		// the total size is declared with the last chunk
+		_, peekErr := br.Peek(1)
+		last := peekErr != nil
+		contentRange := "bytes */*"
+		if n > 0 {
+			contentRange = fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(n)-1)
+		}
+		if last {
+			total := offset + int64(n)
+			contentRange = strings.TrimSuffix(contentRange, "*") + strconv.FormatInt(total, 10)
+		}
+		resp, err = s.do(ctx, "PUT", location, bytes.NewReader(buf[:n]), int64(n), map[string]string{"Content-Range": contentRange})
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			if resp.StatusCode == http.StatusPermanentRedirect {
+				resp.Body.Close()
+				return nil, errors.New("GCS storage: incomplete resumable upload")
+			}
+			return resp, nil
+		}
+		resp.Body.Close()
+		offset += int64(n)
+	}
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string) (Item, error) {
+	resp, err := s.do(ctx, "GET", s.objectURL(key), nil, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var o gcsObject
+	if err = json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return nil, err
+	}
+	return s.item(o), nil
+}
+
+func (s *gcsStore) Remove(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, "DELETE", s.objectURL(key), nil, -1, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type gcsObjectList struct {
+	Items         []gcsObject `json:"items"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+func (s *gcsStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	query := url.Values{}
+	query.Set("fields", "items(name,size,contentType,etag,updated),nextPageToken")
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Token != "" {
+		query.Set("pageToken", opts.Token)
+	}
+	if opts.Limit > 0 {
+		query.Set("maxResults", strconv.Itoa(opts.Limit))
+	}
+	resp, err := s.do(ctx, "GET", s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), nil, -1, nil)
+	if err != nil {
+		return ListPage{}, err
+	}
+	var list gcsObjectList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	page := ListPage{NextToken: list.NextPageToken}
+	for _, o := range list.Items {
+		page.Items = append(page.Items, s.item(o))
+	}
+	return page, nil
+}
+
+// createBucket creates the bucket of the store if it doesn't exist yet
+func (s *gcsStore) createBucket(project string) error {
+	body, _ := json.Marshal(map[string]string{"name": s.bucket})
+	resp, err := s.do(context.Background(), "POST", s.endpoint+"/storage/v1/b?project="+url.QueryEscape(project), bytes.NewReader(body), int64(len(body)), map[string]string{"Content-Type": "application/json"})
+	if err != nil {
+		// the bucket already exists
+		if e, ok := err.(*gcsError); ok && e.status == http.StatusConflict {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// gcsTokenSource provides OAuth2 access tokens
+type gcsTokenSource interface {
+	token() (string, error)
+}
+
+// cachedToken is an access token and its expiry time
+type cachedToken struct {
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+// get returns the cached token, or fetches a new one
+func (c *cachedToken) get(fetch func() (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// renew the token a minute before its expiry
+	if c.value != "" && time.Now().Add(time.Minute).Before(c.expires) {
+		return c.value, nil
+	}
+	value, lifetime, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	c.value = value
+	c.expires = time.Now().Add(lifetime)
+	return value, nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// readTokenResponse decodes the reply of a token endpoint
+func readTokenResponse(resp *http.Response) (string, time.Duration, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("GCS storage: token request failed with status %d", resp.StatusCode)
+	}
+	var t tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", 0, err
+	}
+	return t.AccessToken, time.Duration(t.ExpiresIn) * time.Second, nil
+}
+
+// serviceAccountTokens exchanges a JWT signed with the key of a service account for access tokens
+type serviceAccountTokens struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	client   *http.Client
+	cache    cachedToken
+}
+
+type serviceAccountFile struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func newServiceAccountTokens(path string, client *http.Client) (*serviceAccountTokens, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sa serviceAccountFile
+	if err = json.Unmarshal(b, &sa); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("GCS storage: invalid private key in " + path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("GCS storage: the private key must be an RSA key")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &serviceAccountTokens{email: sa.ClientEmail, key: key, tokenURI: sa.TokenURI, client: client}, nil
+}
+
+func (t *serviceAccountTokens) token() (string, error) {
+	return t.cache.get(func() (string, time.Duration, error) {
+		assertion, err := t.assertion()
+		if err != nil {
+			return "", 0, err
+		}
+		resp, err := t.client.PostForm(t.tokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		return readTokenResponse(resp)
+	})
+}
+
+// assertion builds a JWT signed with RS256, as expected by the token endpoint
+func (t *serviceAccountTokens) assertion() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   t.email,
+		"scope": gcsScope,
+		"aud":   t.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, t.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// metadataTokens gets access tokens from the metadata server of a Google Cloud instance
+type metadataTokens struct {
+	client *http.Client
+	cache  cachedToken
+}
+
+func (t *metadataTokens) token() (string, error) {
+	return t.cache.get(func() (string, time.Duration, error) {
+		req, err := http.NewRequest("GET", gcsMetadataTokenURL, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return "", 0, err
+		}
+		return readTokenResponse(resp)
+	})
+}
+
+// GCSConfig structure
+type GCSConfig struct {
+	Bucket string
+	// CredentialsFile is the path to the json key of a service account.
+	// If missing, credentials are requested from the metadata server of the Google Cloud instance,
+	// unless a custom endpoint is set (e.g. an emulator), in which case no credentials are used.
+	CredentialsFile string
+	// Endpoint is optional, https://storage.googleapis.com by default
+	Endpoint string
+	// PublicBaseURL is optional, e.g. the URL of a CDN in front of the bucket
+	PublicBaseURL string
+}
+
+// GCS inits a Google Cloud Storage
+func GCS(config GCSConfig) (Store, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("GCS storage: bucket is required")
+	}
+	client := &http.Client{}
+	store := &gcsStore{
+		bucket:    config.Bucket,
+		endpoint:  strings.TrimRight(config.Endpoint, "/"),
+		publicURL: strings.TrimRight(config.PublicBaseURL, "/"),
+		client:    client,
+	}
+	if config.CredentialsFile != "" {
+		tokens, err := newServiceAccountTokens(config.CredentialsFile, client)
+		if err != nil {
+			return nil, err
+		}
+		store.tokens = tokens
+	} else if config.Endpoint == "" {
+		store.tokens = &metadataTokens{client: client}
+	}
+	if store.endpoint == "" {
+		store.endpoint = gcsDefaultEndpoint
+	}
+	return store, nil
+}
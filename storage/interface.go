@@ -26,24 +26,139 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"io"
+	"strings"
+	"time"
 )
 
 // ErrNotFound is not found
 var ErrNotFound = errors.New("Item could not be found")
 
+// ErrCorrupted signals that the content of an item does not match its checksum
+var ErrCorrupted = errors.New("Item content does not match its checksum")
+
+// UnknownSize is passed to Store.Add when the length of the content is not known in advance
+const UnknownSize = -1
+
+// DerivedSeparator separates the key of a content from the name of a file derived from it,
+// e.g. the metadata of a publication
+const DerivedSeparator = "~"
+
+// DerivedKey returns the key of a file derived from the content stored under key
+func DerivedKey(key, name string) string {
+	return key + DerivedSeparator + name
+}
+
+// BaseKey returns the key of the content a derived file belongs to; ok is false if key is not a derived key
+func BaseKey(key string) (base string, ok bool) {
+	i := strings.LastIndex(key, DerivedSeparator)
+	if i <= 0 {
+		return "", false
+	}
+	return key[:i], true
+}
+
+// ItemInfo describes a stored item.
+// ContentType and ETag may be empty if the backend doesn't provide them, e.g. when listing S3 objects.
+type ItemInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
 // Item interface
 type Item interface {
 	Key() string
 	PublicURL() string
-	Contents() (io.ReadCloser, error)
+	// Stat returns the information collected when the item was added, fetched or listed
+	Stat() ItemInfo
+	Contents(ctx context.Context) (io.ReadCloser, error)
+}
+
+// ListOptions selects a page of items
+type ListOptions struct {
+	// Prefix restricts the list to keys starting with this value
+	Prefix string
+	// Token is the NextToken of the previous page, empty for the first page
+	Token string
+	// Limit is the maximum number of items in a page; the backend default if 0
+	Limit int
+}
+
+// ListPage is a page of items, sorted by key
+type ListPage struct {
+	Items []Item
+	// NextToken is empty on the last page
+	NextToken string
 }
 
 // Store interface
 type Store interface {
-	Add(key string, r io.ReadSeeker) (Item, error)
-	Get(key string) (Item, error)
-	Remove(key string) error
-	List() ([]Item, error)
+	// Add stores the content read from r, until EOF; size is UnknownSize if the length of the content is not known
+	Add(ctx context.Context, key string, r io.Reader, size int64, contentType string) (Item, error)
+	Get(ctx context.Context, key string) (Item, error)
+	Remove(ctx context.Context, key string) error
+	List(ctx context.Context, opts ListOptions) (ListPage, error)
+}
+
+// Checker is implemented by the stores which can check the reachability of their backend
+type Checker interface {
+	// Check returns an error if the backend cannot be reached; writable also checks that items can be added
+	Check(ctx context.Context, writable bool) error
+}
+
+// Check checks that the backend of a store is reachable, and writable if requested.
+// Stores which don't implement Checker are checked by listing an item.
+func Check(ctx context.Context, s Store, writable bool) error {
+	if c, ok := s.(Checker); ok {
+		return c.Check(ctx, writable)
+	}
+	_, err := s.List(ctx, ListOptions{Limit: 1})
+	return err
+}
+
+// ListAll returns every item whose key starts with prefix, walking through all pages
+func ListAll(ctx context.Context, s Store, prefix string) ([]Item, error) {
+	var items []Item
+	opts := ListOptions{Prefix: prefix}
+	for {
+		page, err := s.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		if page.NextToken == "" {
+			return items, nil
+		}
+		opts.Token = page.NextToken
+	}
+}
+
+// contextReader stops reading as soon as its context is canceled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// countingReader counts the bytes read from its source
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
 }
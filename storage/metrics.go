@@ -0,0 +1,92 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/omani/readium-lcp-server/metrics"
+	"github.com/omani/readium-lcp-server/tracing"
+)
+
+var (
+	// operationDuration measures the latency of storage operations
+	operationDuration = metrics.NewHistogramVec("storage_operation_duration_seconds",
+		"Latency of storage operations, by backend and operation", metrics.DefaultBuckets, "backend", "operation")
+	// operationErrors counts the storage operations which failed; a missing item is not an error
+	operationErrors = metrics.NewCounterVec("storage_operation_errors_total",
+		"Number of failed storage operations, by backend and operation", "backend", "operation")
+)
+
+// instrumentedStore measures the latency of the operations of a store and traces them
+type instrumentedStore struct {
+	store   Store
+	backend string
+}
+
+// Instrument returns a store measuring the latency of the operations of s and tracing them;
+// backend labels the metrics and the spans
+func Instrument(s Store, backend string) Store {
+	return &instrumentedStore{store: s, backend: backend}
+}
+
+// start starts the span of an operation
+func (s *instrumentedStore) start(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "storage "+operation, append([]attribute.KeyValue{attribute.String("storage.backend", s.backend)}, attrs...)...)
+}
+
+func (s *instrumentedStore) observe(span trace.Span, operation string, start time.Time, err error) {
+	// a missing item is not a failure of the storage
+	if err == ErrNotFound {
+		tracing.End(span, nil)
+	} else {
+		tracing.End(span, err)
+	}
+	operationDuration.With(s.backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil && err != ErrNotFound {
+		operationErrors.With(s.backend, operation).Inc()
+	}
+}
+
+func (s *instrumentedStore) Add(ctx context.Context, key string, r io.Reader, size int64, contentType string) (Item, error) {
+	ctx, span := s.start(ctx, "add", attribute.String("storage.key", key))
+	start := time.Now()
+	item, err := s.store.Add(ctx, key, r, size, contentType)
+	s.observe(span, "add", start, err)
+	return item, err
+}
+
+func (s *instrumentedStore) Get(ctx context.Context, key string) (Item, error) {
+	ctx, span := s.start(ctx, "get", attribute.String("storage.key", key))
+	start := time.Now()
+	item, err := s.store.Get(ctx, key)
+	s.observe(span, "get", start, err)
+	return item, err
+}
+
+func (s *instrumentedStore) Remove(ctx context.Context, key string) error {
+	ctx, span := s.start(ctx, "remove", attribute.String("storage.key", key))
+	start := time.Now()
+	err := s.store.Remove(ctx, key)
+	s.observe(span, "remove", start, err)
+	return err
+}
+
+func (s *instrumentedStore) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	ctx, span := s.start(ctx, "list")
+	start := time.Now()
+	page, err := s.store.List(ctx, opts)
+	s.observe(span, "list", start, err)
+	return page, err
+}
+
+func (s *instrumentedStore) Check(ctx context.Context, writable bool) error {
+	return Check(ctx, s.store, writable)
+}
@@ -0,0 +1,40 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestInstrument(t *testing.T) {
+	store := Instrument(NewFileSystem(t.TempDir(), "http://localhost/assets"), "test")
+	ctx := context.Background()
+
+	if _, err := store.Add(ctx, "test", bytes.NewReader([]byte("test1234")), 8, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Add(ctx, "../escape", bytes.NewReader(nil), 0, "text/plain"); err == nil {
+		t.Error("Expected an error for an invalid key")
+	}
+
+	if n := operationDuration.With("test", "get").Count(); n != 1 {
+		t.Errorf("Expected 1 get operation, got %d", n)
+	}
+	if n := operationDuration.With("test", "add").Count(); n != 2 {
+		t.Errorf("Expected 2 add operations, got %d", n)
+	}
+	// a missing item is not an error of the storage
+	if v := operationErrors.With("test", "get").Value(); v != 0 {
+		t.Errorf("Expected no get error, got %v", v)
+	}
+	if v := operationErrors.With("test", "add").Value(); v != 1 {
+		t.Errorf("Expected 1 add error, got %v", v)
+	}
+}
@@ -26,65 +26,116 @@
 package storage
 
 import (
-	"fmt"
+	"context"
 	"io"
+	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type s3store struct {
-	bucket string
-	client *s3.S3
+	bucket    string
+	pathStyle bool
+	client    *s3.S3
+	uploader  *s3manager.Uploader
 }
 
 type s3item struct {
 	bucket string
-	key    string
+	info   ItemInfo
 	store  *s3store
 }
 
 func (i s3item) Key() string {
-	return i.key
+	return i.info.Key
 }
 
+// PublicURL returns the URL of the object, path-style or virtual-hosted-style
+// depending on the configuration of the storage
 func (i s3item) PublicURL() string {
-	return fmt.Sprintf("http://%s/%s/%s", i.store.client.Endpoint, i.bucket, i.key)
+	endpoint, err := url.Parse(i.store.client.Endpoint)
+	if err != nil {
+		return ""
+	}
+	if i.store.pathStyle {
+		endpoint.Path += "/" + i.bucket + "/" + url.PathEscape(i.info.Key)
+	} else {
+		endpoint.Host = i.bucket + "." + endpoint.Host
+		endpoint.Path += "/" + url.PathEscape(i.info.Key)
+	}
+	return endpoint.String()
 }
 
-func (i s3item) Contents() (io.ReadCloser, error) {
-	resp, err := i.store.client.GetObject(&s3.GetObjectInput{
+func (i s3item) Stat() ItemInfo {
+	return i.info
+}
+
+func (i s3item) Contents(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := i.store.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(i.store.bucket),
-		Key:    aws.String(i.key),
+		Key:    aws.String(i.info.Key),
 	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
 
-	return resp.Body, err
+	return resp.Body, nil
 }
 
-func (s *s3store) Add(key string, r io.ReadSeeker) (Item, error) {
-	_, err := s.client.PutObject(&s3.PutObjectInput{
+// s3Error maps a "not found" error from S3 to ErrNotFound
+func s3Error(err error) error {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Add uploads an object; the upload manager switches to a multipart upload
+// if the content is larger than a part, which allows contents of unknown length.
+func (s *s3store) Add(ctx context.Context, key string, r io.Reader, size int64, contentType string) (Item, error) {
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 		Body:   r,
-	})
-
-	item := s3item{bucket: s.bucket, key: key, store: s}
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
 
-	return item, err
+	return s.Get(ctx, key)
 }
 
-func (s *s3store) Get(key string) (Item, error) {
-	_, err := s.client.HeadObject(&s3.HeadObjectInput{
+func (s *s3store) Get(ctx context.Context, key string) (Item, error) {
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
-	return s3item{bucket: s.bucket, key: key, store: s}, err
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	info := ItemInfo{
+		Key:          key,
+		Size:         aws.Int64Value(head.ContentLength),
+		ContentType:  aws.StringValue(head.ContentType),
+		ETag:         strings.Trim(aws.StringValue(head.ETag), `"`),
+		LastModified: aws.TimeValue(head.LastModified),
+	}
+	return s3item{bucket: s.bucket, info: info, store: s}, nil
 }
 
-func (s *s3store) Remove(key string) error {
-	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+func (s *s3store) Remove(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
@@ -92,22 +143,49 @@ func (s *s3store) Remove(key string) error {
 	return err
 }
 
-func (s *s3store) List() ([]Item, error) {
-	objects, err := s.client.ListObjects(&s3.ListObjectsInput{
+// Check checks that the bucket exists and is accessible with the credentials of the store;
+// write access cannot be checked without adding an object
+func (s *s3store) Check(ctx context.Context, writable bool) error {
+	_, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(s.bucket),
 	})
+	return err
+}
 
+// List returns a page of objects; the content type of the objects is not provided by S3
+func (s *s3store) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+	if opts.Prefix != "" {
+		input.Prefix = aws.String(opts.Prefix)
+	}
+	if opts.Token != "" {
+		input.ContinuationToken = aws.String(opts.Token)
+	}
+	if opts.Limit > 0 {
+		input.MaxKeys = aws.Int64(int64(opts.Limit))
+	}
+	objects, err := s.client.ListObjectsV2WithContext(ctx, input)
 	if err != nil {
-		return nil, err
+		return ListPage{}, err
 	}
 
-	var items []Item
-
+	var page ListPage
 	for _, o := range objects.Contents {
-		items = append(items, s3item{bucket: s.bucket, key: *o.Key, store: s})
+		info := ItemInfo{
+			Key:          aws.StringValue(o.Key),
+			Size:         aws.Int64Value(o.Size),
+			ETag:         strings.Trim(aws.StringValue(o.ETag), `"`),
+			LastModified: aws.TimeValue(o.LastModified),
+		}
+		page.Items = append(page.Items, s3item{bucket: s.bucket, info: info, store: s})
+	}
+	if aws.BoolValue(objects.IsTruncated) {
+		page.NextToken = aws.StringValue(objects.NextContinuationToken)
 	}
 
-	return items, nil
+	return page, nil
 }
 
 // S3Config structure
@@ -140,5 +218,6 @@ func S3(config S3Config) (Store, error) {
 		awsConfig.Credentials = credentials.NewStaticCredentials(config.ID, config.Secret, config.Token)
 	}
 
-	return &s3store{client: s3.New(session.New(awsConfig)), bucket: config.Bucket}, nil
+	client := s3.New(session.New(awsConfig))
+	return &s3store{client: client, uploader: s3manager.NewUploaderWithClient(client), bucket: config.Bucket, pathStyle: config.ForcePathStyle}, nil
 }
@@ -0,0 +1,158 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+//go:build debug
+// +build debug
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/omani/readium-lcp-server/epub"
+	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/rwpm"
+	"github.com/omani/readium-lcp-server/xmlenc"
+)
+
+// writeClearText writes a clear-text copy of a protected publication:
+// encrypted resources are decrypted, the license is removed and the encryption metadata is updated.
+// Obfuscated fonts are kept as is.
+func writeClearText(zr *zip.Reader, resources []encryptedResource, key []byte, path string) error {
+	encrypted := make(map[string]encryptedResource)
+	for _, res := range resources {
+		encrypted[res.Path] = res
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+
+	// the mimetype file must come first and must not be compressed
+	for _, f := range zr.File {
+		if f.Name == "mimetype" {
+			if err = copyZipFile(zw, f, zip.Store); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range zr.File {
+		switch {
+		case f.Name == "mimetype", f.Name == epub.LicenseFile, f.Name == "license.lcpl", f.FileInfo().IsDir():
+			continue
+		case f.Name == epub.EncryptionFile:
+			err = writeObfuscationManifest(zw, f)
+		case f.Name == pack.ManifestLocation:
+			err = writeClearManifest(zw, f)
+		default:
+			if res, ok := encrypted[f.Name]; ok {
+				err = writeDecryptedFile(zw, f, res, key)
+			} else {
+				err = copyZipFile(zw, f, f.Method)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func createZipFile(zw *zip.Writer, name string, method uint16) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+}
+
+// copyZipFile copies an entry of a zip file as is
+func copyZipFile(zw *zip.Writer, f *zip.File, method uint16) error {
+	w, err := createZipFile(zw, f.Name, method)
+	if err != nil {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+func writeDecryptedFile(zw *zip.Writer, f *zip.File, res encryptedResource, key []byte) error {
+	data, err := decryptResource(f, res, key)
+	if err != nil {
+		return err
+	}
+	w, err := createZipFile(zw, f.Name, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// writeObfuscationManifest rewrites encryption.xml with the obfuscated fonts only, or drops it if there are none
+func writeObfuscationManifest(zw *zip.Writer, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	manifest, err := xmlenc.Read(rc)
+	if err != nil {
+		return err
+	}
+	var obfuscated []xmlenc.Data
+	for _, d := range manifest.Data {
+		if d.Obfuscated() {
+			obfuscated = append(obfuscated, d)
+		}
+	}
+	if len(obfuscated) == 0 {
+		return nil
+	}
+	manifest.Data = obfuscated
+	w, err := createZipFile(zw, f.Name, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	return manifest.Write(w)
+}
+
+// writeClearManifest rewrites manifest.json without the encryption properties
+func writeClearManifest(zw *zip.Writer, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var manifest rwpm.Publication
+	if err = json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return err
+	}
+	for _, links := range [][]rwpm.Link{manifest.ReadingOrder, manifest.Resources} {
+		for i := range links {
+			if links[i].Properties != nil {
+				links[i].Properties.Encrypted = nil
+			}
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	w, err := createZipFile(zw, f.Name, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, bytes.NewReader(data))
+	return err
+}
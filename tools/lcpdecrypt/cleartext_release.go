@@ -0,0 +1,18 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+//go:build !debug
+// +build !debug
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+)
+
+// writeClearText is not available in release builds: clear-text copies are for test and debug builds only
+func writeClearText(zr *zip.Reader, resources []encryptedResource, key []byte, path string) error {
+	return errors.New("clear-text copies are only available in debug builds (go build -tags debug)")
+}
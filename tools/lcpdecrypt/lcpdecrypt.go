@@ -0,0 +1,319 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// This tool checks that a protected publication (EPUB or Readium package) decrypts correctly with a license and a passphrase.
+// It validates the license signature, derives the user key, checks the key_check, decrypts the content key,
+// then decrypts and decompresses every encrypted resource and prints a per-resource report.
+// A clear-text copy of the publication can be written by test and debug builds only (go build -tags debug).
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	lcpcrypto "github.com/omani/readium-lcp-server/crypto"
+	"github.com/omani/readium-lcp-server/epub"
+	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/pack"
+	"github.com/omani/readium-lcp-server/rwpm"
+	"github.com/omani/readium-lcp-server/sign"
+	"github.com/omani/readium-lcp-server/xmlenc"
+)
+
+// encryptedResource is a resource declared as encrypted in encryption.xml or manifest.json
+type encryptedResource struct {
+	Path           string
+	Algorithm      string
+	Compressed     bool
+	OriginalLength int64
+}
+
+// ResourceReport is the result of the decryption of a resource
+type ResourceReport struct {
+	Path           string `json:"path"`
+	Algorithm      string `json:"algorithm"`
+	Compressed     bool   `json:"compressed"`
+	EncryptedSize  int64  `json:"encrypted_size"`
+	DecryptedSize  int64  `json:"decrypted_size"`
+	OriginalLength int64  `json:"original_length,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Report is the result of the check of a license and a protected publication
+type Report struct {
+	LicenseID string           `json:"license_id"`
+	Profile   string           `json:"profile"`
+	Signature string           `json:"signature"`
+	KeyCheck  string           `json:"key_check"`
+	Resources []ResourceReport `json:"resources"`
+	Errors    int              `json:"errors"`
+}
+
+func main() {
+	var licensePath, passphrase, passphraseHash, inputPath, caPath, crlPath, outputPath string
+
+	flag.StringVar(&licensePath, "license", "", "optional, path to the license; by default the license embedded in the publication")
+	flag.StringVar(&passphrase, "passphrase", "", "user passphrase")
+	flag.StringVar(&passphraseHash, "hash", "", "optional, hex-encoded hash of the user passphrase, used instead of -passphrase")
+	flag.StringVar(&inputPath, "input", "", "path to the protected publication (EPUB or Readium package)")
+	flag.StringVar(&caPath, "cacert", "", "optional, path to the PEM certificate of the provider CA, used to validate the certificate chain")
+	flag.StringVar(&crlPath, "crl", "", "optional, comma-separated paths to the certificate revocation lists of the provider CA")
+	flag.StringVar(&outputPath, "output", "", "optional, path of a clear-text copy of the publication (test and debug builds only)")
+
+	flag.Parse()
+
+	if inputPath == "" || (passphrase == "" && passphraseHash == "") {
+		fmt.Println("usage: lcpdecrypt -input publication [-license license.lcpl] -passphrase passphrase|-hash hex [-cacert ca.pem] [-output clear.epub]")
+		os.Exit(1)
+	}
+
+	zr, err := zip.OpenReader(inputPath)
+	if err != nil {
+		exitWithError("Error opening the publication", err)
+	}
+	defer zr.Close()
+
+	licenseData, err := readLicense(licensePath, &zr.Reader)
+	if err != nil {
+		exitWithError("Error reading the license", err)
+	}
+	var lic license.License
+	if err = json.Unmarshal(licenseData, &lic); err != nil {
+		exitWithError("Error reading the license", err)
+	}
+	report := Report{LicenseID: lic.ID, Profile: lic.Encryption.Profile}
+
+	var crlPaths []string
+	if crlPath != "" {
+		crlPaths = strings.Split(crlPath, ",")
+	}
+	verifier, err := sign.LoadVerifier(caPath, crlPaths)
+	if err != nil {
+		exitWithError("Error reading the provider CA", err)
+	}
+	report.Signature = "valid"
+	if err = license.VerifyLicenseJSON(licenseData, verifier); err != nil {
+		report.Signature = err.Error()
+		report.Errors++
+	}
+
+	userKey, err := deriveUserKey(passphrase, passphraseHash)
+	if err != nil {
+		exitWithError("Error decoding the passphrase hash", err)
+	}
+	report.KeyCheck = "valid"
+	if err = checkUserKey(lic, userKey); err != nil {
+		report.KeyCheck = err.Error()
+		report.Errors++
+		printReport(report)
+		os.Exit(1)
+	}
+	contentKey, err := decryptKey(lic.Encryption.ContentKey.Value, userKey)
+	if err != nil {
+		exitWithError("Error decrypting the content key", err)
+	}
+
+	resources, err := encryptedResources(&zr.Reader)
+	if err != nil {
+		exitWithError("Error reading the encrypted resources", err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	for _, res := range resources {
+		rep := ResourceReport{Path: res.Path, Algorithm: res.Algorithm, Compressed: res.Compressed, OriginalLength: res.OriginalLength}
+		f, ok := files[res.Path]
+		if !ok {
+			rep.Error = "missing from the package"
+		} else {
+			rep.EncryptedSize = int64(f.UncompressedSize64)
+			data, err := decryptResource(f, res, contentKey)
+			rep.DecryptedSize = int64(len(data))
+			if err != nil {
+				rep.Error = err.Error()
+			}
+		}
+		if rep.Error != "" {
+			report.Errors++
+		}
+		report.Resources = append(report.Resources, rep)
+	}
+
+	if outputPath != "" && report.Errors == 0 {
+		if err = writeClearText(&zr.Reader, resources, contentKey, outputPath); err != nil {
+			exitWithError("Error writing the clear-text copy", err)
+		}
+	}
+
+	printReport(report)
+	if report.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func exitWithError(context string, err error) {
+	fmt.Println(context + ": " + err.Error())
+	os.Exit(1)
+}
+
+func printReport(report Report) {
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+}
+
+// readLicense reads the license from a file, or from the publication if no file is given
+func readLicense(path string, zr *zip.Reader) ([]byte, error) {
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	data, err := readZipFile(zr, epub.LicenseFile)
+	if err != nil {
+		data, err = readZipFile(zr, "license.lcpl")
+	}
+	return data, err
+}
+
+func readZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name == name {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
+		}
+	}
+	return nil, errors.New(name + " not found")
+}
+
+// deriveUserKey returns the user key: the SHA-256 hash of the passphrase, or the hash given as hex
+func deriveUserKey(passphrase, passphraseHash string) ([]byte, error) {
+	if passphraseHash != "" {
+		return hex.DecodeString(passphraseHash)
+	}
+	hash := sha256.Sum256([]byte(passphrase))
+	return hash[:], nil
+}
+
+// checkUserKey checks that the key_check of the license decrypts to the license id
+func checkUserKey(lic license.License, userKey []byte) error {
+	id, err := decryptKey(lic.Encryption.UserKey.Check, userKey)
+	if err != nil || string(id) != lic.ID {
+		return errors.New("invalid passphrase: the key check does not match the license id")
+	}
+	return nil
+}
+
+func decryptKey(encrypted, key []byte) ([]byte, error) {
+	var out bytes.Buffer
+	decrypter := lcpcrypto.NewAESEncrypter_CONTENT_KEY().(lcpcrypto.Decrypter)
+	if err := decrypter.Decrypt(key, bytes.NewReader(encrypted), &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// encryptedResources lists the encrypted resources of an EPUB (encryption.xml) or Readium package (manifest.json).
+// Obfuscated fonts are not part of the list.
+func encryptedResources(zr *zip.Reader) ([]encryptedResource, error) {
+	var resources []encryptedResource
+
+	if data, err := readZipFile(zr, epub.EncryptionFile); err == nil {
+		manifest, err := xmlenc.Read(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range manifest.Data {
+			if d.Obfuscated() {
+				continue
+			}
+			res := encryptedResource{Path: unescape(string(d.CipherData.CipherReference.URI)), Algorithm: string(d.Method.Algorithm)}
+			if d.Properties != nil {
+				for _, prop := range d.Properties.Properties {
+					if prop.Compression.Method == 8 {
+						res.Compressed = true
+						res.OriginalLength = int64(prop.Compression.OriginalLength)
+					}
+				}
+			}
+			resources = append(resources, res)
+		}
+		return resources, nil
+	}
+
+	data, err := readZipFile(zr, pack.ManifestLocation)
+	if err != nil {
+		return nil, errors.New("neither " + epub.EncryptionFile + " nor " + pack.ManifestLocation + " found")
+	}
+	var manifest rwpm.Publication
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	for _, links := range [][]rwpm.Link{manifest.ReadingOrder, manifest.Resources} {
+		for _, link := range links {
+			if link.Properties == nil || link.Properties.Encrypted == nil {
+				continue
+			}
+			enc := link.Properties.Encrypted
+			resources = append(resources, encryptedResource{
+				Path:           unescape(link.Href),
+				Algorithm:      enc.Algorithm,
+				Compressed:     enc.Compression == "deflate",
+				OriginalLength: int64(enc.OriginalLength),
+			})
+		}
+	}
+	return resources, nil
+}
+
+func unescape(ref string) string {
+	if unescaped, err := url.PathUnescape(ref); err == nil {
+		return unescaped
+	}
+	return ref
+}
+
+// decryptResource decrypts a resource, inflates it if it was compressed before encryption
+// and checks its length against the original length
+func decryptResource(f *zip.File, res encryptedResource, key []byte) ([]byte, error) {
+	if res.Algorithm != lcpcrypto.NewAESEncrypter_PUBLICATION_RESOURCES().Signature() {
+		return nil, errors.New("unsupported algorithm " + res.Algorithm)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var clear bytes.Buffer
+	decrypter := lcpcrypto.NewAESEncrypter_PUBLICATION_RESOURCES().(lcpcrypto.Decrypter)
+	if err = decrypter.Decrypt(key, rc, &clear); err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	if !res.Compressed {
+		return clear.Bytes(), nil
+	}
+
+	inflated, err := ioutil.ReadAll(flate.NewReader(&clear))
+	if err != nil {
+		return inflated, fmt.Errorf("decompression failed: %w", err)
+	}
+	if res.OriginalLength != 0 && int64(len(inflated)) != res.OriginalLength {
+		return inflated, fmt.Errorf("length mismatch: expected %d, got %d", res.OriginalLength, len(inflated))
+	}
+	return inflated, nil
+}
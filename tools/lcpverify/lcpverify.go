@@ -0,0 +1,66 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// This tool checks the signature of LCP licenses, and the provider certificate embedded in them
+// against the provider CA chain and its revocation lists, at the time each license was issued or last updated.
+// Partners can use it to self-check the licenses they receive.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/omani/readium-lcp-server/license"
+	"github.com/omani/readium-lcp-server/sign"
+)
+
+func main() {
+	caPath := flag.String("cacert", "", "optional, path to the PEM file holding the provider CA chain")
+	crlPath := flag.String("crl", "", "optional, comma-separated paths to certificate revocation lists (PEM or DER)")
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Println("usage: lcpverify [-cacert ca.pem] [-crl crl1,crl2] license.lcpl...")
+		os.Exit(1)
+	}
+
+	var crlPaths []string
+	if *crlPath != "" {
+		crlPaths = strings.Split(*crlPath, ",")
+	}
+	verifier, err := sign.LoadVerifier(*caPath, crlPaths)
+	if err != nil {
+		fmt.Println("Error reading the provider CA: " + err.Error())
+		os.Exit(1)
+	}
+
+	invalid := 0
+	for _, path := range flag.Args() {
+		if err := verify(path, verifier); err != nil {
+			fmt.Printf("%s: invalid, %s\n", path, err.Error())
+			invalid++
+			continue
+		}
+		fmt.Printf("%s: valid\n", path)
+	}
+	if invalid > 0 {
+		os.Exit(1)
+	}
+}
+
+func verify(path string, verifier *sign.Verifier) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("not a json document")
+	}
+	return license.VerifyLicenseJSON(data, verifier)
+}
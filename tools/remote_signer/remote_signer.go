@@ -0,0 +1,47 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// This tool is a local stand-in for a remote signing service, for tests and development environments.
+// It serves the remote signing protocol of the sign package with a private key read from a file,
+// so that a License server configured with the "remote" certificate provider can be run without an HSM.
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/omani/readium-lcp-server/sign"
+)
+
+func main() {
+	certFile := flag.String("cert", "", "path to the provider certificate")
+	keyFile := flag.String("key", "", "path to the private key of the provider certificate")
+	keyID := flag.String("key-id", "", "optional, identifier of the key expected in signing requests")
+	port := flag.Int("port", 8999, "listening port")
+
+	flag.Parse()
+
+	if *certFile == "" || *keyFile == "" {
+		fmt.Println("usage: remote_signer -cert cert.pem -key key.pem [-key-id id] [-port 8999]")
+		os.Exit(1)
+	}
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		log.Fatal("unsupported private key")
+	}
+
+	http.Handle("/sign", sign.RemoteSigningHandler(*keyID, key))
+	log.Println("Remote signing stand-in listening on port", *port, "at /sign")
+	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
+}
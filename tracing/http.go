@@ -0,0 +1,90 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/omani/readium-lcp-server/logging"
+)
+
+// HTTPMiddleware starts a server span for each request, child of the span given by the
+// traceparent header of the request if any. The span is named after the method and the path
+// template of the router route matching the request, e.g. "POST /contents/{content_id}/license".
+func HTTPMiddleware(router *mux.Router) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := "other"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPRouteKey.String(route), semconv.HTTPTargetKey.String(r.URL.Path)))
+		if id := logging.RequestID(ctx); id != "" {
+			span.SetAttributes(attribute.String("request_id", id))
+		}
+		defer span.End()
+
+		next(rw, r.WithContext(ctx))
+
+		code := http.StatusOK
+		if nrw, ok := rw.(negroni.ResponseWriter); ok && nrw.Status() != 0 {
+			code = nrw.Status()
+		}
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(code))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(code, trace.SpanKindServer))
+	}
+}
+
+// transport starts a client span for each outbound request and propagates the trace context
+type transport struct {
+	base http.RoundTripper
+}
+
+// Transport returns an http transport which traces the requests sent through base,
+// http.DefaultTransport if nil, and sets their traceparent header.
+// The parent of the client spans is the span of the context of the requests.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.User = nil
+	u.RawQuery = ""
+	ctx, span := tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(req.Method), semconv.HTTPURLKey.String(u.String())))
+	defer span.End()
+
+	// a round tripper must not modify the request
+	req = req.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(resp.StatusCode, trace.SpanKindClient))
+	return resp, nil
+}
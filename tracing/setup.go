@@ -0,0 +1,158 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/omani/readium-lcp-server/config"
+)
+
+// Exporter names of the configuration
+const (
+	ExporterNone = "none"
+	ExporterFile = "file"
+	ExporterOTLP = "otlp"
+)
+
+var (
+	mu sync.Mutex
+	// provider is the tracer provider set by Setup, nil if no span is recorded
+	provider *sdktrace.TracerProvider
+	// output is the file of the file exporter, closed on shutdown
+	output io.Closer
+)
+
+// Setup configures the tracing of a server; service is the name of the server in the traces.
+// The default exporter, none, records no span but the incoming trace context is still
+// forwarded to the other servers.
+func Setup(service string, c config.Tracing) error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing: the sample ratio must be between 0 and 1, got %v", c.SampleRatio)
+	}
+	var exp sdktrace.SpanExporter
+	var out io.Closer
+	switch c.Exporter {
+	case "", ExporterNone:
+	case ExporterFile:
+		if c.File == "" {
+			return errors.New("tracing: the file exporter requires a file")
+		}
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if exp, err = stdouttrace.New(stdouttrace.WithWriter(f)); err != nil {
+			f.Close()
+			return err
+		}
+		out = f
+	case ExporterOTLP:
+		opts, err := otlpOptions(c)
+		if err != nil {
+			return err
+		}
+		if exp, err = otlptracehttp.New(context.Background(), opts...); err != nil {
+			return err
+		}
+	default:
+		return errors.New("tracing: unknown exporter " + c.Exporter)
+	}
+
+	var tp *sdktrace.TracerProvider
+	if exp != nil {
+		ratio := c.SampleRatio
+		if ratio == 0 {
+			ratio = 1
+		}
+		tp = newProvider(service, ratio, sdktrace.NewBatchSpanProcessor(exp))
+	}
+	return install(tp, out)
+}
+
+// otlpOptions converts the base url of a collector to the options of the OTLP/HTTP exporter
+func otlpOptions(c config.Tracing) ([]otlptracehttp.Option, error) {
+	if c.Endpoint == "" {
+		return nil, errors.New("tracing: the otlp exporter requires an endpoint")
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("tracing: invalid otlp endpoint " + c.Endpoint)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(c.Headers))
+	}
+	return opts, nil
+}
+
+// newProvider creates a tracer provider; a trace started by another server follows
+// the sampling decision of that server, new traces are sampled with the given ratio
+func newProvider(service string, ratio float64, processor sdktrace.SpanProcessor) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithSpanProcessor(processor),
+	)
+}
+
+// install sets the tracer provider of the servers, a no-op provider if tp is nil,
+// and shuts the previous one down
+func install(tp *sdktrace.TracerProvider, out io.Closer) error {
+	mu.Lock()
+	previous, previousOut := provider, output
+	provider, output = tp, out
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+	} else {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	}
+	mu.Unlock()
+	return shutdown(context.Background(), previous, previousOut)
+}
+
+// Shutdown exports the pending spans and stops tracing; ctx bounds the time spent exporting
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	tp, out := provider, output
+	provider, output = nil, nil
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	mu.Unlock()
+	return shutdown(ctx, tp, out)
+}
+
+func shutdown(ctx context.Context, tp *sdktrace.TracerProvider, out io.Closer) error {
+	if tp == nil {
+		return nil
+	}
+	err := tp.Shutdown(ctx)
+	if out != nil {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
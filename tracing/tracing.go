@@ -0,0 +1,64 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+// Package tracing records the spans of the license generation and status flows with the OpenTelemetry SDK,
+// and propagates the trace context between the servers, following the W3C trace context recommendation.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/omani/readium-lcp-server/logging"
+)
+
+// instrumentationName is the name of the tracer of the servers
+const instrumentationName = "github.com/omani/readium-lcp-server"
+
+// propagator reads and writes the traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts an internal span, child of the span of ctx, with the given attributes.
+// The returned context holds the new span, the parent of the spans started from it.
+// The span must be ended by the caller, e.g. with End.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartDB starts the span of a database query; operation is the sql statement, e.g. INSERT,
+// and table the queried table. The span must be ended by the caller.
+func StartDB(ctx context.Context, operation, table string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, operation+" "+table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBOperationKey.String(operation), semconv.DBSQLTableKey.String(table)))
+}
+
+// End sets the status of a span to error if err is not nil, then ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Detach returns a context holding the request id and the span context of ctx, which is not canceled with ctx;
+// it is used by tasks outliving a request
+func Detach(ctx context.Context) context.Context {
+	detached := logging.Detach(ctx)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		detached = trace.ContextWithSpanContext(detached, sc)
+	}
+	return detached
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 Readium Foundation. All rights reserved.
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file exposed on Github (readium) in the project repository.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/omani/readium-lcp-server/config"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// setupMemory records the spans in memory, synchronously
+func setupMemory(t *testing.T, ratio float64) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	if err := install(newProvider("test", ratio, sdktrace.NewSimpleSpanProcessor(exp)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return exp
+}
+
+func TestPropagation(t *testing.T) {
+	exp := setupMemory(t, 1)
+	defer Shutdown(context.Background())
+
+	// the downstream server gets the trace context of the client span
+	var received string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+	}))
+	defer downstream.Close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/licenses/{key}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := Start(r.Context(), "buildLicense")
+		_, db := StartDB(ctx, "INSERT", "license")
+		End(db, errors.New("duplicate key"))
+		End(span, nil)
+
+		req, _ := http.NewRequestWithContext(r.Context(), "PUT", downstream.URL+"/licenses", nil)
+		client := &http.Client{Transport: Transport(nil)}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		w.WriteHeader(http.StatusCreated)
+	})
+	n := negroni.New()
+	n.Use(HTTPMiddleware(router))
+	n.UseHandler(router)
+
+	req := httptest.NewRequest("POST", "/licenses/123", nil)
+	req.Header.Set("traceparent", traceParent)
+	n.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exp.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Expected 4 spans, got %d", len(spans))
+	}
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		if s.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected the trace id of the caller, got %s", s.SpanContext.TraceID())
+		}
+		byName[s.Name] = s
+	}
+	server, ok := byName["POST /licenses/{key}"]
+	if !ok || server.SpanKind != trace.SpanKindServer || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected server span %+v", server)
+	}
+	if byName["buildLicense"].Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("Expected buildLicense to be a child of the server span")
+	}
+	db := byName["INSERT license"]
+	if db.Parent.SpanID() != byName["buildLicense"].SpanContext.SpanID() || db.Status.Code != codes.Error || db.Status.Description != "duplicate key" {
+		t.Errorf("Unexpected db span %+v", db)
+	}
+	client := byName["HTTP PUT"]
+	if client.SpanKind != trace.SpanKindClient || client.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("Unexpected client span %+v", client)
+	}
+	if expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanContext.SpanID().String() + "-01"; received != expected {
+		t.Errorf("Expected traceparent %s downstream, got %s", expected, received)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	if err := Setup("test", config.Tracing{}); err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "noop")
+	if span.IsRecording() {
+		t.Error("Expected no span to be recorded when tracing is disabled")
+	}
+
+	// the trace context of the caller is forwarded as is
+	var received string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+	}))
+	defer downstream.Close()
+	router := mux.NewRouter()
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(Detach(r.Context()), "GET", downstream.URL, nil)
+		resp, err := (&http.Client{Transport: Transport(nil)}).Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})
+	n := negroni.New()
+	n.Use(HTTPMiddleware(router))
+	n.UseHandler(router)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", traceParent)
+	n.ServeHTTP(httptest.NewRecorder(), req)
+	if received != traceParent {
+		t.Errorf("Expected traceparent %s, got %s", traceParent, received)
+	}
+
+	if err := Setup("test", config.Tracing{Exporter: "zipkin"}); err == nil {
+		t.Error("Expected an error for an unknown exporter")
+	}
+	if err := Setup("test", config.Tracing{Exporter: ExporterOTLP, Endpoint: "localhost:4318"}); err == nil {
+		t.Error("Expected an error for an endpoint without scheme")
+	}
+}
+
+func TestSampling(t *testing.T) {
+	exp := setupMemory(t, 0.000001)
+	defer Shutdown(context.Background())
+
+	for i := 0; i < 100; i++ {
+		ctx, span := Start(context.Background(), "root")
+		// children follow the decision of their parent
+		_, child := Start(ctx, "child")
+		if child.IsRecording() != span.IsRecording() {
+			t.Error("Expected the child to follow the sampling decision of its parent")
+		}
+		child.End()
+		span.End()
+	}
+	if sampled := len(exp.GetSpans()); sampled > 10 {
+		t.Errorf("Expected few sampled spans, got %d", sampled)
+	}
+
+	// a sampled remote parent is followed
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceParent})
+	if _, span := Start(ctx, "child"); !span.IsRecording() {
+		t.Error("Expected a span for a sampled parent")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	if err := Setup("test", config.Tracing{Exporter: ExporterFile, File: path}); err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "SignLicense")
+	span.End()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Name":"SignLicense"`) {
+		t.Errorf("Expected the span in the file, got %s", data)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var payload coltracepb.ExportTraceServiceRequest
+	var path, auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		auth = r.Header.Get("Authorization")
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = proto.Unmarshal(body, &payload)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	c := config.Tracing{Exporter: ExporterOTLP, Endpoint: collector.URL + "/", Headers: map[string]string{"Authorization": "Bearer token"}}
+	if err := Setup("test", c); err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "SignLicense")
+	span.End()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/v1/traces" || auth != "Bearer token" {
+		t.Errorf("Unexpected request to the collector: %s, %s", path, auth)
+	}
+	if len(payload.ResourceSpans) != 1 || len(payload.ResourceSpans[0].ScopeSpans) != 1 || len(payload.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("Expected a single span, got %v", payload.ResourceSpans)
+	}
+	if name := payload.ResourceSpans[0].ScopeSpans[0].Spans[0].Name; name != "SignLicense" {
+		t.Errorf("Unexpected span %s", name)
+	}
+}
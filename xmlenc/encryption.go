@@ -12,22 +12,27 @@ import (
 	"golang.org/x/net/html/charset"
 )
 
+// Font obfuscation algorithms; obfuscated resources are not encrypted
+const (
+	AlgorithmObfuscationIDPF  URI = "http://www.idpf.org/2008/embedding"
+	AlgorithmObfuscationAdobe URI = "http://ns.adobe.com/pdf/enc#RC"
+)
+
 type Manifest struct {
 	//Keys []Key
 	Data    []Data   `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
 	XMLName struct{} `xml:"urn:oasis:names:tc:opendocument:xmlns:container encryption"`
 }
 
-// DataForFile returns the EncryptedData item corresponding to a given path
+// DataForFile returns the EncryptedData item corresponding to a given path.
+// References are compared unescaped, as some packagers do not escape them.
 func (m Manifest) DataForFile(path string) (Data, bool) {
-	fileUri, err := url.Parse(path)
-	if err != nil {
-		return Data{}, false
-	}
-
-	uri := URI(fileUri.EscapedPath())
 	for _, datum := range m.Data {
-		if datum.CipherData.CipherReference.URI == uri {
+		ref := string(datum.CipherData.CipherReference.URI)
+		if unescaped, err := url.PathUnescape(ref); err == nil {
+			ref = unescaped
+		}
+		if ref == path {
 			return datum, true
 		}
 	}
@@ -156,3 +161,8 @@ type Data struct {
 	encryptedType
 	Properties *EncryptionProperties `xml:"http://www.w3.org/2001/04/xmlenc# EncryptionProperties,omitempty"`
 }
+
+// Obfuscated indicates that the resource is obfuscated (IDPF or Adobe font obfuscation) rather than encrypted
+func (d Data) Obfuscated() bool {
+	return d.Method.Algorithm == AlgorithmObfuscationIDPF || d.Method.Algorithm == AlgorithmObfuscationAdobe
+}